@@ -0,0 +1,125 @@
+// Command safesplit-fsck cross-checks the files, shard_locations and
+// key_fragments tables against the objects on the storage nodes and reports
+// under-replicated files, dangling rows and orphan objects.
+//
+// With --repair it points rows at objects found on another node, drops rows of
+// deleted files and rebuilds missing shards from parity. With --gc it deletes,
+// after the grace period, objects of files that don't exist and stale copies
+// of files whose rows didn't change in the meantime.
+// The API server's rebalancer and scrubber don't coordinate with this command;
+// while the server is running, prefer POST /api/sysadmin/storage/fsck.
+//
+// Example:
+//
+//	safesplit-fsck
+//	safesplit-fsck --repair --gc --grace 0   # API server stopped
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"safesplit/config"
+	"safesplit/jobs"
+	"safesplit/models"
+	"safesplit/services"
+	"sync"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	repair := flag.Bool("repair", false, "repoint misplaced rows, drop dangling rows and rebuild missing shards")
+	gc := flag.Bool("gc", false, "delete orphan objects")
+	grace := flag.Duration("grace", jobs.FsckOrphanGrace, "how long objects must stay orphaned before --gc deletes them")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	verbose := flag.Bool("v", false, "show service logs")
+	flag.Parse()
+
+	// The environment may also be set directly
+	godotenv.Load()
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	fatalf := func(format string, args ...interface{}) {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+		os.Exit(2)
+	}
+
+	db, err := config.SetupDatabase()
+	if err != nil {
+		fatalf("Failed to connect to database: %v", err)
+	}
+
+	storage := services.NewDistributedStorageService()
+	if err := models.NewStorageNodeModel(db, storage).Load(); err != nil {
+		fatalf("Failed to initialize distributed storage: %v", err)
+	}
+
+	signer, err := services.NewManifestSigner(os.Getenv("MANIFEST_SIGNING_KEY"))
+	if err != nil {
+		fatalf("Failed to initialize manifest signer: %v", err)
+	}
+	rsService, err := services.NewReedSolomonService(storage, signer)
+	if err != nil {
+		fatalf("Failed to initialize Reed-Solomon service: %v", err)
+	}
+
+	maintenance := &sync.Mutex{}
+	fsck := jobs.NewFsck(db, storage, jobs.NewScrubber(db, storage, rsService, maintenance), maintenance)
+	if *gc && *grace > 0 {
+		fmt.Fprintf(os.Stderr, "Orphan objects are collected after %s\n", *grace)
+	}
+
+	report, err := fsck.Run(jobs.FsckOptions{Repair: *repair, GC: *gc, OrphanGrace: *grace})
+	if report == nil {
+		fatalf("Consistency check failed: %v", err)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		printReport(report)
+	}
+
+	switch {
+	case err != nil:
+		os.Exit(2)
+	case report.Unresolved() > 0:
+		os.Exit(1)
+	}
+}
+
+func printReport(report *jobs.FsckReport) {
+	for _, issue := range report.Issues {
+		line := fmt.Sprintf("%-18s file %d", issue.Kind, issue.FileID)
+		if issue.NodeIndex != nil {
+			line += fmt.Sprintf(" node %d", *issue.NodeIndex)
+		}
+		if issue.Key != "" {
+			line += " " + issue.Key
+		}
+		line += ": " + issue.Detail
+		if issue.Fixed {
+			line += " [fixed]"
+		}
+		fmt.Println(line)
+	}
+	if report.Truncated {
+		fmt.Printf("... only the first %d issues are listed\n", jobs.MaxFsckIssues)
+	}
+
+	fmt.Printf("Checked %d files and %d objects\n", report.FilesChecked, report.ObjectsScanned)
+	for kind, count := range report.Counts {
+		fmt.Printf("  %-18s %d\n", kind, count)
+	}
+	fmt.Printf("Fixed %d, unresolved %d\n", report.Fixed, report.Unresolved())
+	if report.Error != "" {
+		fmt.Printf("Error: %s\n", report.Error)
+	}
+}
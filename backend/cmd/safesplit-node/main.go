@@ -0,0 +1,69 @@
+// Command safesplit-node serves one storage node's shard and fragment namespace
+// over the signed HTTP protocol used by the API server's remote storage backend.
+//
+// Example, running three local nodes:
+//
+//	export SAFESPLIT_NODE_SECRET=<at least 32 characters, same as STORAGE_NODE_SECRET on the API server>
+//	safesplit-node -listen :9101 -data /srv/safesplit/node_0
+//	safesplit-node -listen :9102 -data /srv/safesplit/node_1
+//	safesplit-node -listen :9103 -data /srv/safesplit/node_2
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"safesplit/services"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func main() {
+	listen := flag.String("listen", ":9100", "address to listen on")
+	dataDir := flag.String("data", "storage/node", "directory holding this node's shards and fragments")
+	secretFile := flag.String("secret-file", "", "file containing the shared request signing secret (defaults to $SAFESPLIT_NODE_SECRET)")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file; serves plain HTTP when empty")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	maxObjectSize := flag.Int64("max-object-size", services.DefaultNodeMaxObjectSize, "largest accepted object in bytes")
+	flag.Parse()
+
+	secret := os.Getenv("SAFESPLIT_NODE_SECRET")
+	if *secretFile != "" {
+		data, err := os.ReadFile(*secretFile)
+		if err != nil {
+			log.Fatal("Failed to read secret file:", err)
+		}
+		secret = strings.TrimSpace(string(data))
+	}
+	if len(secret) < services.MinNodeSecretLength {
+		log.Fatalf("Node secret must be at least %d characters", services.MinNodeSecretLength)
+	}
+
+	backend, err := services.NewLocalStorageBackend(*dataDir)
+	if err != nil {
+		log.Fatal("Failed to initialize node storage:", err)
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	nodeServer := services.NewStorageNodeServer(backend, []byte(secret), *maxObjectSize)
+
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           nodeServer.Handler(),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	log.Printf("Storage node serving %s on %s", *dataDir, *listen)
+	if *tlsCert != "" {
+		err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		log.Println("Warning: serving without TLS; shard contents travel in the clear")
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		log.Fatal("Storage node stopped:", err)
+	}
+}
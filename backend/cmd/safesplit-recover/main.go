@@ -0,0 +1,423 @@
+// Command safesplit-recover rebuilds files straight from storage node
+// directories, without the database or the API server. It finds shards by
+// scanning the nodes, decodes them with the signed manifest stored next to
+// them, recombines the key from the fragments it can decrypt and writes the
+// decrypted originals to <out>/user_<owner>/file_<id>.
+//
+// Server fragments need the server master key, which is stored wrapped; print
+// it with safesplit-seal export-keys. User fragments need the
+// owner's master key, given directly or unlocked from the owner's users row
+// (user_id, password_hash, master_key_salt, encrypted_master_key,
+// master_key_nonce, master_key_wrap_version and kdf_params as JSON, binary
+// fields base64 encoded). Master keys wrapped under the owner's password also need the
+// owner's password in the record's "password" field. Files stored before
+// manifests existed can only be recovered once the scrubber has written one.
+//
+// Example, a recovery drill against the default node layout:
+//
+//	export MANIFEST_SIGNING_KEY=<same as the API server>
+//	safesplit-recover -nodes storage/nodes -server-key <key-id>:<hex key> -check
+//	safesplit-recover -nodes storage/nodes -server-key <hex key> -user-key 42:<hex key> -user 42 -out /tmp/restore
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"safesplit/models"
+	"safesplit/services"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// listFlag collects a flag that may be given more than once
+type listFlag []string
+
+func (f *listFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *listFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// userRecord is the part of a users row needed to unlock a user's master key
+type userRecord struct {
+	UserID             uint   `json:"user_id"`
+	PasswordHash       string `json:"password_hash"`
+	MasterKeySalt      []byte `json:"master_key_salt"`
+	EncryptedMasterKey []byte `json:"encrypted_master_key"`
+	MasterKeyNonce     []byte `json:"master_key_nonce"`
+	WrapVersion        int    `json:"master_key_wrap_version"`
+	KDFParams          string `json:"kdf_params"`
+	Password           string `json:"password"` // the owner's password, supplied by the owner
+}
+
+func main() {
+	var nodeFlags, serverKeyFlags, userKeyFlags, userRecordFlags listFlag
+	nodesDir := flag.String("nodes", "", "directory holding one node_<N> directory per storage node")
+	flag.Var(&nodeFlags, "node", "storage node directory as <index>=<dir>; repeatable")
+	manifestKeyFile := flag.String("manifest-key-file", "", "file containing the manifest signing key (defaults to $MANIFEST_SIGNING_KEY)")
+	flag.Var(&serverKeyFlags, "server-key", "hex server master key, optionally as <key-id>:<hex>; repeatable")
+	flag.Var(&userKeyFlags, "user-key", "hex user master key, optionally as <user-id>:<hex>; repeatable")
+	flag.Var(&userRecordFlags, "user-record", "JSON file with a user's key fields from the users table; repeatable")
+	fileList := flag.String("files", "", "comma separated file IDs to recover (default all)")
+	owner := flag.Uint("user", 0, "only recover files owned by this user ID")
+	outDir := flag.String("out", "", "directory to write recovered files to")
+	check := flag.Bool("check", false, "recover and decrypt without writing anything")
+	verbose := flag.Bool("v", false, "show service logs")
+	flag.Parse()
+
+	if *outDir == "" && !*check {
+		log.Fatal("Either -out or -check is required")
+	}
+	if !*verbose {
+		// The storage and encryption services log every step
+		log.SetOutput(io.Discard)
+	}
+	fatalf := func(format string, args ...interface{}) {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+		os.Exit(2)
+	}
+
+	storage := services.NewDistributedStorageService()
+	nodes, err := nodeDirectories(*nodesDir, nodeFlags)
+	if err != nil {
+		fatalf("Invalid node directories: %v", err)
+	}
+	if len(nodes) == 0 {
+		fatalf("No storage node directories given; use -nodes or -node")
+	}
+	for nodeIndex, dir := range nodes {
+		backend, err := services.NewLocalStorageBackend(dir)
+		if err != nil {
+			fatalf("Failed to open node %d: %v", nodeIndex, err)
+		}
+		if err := storage.AddNode(nodeIndex, backend, false); err != nil {
+			fatalf("Failed to add node %d: %v", nodeIndex, err)
+		}
+	}
+
+	signingKey := os.Getenv("MANIFEST_SIGNING_KEY")
+	if *manifestKeyFile != "" {
+		data, err := os.ReadFile(*manifestKeyFile)
+		if err != nil {
+			fatalf("Failed to read manifest key file: %v", err)
+		}
+		signingKey = strings.TrimSpace(string(data))
+	}
+	signer, err := services.NewManifestSigner(signingKey)
+	if err != nil {
+		fatalf("Invalid manifest signing key: %v", err)
+	}
+	rsService, err := services.NewReedSolomonService(storage, signer)
+	if err != nil {
+		fatalf("Failed to initialize Reed-Solomon service: %v", err)
+	}
+
+	keys, err := recoveryKeys(serverKeyFlags, userKeyFlags, userRecordFlags)
+	if err != nil {
+		fatalf("Invalid key material: %v", err)
+	}
+
+	encryptionService := services.NewEncryptionService(services.NewShamirService(len(nodes)))
+	compressionService, err := services.NewCompressionService()
+	if err != nil {
+		fatalf("Failed to initialize compression service: %v", err)
+	}
+	defer compressionService.Close()
+
+	found, err := storage.ScanShards()
+	if err != nil {
+		fatalf("Failed to scan nodes: %v", err)
+	}
+	fileIDs, err := selectFiles(found, *fileList)
+	if err != nil {
+		fatalf("Invalid -files: %v", err)
+	}
+	fmt.Printf("Found shards of %d files on %d nodes\n", len(found), len(nodes))
+
+	recovered, failed := 0, 0
+	for _, fileID := range fileIDs {
+		manifest, err := rsService.ReadManifest(fileID, nil)
+		if err != nil {
+			fmt.Printf("file %d: FAILED: %v\n", fileID, err)
+			failed++
+			continue
+		}
+		if *owner != 0 && manifest.OwnerID != *owner {
+			continue
+		}
+
+		target := "not written"
+		var out *os.File
+		w := io.Discard
+		if !*check {
+			target = filepath.Join(*outDir, fmt.Sprintf("user_%d", manifest.OwnerID), fmt.Sprintf("file_%d", fileID))
+			if out, err = createFile(target); err != nil {
+				fmt.Printf("file %d: FAILED: %v\n", fileID, err)
+				failed++
+				continue
+			}
+			w = out
+		}
+
+		size, corrupted, err := recoverFile(rsService, encryptionService, compressionService, manifest, found[fileID], keys, w)
+		if out != nil {
+			if closeErr := out.Close(); err == nil && closeErr != nil {
+				err = fmt.Errorf("failed to write file: %w", closeErr)
+			}
+			if err != nil {
+				os.Remove(target)
+			}
+		}
+		if err != nil {
+			fmt.Printf("file %d: FAILED: %v\n", fileID, err)
+			failed++
+			continue
+		}
+		fmt.Printf("file %d: recovered %d bytes (owner %d, %d corrupt shards skipped), %s\n",
+			fileID, size, manifest.OwnerID, len(corrupted), target)
+		recovered++
+	}
+
+	fmt.Printf("Recovered %d files, %d failed\n", recovered, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// recoverFile rebuilds, decrypts and decompresses one file to w and returns
+// its size. Files encrypted with services.EncryptionSegmented are streamed;
+// older ones have to be decrypted in memory.
+func recoverFile(
+	rsService *services.ReedSolomonService,
+	encryptionService *services.EncryptionService,
+	compressionService *services.CompressionService,
+	manifest *services.ShardManifest,
+	locations map[int][]int,
+	keys services.RecoveryKeys,
+	w io.Writer,
+) (int64, []services.CorruptShard, error) {
+	shares, err := rsService.RecoverKeyShares(manifest, keys)
+	if err != nil {
+		return 0, nil, err
+	}
+	encType := services.EncryptionType(manifest.EncryptionType)
+
+	if manifest.EncryptionVersion != services.EncryptionSegmented {
+		var encrypted bytes.Buffer
+		corrupted, err := rsService.RecoverFile(manifest, locations, &encrypted)
+		if err != nil {
+			return 0, corrupted, fmt.Errorf("failed to rebuild shards: %w", err)
+		}
+		data, err := encryptionService.DecryptFileWithType(encrypted.Bytes(), manifest.EncryptionIV, shares,
+			manifest.Threshold, nil, encType)
+		if err != nil {
+			return 0, corrupted, err
+		}
+		if manifest.Compressed {
+			data, err = compressionService.Decompress(data)
+			if err != nil {
+				return 0, corrupted, fmt.Errorf("failed to decompress: %w", err)
+			}
+		}
+		if _, err := w.Write(data); err != nil {
+			return 0, corrupted, fmt.Errorf("failed to write file: %w", err)
+		}
+		return int64(len(data)), corrupted, nil
+	}
+
+	pr, pw := io.Pipe()
+	var corrupted []services.CorruptShard
+	rebuilt := make(chan error, 1)
+	go func() {
+		var err error
+		corrupted, err = rsService.RecoverFile(manifest, locations, pw)
+		pw.CloseWithError(err)
+		rebuilt <- err
+	}()
+
+	var content io.Reader
+	content, err = encryptionService.DecryptStream(pr, manifest.EncryptionIV, shares, manifest.Threshold, encType)
+	if err == nil && manifest.Compressed {
+		var decompressed io.ReadCloser
+		if decompressed, err = compressionService.NewReader(content); err == nil {
+			defer decompressed.Close()
+			content = decompressed
+		}
+	}
+	var size int64
+	if err == nil {
+		size, err = io.Copy(w, content)
+	}
+	pr.Close()
+	if rebuildErr := <-rebuilt; rebuildErr != nil && err == nil {
+		err = fmt.Errorf("failed to rebuild shards: %w", rebuildErr)
+	}
+	return size, corrupted, err
+}
+
+// nodeDirectories maps node indexes to directories from -nodes and -node
+func nodeDirectories(nodesDir string, nodeFlags []string) (map[int]string, error) {
+	nodes := make(map[int]string)
+	if nodesDir != "" {
+		entries, err := os.ReadDir(nodesDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			var nodeIndex int
+			if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "node_") {
+				continue
+			}
+			if _, err := fmt.Sscanf(entry.Name(), "node_%d", &nodeIndex); err != nil {
+				continue
+			}
+			nodes[nodeIndex] = filepath.Join(nodesDir, entry.Name())
+		}
+	}
+
+	for _, value := range nodeFlags {
+		index, dir, ok := strings.Cut(value, "=")
+		nodeIndex, err := strconv.Atoi(index)
+		if !ok || err != nil || nodeIndex < 0 {
+			return nil, fmt.Errorf("expected <index>=<dir>, got %q", value)
+		}
+		nodes[nodeIndex] = dir
+	}
+	return nodes, nil
+}
+
+// recoveryKeys parses the server and user key flags
+func recoveryKeys(serverKeyFlags, userKeyFlags, userRecordFlags []string) (services.RecoveryKeys, error) {
+	keys := services.RecoveryKeys{
+		ServerKeys: make(map[string][]byte),
+		UserKeys:   make(map[uint][]byte),
+	}
+
+	for _, value := range serverKeyFlags {
+		keyID, hexKey, ok := strings.Cut(value, ":")
+		if !ok {
+			keyID, hexKey = "", value
+		}
+		key, err := decodeKey(hexKey)
+		if err != nil {
+			return keys, fmt.Errorf("server key: %w", err)
+		}
+		keys.ServerKeys[keyID] = key
+	}
+
+	for _, value := range userKeyFlags {
+		var userID uint64
+		hexKey := value
+		if id, rest, ok := strings.Cut(value, ":"); ok {
+			var err error
+			if userID, err = strconv.ParseUint(id, 10, 32); err != nil {
+				return keys, fmt.Errorf("invalid user ID %q", id)
+			}
+			hexKey = rest
+		}
+		key, err := decodeKey(hexKey)
+		if err != nil {
+			return keys, fmt.Errorf("user key: %w", err)
+		}
+		keys.UserKeys[uint(userID)] = key
+	}
+
+	for _, path := range userRecordFlags {
+		userID, key, err := unlockUserRecord(path)
+		if err != nil {
+			return keys, fmt.Errorf("user record %s: %w", path, err)
+		}
+		keys.UserKeys[userID] = key
+	}
+	return keys, nil
+}
+
+func decodeKey(hexKey string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(hexKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key length: expected 32, got %d", len(key))
+	}
+	return key, nil
+}
+
+// unlockUserRecord decrypts a user's master key the same way the API server does
+func unlockUserRecord(path string) (uint, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	var record userRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return 0, nil, fmt.Errorf("failed to decode: %w", err)
+	}
+	if record.UserID == 0 {
+		return 0, nil, fmt.Errorf("user_id is required")
+	}
+	if len(record.EncryptedMasterKey) < 48 {
+		return 0, nil, fmt.Errorf("encrypted_master_key too short")
+	}
+
+	var kek []byte
+	if record.WrapVersion == models.MasterKeyWrapLegacy {
+		kek, err = services.DeriveKeyEncryptionKey(record.PasswordHash, record.MasterKeySalt)
+	} else {
+		if record.Password == "" {
+			return 0, nil, fmt.Errorf("the master key is wrapped under the user's password; add it as \"password\"")
+		}
+		var params services.KDFParams
+		if params, err = services.ParseKDFParams(record.KDFParams, services.PBKDF2Iterations); err == nil {
+			kek, err = params.DeriveKey([]byte(record.Password), record.MasterKeySalt)
+		}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	masterKey, err := services.DecryptMasterKey(record.EncryptedMasterKey, kek, record.MasterKeyNonce)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to decrypt master key: %w", err)
+	}
+	return record.UserID, masterKey[:32], nil
+}
+
+// selectFiles returns the IDs of the files to recover in ascending order
+func selectFiles(found map[uint]map[int][]int, fileList string) ([]uint, error) {
+	var fileIDs []uint
+	if fileList == "" {
+		for fileID := range found {
+			fileIDs = append(fileIDs, fileID)
+		}
+	} else {
+		for _, field := range strings.Split(fileList, ",") {
+			fileID, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid file ID %q", field)
+			}
+			fileIDs = append(fileIDs, uint(fileID))
+		}
+	}
+	sort.Slice(fileIDs, func(i, j int) bool { return fileIDs[i] < fileIDs[j] })
+	return fileIDs, nil
+}
+
+func createFile(target string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+	return f, nil
+}
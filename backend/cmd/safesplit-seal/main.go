@@ -0,0 +1,150 @@
+// Command safesplit-seal manages the key-encryption key (KEK) that wraps the
+// server master keys in the database.
+//
+//	init          generate a KEK and print it with its unseal shares
+//	split         split an existing KEK into new unseal shares
+//	export-keys   print the unwrapped server keys for safesplit-recover
+//
+// The API server reads the KEK from the file named by SERVER_KEK_FILE or from
+// SERVER_KEK at startup; without either it starts sealed and waits for
+// -threshold of the unseal shares at POST /api/system/seal/unseal. Give each
+// share to a different operator and keep the KEK itself offline, or don't keep
+// it at all. split and export-keys read the KEK the same way as the server, or
+// recombine it from unseal shares given one per line on stdin.
+//
+// Example:
+//
+//	safesplit-seal init -shares 5 -threshold 3
+//	SERVER_KEK_FILE=/etc/safesplit/kek safesplit-seal export-keys
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"safesplit/config"
+	"safesplit/models"
+	"safesplit/services"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	// The environment may also be set directly
+	godotenv.Load()
+	log.SetOutput(io.Discard)
+
+	seal := services.NewSealService(services.NewShamirService(1))
+	command, args := os.Args[1], os.Args[2:]
+	switch command {
+	case "init":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		shares, threshold := shareFlags(flags)
+		flags.Parse(args)
+
+		kek, err := services.GenerateKEK()
+		if err != nil {
+			fatalf("%v", err)
+		}
+		fmt.Printf("Key-encryption key (for SERVER_KEK or SERVER_KEK_FILE):\n%s\n\n", hex.EncodeToString(kek))
+		printShares(seal, kek, *shares, *threshold)
+
+	case "split":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		shares, threshold := shareFlags(flags)
+		flags.Parse(args)
+
+		printShares(seal, loadKEK(seal), *shares, *threshold)
+
+	case "export-keys":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		flags.Parse(args)
+
+		kek := loadKEK(seal)
+		db, err := config.SetupDatabase()
+		if err != nil {
+			fatalf("Failed to connect to database: %v", err)
+		}
+		keys, err := models.NewServerMasterKeyModel(db, seal).ListAll()
+		if err != nil {
+			fatalf("%v", err)
+		}
+		for _, key := range keys {
+			serverKey := key.EncryptedKey
+			if key.WrapVersion != models.KeyUnwrapped {
+				serverKey, err = services.UnwrapKey(kek, key.EncryptedKey, key.KeyNonce, []byte(key.KeyID))
+				if err != nil {
+					fatalf("Failed to unwrap server key %s: %v", key.KeyID, err)
+				}
+			}
+			fmt.Printf("%s:%s\n", key.KeyID, hex.EncodeToString(serverKey))
+		}
+
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: safesplit-seal init|split [-shares n] [-threshold k] | export-keys")
+	os.Exit(2)
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(2)
+}
+
+func shareFlags(flags *flag.FlagSet) (*int, *int) {
+	shares := flags.Int("shares", 5, "number of unseal shares")
+	threshold := flags.Int("threshold", 3, "unseal shares needed to recombine the key")
+	return shares, threshold
+}
+
+func printShares(seal *services.SealService, kek []byte, n, k int) {
+	shares, err := seal.SplitKEK(kek, n, k)
+	if err != nil {
+		fatalf("Failed to split key-encryption key: %v", err)
+	}
+	fmt.Printf("Unseal shares (%d of %d needed):\n", k, n)
+	for i, share := range shares {
+		fmt.Printf("%d: %s\n", i+1, share)
+	}
+}
+
+// loadKEK reads the KEK like the API server does, falling back to unseal shares on stdin
+func loadKEK(seal *services.SealService) []byte {
+	kek, _, err := services.LoadKEK()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if kek != nil {
+		return kek
+	}
+
+	fmt.Fprintln(os.Stderr, "SERVER_KEK_FILE and SERVER_KEK are unset; enter unseal shares, one per line:")
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		kek, err := seal.AddUnsealShare(line)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if kek != nil {
+			return kek
+		}
+	}
+	fatalf("Not enough unseal shares")
+	return nil
+}
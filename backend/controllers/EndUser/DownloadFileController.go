@@ -3,6 +3,7 @@ package EndUser
 import (
 	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -20,7 +21,8 @@ type DownloadFileController struct {
 	activityLogModel   *models.ActivityLogModel
 	compressionService *services.CompressionService
 	rsService          *services.ReedSolomonService
-	serverKeyModel     *models.ServerMasterKeyModel
+	keyProvider        services.KeyProvider
+	sessionKeys        *services.SessionKeyCache
 }
 
 func NewDownloadFileController(
@@ -30,7 +32,8 @@ func NewDownloadFileController(
 	activityLogModel *models.ActivityLogModel,
 	compressionService *services.CompressionService,
 	rsService *services.ReedSolomonService,
-	serverKeyModel *models.ServerMasterKeyModel,
+	keyProvider services.KeyProvider,
+	sessionKeys *services.SessionKeyCache,
 ) *DownloadFileController {
 	return &DownloadFileController{
 		fileModel:          fileModel,
@@ -39,7 +42,8 @@ func NewDownloadFileController(
 		activityLogModel:   activityLogModel,
 		compressionService: compressionService,
 		rsService:          rsService,
-		serverKeyModel:     serverKeyModel,
+		keyProvider:        keyProvider,
+		sessionKeys:        sessionKeys,
 	}
 }
 
@@ -71,27 +75,16 @@ func (c *DownloadFileController) Download(ctx *gin.Context) {
 		return
 	}
 
-	// Get file data based on storage type
-	encryptedData, err := c.getFileData(ctx, file)
-	if err != nil {
-		return
-	}
-
-	// Decrypt the data
-	decryptedData, err := c.decryptData(ctx, file, encryptedData, shares)
-	if err != nil {
-		return
-	}
-
-	// Decompress if needed
-	finalData, err := c.handleDecompression(ctx, file, decryptedData)
+	// Decrypt and decompress the content while it is sent
+	content, err := c.openContent(ctx, file, shares)
 	if err != nil {
 		return
 	}
+	defer content.Close()
 
 	// Log success and send response
 	c.logDownloadActivity(currentUser, file, ctx.ClientIP())
-	c.sendFileResponse(ctx, file, finalData)
+	c.sendFileResponse(ctx, file, content)
 }
 
 func (c *DownloadFileController) getCurrentUser(ctx *gin.Context) (*models.User, error) {
@@ -204,63 +197,24 @@ func (c *DownloadFileController) getKeyShares(ctx *gin.Context, file *models.Fil
 	log.Printf("Retrieving key fragments for file %d - Threshold: %d, Expected shares: %d",
 		file.ID, file.Threshold, file.ShareCount)
 
-	// Get the server master key
-	serverKey, err := c.serverKeyModel.GetActive()
-	if err != nil {
-		log.Printf("Failed to retrieve server key: %v", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "Failed to retrieve server key",
-		})
-		return nil, err
-	}
-
-	// Get the decrypted server key data
-	serverKeyData, err := c.serverKeyModel.GetServerKey(serverKey.KeyID)
-	if err != nil {
-		log.Printf("Failed to get server key data: %v", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "Failed to get server key data",
-		})
-		return nil, err
-	}
-
 	// Get user
 	currentUser, err := c.getCurrentUser(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	// Derive the user's KEK
-	kek, err := services.DeriveKeyEncryptionKey(currentUser.Password, currentUser.MasterKeySalt)
+	// The master key is only unwrapped while the user's session is unlocked
+	userMasterKey, err := c.sessionKeys.MasterKey(ctx.GetString("session_id"), currentUser.ID)
 	if err != nil {
-		log.Printf("Failed to derive KEK: %v", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "Failed to derive KEK",
-		})
-		return nil, err
-	}
-
-	// Decrypt the user's master key
-	decryptedMasterKey, err := services.DecryptMasterKey(
-		currentUser.EncryptedMasterKey,
-		kek,
-		currentUser.MasterKeyNonce,
-	)
-	if err != nil {
-		log.Printf("Failed to decrypt master key: %v", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "Failed to decrypt master key",
+		log.Printf("Master key of user %d is not available: %v", currentUser.ID, err)
+		ctx.JSON(http.StatusUnauthorized, gin.H{
+			"status":         "error",
+			"error":          err.Error(),
+			"session_locked": true,
 		})
 		return nil, err
 	}
 
-	// Use first 32 bytes of decrypted master key
-	userMasterKey := decryptedMasterKey[:32]
-
 	// Get fragments with their data
 	fragments, err := c.keyFragmentModel.GetKeyFragments(file.ID)
 	if err != nil {
@@ -281,11 +235,7 @@ func (c *DownloadFileController) getKeyShares(ctx *gin.Context, file *models.Fil
 		// Decrypt fragment based on its holder type
 		if fragment.KeyFragment.HolderType == models.ServerHolder {
 			log.Printf("Decrypting server fragment %d with server key", i)
-			decryptedFragment, err = services.DecryptMasterKey(
-				fragment.Data,
-				serverKeyData,
-				fragment.KeyFragment.EncryptionNonce,
-			)
+			decryptedFragment, err = models.UnwrapServerFragment(c.keyProvider, &fragment.KeyFragment, fragment.Data)
 		} else {
 			log.Printf("Decrypting user fragment %d with decrypted user master key", i)
 			decryptedFragment, err = services.DecryptMasterKey(
@@ -309,7 +259,6 @@ func (c *DownloadFileController) getKeyShares(ctx *gin.Context, file *models.Fil
 		copy(normalizedFragment, decryptedFragment)
 
 		log.Printf("Fragment %d raw decrypted length: %d", i, len(decryptedFragment))
-		log.Printf("Fragment %d raw bytes: %x", i, decryptedFragment)
 
 		// Convert to hex string to match encryption format
 		shares[i] = services.KeyShare{
@@ -319,134 +268,26 @@ func (c *DownloadFileController) getKeyShares(ctx *gin.Context, file *models.Fil
 			FragmentPath: fragment.KeyFragment.FragmentPath,
 		}
 
-		log.Printf("Fragment %d normalized: Index=%d, Node=%d, Path=%s, Length=%d, Bytes=%x, HexValue=%s",
-			i, shares[i].Index, shares[i].NodeIndex, shares[i].FragmentPath,
-			len(normalizedFragment), normalizedFragment, shares[i].Value)
+		log.Printf("Fragment %d normalized: Index=%d, Node=%d, Path=%s, Length=%d",
+			i, shares[i].Index, shares[i].NodeIndex, shares[i].FragmentPath, len(normalizedFragment))
 	}
 
 	return shares, nil
 }
-func (c *DownloadFileController) getFileData(ctx *gin.Context, file *models.File) ([]byte, error) {
-	log.Printf("Getting file data for file ID: %d", file.ID)
-
-	if file.IsSharded {
-		// Handle sharded files using Reed-Solomon
-		return c.getShardedData(ctx, file)
-	}
-
-	// Handle regular files
-	data, err := os.ReadFile(file.FilePath)
-	if err != nil {
-		log.Printf("Failed to read file from disk: %v", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "Failed to read file data",
-		})
-		return nil, err
-	}
-
-	log.Printf("Successfully read file data - Size: %d bytes", len(data))
-	return data, nil
-}
-
-func (c *DownloadFileController) getShardedData(ctx *gin.Context, file *models.File) ([]byte, error) {
-	log.Printf("Beginning shard retrieval for file %d - Data shards: %d, Parity shards: %d",
-		file.ID, file.DataShardCount, file.ParityShardCount)
+func (c *DownloadFileController) openContent(ctx *gin.Context, file *models.File, shares []services.KeyShare) (io.ReadCloser, error) {
+	log.Printf("Opening content of file %d - Sharded: %v, Data shards: %d, Parity shards: %d, Encryption: %s v%d",
+		file.ID, file.IsSharded, file.DataShardCount, file.ParityShardCount, file.EncryptionType, file.EncryptionVersion)
 
-	fileShards, err := c.rsService.RetrieveShards(file.ID, int(file.DataShardCount+file.ParityShardCount))
+	content, err := c.fileModel.OpenContent(file, shares, c.compressionService)
 	if err != nil {
-		log.Printf("Failed to retrieve shards: %v", err)
+		log.Printf("Failed to open file content: %v", err)
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"status": "error",
-			"error":  "Failed to retrieve file shards",
+			"error":  fmt.Sprintf("Failed to read file: %v", err),
 		})
 		return nil, err
 	}
-
-	validShards := 0
-	for i, shard := range fileShards.Shards {
-		if shard != nil {
-			validShards++
-			log.Printf("Shard %d: Length = %d bytes", i, len(shard))
-		} else {
-			log.Printf("Shard %d: Missing", i)
-		}
-	}
-	log.Printf("Retrieved %d valid shards out of %d total shards",
-		validShards, file.DataShardCount+file.ParityShardCount)
-
-	if !c.rsService.ValidateShards(fileShards.Shards, int(file.DataShardCount)) {
-		log.Printf("Insufficient shards for file %d - Need %d data shards, have %d valid shards",
-			file.ID, file.DataShardCount, validShards)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "Insufficient shards available for reconstruction",
-		})
-		return nil, fmt.Errorf("insufficient shards")
-	}
-
-	reconstructed, err := c.rsService.ReconstructFile(fileShards.Shards, int(file.DataShardCount), int(file.ParityShardCount))
-	if err != nil {
-		log.Printf("Failed to reconstruct file from shards: %v", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "Failed to reconstruct file",
-		})
-		return nil, err
-	}
-
-	log.Printf("Successfully reconstructed file from shards - Total size: %d bytes", len(reconstructed))
-	return reconstructed, nil
-}
-
-func (c *DownloadFileController) decryptData(ctx *gin.Context, file *models.File, data []byte, shares []services.KeyShare) ([]byte, error) {
-	log.Printf("Starting decryption for file ID: %d with encryption type: %s", file.ID, file.EncryptionType)
-	log.Printf("Data size: %d bytes", len(data))
-	log.Printf("IV length: %d bytes", len(file.EncryptionIV))
-	log.Printf("Salt length: %d bytes", len(file.EncryptionSalt))
-
-	for i, share := range shares {
-		log.Printf("Share %d - Index: %d, Value length: %d", i, share.Index, len(share.Value))
-	}
-
-	// Use the appropriate decryption method based on encryption type
-	decrypted, err := c.encryptionService.DecryptFileWithType(
-		data,
-		file.EncryptionIV,
-		shares,
-		int(file.Threshold),
-		file.EncryptionSalt,
-		file.EncryptionType,
-	)
-	if err != nil {
-		log.Printf("Decryption failed: %v", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  fmt.Sprintf("Failed to decrypt file: %v", err),
-		})
-		return nil, err
-	}
-
-	log.Printf("Successfully decrypted data - Decrypted size: %d bytes", len(decrypted))
-	return decrypted, nil
-}
-
-func (c *DownloadFileController) handleDecompression(ctx *gin.Context, file *models.File, data []byte) ([]byte, error) {
-	if !file.IsCompressed {
-		return data, nil
-	}
-
-	log.Printf("Decompressing data for file ID: %d", file.ID)
-	decompressed, err := c.compressionService.Decompress(data)
-	if err != nil {
-		log.Printf("Decompression failed: %v", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "Failed to decompress file",
-		})
-		return nil, err
-	}
-	return decompressed, nil
+	return content, nil
 }
 
 func (c *DownloadFileController) logDownloadActivity(user *models.User, file *models.File, ipAddress string) {
@@ -471,14 +312,18 @@ func (c *DownloadFileController) logDownloadActivity(user *models.User, file *mo
 	}
 }
 
-func (c *DownloadFileController) sendFileResponse(ctx *gin.Context, file *models.File, data []byte) {
+func (c *DownloadFileController) sendFileResponse(ctx *gin.Context, file *models.File, content io.Reader) {
 	ctx.Header("Content-Description", "File Transfer")
 	ctx.Header("Content-Transfer-Encoding", "binary")
 	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, file.OriginalName))
 	ctx.Header("Content-Type", file.MimeType)
-	ctx.Header("Content-Length", fmt.Sprintf("%d", len(data)))
+	ctx.Header("Content-Length", fmt.Sprintf("%d", file.Size))
 
 	log.Printf("Sending file response: %s (sharded=%v, compressed=%v)",
 		file.Name, file.IsSharded, file.IsCompressed)
-	ctx.Data(http.StatusOK, file.MimeType, data)
+	ctx.Status(http.StatusOK)
+	if _, err := io.Copy(ctx.Writer, content); err != nil {
+		// The client sees a body shorter than Content-Length
+		log.Printf("Failed to send file %d: %v", file.ID, err)
+	}
 }
@@ -3,9 +3,9 @@ package EndUser
 import (
 	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"os"
 	"safesplit/models"
 	"safesplit/services"
 	"strconv"
@@ -21,7 +21,8 @@ type MassDownloadFileController struct {
 	activityLogModel   *models.ActivityLogModel
 	compressionService *services.CompressionService
 	rsService          *services.ReedSolomonService
-	serverKeyModel     *models.ServerMasterKeyModel
+	keyProvider        services.KeyProvider
+	sessionKeys        *services.SessionKeyCache
 }
 
 type DownloadResult struct {
@@ -39,7 +40,8 @@ func NewMassDownloadFileController(
 	activityLogModel *models.ActivityLogModel,
 	compressionService *services.CompressionService,
 	rsService *services.ReedSolomonService,
-	serverKeyModel *models.ServerMasterKeyModel,
+	keyProvider services.KeyProvider,
+	sessionKeys *services.SessionKeyCache,
 ) *MassDownloadFileController {
 	return &MassDownloadFileController{
 		fileModel:          fileModel,
@@ -48,7 +50,8 @@ func NewMassDownloadFileController(
 		activityLogModel:   activityLogModel,
 		compressionService: compressionService,
 		rsService:          rsService,
-		serverKeyModel:     serverKeyModel,
+		keyProvider:        keyProvider,
+		sessionKeys:        sessionKeys,
 	}
 }
 
@@ -163,30 +166,20 @@ func (c *MassDownloadFileController) GetFile(ctx *gin.Context) {
 		return
 	}
 
-	// Get encrypted data
-	encryptedData, err := c.getFileData(ctx, file)
-	if err != nil {
-		return
-	}
-
-	// Decrypt data
-	decryptedData, err := c.decryptData(ctx, file, encryptedData, shares)
-	if err != nil {
-		return
-	}
-
-	// Decompress if needed
-	finalData, err := c.handleDecompression(ctx, file, decryptedData)
+	// Decrypt and decompress the content while it is sent
+	content, err := c.openContent(ctx, file, shares)
 	if err != nil {
 		return
 	}
+	defer content.Close()
 
 	// Log the download
 	c.logDownloadActivity(currentUser, file, ctx.ClientIP())
 
 	// Send the file
-	c.sendFileResponse(ctx, file, finalData)
+	c.sendFileResponse(ctx, file, content)
 }
+
 func (c *MassDownloadFileController) logDownloadActivity(user *models.User, file *models.File, ipAddress string) error {
 	activityDetail := "File downloaded successfully"
 	if file.IsCompressed {
@@ -261,24 +254,15 @@ func (c *MassDownloadFileController) processDownload(ctx *gin.Context, user *mod
 		return result
 	}
 
-	// Get file data
-	encryptedData, err := c.getFileData(ctx, file)
+	// Read the whole content to check the file can be decrypted
+	content, err := c.openContent(ctx, file, shares)
 	if err != nil {
-		result.Error = fmt.Sprintf("Failed to get file data: %v", err)
+		result.Error = fmt.Sprintf("Failed to read file: %v", err)
 		return result
 	}
-
-	// Decrypt data
-	decryptedData, err := c.decryptData(ctx, file, encryptedData, shares)
-	if err != nil {
-		result.Error = fmt.Sprintf("Failed to decrypt data: %v", err)
-		return result
-	}
-
-	// Decompress if needed
-	_, err = c.handleDecompression(ctx, file, decryptedData)
-	if err != nil {
-		result.Error = fmt.Sprintf("Failed to decompress data: %v", err)
+	defer content.Close()
+	if _, err := io.Copy(io.Discard, content); err != nil {
+		result.Error = fmt.Sprintf("Failed to read file: %v", err)
 		return result
 	}
 
@@ -405,26 +389,6 @@ func (c *MassDownloadFileController) validateFileMetadata(file *models.File) err
 func (c *MassDownloadFileController) getKeyShares(ctx *gin.Context, file *models.File) ([]services.KeyShare, error) {
 	log.Printf("Retrieving key fragments for file %d", file.ID)
 
-	serverKey, err := c.serverKeyModel.GetActive()
-	if err != nil {
-		log.Printf("Failed to retrieve server key: %v", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "Failed to retrieve server key",
-		})
-		return nil, err
-	}
-
-	serverKeyData, err := c.serverKeyModel.GetServerKey(serverKey.KeyID)
-	if err != nil {
-		log.Printf("Failed to get server key data: %v", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "Failed to get server key data",
-		})
-		return nil, err
-	}
-
 	currentUser, err := c.getCurrentUser(ctx)
 	if err != nil {
 		return nil, err
@@ -441,46 +405,25 @@ func (c *MassDownloadFileController) getKeyShares(ctx *gin.Context, file *models
 		return nil, err
 	}
 
-	// Derive user's KEK - do this only once before the loop
-	kek, err := services.DeriveKeyEncryptionKey(currentUser.Password, currentUser.MasterKeySalt)
-	if err != nil {
-		log.Printf("Failed to derive KEK: %v", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "Failed to derive KEK",
-		})
-		return nil, err
-	}
-
-	// Decrypt master key - do this only once before the loop
-	decryptedMasterKey, err := services.DecryptMasterKey(
-		currentUser.EncryptedMasterKey,
-		kek,
-		currentUser.MasterKeyNonce,
-	)
+	// The master key is only unwrapped while the user's session is unlocked
+	userMasterKey, err := c.sessionKeys.MasterKey(ctx.GetString("session_id"), currentUser.ID)
 	if err != nil {
-		log.Printf("Failed to decrypt master key: %v", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "Failed to decrypt master key",
+		log.Printf("Master key of user %d is not available: %v", currentUser.ID, err)
+		ctx.JSON(http.StatusUnauthorized, gin.H{
+			"status":         "error",
+			"error":          err.Error(),
+			"session_locked": true,
 		})
 		return nil, err
 	}
 
-	// Use first 32 bytes of decrypted master key
-	userMasterKey := decryptedMasterKey[:32]
-
 	shares := make([]services.KeyShare, len(fragments))
 	for i, fragment := range fragments {
 		var decryptedFragment []byte
 
 		if fragment.KeyFragment.HolderType == models.ServerHolder {
 			log.Printf("Decrypting server fragment %d with server key", i)
-			decryptedFragment, err = services.DecryptMasterKey(
-				fragment.Data,
-				serverKeyData,
-				fragment.KeyFragment.EncryptionNonce,
-			)
+			decryptedFragment, err = models.UnwrapServerFragment(c.keyProvider, &fragment.KeyFragment, fragment.Data)
 		} else {
 			log.Printf("Decrypting user fragment %d with decrypted user master key", i)
 			decryptedFragment, err = services.DecryptMasterKey(
@@ -510,102 +453,31 @@ func (c *MassDownloadFileController) getKeyShares(ctx *gin.Context, file *models
 
 	return shares, nil
 }
-func (c *MassDownloadFileController) getFileData(ctx *gin.Context, file *models.File) ([]byte, error) {
-	if file.IsSharded {
-		return c.getShardedData(ctx, file)
-	}
-
-	data, err := os.ReadFile(file.FilePath)
-	if err != nil {
-		log.Printf("Failed to read file from disk: %v", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "Failed to read file data",
-		})
-		return nil, err
-	}
-
-	return data, nil
-}
-
-func (c *MassDownloadFileController) getShardedData(ctx *gin.Context, file *models.File) ([]byte, error) {
-	fileShards, err := c.rsService.RetrieveShards(file.ID, int(file.DataShardCount+file.ParityShardCount))
-	if err != nil {
-		log.Printf("Failed to retrieve shards: %v", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "Failed to retrieve file shards",
-		})
-		return nil, err
-	}
-
-	if !c.rsService.ValidateShards(fileShards.Shards, int(file.DataShardCount)) {
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "Insufficient shards for reconstruction",
-		})
-		return nil, fmt.Errorf("insufficient shards")
-	}
-
-	reconstructed, err := c.rsService.ReconstructFile(fileShards.Shards, int(file.DataShardCount), int(file.ParityShardCount))
-	if err != nil {
-		log.Printf("Failed to reconstruct file: %v", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "Failed to reconstruct file",
-		})
-		return nil, err
-	}
-
-	return reconstructed, nil
-}
-
-func (c *MassDownloadFileController) decryptData(ctx *gin.Context, file *models.File, data []byte, shares []services.KeyShare) ([]byte, error) {
-	decrypted, err := c.encryptionService.DecryptFileWithType(
-		data,
-		file.EncryptionIV,
-		shares,
-		int(file.Threshold),
-		file.EncryptionSalt,
-		file.EncryptionType,
-	)
-	if err != nil {
-		log.Printf("Decryption failed: %v", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  fmt.Sprintf("Failed to decrypt file: %v", err),
-		})
-		return nil, err
-	}
-
-	return decrypted, nil
-}
-
-func (c *MassDownloadFileController) handleDecompression(ctx *gin.Context, file *models.File, data []byte) ([]byte, error) {
-	if !file.IsCompressed {
-		return data, nil
-	}
-
-	decompressed, err := c.compressionService.Decompress(data)
+func (c *MassDownloadFileController) openContent(ctx *gin.Context, file *models.File, shares []services.KeyShare) (io.ReadCloser, error) {
+	content, err := c.fileModel.OpenContent(file, shares, c.compressionService)
 	if err != nil {
-		log.Printf("Decompression failed: %v", err)
+		log.Printf("Failed to open content of file %d: %v", file.ID, err)
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"status": "error",
-			"error":  "Failed to decompress file",
+			"error":  fmt.Sprintf("Failed to read file: %v", err),
 		})
 		return nil, err
 	}
-	return decompressed, nil
+	return content, nil
 }
 
-func (c *MassDownloadFileController) sendFileResponse(ctx *gin.Context, file *models.File, data []byte) {
+func (c *MassDownloadFileController) sendFileResponse(ctx *gin.Context, file *models.File, content io.Reader) {
 	ctx.Header("Content-Description", "File Transfer")
 	ctx.Header("Content-Transfer-Encoding", "binary")
 	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, file.OriginalName))
 	ctx.Header("Content-Type", file.MimeType)
-	ctx.Header("Content-Length", fmt.Sprintf("%d", len(data)))
+	ctx.Header("Content-Length", fmt.Sprintf("%d", file.Size))
 
 	log.Printf("Sending file response: %s (sharded=%v, compressed=%v)",
 		file.Name, file.IsSharded, file.IsCompressed)
-	ctx.Data(http.StatusOK, file.MimeType, data)
+	ctx.Status(http.StatusOK)
+	if _, err := io.Copy(ctx.Writer, content); err != nil {
+		// The client sees a body shorter than Content-Length
+		log.Printf("Failed to send file %d: %v", file.ID, err)
+	}
 }
@@ -1,10 +1,8 @@
 package EndUser
 
 import (
-	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
-	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
@@ -12,7 +10,6 @@ import (
 	"safesplit/services"
 	"strconv"
 	"sync"
-	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -27,25 +24,15 @@ type MassUploadFileController struct {
 	compressionService *services.CompressionService
 	folderModel        *models.FolderModel
 	rsService          *services.ReedSolomonService
-	serverKeyModel     *models.ServerMasterKeyModel
+	keyProvider        services.KeyProvider
+	sessionKeys        *services.SessionKeyCache
+	profileModel       *models.DurabilityProfileModel
 }
 
-type massProcessedFile struct {
-	compressed []byte
-	encrypted  []byte
-	iv         []byte
-	salt       []byte
-	shares     []services.KeyShare
-	shards     [][]byte
-	fileHash   string
-	ratio      float64
-}
 type UploadParams struct {
 	EncryptionType services.EncryptionType
-	NShares        int
-	Threshold      int
-	DataShards     int
-	ParityShards   int
+	Profile        *models.DurabilityProfile // parameters are resolved per file from its size
+	MasterKey      []byte                    // the user's master key, unlocked for the session
 }
 
 type UploadResult struct {
@@ -68,7 +55,9 @@ func NewMassUploadFileController(
 	compressionService *services.CompressionService,
 	folderModel *models.FolderModel,
 	rsService *services.ReedSolomonService,
-	serverKeyModel *models.ServerMasterKeyModel,
+	keyProvider services.KeyProvider,
+	sessionKeys *services.SessionKeyCache,
+	profileModel *models.DurabilityProfileModel,
 ) *MassUploadFileController {
 	return &MassUploadFileController{
 		fileModel:          fileModel,
@@ -80,7 +69,9 @@ func NewMassUploadFileController(
 		compressionService: compressionService,
 		folderModel:        folderModel,
 		rsService:          rsService,
-		serverKeyModel:     serverKeyModel,
+		keyProvider:        keyProvider,
+		sessionKeys:        sessionKeys,
+		profileModel:       profileModel,
 	}
 }
 
@@ -120,13 +111,15 @@ func (c *MassUploadFileController) MassUpload(ctx *gin.Context) {
 		return
 	}
 
-	nShares := c.parseIntParam(ctx, "shares", 5)
-	threshold := c.parseIntParam(ctx, "threshold", 3)
-	dataShards := c.parseIntParam(ctx, "data_shards", 4)
-	parityShards := c.parseIntParam(ctx, "parity_shards", 2)
+	profile, ok := resolveDurabilityProfile(ctx, c.profileModel, currentUser)
+	if !ok {
+		return
+	}
 
-	if err := c.validateParameters(nShares, threshold, dataShards, parityShards); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+	// User fragments are wrapped with the master key unlocked for this session
+	masterKey, err := c.sessionKeys.MasterKey(ctx.GetString("session_id"), currentUser.ID)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"status": "error", "error": err.Error(), "session_locked": true})
 		return
 	}
 
@@ -156,10 +149,8 @@ func (c *MassUploadFileController) MassUpload(ctx *gin.Context) {
 
 	uploadParams := &UploadParams{
 		EncryptionType: encryptionType,
-		NShares:        nShares,
-		Threshold:      threshold,
-		DataShards:     dataShards,
-		ParityShards:   parityShards,
+		Profile:        profile,
+		MasterKey:      masterKey,
 	}
 
 	for _, fileHeader := range files {
@@ -203,41 +194,38 @@ func (c *MassUploadFileController) processUpload(
 		Status:   "failed",
 	}
 
-	// Process file upload
-	processedFile, err := c.processFileUpload(
-		fileHeader,
-		params.NShares,
-		params.Threshold,
-		params.DataShards,
-		params.ParityShards,
-		params.EncryptionType,
-	)
+	durability := params.Profile.ParamsFor(fileHeader.Size)
+
+	// Get server key
+	serverKeyID, err := c.keyProvider.KeyID()
 	if err != nil {
-		result.Error = err.Error()
+		result.Error = fmt.Sprintf("Failed to get server key: %v", err)
 		return result
 	}
 
-	// Get server key
-	serverKey, err := c.serverKeyModel.GetActive()
+	// The file is compressed and encrypted while it is stored
+	content, err := newUploadContent(fileHeader, c.encryptionService, c.compressionService,
+		durability.Shares, durability.Threshold, serverKeyID, params.EncryptionType)
 	if err != nil {
-		result.Error = fmt.Sprintf("Failed to get server key: %v", err)
+		result.Error = err.Error()
 		return result
 	}
 
 	// Create file record
-	fileRecord, err := c.createFileRecord(fileHeader, user.ID, folderID, processedFile, params, serverKey)
+	fileRecord, err := c.createFileRecord(fileHeader, user.ID, folderID, content, params, durability, serverKeyID)
 	if err != nil {
 		result.Error = fmt.Sprintf("Failed to create file record: %v", err)
 		return result
 	}
 
-	// Create file with shards
-	if err := c.fileModel.CreateFileWithShards(
+	// Erasure code the encrypted content straight to the storage nodes
+	if err := c.fileModel.CreateFileFromStream(
 		fileRecord,
-		processedFile.shares,
-		processedFile.shards,
+		content.key.Shares,
+		content,
 		c.keyFragmentModel,
-		c.serverKeyModel,
+		params.MasterKey,
+		c.keyProvider,
 	); err != nil {
 		result.Error = fmt.Sprintf("Failed to save file: %v", err)
 		return result
@@ -255,94 +243,21 @@ func (c *MassUploadFileController) processUpload(
 	return result
 }
 
-func (c *MassUploadFileController) processFileUpload(
-	fileHeader *multipart.FileHeader,
-	n, k int,
-	dataShards, parityShards int,
-	encType services.EncryptionType,
-) (*processedFile, error) {
-	log.Printf("Starting file processing - Size: %d bytes, Encryption: %s", fileHeader.Size, encType)
-
-	src, err := fileHeader.Open()
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
-	}
-	defer src.Close()
-
-	content, err := io.ReadAll(src)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file content: %w", err)
-	}
-	log.Printf("Read file content - Size: %d bytes", len(content))
-
-	// Calculate hash
-	hash := sha256.Sum256(content)
-	fileHash := base64.StdEncoding.EncodeToString(hash[:])
-	log.Printf("File hash: %s", fileHash)
-
-	// Compress content
-	compressed, ratio, err := c.compressionService.Compress(content)
-	if err != nil {
-		return nil, fmt.Errorf("compression failed: %w", err)
-	}
-	log.Printf("Compressed data - Original: %d, Compressed: %d bytes, Ratio: %.2f%%",
-		len(content), len(compressed), ratio*100)
-
-	// Get active server key
-	serverKey, err := c.serverKeyModel.GetActive()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get server key: %w", err)
-	}
-
-	// Generate a temporary file ID for encryption
-	tempFileID := uint(time.Now().UnixNano())
-
-	// Use EncryptFileWithType for encryption
-	encrypted, iv, salt, shares, err := c.encryptionService.EncryptFileWithType(
-		compressed,
-		n,
-		k,
-		tempFileID,
-		serverKey.KeyID,
-		encType,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("encryption failed: %w", err)
-	}
-
-	// Create Reed-Solomon shards
-	fileShards, err := c.rsService.SplitFile(encrypted, dataShards, parityShards)
-	if err != nil {
-		return nil, fmt.Errorf("reed-solomon encoding failed: %w", err)
-	}
-	log.Printf("Created %d shards", len(fileShards.Shards))
-
-	return &processedFile{
-		compressed: compressed,
-		encrypted:  encrypted,
-		iv:         iv,
-		salt:       salt,
-		shares:     shares,
-		shards:     fileShards.Shards,
-		fileHash:   fileHash,
-		ratio:      ratio,
-	}, nil
-}
-
 func (c *MassUploadFileController) createFileRecord(
 	fileHeader *multipart.FileHeader,
 	userID uint,
 	folderID *uint,
-	processedFile *processedFile,
+	content *uploadContent,
 	params *UploadParams,
-	serverKey *models.ServerMasterKey,
+	durability models.DurabilityParams,
+	serverKeyID string,
 ) (*models.File, error) {
-	if processedFile == nil {
-		return nil, fmt.Errorf("processedFile is nil")
+	if content == nil {
+		return nil, fmt.Errorf("content is nil")
 	}
 
-	if serverKey == nil {
-		return nil, fmt.Errorf("serverKey is nil")
+	if serverKeyID == "" {
+		return nil, fmt.Errorf("serverKeyID is empty")
 	}
 
 	encryptedFileName := base64.RawURLEncoding.EncodeToString([]byte(fileHeader.Filename))
@@ -353,21 +268,19 @@ func (c *MassUploadFileController) createFileRecord(
 		Name:              encryptedFileName,
 		OriginalName:      fileHeader.Filename,
 		Size:              fileHeader.Size,
-		CompressedSize:    int64(len(processedFile.compressed)),
 		MimeType:          fileHeader.Header.Get("Content-Type"),
-		EncryptionIV:      processedFile.iv,
-		EncryptionSalt:    processedFile.salt,
+		EncryptionIV:      content.iv,
+		EncryptionSalt:    content.key.Salt,
 		EncryptionType:    params.EncryptionType,
-		EncryptionVersion: 1,
-		FileHash:          processedFile.fileHash,
-		ShareCount:        uint(params.NShares),
-		Threshold:         uint(params.Threshold),
-		DataShardCount:    uint(params.DataShards),
-		ParityShardCount:  uint(params.ParityShards),
+		EncryptionVersion: services.EncryptionSegmented,
+		ShareCount:        uint(durability.Shares),
+		Threshold:         uint(durability.Threshold),
+		DataShardCount:    uint(durability.DataShards),
+		ParityShardCount:  uint(durability.ParityShards),
 		IsCompressed:      true,
 		IsSharded:         true,
-		CompressionRatio:  processedFile.ratio,
-		ServerKeyID:       serverKey.KeyID,
+		DurabilityProfile: params.Profile.Name,
+		ServerKeyID:       serverKeyID,
 		MasterKeyVersion:  1,
 	}, nil
 }
@@ -386,36 +299,6 @@ func (c *MassUploadFileController) validateEncryptionType(encType services.Encry
 	}
 }
 
-func (c *MassUploadFileController) validateParameters(n, k, dataShards, parityShards int) error {
-	if n < k {
-		return fmt.Errorf("number of shares (n) must be greater than or equal to threshold (k)")
-	}
-	if k < 2 {
-		return fmt.Errorf("threshold (k) must be at least 2")
-	}
-	if n > 10 {
-		return fmt.Errorf("number of shares (n) cannot exceed 10")
-	}
-	if dataShards < 1 {
-		return fmt.Errorf("data shards must be at least 1")
-	}
-	if parityShards < 1 {
-		return fmt.Errorf("parity shards must be at least 1")
-	}
-	if dataShards+parityShards > 20 {
-		return fmt.Errorf("total number of shards cannot exceed 20")
-	}
-	return nil
-}
-
-func (c *MassUploadFileController) parseIntParam(ctx *gin.Context, name string, defaultValue int) int {
-	value, err := strconv.Atoi(ctx.DefaultPostForm(name, fmt.Sprintf("%d", defaultValue)))
-	if err != nil {
-		return defaultValue
-	}
-	return value
-}
-
 func (c *MassUploadFileController) handleFolderAssignment(ctx *gin.Context, user *models.User) *uint {
 	if folderIDStr := ctx.PostForm("folder_id"); folderIDStr != "" {
 		id, err := strconv.ParseUint(folderIDStr, 10, 32)
@@ -470,10 +353,11 @@ func (c *MassUploadFileController) logUploadActivity(userID uint, file *models.F
 		IPAddress:    ipAddress,
 		Status:       "success",
 		Details: fmt.Sprintf(
-			"File uploaded with %s encryption, %d shares, %d threshold, %.2f%% compression",
+			"File uploaded with %s encryption, %s durability, %d shares, %d threshold, %.2f%% compression",
 			params.EncryptionType,
-			params.NShares,
-			params.Threshold,
+			file.DurabilityProfile,
+			file.ShareCount,
+			file.Threshold,
 			file.CompressionRatio*100,
 		),
 	}); err != nil {
@@ -496,9 +380,10 @@ func (c *MassUploadFileController) getFileInfo(file *models.File, params *Upload
 			"version": file.EncryptionVersion,
 		},
 		"sharding": gin.H{
-			"data_shards":   params.DataShards,
-			"parity_shards": params.ParityShards,
-			"total_shards":  params.DataShards + params.ParityShards,
+			"profile":       file.DurabilityProfile,
+			"data_shards":   file.DataShardCount,
+			"parity_shards": file.ParityShardCount,
+			"total_shards":  file.DataShardCount + file.ParityShardCount,
 		},
 		"creation_time": file.CreatedAt,
 		"file_hash":     file.FileHash,
@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"safesplit/models"
+	"safesplit/services"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,6 +15,7 @@ type PasswordResetController struct {
     passwordHistoryModel *models.PasswordHistoryModel
     keyFragmentModel     *models.KeyFragmentModel  
     fileModel           *models.FileModel         
+    sessionKeys          *services.SessionKeyCache
 }
 
 type PasswordResetRequest struct {
@@ -26,12 +28,14 @@ func NewPasswordResetController(
     passwordHistoryModel *models.PasswordHistoryModel,
     keyFragmentModel *models.KeyFragmentModel,
     fileModel *models.FileModel,
+    sessionKeys *services.SessionKeyCache,
 ) *PasswordResetController {
     return &PasswordResetController{
         userModel:            userModel,
         passwordHistoryModel: passwordHistoryModel,
         keyFragmentModel:     keyFragmentModel,
         fileModel:            fileModel,
+        sessionKeys:          sessionKeys,
     }
 }
 
@@ -84,6 +88,11 @@ func (c *PasswordResetController) ResetPassword(ctx *gin.Context) {
         return
     }
 
+    // The master key stays the same, but other sessions have to log in with the new password
+    if locked := c.sessionKeys.LockUser(endUser.ID, ctx.GetString("session_id")); locked > 0 {
+        log.Printf("Locked %d other sessions of user %d after password reset", locked, endUser.ID)
+    }
+
     duration := time.Since(startTime)
     log.Printf("Password reset successful for user %d - Duration: %v", endUser.ID, duration)
 
@@ -0,0 +1,351 @@
+package EndUser
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"safesplit/models"
+	"safesplit/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Recovery kit kinds as named in requests
+const (
+	recoveryKitKindMasterKey = "master_key"
+	recoveryKitKindFragments = "fragments"
+)
+
+// RecoveryKitController exports a user's master key or user-held key
+// fragments as a recovery kit sealed under a passphrase, and imports such kits
+// to restore access after the master key was lost or on another instance
+type RecoveryKitController struct {
+	userModel        *models.UserModel
+	fileModel        *models.FileModel
+	keyFragmentModel *models.KeyFragmentModel
+	sessionKeys      *services.SessionKeyCache
+}
+
+// NewRecoveryKitController creates a new RecoveryKitController instance
+func NewRecoveryKitController(
+	userModel *models.UserModel,
+	fileModel *models.FileModel,
+	keyFragmentModel *models.KeyFragmentModel,
+	sessionKeys *services.SessionKeyCache,
+) *RecoveryKitController {
+	return &RecoveryKitController{
+		userModel:        userModel,
+		fileModel:        fileModel,
+		keyFragmentModel: keyFragmentModel,
+		sessionKeys:      sessionKeys,
+	}
+}
+
+type ExportRecoveryKitRequest struct {
+	Password   string `json:"password" binding:"required"`
+	Passphrase string `json:"passphrase" binding:"required"`
+	Kind       string `json:"kind" binding:"required,oneof=master_key fragments"`
+	FileIDs    []uint `json:"file_ids"`
+	Format     string `json:"format" binding:"omitempty,oneof=words armor"`
+}
+
+type ImportRecoveryKitRequest struct {
+	Password   string `json:"password" binding:"required"`
+	Passphrase string `json:"passphrase" binding:"required"`
+	Kit        string `json:"kit" binding:"required"`
+}
+
+// RecoveryKitFileResult reports what importing one file of a fragments kit did
+type RecoveryKitFileResult struct {
+	KitFileID    uint   `json:"kit_file_id"`
+	FileID       uint   `json:"file_id,omitempty"`
+	OriginalName string `json:"original_name"`
+	Status       string `json:"status"` // restored, intact, not_found or failed
+	Fragments    int    `json:"fragments"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Export seals the user's master key, or the user-held shares of the given
+// files, under the passphrase and prints the kit as words or armor
+func (c *RecoveryKitController) Export(ctx *gin.Context) {
+	user, ok := c.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	var req ExportRecoveryKitRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid request: " + err.Error(),
+		})
+		return
+	}
+	if len(req.Passphrase) < services.MinRecoveryPassphraseLength {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Passphrase must be at least 12 characters",
+		})
+		return
+	}
+	if req.Kind == recoveryKitKindFragments && len(req.FileIDs) == 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Select the files to export fragments of",
+		})
+		return
+	}
+	if req.Format == "" {
+		req.Format = services.RecoveryKitFormatWords
+	}
+
+	if err := c.userModel.VerifyPassword(user, req.Password); err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+	masterKey, ok := c.masterKey(ctx, user)
+	if !ok {
+		return
+	}
+
+	kind := services.RecoveryKitMasterKey
+	payload := masterKey
+	var exported []uint
+	if req.Kind == recoveryKitKindFragments {
+		kind = services.RecoveryKitFragments
+		files, err := c.exportFiles(user, masterKey, req.FileIDs)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  err.Error(),
+			})
+			return
+		}
+		if payload, err = json.Marshal(files); err != nil {
+			log.Printf("Error encoding recovery kit of user %d: %v", user.ID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error":  "Failed to create recovery kit",
+			})
+			return
+		}
+		for _, file := range files.Files {
+			exported = append(exported, file.FileID)
+		}
+	}
+
+	kit, err := services.SealRecoveryKit(kind, payload, req.Passphrase)
+	if err == nil {
+		var text string
+		if text, err = services.EncodeRecoveryKit(kit, req.Format); err == nil {
+			log.Printf("User %d exported a %s recovery kit", user.ID, req.Kind)
+			ctx.JSON(http.StatusOK, gin.H{
+				"status": "success",
+				"data": gin.H{
+					"kind":       req.Kind,
+					"format":     req.Format,
+					"kit":        text,
+					"file_ids":   exported,
+					"created_at": time.Now(),
+				},
+			})
+			return
+		}
+	}
+	log.Printf("Error creating recovery kit of user %d: %v", user.ID, err)
+	ctx.JSON(http.StatusInternalServerError, gin.H{
+		"status": "error",
+		"error":  "Failed to create recovery kit",
+	})
+}
+
+func (c *RecoveryKitController) exportFiles(user *models.User, masterKey []byte, fileIDs []uint) (*services.RecoveryKitFiles, error) {
+	files, err := c.fileModel.ListAllUserFiles(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	owned := make(map[uint]*models.File, len(files))
+	for i := range files {
+		owned[files[i].ID] = &files[i]
+	}
+
+	kitFiles := &services.RecoveryKitFiles{}
+	for _, fileID := range fileIDs {
+		file, ok := owned[fileID]
+		if !ok {
+			return nil, errors.New("file not found or access denied")
+		}
+		entry, err := c.keyFragmentModel.ExportUserShares(file, masterKey)
+		if err != nil {
+			return nil, err
+		}
+		kitFiles.Files = append(kitFiles.Files, entry)
+	}
+	return kitFiles, nil
+}
+
+// Import opens a recovery kit with its passphrase. A master key kit makes the
+// kit's key the user's master key again; a fragments kit rewrites the user
+// fragments of matching files that are missing or no longer open.
+func (c *RecoveryKitController) Import(ctx *gin.Context) {
+	user, ok := c.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	var req ImportRecoveryKitRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid request: " + err.Error(),
+		})
+		return
+	}
+	if err := c.userModel.VerifyPassword(user, req.Password); err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	kit, err := services.DecodeRecoveryKit(req.Kit)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+	kind, payload, err := services.OpenRecoveryKit(kit, req.Passphrase)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if kind == services.RecoveryKitMasterKey {
+		c.importMasterKey(ctx, user, req.Password, payload)
+		return
+	}
+	c.importFragments(ctx, user, payload)
+}
+
+func (c *RecoveryKitController) importMasterKey(ctx *gin.Context, user *models.User, password string, masterKey []byte) {
+	moved, err := c.userModel.RestoreMasterKey(user.ID, password, masterKey, c.keyFragmentModel, c.fileModel)
+	if err != nil {
+		log.Printf("Error restoring master key of user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to restore master key",
+		})
+		return
+	}
+
+	// Other sessions hold the replaced key; this one carries on with the restored key if it was unlocked
+	sessionID := ctx.GetString("session_id")
+	if locked := c.sessionKeys.LockUser(user.ID, sessionID); locked > 0 {
+		log.Printf("Locked %d other sessions of user %d after restoring their master key", locked, user.ID)
+	}
+	sessionLocked := c.sessionKeys.Rekey(sessionID, user.ID, masterKey) != nil
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Master key restored",
+		"data": gin.H{
+			"kind":            recoveryKitKindMasterKey,
+			"moved_fragments": moved,
+			"session_locked":  sessionLocked,
+		},
+	})
+}
+
+func (c *RecoveryKitController) importFragments(ctx *gin.Context, user *models.User, payload []byte) {
+	var kitFiles services.RecoveryKitFiles
+	if err := json.Unmarshal(payload, &kitFiles); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Recovery kit content is malformed",
+		})
+		return
+	}
+	masterKey, ok := c.masterKey(ctx, user)
+	if !ok {
+		return
+	}
+
+	results := make([]RecoveryKitFileResult, 0, len(kitFiles.Files))
+	restored := 0
+	for _, entry := range kitFiles.Files {
+		result := RecoveryKitFileResult{KitFileID: entry.FileID, OriginalName: entry.OriginalName}
+		file, count, err := c.keyFragmentModel.ImportUserShares(user.ID, masterKey, entry)
+		switch {
+		case errors.Is(err, models.ErrRecoveryKitFileNotFound):
+			result.Status = "not_found"
+		case err != nil:
+			log.Printf("Error importing recovery kit fragments of file %d for user %d: %v", entry.FileID, user.ID, err)
+			result.Status = "failed"
+			result.Error = err.Error()
+		case count == 0:
+			result.FileID = file.ID
+			result.Status = "intact"
+		default:
+			c.fileModel.RefreshManifest(file)
+			result.FileID = file.ID
+			result.Status = "restored"
+			result.Fragments = count
+			restored++
+		}
+		results = append(results, result)
+	}
+
+	log.Printf("User %d imported a fragments recovery kit: %d of %d files restored", user.ID, restored, len(results))
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data": gin.H{
+			"kind":  recoveryKitKindFragments,
+			"files": results,
+		},
+	})
+}
+
+// masterKey returns the master key unlocked for the session or answers that it is locked
+func (c *RecoveryKitController) masterKey(ctx *gin.Context, user *models.User) ([]byte, bool) {
+	masterKey, err := c.sessionKeys.MasterKey(ctx.GetString("session_id"), user.ID)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{
+			"status":         "error",
+			"error":          err.Error(),
+			"session_locked": true,
+		})
+		return nil, false
+	}
+	return masterKey, true
+}
+
+func (c *RecoveryKitController) getCurrentUser(ctx *gin.Context) (*models.User, bool) {
+	user, exists := ctx.Get("user")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+			"error":  "Unauthorized",
+		})
+		return nil, false
+	}
+	currentUser, ok := user.(*models.User)
+	if !ok {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Invalid user data",
+		})
+		return nil, false
+	}
+	return currentUser, true
+}
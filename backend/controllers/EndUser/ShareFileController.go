@@ -3,6 +3,7 @@ package EndUser
 import (
 	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -24,7 +25,8 @@ type ShareFileController struct {
 	activityLogModel   *models.ActivityLogModel
 	rsService          *services.ReedSolomonService
 	userModel          *models.UserModel
-	serverKeyModel     *models.ServerMasterKeyModel
+	keyProvider        services.KeyProvider
+	sessionKeys        *services.SessionKeyCache
 	twoFactorService   *services.TwoFactorAuthService
 	emailService       *services.SMTPEmailService
 	compressionService *services.CompressionService
@@ -38,7 +40,8 @@ func NewShareFileController(
 	activityLogModel *models.ActivityLogModel,
 	rsService *services.ReedSolomonService,
 	userModel *models.UserModel,
-	serverKeyModel *models.ServerMasterKeyModel,
+	keyProvider services.KeyProvider,
+	sessionKeys *services.SessionKeyCache,
 	twoFactorService *services.TwoFactorAuthService,
 	emailService *services.SMTPEmailService,
 	compressionService *services.CompressionService,
@@ -51,7 +54,8 @@ func NewShareFileController(
 		activityLogModel:   activityLogModel,
 		rsService:          rsService,
 		userModel:          userModel,
-		serverKeyModel:     serverKeyModel,
+		keyProvider:        keyProvider,
+		sessionKeys:        sessionKeys,
 		twoFactorService:   twoFactorService,
 		emailService:       emailService,
 		compressionService: compressionService,
@@ -107,19 +111,12 @@ func (c *ShareFileController) CreateShare(ctx *gin.Context) {
 		return
 	}
 
-	kek, err := services.DeriveKeyEncryptionKey(user.Password, user.MasterKeySalt)
+	// The master key is only unwrapped while the user's session is unlocked
+	userMasterKey, err := c.sessionKeys.MasterKey(ctx.GetString("session_id"), user.ID)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Encryption failed"})
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error(), "session_locked": true})
 		return
 	}
-
-	decryptedMasterKey, err := services.DecryptMasterKey(user.EncryptedMasterKey, kek, user.MasterKeyNonce)
-	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Decryption failed"})
-		return
-	}
-
-	userMasterKey := decryptedMasterKey[:32]
 	fragments, err := c.keyFragmentModel.GetUserFragmentsForFile(file.ID)
 	if err != nil || len(fragments) == 0 {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get fragments"})
@@ -137,9 +134,11 @@ func (c *ShareFileController) CreateShare(ctx *gin.Context) {
 		return
 	}
 
+	kdfParams := services.DefaultKDFParams()
 	encryptedFragment, err := c.encryptionService.EncryptKeyFragment(
 		decryptedFragment,
 		[]byte(req.Password),
+		kdfParams,
 	)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Fragment encryption failed"})
@@ -150,6 +149,7 @@ func (c *ShareFileController) CreateShare(ctx *gin.Context) {
 		FileID:               file.ID,
 		SharedBy:             user.ID,
 		EncryptedKeyFragment: encryptedFragment,
+		KDFParams:            kdfParams.String(),
 		FragmentIndex:        userFragment.FragmentIndex,
 		IsActive:             true,
 		ShareType:            req.ShareType,
@@ -401,22 +401,7 @@ func (c *ShareFileController) processFileAccess(ctx *gin.Context, share *models.
 		return
 	}
 
-	serverKey, err := c.serverKeyModel.GetActive()
-	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Server key error"})
-		return
-	}
-
-	serverKeyData, err := c.serverKeyModel.GetServerKey(serverKey.KeyID)
-	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Server key data error"})
-		return
-	}
-
-	sharedDecryptedFragment, err := c.encryptionService.DecryptKeyFragment(
-		share.EncryptedKeyFragment,
-		[]byte(password),
-	)
+	sharedDecryptedFragment, err := c.fileShareModel.OpenKeyFragment(share, password, c.encryptionService)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Fragment decryption failed"})
 		return
@@ -438,11 +423,7 @@ func (c *ShareFileController) processFileAccess(ctx *gin.Context, share *models.
 			continue
 		}
 
-		decryptedFragment, err := services.DecryptMasterKey(
-			fragment.Data,
-			serverKeyData,
-			fragment.EncryptionNonce,
-		)
+		decryptedFragment, err := models.UnwrapServerFragment(c.keyProvider, &fragment.KeyFragment, fragment.Data)
 		if err != nil {
 			continue
 		}
@@ -462,42 +443,13 @@ func (c *ShareFileController) processFileAccess(ctx *gin.Context, share *models.
 		return
 	}
 
-	var encryptedData []byte
-	var retrievalErr error
-
-	if file.IsSharded {
-		encryptedData, retrievalErr = c.getShardedData(file)
-	} else {
-		encryptedData, retrievalErr = c.fileModel.ReadFileContent(file.FilePath)
-	}
-
-	if retrievalErr != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "File retrieval failed"})
-		return
-	}
-
-	decryptedData, err := c.encryptionService.DecryptFileWithType(
-		encryptedData,
-		file.EncryptionIV,
-		shares,
-		int(file.Threshold),
-		file.EncryptionSalt,
-		file.EncryptionType,
-	)
+	content, err := c.fileModel.OpenContent(file, shares, c.compressionService)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "File decryption failed"})
+		log.Printf("Failed to read file %d: %v", file.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "File retrieval failed"})
 		return
 	}
-
-	// Handle decompression if the file is compressed
-	if file.IsCompressed {
-		log.Printf("Decompressing data for file ID: %d", file.ID)
-		decryptedData, err = c.compressionService.Decompress(decryptedData)
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decompress file"})
-			return
-		}
-	}
+	defer content.Close()
 
 	if err := c.fileShareModel.IncrementDownloadCount(share.ID); err != nil {
 		log.Printf("Failed to increment download count: %v", err)
@@ -512,23 +464,10 @@ func (c *ShareFileController) processFileAccess(ctx *gin.Context, share *models.
 		Details:      fmt.Sprintf("Download with %d fragments", file.Threshold),
 	})
 
-	c.sendFileResponse(ctx, file, decryptedData)
+	c.sendFileResponse(ctx, file, content)
 }
-func (c *ShareFileController) getShardedData(file *models.File) ([]byte, error) {
-	fileShards, err := c.rsService.RetrieveShards(file.ID, int(file.DataShardCount+file.ParityShardCount))
-	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve shards: %w", err)
-	}
 
-	if !c.rsService.ValidateShards(fileShards.Shards, int(file.DataShardCount)) {
-		return nil, fmt.Errorf("insufficient shards for reconstruction")
-	}
-
-	return c.rsService.ReconstructFile(fileShards.Shards,
-		int(file.DataShardCount), int(file.ParityShardCount))
-}
-
-func (c *ShareFileController) sendFileResponse(ctx *gin.Context, file *models.File, data []byte) {
+func (c *ShareFileController) sendFileResponse(ctx *gin.Context, file *models.File, content io.Reader) {
 	escapedName := strings.ReplaceAll(file.OriginalName, `"`, `\"`)
 	utf8Name := url.PathEscape(file.OriginalName)
 	ctx.Header("Content-Disposition", fmt.Sprintf(
@@ -537,11 +476,15 @@ func (c *ShareFileController) sendFileResponse(ctx *gin.Context, file *models.Fi
 		utf8Name,
 	))
 	ctx.Header("Content-Type", file.MimeType)
-	ctx.Header("Content-Length", fmt.Sprintf("%d", len(data)))
+	ctx.Header("Content-Length", fmt.Sprintf("%d", file.Size))
 	ctx.Header("X-Original-Filename", escapedName)
 	ctx.Header("Access-Control-Expose-Headers", "Content-Disposition, Content-Type, Content-Length, X-Original-Filename")
 	ctx.Header("Content-Description", "File Transfer")
 	ctx.Header("Content-Transfer-Encoding", "binary")
-	log.Printf("Sending file response: %s (Size: %d bytes)", file.OriginalName, len(data))
-	ctx.Data(http.StatusOK, file.MimeType, data)
+	log.Printf("Sending file response: %s (Size: %d bytes)", file.OriginalName, file.Size)
+	ctx.Status(http.StatusOK)
+	if _, err := io.Copy(ctx.Writer, content); err != nil {
+		// The client sees a body shorter than Content-Length
+		log.Printf("Failed to send file %d: %v", file.ID, err)
+	}
 }
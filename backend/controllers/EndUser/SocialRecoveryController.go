@@ -0,0 +1,635 @@
+package EndUser
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"safesplit/models"
+	"safesplit/services"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits on recovery links asked for through the public endpoint
+const (
+	recoveryLinksPerEmail = 3
+	recoveryLinksPerIP    = 10
+	recoveryLinkWindow    = time.Hour
+)
+
+// SocialRecoveryController lets users split their master key between trusted
+// contacts and, once locked out, recover it with the approval of enough of
+// them to set a new password without losing their files
+type SocialRecoveryController struct {
+	socialRecoveryModel  *models.SocialRecoveryModel
+	userModel            *models.UserModel
+	passwordHistoryModel *models.PasswordHistoryModel
+	sessionKeys          *services.SessionKeyCache
+	emailService         *services.SMTPEmailService
+	emailLimiter         *services.WindowLimiter
+	ipLimiter            *services.WindowLimiter
+}
+
+// NewSocialRecoveryController creates a new SocialRecoveryController instance
+func NewSocialRecoveryController(
+	socialRecoveryModel *models.SocialRecoveryModel,
+	userModel *models.UserModel,
+	passwordHistoryModel *models.PasswordHistoryModel,
+	sessionKeys *services.SessionKeyCache,
+	emailService *services.SMTPEmailService,
+) *SocialRecoveryController {
+	return &SocialRecoveryController{
+		socialRecoveryModel:  socialRecoveryModel,
+		userModel:            userModel,
+		passwordHistoryModel: passwordHistoryModel,
+		sessionKeys:          sessionKeys,
+		emailService:         emailService,
+		emailLimiter:         services.NewWindowLimiter(recoveryLinksPerEmail, recoveryLinkWindow),
+		ipLimiter:            services.NewWindowLimiter(recoveryLinksPerIP, recoveryLinkWindow),
+	}
+}
+
+type SetupSocialRecoveryRequest struct {
+	Password  string   `json:"password" binding:"required"`
+	Contacts  []string `json:"contacts" binding:"required"` // emails of the trusted contacts
+	Threshold int      `json:"threshold" binding:"required"`
+}
+
+type StartSocialRecoveryRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ConfirmSocialRecoveryRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type RecoveryCodeRequest struct {
+	RecoveryCode string `json:"recovery_code" binding:"required"`
+}
+
+type CompleteSocialRecoveryRequest struct {
+	RecoveryCode string `json:"recovery_code" binding:"required"`
+	NewPassword  string `json:"new_password" binding:"required,min=8"`
+}
+
+type ApproveSocialRecoveryRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// GetSetup returns the user's trusted contacts and recent recovery requests
+func (c *SocialRecoveryController) GetSetup(ctx *gin.Context) {
+	user, ok := c.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	setup, err := c.socialRecoveryModel.GetSetup(user.ID)
+	if err != nil && !errors.Is(err, models.ErrSocialRecoveryNotSetUp) {
+		log.Printf("Error getting social recovery setup of user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to get social recovery setup",
+		})
+		return
+	}
+	requests, err := c.socialRecoveryModel.ListRequests(user.ID)
+	if err != nil {
+		log.Printf("Error listing recovery requests of user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to get social recovery setup",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data": gin.H{
+			"setup":    setup,
+			"requests": requests,
+		},
+	})
+}
+
+// Setup splits the user's master key between the given contacts, replacing
+// any earlier setup
+func (c *SocialRecoveryController) Setup(ctx *gin.Context) {
+	user, ok := c.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+
+	var req SetupSocialRecoveryRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid request: " + err.Error(),
+		})
+		return
+	}
+	if err := c.userModel.VerifyPassword(user, req.Password); err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+	masterKey, ok := c.masterKey(ctx, user)
+	if !ok {
+		return
+	}
+
+	setup, err := c.socialRecoveryModel.Setup(user, masterKey, req.Contacts, req.Threshold)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidRecoveryContacts) {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  err.Error(),
+			})
+			return
+		}
+		log.Printf("Error setting up social recovery of user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to set up social recovery",
+		})
+		return
+	}
+
+	for _, contact := range setup.Contacts {
+		c.notify(contact.Email, "You are now a SafeSplit recovery contact", fmt.Sprintf(`Hello %s,
+
+%s chose you as one of the trusted contacts who can help them recover their SafeSplit account.
+
+If they ever lose access, you will be asked to approve their recovery request. Only approve a request after confirming with them directly that they made it.
+
+Best regards,
+SafeSplit Team`, contact.Username, user.Username))
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Social recovery set up",
+		"data":    setup,
+	})
+}
+
+// RemoveSetup deletes the user's social recovery setup
+func (c *SocialRecoveryController) RemoveSetup(ctx *gin.Context) {
+	user, ok := c.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+	if err := c.socialRecoveryModel.Remove(user.ID); err != nil {
+		log.Printf("Error removing social recovery of user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to remove social recovery",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Social recovery removed",
+	})
+}
+
+// CancelRequest cancels a pending recovery request for the user's own account
+func (c *SocialRecoveryController) CancelRequest(ctx *gin.Context) {
+	user, ok := c.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+	requestID, ok := c.parseID(ctx)
+	if !ok {
+		return
+	}
+
+	if err := c.socialRecoveryModel.CancelRequest(requestID, user.ID); err != nil {
+		if errors.Is(err, models.ErrRecoveryRequestNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"status": "error",
+				"error":  "No pending recovery request found",
+			})
+			return
+		}
+		log.Printf("Error cancelling recovery request %d: %v", requestID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to cancel recovery request",
+		})
+		return
+	}
+	log.Printf("User %d cancelled recovery request %d", user.ID, requestID)
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Recovery request cancelled",
+	})
+}
+
+// ListApprovals returns the recovery requests the user is asked to approve as a contact
+func (c *SocialRecoveryController) ListApprovals(ctx *gin.Context) {
+	user, ok := c.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+	approvals, err := c.socialRecoveryModel.PendingApprovals(user.ID)
+	if err != nil {
+		log.Printf("Error listing recovery approvals of user %d: %v", user.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to list recovery requests",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data":   approvals,
+	})
+}
+
+// Approve releases the user's share of a contact's master key to the recovery request
+func (c *SocialRecoveryController) Approve(ctx *gin.Context) {
+	user, ok := c.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+	approvalID, ok := c.parseID(ctx)
+	if !ok {
+		return
+	}
+
+	var req ApproveSocialRecoveryRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid request: " + err.Error(),
+		})
+		return
+	}
+	if err := c.userModel.VerifyPassword(user, req.Password); err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+	masterKey, ok := c.masterKey(ctx, user)
+	if !ok {
+		return
+	}
+
+	if err := c.socialRecoveryModel.Approve(approvalID, user, masterKey); err != nil {
+		c.approvalError(ctx, approvalID, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Recovery request approved",
+	})
+}
+
+// Decline refuses a recovery request the user is asked to approve
+func (c *SocialRecoveryController) Decline(ctx *gin.Context) {
+	user, ok := c.getCurrentUser(ctx)
+	if !ok {
+		return
+	}
+	approvalID, ok := c.parseID(ctx)
+	if !ok {
+		return
+	}
+
+	if err := c.socialRecoveryModel.Decline(approvalID, user.ID); err != nil {
+		c.approvalError(ctx, approvalID, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Recovery request declined",
+	})
+}
+
+func (c *SocialRecoveryController) approvalError(ctx *gin.Context, approvalID uint, err error) {
+	switch {
+	case errors.Is(err, models.ErrRecoveryApprovalNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	case errors.Is(err, models.ErrRecoveryRequestClosed):
+		ctx.JSON(http.StatusConflict, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	default:
+		log.Printf("Error answering recovery approval %d: %v", approvalID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to answer recovery request",
+		})
+	}
+}
+
+// StartRequest emails the owner of an account a link to confirm that they
+// want to recover it. The answer is the same whether or not the account
+// exists or has social recovery set up, and contacts are only asked once
+// the link is followed.
+func (c *SocialRecoveryController) StartRequest(ctx *gin.Context) {
+	var req StartSocialRecoveryRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if !c.ipLimiter.Allow(ctx.ClientIP()) || !c.emailLimiter.Allow(email) {
+		ctx.JSON(http.StatusTooManyRequests, gin.H{
+			"status": "error",
+			"error":  "Too many recovery requests, try again later",
+		})
+		return
+	}
+
+	token, owner, err := c.socialRecoveryModel.RequestConfirmation(email)
+	switch {
+	case errors.Is(err, models.ErrSocialRecoveryNotSetUp):
+		// Answered like any other request below
+	case err != nil:
+		log.Printf("Error creating recovery link: %v", err)
+	default:
+		baseURL := os.Getenv("BASE_URL")
+		if baseURL == "" {
+			baseURL = "http://localhost:3000"
+		}
+		// Sent in the background so the response time doesn't tell whether there was anyone to email
+		go c.notify(owner.Email, "Confirm your SafeSplit account recovery", fmt.Sprintf(`Hello %s,
+
+Someone asked to recover your SafeSplit account with the help of your trusted contacts. If this was you, open the link below within %d minutes to start the recovery and get your recovery code:
+
+%s/social-recovery/confirm?token=%s
+
+Your contacts are only asked for their approval once the link is opened. If this was not you, ignore this email.
+
+Best regards,
+SafeSplit Team`, owner.Username, int(models.RecoveryConfirmationLifetime.Minutes()), baseURL, token))
+	}
+
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"status":  "success",
+		"message": "If social recovery is set up for this account, a link to confirm the recovery was sent to its email address.",
+	})
+}
+
+// ConfirmRequest opens a recovery request with the link emailed by
+// StartRequest, superseding any earlier pending request, and returns the
+// recovery code needed to complete it, which is shown only once
+func (c *SocialRecoveryController) ConfirmRequest(ctx *gin.Context) {
+	var req ConfirmSocialRecoveryRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	privateKey, publicKey, err := services.GenerateRecoveryKeyPair()
+	if err != nil {
+		log.Printf("Error generating recovery code: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to start recovery",
+		})
+		return
+	}
+
+	request, owner, err := c.socialRecoveryModel.StartRequest(req.Token, publicKey)
+	switch {
+	case errors.Is(err, models.ErrRecoveryConfirmation):
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	case errors.Is(err, models.ErrSocialRecoveryNotSetUp):
+		// Removed since the link was sent
+		ctx.JSON(http.StatusConflict, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	case err != nil:
+		log.Printf("Error starting recovery request: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to start recovery",
+		})
+		return
+	}
+
+	c.notify(owner.Email, "SafeSplit account recovery started", fmt.Sprintf(`Hello %s,
+
+A recovery of your SafeSplit account was confirmed and your trusted contacts were asked for their approval. The request expires on %s.
+
+If this was not you, log in and cancel recovery request %d under your social recovery settings.
+
+Best regards,
+SafeSplit Team`, owner.Username, request.ExpiresAt.Format("2006-01-02 15:04 MST"), request.ID))
+
+	contacts, err := c.socialRecoveryModel.ContactsOf(request)
+	if err != nil {
+		log.Printf("Error notifying contacts of recovery request %d: %v", request.ID, err)
+	}
+	for _, contact := range contacts {
+		c.notify(contact.Email, "A SafeSplit contact needs your help", fmt.Sprintf(`Hello %s,
+
+%s asked to recover their SafeSplit account and needs your approval.
+
+Confirm with them directly that they made this request, then log in to SafeSplit to approve or decline it. The request expires on %s.
+
+Best regards,
+SafeSplit Team`, contact.Username, owner.Username, request.ExpiresAt.Format("2006-01-02 15:04 MST")))
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{
+		"status":  "success",
+		"message": "Recovery requested. Keep the recovery code, it is needed to finish and is not shown again.",
+		"data": gin.H{
+			"request_id":    request.ID,
+			"recovery_code": hex.EncodeToString(privateKey),
+			"expires_at":    request.ExpiresAt,
+		},
+	})
+}
+
+// RequestStatus reports how many contacts approved a recovery request
+func (c *SocialRecoveryController) RequestStatus(ctx *gin.Context) {
+	requestID, ok := c.parseID(ctx)
+	if !ok {
+		return
+	}
+	var req RecoveryCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	status, err := c.socialRecoveryModel.RequestStatus(requestID, parseRecoveryCode(req.RecoveryCode))
+	if err != nil {
+		c.requestError(ctx, requestID, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data":   status,
+	})
+}
+
+// CompleteRequest sets a new password once enough contacts have approved,
+// keeping the account's master key and with it access to its files
+func (c *SocialRecoveryController) CompleteRequest(ctx *gin.Context) {
+	requestID, ok := c.parseID(ctx)
+	if !ok {
+		return
+	}
+	var req CompleteSocialRecoveryRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	user, err := c.socialRecoveryModel.Complete(requestID, parseRecoveryCode(req.RecoveryCode), req.NewPassword, c.passwordHistoryModel)
+	if err != nil {
+		c.requestError(ctx, requestID, err)
+		return
+	}
+
+	// Sessions still running elsewhere were opened with the old password
+	if locked := c.sessionKeys.LockUser(user.ID, ""); locked > 0 {
+		log.Printf("Locked %d sessions of user %d after social recovery", locked, user.ID)
+	}
+	c.notify(user.Email, "Your SafeSplit account was recovered", fmt.Sprintf(`Hello %s,
+
+The password of your SafeSplit account was reset with the approval of your trusted contacts. Your files remain accessible with the new password.
+
+If this was not you, contact support immediately.
+
+Best regards,
+SafeSplit Team`, user.Username))
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Account recovered, log in with your new password",
+	})
+}
+
+func (c *SocialRecoveryController) requestError(ctx *gin.Context, requestID uint, err error) {
+	switch {
+	case errors.Is(err, models.ErrRecoveryRequestNotFound), errors.Is(err, models.ErrRecoveryCode):
+		// Don't tell whether the request exists to someone without its code
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "Recovery request not found or recovery code is wrong",
+		})
+	case errors.Is(err, models.ErrRecoveryRequestClosed), errors.Is(err, models.ErrRecoveryThresholdNotMet):
+		ctx.JSON(http.StatusConflict, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	case errors.Is(err, models.ErrRecoveredKeyMismatch):
+		log.Printf("Recovery request %d: %v", requestID, err)
+		ctx.JSON(http.StatusUnprocessableEntity, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	case errors.Is(err, models.ErrRecoveryPasswordReused):
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	default:
+		log.Printf("Error completing recovery request %d: %v", requestID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to recover account",
+		})
+	}
+}
+
+// parseRecoveryCode decodes a recovery code as shown, ignoring spaces and dashes
+func parseRecoveryCode(code string) []byte {
+	code = strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code))
+	privateKey, err := hex.DecodeString(code)
+	if err != nil {
+		return nil
+	}
+	return privateKey
+}
+
+func (c *SocialRecoveryController) notify(to, subject, body string) {
+	if err := c.emailService.SendEmail(to, subject, body); err != nil {
+		log.Printf("Failed to send email: %v", err)
+	}
+}
+
+// masterKey returns the master key unlocked for the session or answers that it is locked
+func (c *SocialRecoveryController) masterKey(ctx *gin.Context, user *models.User) ([]byte, bool) {
+	masterKey, err := c.sessionKeys.MasterKey(ctx.GetString("session_id"), user.ID)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{
+			"status":         "error",
+			"error":          err.Error(),
+			"session_locked": true,
+		})
+		return nil, false
+	}
+	return masterKey, true
+}
+
+func (c *SocialRecoveryController) parseID(ctx *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 32)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid ID",
+		})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func (c *SocialRecoveryController) getCurrentUser(ctx *gin.Context) (*models.User, bool) {
+	user, exists := ctx.Get("user")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+			"error":  "Unauthorized",
+		})
+		return nil, false
+	}
+	currentUser, ok := user.(*models.User)
+	if !ok {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Invalid user data",
+		})
+		return nil, false
+	}
+	return currentUser, true
+}
@@ -3,6 +3,7 @@ package EndUser
 import (
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -26,7 +27,9 @@ type UploadFileController struct {
 	compressionService *services.CompressionService
 	folderModel        *models.FolderModel
 	rsService          *services.ReedSolomonService
-	serverKeyModel     *models.ServerMasterKeyModel
+	keyProvider        services.KeyProvider
+	sessionKeys        *services.SessionKeyCache
+	profileModel       *models.DurabilityProfileModel
 }
 
 func NewFileController(
@@ -39,7 +42,9 @@ func NewFileController(
 	compressionService *services.CompressionService,
 	folderModel *models.FolderModel,
 	rsService *services.ReedSolomonService,
-	serverKeyModel *models.ServerMasterKeyModel,
+	keyProvider services.KeyProvider,
+	sessionKeys *services.SessionKeyCache,
+	profileModel *models.DurabilityProfileModel,
 ) *UploadFileController {
 	return &UploadFileController{
 		fileModel:          fileModel,
@@ -51,47 +56,95 @@ func NewFileController(
 		compressionService: compressionService,
 		folderModel:        folderModel,
 		rsService:          rsService,
-		serverKeyModel:     serverKeyModel,
+		keyProvider:        keyProvider,
+		sessionKeys:        sessionKeys,
+		profileModel:       profileModel,
 	}
 }
 
-// Validation methods
-func (c *UploadFileController) validateShamirParameters(n, k int) error {
-	if n < k {
-		return fmt.Errorf("number of shares (n) must be greater than or equal to threshold (k)")
+// rawDurabilityFields were accepted before uploads were tied to durability profiles
+var rawDurabilityFields = []string{"shares", "threshold", "data_shards", "parity_shards"}
+
+// resolveDurabilityProfile returns the profile named by the durability_profile
+// form value, or the default one. On failure it writes the error response.
+func resolveDurabilityProfile(ctx *gin.Context, profileModel *models.DurabilityProfileModel, user *models.User) (*models.DurabilityProfile, bool) {
+	for _, field := range rawDurabilityFields {
+		if _, set := ctx.GetPostForm(field); set {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  fmt.Sprintf("%s is no longer accepted; choose a durability_profile instead", field),
+			})
+			return nil, false
+		}
 	}
-	if k < 2 {
-		return fmt.Errorf("threshold (k) must be at least 2")
+
+	profile, err := profileModel.GetForUser(ctx.PostForm("durability_profile"), user)
+	if err == nil {
+		return profile, true
 	}
-	if n > 10 {
-		return fmt.Errorf("number of shares (n) cannot exceed 10")
+
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, models.ErrDurabilityProfileNotFound):
+		status = http.StatusBadRequest
+	case errors.Is(err, models.ErrDurabilityProfileNotAllowed):
+		status = http.StatusForbidden
+	default:
+		log.Printf("Error resolving durability profile: %v", err)
 	}
-	return nil
+	response := gin.H{"status": "error", "error": err.Error()}
+	if status != http.StatusInternalServerError {
+		if available, err := profileModel.ListAvailable(user); err == nil {
+			response["available_profiles"] = available
+		}
+	}
+	ctx.JSON(status, response)
+	return nil, false
 }
 
-func (c *UploadFileController) validateRSParameters(dataShards, parityShards int) error {
-	if dataShards < 1 {
-		return fmt.Errorf("data shards must be at least 1")
-	}
-	if parityShards < 1 {
-		return fmt.Errorf("parity shards must be at least 1")
+// GetDurabilityProfiles lists the durability profiles the user's plan allows
+func (c *UploadFileController) GetDurabilityProfiles(ctx *gin.Context) {
+	user, exists := ctx.Get("user")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"status": "error", "error": "Unauthorized access"})
+		return
 	}
-	if dataShards+parityShards > 20 {
-		return fmt.Errorf("total number of shards cannot exceed 20")
+
+	currentUser, ok := user.(*models.User)
+	if !ok {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": "Invalid user data"})
+		return
 	}
-	return nil
-}
 
-func (c *UploadFileController) validateParameters(n, k, dataShards, parityShards int) error {
-	if err := c.validateShamirParameters(n, k); err != nil {
-		return err
+	profiles, err := c.profileModel.ListAvailable(currentUser)
+	if err != nil {
+		log.Printf("Error listing durability profiles: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": "Failed to list durability profiles"})
+		return
 	}
 
-	if err := c.validateRSParameters(dataShards, parityShards); err != nil {
-		return err
+	defaultProfile := ""
+	for _, profile := range profiles {
+		if profile.IsDefault {
+			defaultProfile = profile.Name
+		}
+	}
+	if len(profiles) == 0 {
+		// No profiles defined yet; uploads fall back to the built-in parameters
+		fallback, err := c.profileModel.GetForUser("", currentUser)
+		if err == nil {
+			profiles, defaultProfile = append(profiles, *fallback), fallback.Name
+		}
 	}
 
-	return nil
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data": gin.H{
+			"profiles":   profiles,
+			"is_premium": currentUser.IsPremiumUser(),
+			"default":    defaultProfile,
+		},
+	})
 }
 
 // Add new method for encryption options
@@ -204,15 +257,141 @@ func (c *UploadFileController) validateEncryptionType(encType services.Encryptio
 	}
 }
 
-type processedFile struct {
-	compressed []byte
-	encrypted  []byte
-	iv         []byte
-	salt       []byte
-	shares     []services.KeyShare
-	shards     [][]byte
-	fileHash   string
-	ratio      float64
+// uploadContent compresses and encrypts an uploaded file while the storage
+// nodes are fed, as models.FileContent. Only the buffers of the compressor and
+// the current encryption segment are held in memory.
+type uploadContent struct {
+	header      *multipart.FileHeader
+	compression *services.CompressionService
+	key         *services.FileKey
+	iv          []byte
+
+	// Outcome of producing the content, set before its reader is closed
+	err            error
+	size           int64
+	compressedSize int64
+	fileHash       string
+}
+
+func newUploadContent(
+	fileHeader *multipart.FileHeader,
+	encryptionService *services.EncryptionService,
+	compressionService *services.CompressionService,
+	n, k int,
+	serverKeyID string,
+	encType services.EncryptionType,
+) (*uploadContent, error) {
+	log.Printf("Preparing file upload - Size: %d bytes, Encryption: %s", fileHeader.Size, encType)
+
+	// Generate a temporary file ID for encryption
+	tempFileID := uint(time.Now().UnixNano())
+
+	key, err := encryptionService.NewFileKey(n, k, tempFileID, serverKeyID, encType)
+	if err != nil {
+		return nil, fmt.Errorf("encryption failed: %w", err)
+	}
+	iv, err := key.NewIV()
+	if err != nil {
+		return nil, fmt.Errorf("encryption failed: %w", err)
+	}
+
+	return &uploadContent{
+		header:      fileHeader,
+		compression: compressionService,
+		key:         key,
+		iv:          iv,
+	}, nil
+}
+
+func (u *uploadContent) Open() (io.ReadCloser, error) {
+	src, err := u.header.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer src.Close()
+		u.err = u.produce(src, pw)
+		pw.CloseWithError(u.err)
+	}()
+	return &uploadReader{PipeReader: pr, done: done}, nil
+}
+
+// produce hashes, compresses and encrypts src to w
+func (u *uploadContent) produce(src io.Reader, w io.Writer) error {
+	encrypter, err := u.key.NewEncryptWriter(w, u.iv)
+	if err != nil {
+		return fmt.Errorf("encryption failed: %w", err)
+	}
+	compressed := &countingWriter{w: encrypter}
+	compressor, err := u.compression.NewWriter(compressed)
+	if err != nil {
+		return fmt.Errorf("compression failed: %w", err)
+	}
+	defer compressor.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(compressor, io.TeeReader(src, hasher))
+	if err != nil {
+		return fmt.Errorf("failed to process file content: %w", err)
+	}
+	if err := compressor.Close(); err != nil {
+		return fmt.Errorf("compression failed: %w", err)
+	}
+	if err := encrypter.Close(); err != nil {
+		return fmt.Errorf("encryption failed: %w", err)
+	}
+
+	u.size = size
+	u.compressedSize = compressed.n
+	u.fileHash = base64.StdEncoding.EncodeToString(hasher.Sum(nil))
+	return nil
+}
+
+func (u *uploadContent) Complete(file *models.File) error {
+	if u.err != nil {
+		return u.err
+	}
+	if u.size != file.Size {
+		return fmt.Errorf("read %d bytes of a %d byte upload", u.size, file.Size)
+	}
+
+	file.EncryptionIV = u.iv
+	file.FileHash = u.fileHash
+	file.CompressedSize = u.compressedSize
+	if u.size > 0 {
+		file.CompressionRatio = float64(u.compressedSize) / float64(u.size)
+	}
+	log.Printf("Compressed and encrypted data - Original: %d, Compressed: %d bytes, Ratio: %.2f%%",
+		u.size, u.compressedSize, file.CompressionRatio*100)
+	return nil
+}
+
+// uploadReader waits for the content to be finished, or abandoned, on Close
+type uploadReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+func (r *uploadReader) Close() error {
+	r.PipeReader.Close()
+	<-r.done
+	return nil
+}
+
+// countingWriter tracks how many bytes were written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
 }
 
 func (c *UploadFileController) Upload(ctx *gin.Context) {
@@ -241,34 +420,8 @@ func (c *UploadFileController) Upload(ctx *gin.Context) {
 		return
 	}
 
-	// Parse Reed-Solomon parameters
-	dataShards, err := strconv.Atoi(ctx.DefaultPostForm("data_shards", "4"))
-	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "Invalid data shards value"})
-		return
-	}
-
-	parityShards, err := strconv.Atoi(ctx.DefaultPostForm("parity_shards", "2"))
-	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "Invalid parity shards value"})
-		return
-	}
-
-	// Parse Shamir parameters
-	nShares, err := strconv.Atoi(ctx.DefaultPostForm("shares", "5"))
-	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "Invalid number of shares"})
-		return
-	}
-
-	threshold, err := strconv.Atoi(ctx.DefaultPostForm("threshold", "3"))
-	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "Invalid threshold"})
-		return
-	}
-
-	if err := c.validateParameters(nShares, threshold, dataShards, parityShards); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+	profile, ok := resolveDurabilityProfile(ctx, c.profileModel, currentUser)
+	if !ok {
 		return
 	}
 
@@ -285,13 +438,15 @@ func (c *UploadFileController) Upload(ctx *gin.Context) {
 		return
 	}
 
-	// Process file upload with encryption type
-	processedFile, err := c.processFileUpload(fileHeader, nShares, threshold, dataShards, parityShards, encryptionType)
+	// User fragments are wrapped with the master key unlocked for this session
+	userMasterKey, err := c.sessionKeys.MasterKey(ctx.GetString("session_id"), currentUser.ID)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		ctx.JSON(http.StatusUnauthorized, gin.H{"status": "error", "error": err.Error(), "session_locked": true})
 		return
 	}
 
+	params := profile.ParamsFor(fileHeader.Size)
+
 	// Handle folder assignment
 	folderID := c.handleFolderAssignment(ctx, currentUser)
 	if folderID == nil {
@@ -299,7 +454,7 @@ func (c *UploadFileController) Upload(ctx *gin.Context) {
 	}
 
 	// Create file record
-	serverKey, err := c.serverKeyModel.GetActive()
+	serverKeyID, err := c.keyProvider.KeyID()
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"status": "error",
@@ -308,6 +463,14 @@ func (c *UploadFileController) Upload(ctx *gin.Context) {
 		return
 	}
 
+	// The file is compressed and encrypted while it is stored
+	content, err := newUploadContent(fileHeader, c.encryptionService, c.compressionService,
+		params.Shares, params.Threshold, serverKeyID, encryptionType)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+
 	encryptedFileName := base64.RawURLEncoding.EncodeToString([]byte(fileHeader.Filename))
 	fileRecord := &models.File{
 		UserID:            currentUser.ID,
@@ -315,33 +478,42 @@ func (c *UploadFileController) Upload(ctx *gin.Context) {
 		Name:              encryptedFileName,
 		OriginalName:      fileHeader.Filename,
 		Size:              fileHeader.Size,
-		CompressedSize:    int64(len(processedFile.compressed)),
 		MimeType:          fileHeader.Header.Get("Content-Type"),
-		EncryptionIV:      processedFile.iv,
-		EncryptionSalt:    processedFile.salt,
+		EncryptionIV:      content.iv,
+		EncryptionSalt:    content.key.Salt,
 		EncryptionType:    encryptionType,
-		EncryptionVersion: 1,
-		FileHash:          processedFile.fileHash,
-		ShareCount:        uint(nShares),
-		Threshold:         uint(threshold),
-		DataShardCount:    uint(dataShards),
-		ParityShardCount:  uint(parityShards),
+		EncryptionVersion: services.EncryptionSegmented,
+		ShareCount:        uint(params.Shares),
+		Threshold:         uint(params.Threshold),
+		DataShardCount:    uint(params.DataShards),
+		ParityShardCount:  uint(params.ParityShards),
 		IsCompressed:      true,
 		IsSharded:         true,
-		CompressionRatio:  processedFile.ratio,
-		ServerKeyID:       serverKey.KeyID,
+		DurabilityProfile: profile.Name,
+		ServerKeyID:       serverKeyID,
 		MasterKeyVersion:  1,
 	}
 
-	// Create file with shards
-	if err := c.fileModel.CreateFileWithShards(
+	// Erasure code the encrypted content straight to the storage nodes
+	if err := c.fileModel.CreateFileFromStream(
 		fileRecord,
-		processedFile.shares,
-		processedFile.shards,
+		content.key.Shares,
+		content,
 		c.keyFragmentModel,
-		c.serverKeyModel,
+		userMasterKey,
+		c.keyProvider,
 	); err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, services.ErrPlacementUnsatisfiable):
+			// Too many shares or too few parity shards for the available zones
+			status = http.StatusBadRequest
+		case errors.Is(err, services.ErrInsufficientCapacity), errors.Is(err, services.ErrInsufficientSpoolSpace):
+			status = http.StatusInsufficientStorage
+		case errors.Is(err, services.ErrNotEnoughHealthyNodes):
+			status = http.StatusServiceUnavailable
+		}
+		ctx.JSON(status, gin.H{
 			"status": "error",
 			"error":  fmt.Sprintf("Failed to save file information: %v", err),
 		})
@@ -356,11 +528,12 @@ func (c *UploadFileController) Upload(ctx *gin.Context) {
 		IPAddress:    ctx.ClientIP(),
 		Status:       "success", // Must match ENUM value in DB
 		Details: fmt.Sprintf(
-			"File uploaded with %s encryption, %d shares, %d threshold, %.2f%% compression",
+			"File uploaded with %s encryption, %s durability, %d shares, %d threshold, %.2f%% compression",
 			encryptionType,
-			nShares,
-			threshold,
-			processedFile.ratio*100,
+			profile.Name,
+			params.Shares,
+			params.Threshold,
+			fileRecord.CompressionRatio*100,
 		),
 	}); err != nil {
 		log.Printf("Failed to log activity: %v", err)
@@ -372,102 +545,21 @@ func (c *UploadFileController) Upload(ctx *gin.Context) {
 		"data": gin.H{
 			"file": fileRecord,
 			"shardInfo": gin.H{
-				"dataShards":   dataShards,
-				"parityShards": parityShards,
-				"totalShards":  dataShards + parityShards,
+				"profile":      profile.Name,
+				"dataShards":   params.DataShards,
+				"parityShards": params.ParityShards,
+				"totalShards":  params.DataShards + params.ParityShards,
 			},
 			"compressionStats": gin.H{
 				"originalSize":     fileRecord.Size,
 				"compressedSize":   fileRecord.CompressedSize,
-				"compressionRatio": fmt.Sprintf("%.2f%%", processedFile.ratio*100),
+				"compressionRatio": fmt.Sprintf("%.2f%%", fileRecord.CompressionRatio*100),
 			},
 			"encryptionInfo": gin.H{
 				"type":    encryptionType,
-				"version": 1,
+				"version": fileRecord.EncryptionVersion,
 			},
 			"folder_id": folderID,
 		},
 	})
 }
-
-func (c *UploadFileController) processFileUpload(
-	fileHeader *multipart.FileHeader,
-	n, k int,
-	dataShards, parityShards int,
-	encType services.EncryptionType,
-) (*processedFile, error) {
-	log.Printf("Starting file processing - Size: %d bytes, Encryption: %s", fileHeader.Size, encType)
-
-	src, err := fileHeader.Open()
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
-	}
-	defer src.Close()
-
-	content, err := io.ReadAll(src)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file content: %w", err)
-	}
-	log.Printf("Read file content - Size: %d bytes", len(content))
-
-	// Calculate hash
-	hash := sha256.Sum256(content)
-	fileHash := base64.StdEncoding.EncodeToString(hash[:])
-	log.Printf("File hash: %s", fileHash)
-
-	// Compress content
-	compressed, ratio, err := c.compressionService.Compress(content)
-	if err != nil {
-		return nil, fmt.Errorf("compression failed: %w", err)
-	}
-	log.Printf("Compressed data - Original: %d, Compressed: %d bytes, Ratio: %.2f%%",
-		len(content), len(compressed), ratio*100)
-
-	// Get active server key
-	serverKey, err := c.serverKeyModel.GetActive()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get server key: %w", err)
-	}
-
-	// Generate a temporary file ID for encryption
-	tempFileID := uint(time.Now().UnixNano())
-
-	// Use EncryptFileWithType for encryption
-	encrypted, iv, salt, shares, err := c.encryptionService.EncryptFileWithType(
-		compressed,
-		n,
-		k,
-		tempFileID,
-		serverKey.KeyID,
-		encType,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("encryption failed: %w", err)
-	}
-	log.Printf("Encrypted data - Size: %d bytes, Raw shares: %d, Algorithm: %s",
-		len(encrypted), len(shares), encType)
-
-	// Log the shares received from encryption service
-	for i, share := range shares {
-		log.Printf("Share %d - Index: %d, Value length: %d",
-			i, share.Index, len(share.Value))
-	}
-
-	// Create Reed-Solomon shards
-	fileShards, err := c.rsService.SplitFile(encrypted, dataShards, parityShards)
-	if err != nil {
-		return nil, fmt.Errorf("reed-solomon encoding failed: %w", err)
-	}
-	log.Printf("Created %d shards", len(fileShards.Shards))
-
-	return &processedFile{
-		compressed: compressed,
-		encrypted:  encrypted,
-		iv:         iv,
-		salt:       salt,
-		shares:     shares,
-		shards:     fileShards.Shards,
-		fileHash:   fileHash,
-		ratio:      ratio,
-	}, nil
-}
@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"net/http"
+	"safesplit/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Overall service status reported by /api/health
+const (
+	HealthOK       = "ok"       // database reachable and every node up
+	HealthDegraded = "degraded" // some nodes are degraded or down, but files can still be written
+	HealthDown     = "down"     // database unreachable, no writable node left or server sealed
+)
+
+type HealthController struct {
+	db      *gorm.DB
+	storage *services.DistributedStorageService
+	keys    services.KeyProvider
+}
+
+type nodeHealthResponse struct {
+	NodeIndex int                `json:"node_index"`
+	State     services.NodeState `json:"state"`
+	CheckedAt time.Time          `json:"checked_at"`
+}
+
+func NewHealthController(db *gorm.DB, storage *services.DistributedStorageService, keys services.KeyProvider) *HealthController {
+	return &HealthController{
+		db:      db,
+		storage: storage,
+		keys:    keys,
+	}
+}
+
+// Health reports whether the database is reachable and the state of each
+// storage node as of the last health check, and whether the server is sealed. Probe errors are left out since
+// the endpoint is public; sysadmins see them in the node list.
+func (c *HealthController) Health(ctx *gin.Context) {
+	database := "ok"
+	if sqlDB, err := c.db.DB(); err != nil || sqlDB.PingContext(ctx.Request.Context()) != nil {
+		database = "unreachable"
+	}
+
+	writable := make(map[int]bool)
+	for _, nodeIndex := range c.storage.WritableNodes() {
+		writable[nodeIndex] = true
+	}
+
+	counts := make(map[services.NodeState]int)
+	nodes := make([]nodeHealthResponse, 0)
+	healthyWritable := 0
+	for _, nodeIndex := range c.storage.AttachedNodes() {
+		health := c.storage.NodeHealth(nodeIndex)
+		counts[health.State]++
+		if writable[nodeIndex] && health.State != services.NodeDown {
+			healthyWritable++
+		}
+		nodes = append(nodes, nodeHealthResponse{
+			NodeIndex: nodeIndex,
+			State:     health.State,
+			CheckedAt: health.CheckedAt,
+		})
+	}
+
+	sealed := services.ProviderSealed(c.keys)
+	status, code := HealthOK, http.StatusOK
+	switch {
+	case database != "ok" || healthyWritable == 0 || sealed:
+		status, code = HealthDown, http.StatusServiceUnavailable
+	case counts[services.NodeDegraded] > 0 || counts[services.NodeDown] > 0:
+		status = HealthDegraded
+	}
+
+	ctx.JSON(code, gin.H{
+		"status":   status,
+		"database": database,
+		"sealed":   sealed,
+		"storage": gin.H{
+			"nodes":    len(nodes),
+			"up":       counts[services.NodeUp],
+			"degraded": counts[services.NodeDegraded],
+			"down":     counts[services.NodeDown],
+			"unknown":  counts[services.NodeUnknown],
+			"details":  nodes,
+		},
+	})
+}
@@ -2,9 +2,11 @@ package controllers
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"safesplit/config"
 	"safesplit/models"
+	"safesplit/services"
 	"strings"
 	"time"
 
@@ -16,6 +18,7 @@ type LoginController struct {
 	userModel      *models.UserModel
 	billingModel   *models.BillingModel
 	activityLogger *models.ActivityLogModel
+	sessionKeys    *services.SessionKeyCache
 }
 
 type LoginRequest struct {
@@ -29,11 +32,12 @@ type UserResponse struct {
 	BillingProfile *models.BillingProfile `json:"billing_profile,omitempty"`
 }
 
-func NewLoginController(userModel *models.UserModel, billingModel *models.BillingModel, activityLogger *models.ActivityLogModel) *LoginController {
+func NewLoginController(userModel *models.UserModel, billingModel *models.BillingModel, activityLogger *models.ActivityLogModel, sessionKeys *services.SessionKeyCache) *LoginController {
 	return &LoginController{
 		userModel:      userModel,
 		billingModel:   billingModel,
 		activityLogger: activityLogger,
+		sessionKeys:    sessionKeys,
 	}
 }
 
@@ -143,7 +147,19 @@ func (c *LoginController) Login(ctx *gin.Context) {
 		}
 	}
 
-	token, err := config.GenerateToken(user.ID, user.Role)
+	// The master key can only be unwrapped with the plaintext password, so unlock
+	// it for this session now; the session stays locked if that fails
+	masterKey, unlockErr := c.userModel.UnlockMasterKey(user, loginReq.Password)
+	if unlockErr != nil {
+		log.Printf("Warning: failed to unlock master key of user %d: %v", user.ID, unlockErr)
+	}
+
+	expiresAt := time.Now().Add(config.TokenLifetime)
+	sessionID, err := services.NewSessionID()
+	var token string
+	if err == nil {
+		token, err = config.GenerateToken(user.ID, user.Role, sessionID, expiresAt)
+	}
 	if err != nil {
 		c.activityLogger.LogActivity(&models.ActivityLog{
 			UserID:       user.ID,
@@ -158,6 +174,10 @@ func (c *LoginController) Login(ctx *gin.Context) {
 		return
 	}
 
+	if unlockErr == nil {
+		c.sessionKeys.Unlock(sessionID, user.ID, masterKey, expiresAt)
+	}
+
 	// Get billing profile
 	user.Password = ""
 	billingProfile, err := c.billingModel.GetUserBillingProfile(user.ID)
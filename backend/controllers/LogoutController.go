@@ -3,19 +3,23 @@ package controllers
 import (
 	"net/http"
 	"safesplit/models"
+	"safesplit/services"
 
 	"github.com/gin-gonic/gin"
 )
 
 type LogoutController struct {
-	userModel *models.UserModel
+	userModel   *models.UserModel
+	sessionKeys *services.SessionKeyCache
 }
 
-func NewLogoutController(userModel *models.UserModel) *LogoutController {
-	return &LogoutController{userModel: userModel}
+func NewLogoutController(userModel *models.UserModel, sessionKeys *services.SessionKeyCache) *LogoutController {
+	return &LogoutController{userModel: userModel, sessionKeys: sessionKeys}
 }
 
+// Logout wipes the master key unlocked for the session
 func (c *LogoutController) Logout(ctx *gin.Context) {
+	c.sessionKeys.Lock(ctx.GetString("session_id"))
 	ctx.JSON(http.StatusOK, gin.H{
 		"message": "Successfully logged out",
 	})
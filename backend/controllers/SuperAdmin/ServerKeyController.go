@@ -0,0 +1,98 @@
+package SuperAdmin
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"safesplit/jobs"
+	"safesplit/models"
+	"safesplit/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServerKeyController lists the server master keys and rotates the key of
+// the server key provider
+type ServerKeyController struct {
+	serverKeyModel *models.ServerMasterKeyModel
+	keyProvider    services.KeyProvider
+	keyRotator     *jobs.KeyRotator
+}
+
+// NewServerKeyController creates a new ServerKeyController instance
+func NewServerKeyController(serverKeyModel *models.ServerMasterKeyModel, keyProvider services.KeyProvider, keyRotator *jobs.KeyRotator) *ServerKeyController {
+	return &ServerKeyController{
+		serverKeyModel: serverKeyModel,
+		keyProvider:    keyProvider,
+		keyRotator:     keyRotator,
+	}
+}
+
+// ListServerKeys returns the server master keys stored in the database, the
+// key new fragments are wrapped under and the progress of the current or last
+// rotation
+func (c *ServerKeyController) ListServerKeys(ctx *gin.Context) {
+	keys, err := c.serverKeyModel.ListAll()
+	if err != nil {
+		log.Printf("Error listing server keys: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to list server keys",
+		})
+		return
+	}
+
+	// Empty while the server is sealed
+	currentKeyID, _ := c.keyProvider.KeyID()
+
+	running, report := c.keyRotator.Status()
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data": gin.H{
+			"keys":           keys,
+			"current_key_id": currentKeyID,
+			"rotation": gin.H{
+				"running": running,
+				"report":  report,
+			},
+		},
+	})
+}
+
+// RotateServerKey makes a new server key current and re-wraps the server
+// fragments under it in the background
+func (c *ServerKeyController) RotateServerKey(ctx *gin.Context) {
+	keyID, err := c.keyRotator.Rotate()
+	switch {
+	case errors.Is(err, jobs.ErrKeyRotationRunning):
+		ctx.JSON(http.StatusConflict, gin.H{
+			"status": "error",
+			"error":  "A server key rotation is already running",
+		})
+		return
+	case errors.Is(err, services.ErrSealed):
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "error",
+			"error":  "Server is sealed",
+		})
+		return
+	case err != nil:
+		log.Printf("Error rotating server key: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to rotate server key",
+		})
+		return
+	}
+
+	if user, ok := ctx.Get("user"); ok {
+		if currentUser, ok := user.(*models.User); ok {
+			log.Printf("Server key rotated to %s by user %d", keyID, currentUser.ID)
+		}
+	}
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"status":  "success",
+		"message": "Server key rotated; re-wrapping server fragments",
+		"data":    gin.H{"key_id": keyID},
+	})
+}
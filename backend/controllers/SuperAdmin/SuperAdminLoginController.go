@@ -1,15 +1,19 @@
 package SuperAdmin
 
 import (
+	"log"
 	"net/http"
 	"safesplit/config"
 	"safesplit/models"
+	"safesplit/services"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type LoginController struct {
-	userModel *models.UserModel
+	userModel   *models.UserModel
+	sessionKeys *services.SessionKeyCache
 }
 
 type LoginRequest struct {
@@ -18,9 +22,10 @@ type LoginRequest struct {
 	TwoFactorCode string `json:"two_factor_code"`
 }
 
-func NewLoginController(userModel *models.UserModel) *LoginController {
+func NewLoginController(userModel *models.UserModel, sessionKeys *services.SessionKeyCache) *LoginController {
 	return &LoginController{
-		userModel: userModel,
+		userModel:   userModel,
+		sessionKeys: sessionKeys,
 	}
 }
 
@@ -62,12 +67,26 @@ func (c *LoginController) Login(ctx *gin.Context) {
 		return
 	}
 
+	// Unlock the master key for this session with the plaintext password
+	masterKey, unlockErr := c.userModel.UnlockMasterKey(user, loginReq.Password)
+	if unlockErr != nil {
+		log.Printf("Warning: failed to unlock master key of super admin %d: %v", user.ID, unlockErr)
+	}
+
 	// Generate token after successful 2FA
-	token, err := config.GenerateToken(user.ID, user.Role)
+	expiresAt := time.Now().Add(config.TokenLifetime)
+	sessionID, err := services.NewSessionID()
+	var token string
+	if err == nil {
+		token, err = config.GenerateToken(user.ID, user.Role, sessionID, expiresAt)
+	}
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
 		return
 	}
+	if unlockErr == nil {
+		c.sessionKeys.Unlock(sessionID, user.ID, masterKey, expiresAt)
+	}
 
 	// Clear sensitive data
 	user.Password = ""
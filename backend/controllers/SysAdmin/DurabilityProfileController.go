@@ -0,0 +1,177 @@
+package SysAdmin
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"safesplit/models"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DurabilityProfileController manages the durability profiles offered to users
+type DurabilityProfileController struct {
+	profileModel *models.DurabilityProfileModel
+}
+
+// NewDurabilityProfileController creates a new DurabilityProfileController instance
+func NewDurabilityProfileController(profileModel *models.DurabilityProfileModel) *DurabilityProfileController {
+	return &DurabilityProfileController{
+		profileModel: profileModel,
+	}
+}
+
+// DurabilityProfileRequest creates or replaces a profile. IsActive defaults
+// to true; overrides apply to files of at least their min_size bytes.
+type DurabilityProfileRequest struct {
+	Name        string                      `json:"name" binding:"required,max=64"`
+	DisplayName string                      `json:"display_name" binding:"required,max=255"`
+	Description string                      `json:"description"`
+	Params      models.DurabilityParams     `json:"params"`
+	PremiumOnly bool                        `json:"premium_only"`
+	IsDefault   bool                        `json:"is_default"`
+	IsActive    *bool                       `json:"is_active"`
+	Overrides   []DurabilityOverrideRequest `json:"overrides"`
+}
+
+// DurabilityOverrideRequest replaces the profile parameters for large files
+type DurabilityOverrideRequest struct {
+	MinSize int64                   `json:"min_size" binding:"required,min=1"`
+	Params  models.DurabilityParams `json:"params"`
+}
+
+func (r DurabilityProfileRequest) profile() *models.DurabilityProfile {
+	profile := &models.DurabilityProfile{
+		Name:             r.Name,
+		DisplayName:      r.DisplayName,
+		Description:      r.Description,
+		DurabilityParams: r.Params,
+		PremiumOnly:      r.PremiumOnly,
+		IsDefault:        r.IsDefault,
+		IsActive:         r.IsActive == nil || *r.IsActive,
+	}
+	for _, override := range r.Overrides {
+		profile.Overrides = append(profile.Overrides, models.DurabilityProfileOverride{
+			MinSize:          override.MinSize,
+			DurabilityParams: override.Params,
+		})
+	}
+	return profile
+}
+
+func parseProfileID(ctx *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 32)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid profile ID",
+		})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func respondProfileError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrDurabilityProfileNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"status": "error", "error": err.Error()})
+	case errors.Is(err, models.ErrDurabilityProfileIsDefault):
+		ctx.JSON(http.StatusConflict, gin.H{"status": "error", "error": err.Error()})
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+	}
+}
+
+// ListProfiles returns every durability profile, including inactive ones
+func (c *DurabilityProfileController) ListProfiles(ctx *gin.Context) {
+	profiles, err := c.profileModel.ListProfiles()
+	if err != nil {
+		log.Printf("Error listing durability profiles: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to list durability profiles",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data":   profiles,
+	})
+}
+
+// CreateProfile adds a durability profile
+func (c *DurabilityProfileController) CreateProfile(ctx *gin.Context) {
+	var req DurabilityProfileRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid request parameters",
+		})
+		return
+	}
+
+	profile := req.profile()
+	if err := c.profileModel.CreateProfile(profile); err != nil {
+		log.Printf("Error creating durability profile: %v", err)
+		respondProfileError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{
+		"status":  "success",
+		"message": "Durability profile created",
+		"data":    profile,
+	})
+}
+
+// UpdateProfile replaces the settings of a durability profile. Files already
+// stored keep the parameters they were uploaded with.
+func (c *DurabilityProfileController) UpdateProfile(ctx *gin.Context) {
+	id, ok := parseProfileID(ctx)
+	if !ok {
+		return
+	}
+
+	var req DurabilityProfileRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid request parameters",
+		})
+		return
+	}
+
+	profile, err := c.profileModel.UpdateProfile(id, req.profile())
+	if err != nil {
+		log.Printf("Error updating durability profile %d: %v", id, err)
+		respondProfileError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Durability profile updated",
+		"data":    profile,
+	})
+}
+
+// DeleteProfile removes a durability profile other than the default one
+func (c *DurabilityProfileController) DeleteProfile(ctx *gin.Context) {
+	id, ok := parseProfileID(ctx)
+	if !ok {
+		return
+	}
+
+	if err := c.profileModel.DeleteProfile(id); err != nil {
+		log.Printf("Error deleting durability profile %d: %v", id, err)
+		respondProfileError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Durability profile deleted",
+	})
+}
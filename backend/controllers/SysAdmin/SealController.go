@@ -0,0 +1,102 @@
+package SysAdmin
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"safesplit/models"
+	"safesplit/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SealController reports the seal state and takes operators' unseal shares
+type SealController struct {
+	serverKeyModel *models.ServerMasterKeyModel
+	seal           *services.SealService
+}
+
+// NewSealController creates a new SealController instance
+func NewSealController(serverKeyModel *models.ServerMasterKeyModel, seal *services.SealService) *SealController {
+	return &SealController{
+		serverKeyModel: serverKeyModel,
+		seal:           seal,
+	}
+}
+
+// UnsealRequest carries one operator's unseal share
+type UnsealRequest struct {
+	Share string `json:"share" binding:"required"`
+}
+
+// GetSealStatus returns whether the server is sealed and the unseal progress
+func (c *SealController) GetSealStatus(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data":   c.seal.Status(),
+	})
+}
+
+// SubmitUnsealShare adds an unseal share; the server unseals once the
+// threshold is reached
+func (c *SealController) SubmitUnsealShare(ctx *gin.Context) {
+	var req UnsealRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid request format",
+		})
+		return
+	}
+
+	status, err := c.serverKeyModel.SubmitUnsealShare(req.Share)
+	if err != nil {
+		log.Printf("Unseal share rejected: %v", err)
+		code := http.StatusBadRequest
+		if errors.Is(err, services.ErrWrongKEK) {
+			code = http.StatusForbidden
+		}
+		ctx.JSON(code, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+			"data":   status,
+		})
+		return
+	}
+
+	message := "Unseal share accepted"
+	if !status.Sealed {
+		message = "Server unsealed"
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": message,
+		"data":    status,
+	})
+}
+
+// ResetUnseal discards the unseal shares submitted so far
+func (c *SealController) ResetUnseal(ctx *gin.Context) {
+	c.seal.ResetUnsealShares()
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Unseal progress reset",
+		"data":    c.seal.Status(),
+	})
+}
+
+// Seal discards the key-encryption key so no file can be encrypted or
+// decrypted until the server is unsealed again
+func (c *SealController) Seal(ctx *gin.Context) {
+	c.seal.Seal()
+	if user, ok := ctx.Get("user"); ok {
+		if currentUser, ok := user.(*models.User); ok {
+			log.Printf("Server sealed by user %d", currentUser.ID)
+		}
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Server sealed",
+		"data":    c.seal.Status(),
+	})
+}
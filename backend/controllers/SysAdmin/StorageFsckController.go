@@ -0,0 +1,81 @@
+package SysAdmin
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"safesplit/jobs"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StorageFsckController runs the database versus storage node consistency check
+type StorageFsckController struct {
+	fsck *jobs.Fsck
+}
+
+// NewStorageFsckController creates a new StorageFsckController instance
+func NewStorageFsckController(fsck *jobs.Fsck) *StorageFsckController {
+	return &StorageFsckController{
+		fsck: fsck,
+	}
+}
+
+// StartFsckRequest selects what the check may change
+type StartFsckRequest struct {
+	Repair bool `json:"repair"`
+	GC     bool `json:"gc"`
+}
+
+// GetFsckStatus returns whether a check is running and the last report
+func (c *StorageFsckController) GetFsckStatus(ctx *gin.Context) {
+	running, report := c.fsck.Status()
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data": gin.H{
+			"running": running,
+			"report":  report,
+		},
+	})
+}
+
+// StartFsck starts a consistency check in the background. Orphan collection
+// only finishes after jobs.FsckOrphanGrace.
+func (c *StorageFsckController) StartFsck(ctx *gin.Context) {
+	var req StartFsckRequest
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  "Invalid request format",
+			})
+			return
+		}
+	}
+
+	err := c.fsck.Start(jobs.FsckOptions{
+		Repair:      req.Repair,
+		GC:          req.GC,
+		OrphanGrace: jobs.FsckOrphanGrace,
+	})
+	if errors.Is(err, jobs.ErrFsckRunning) {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"status": "error",
+			"error":  "A consistency check is already running",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Error starting consistency check: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to start consistency check",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"status":  "success",
+		"message": "Consistency check started",
+	})
+}
@@ -0,0 +1,299 @@
+package SysAdmin
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"safesplit/jobs"
+	"safesplit/models"
+	"safesplit/services"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StorageNodeController handles storage node membership and rebalancing
+type StorageNodeController struct {
+	storageNodeModel *models.StorageNodeModel
+	rebalancer       *jobs.Rebalancer
+}
+
+// NewStorageNodeController creates a new StorageNodeController instance
+func NewStorageNodeController(storageNodeModel *models.StorageNodeModel, rebalancer *jobs.Rebalancer) *StorageNodeController {
+	return &StorageNodeController{
+		storageNodeModel: storageNodeModel,
+		rebalancer:       rebalancer,
+	}
+}
+
+// AddNodeRequest describes a new storage node. Credentials are not accepted
+// here; they are read from the STORAGE_NODE_<index>_* environment variables.
+type AddNodeRequest struct {
+	Name    string                       `json:"name"`
+	Backend string                       `json:"backend" binding:"required,oneof=local s3 remote"`
+	Path    string                       `json:"path"`
+	S3      services.S3BackendConfig     `json:"s3"`
+	Remote  services.RemoteBackendConfig `json:"remote"`
+	// CapacityLimit caps the bytes placed on the node; 0 uses the free space of its device
+	CapacityLimit int64 `json:"capacity_limit" binding:"min=0"`
+	TopologyRequest
+}
+
+// CapacityRequest sets the capacity limit of a node
+type CapacityRequest struct {
+	CapacityLimit *int64 `json:"capacity_limit" binding:"required,min=0"`
+}
+
+// TopologyRequest holds the failure-domain labels, placement weight and tier
+// of a node. Unlabeled nodes count as a zone of their own; weight defaults to
+// 1 and tier to hot.
+type TopologyRequest struct {
+	Zone   string `json:"zone"`
+	Rack   string `json:"rack"`
+	Host   string `json:"host"`
+	Weight int    `json:"weight"`
+	Tier   string `json:"tier" binding:"omitempty,oneof=hot cold"`
+}
+
+func (r TopologyRequest) topology() services.NodeTopology {
+	weight := r.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	tier := r.Tier
+	if tier == "" {
+		tier = services.TierHot
+	}
+	return services.NodeTopology{
+		Zone:   r.Zone,
+		Rack:   r.Rack,
+		Host:   r.Host,
+		Weight: weight,
+		Tier:   tier,
+	}
+}
+
+func parseNodeIndex(ctx *gin.Context) (int, bool) {
+	nodeIndex, err := strconv.Atoi(ctx.Param("index"))
+	if err != nil || nodeIndex < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid node index",
+		})
+		return 0, false
+	}
+	return nodeIndex, true
+}
+
+func respondNodeError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrStorageNodeNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"status": "error", "error": err.Error()})
+	case errors.Is(err, models.ErrStorageNodeInUse):
+		ctx.JSON(http.StatusConflict, gin.H{"status": "error", "error": err.Error()})
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+	}
+}
+
+// ListNodes returns all registered storage nodes with their placement counts
+func (c *StorageNodeController) ListNodes(ctx *gin.Context) {
+	nodes, err := c.storageNodeModel.ListNodes()
+	if err != nil {
+		log.Printf("Error listing storage nodes: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to list storage nodes",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data": gin.H{
+			"nodes":          nodes,
+			"last_rebalance": c.rebalancer.LastResult(),
+		},
+	})
+}
+
+// AddNode registers a new storage node and starts moving data onto it
+func (c *StorageNodeController) AddNode(ctx *gin.Context) {
+	var req AddNodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid request parameters",
+		})
+		return
+	}
+
+	node, err := c.storageNodeModel.AddNode(req.Name, services.StorageNodeConfig{
+		Backend: req.Backend,
+		Path:    req.Path,
+		S3:      req.S3,
+		Remote:  req.Remote,
+	}, req.topology(), req.CapacityLimit)
+	if err != nil {
+		log.Printf("Error adding storage node: %v", err)
+		respondNodeError(ctx, err)
+		return
+	}
+
+	c.rebalancer.Trigger()
+	ctx.JSON(http.StatusCreated, gin.H{
+		"status": "success",
+		"data":   node,
+	})
+}
+
+// SetNodeTopology relabels a node and moves objects that now share a zone too
+// closely or sit on the wrong tier
+func (c *StorageNodeController) SetNodeTopology(ctx *gin.Context) {
+	nodeIndex, ok := parseNodeIndex(ctx)
+	if !ok {
+		return
+	}
+
+	var req TopologyRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid request parameters",
+		})
+		return
+	}
+
+	node, err := c.storageNodeModel.SetTopology(nodeIndex, req.topology())
+	if err != nil {
+		log.Printf("Error updating topology of storage node %d: %v", nodeIndex, err)
+		respondNodeError(ctx, err)
+		return
+	}
+
+	c.rebalancer.Trigger()
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data":   node,
+	})
+}
+
+// SetNodeCapacity changes the capacity limit of a node and measures it again
+func (c *StorageNodeController) SetNodeCapacity(ctx *gin.Context) {
+	nodeIndex, ok := parseNodeIndex(ctx)
+	if !ok {
+		return
+	}
+
+	var req CapacityRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid request parameters",
+		})
+		return
+	}
+
+	node, err := c.storageNodeModel.SetCapacityLimit(nodeIndex, *req.CapacityLimit)
+	if err != nil {
+		log.Printf("Error updating capacity of storage node %d: %v", nodeIndex, err)
+		respondNodeError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data":   node,
+	})
+}
+
+// DrainNode stops new placements on a node and moves its data to the others
+func (c *StorageNodeController) DrainNode(ctx *gin.Context) {
+	nodeIndex, ok := parseNodeIndex(ctx)
+	if !ok {
+		return
+	}
+
+	if err := c.storageNodeModel.DrainNode(nodeIndex); err != nil {
+		log.Printf("Error draining storage node %d: %v", nodeIndex, err)
+		respondNodeError(ctx, err)
+		return
+	}
+
+	c.rebalancer.Trigger()
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Node is draining",
+	})
+}
+
+// GetDrainProgress reports how much a draining node still holds and whether it can be removed
+func (c *StorageNodeController) GetDrainProgress(ctx *gin.Context) {
+	nodeIndex, ok := parseNodeIndex(ctx)
+	if !ok {
+		return
+	}
+
+	progress, err := c.storageNodeModel.DrainProgress(nodeIndex)
+	if err != nil {
+		log.Printf("Error getting drain progress of storage node %d: %v", nodeIndex, err)
+		respondNodeError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data": gin.H{
+			"progress":       progress,
+			"last_rebalance": c.rebalancer.LastResult(),
+		},
+	})
+}
+
+// ActivateNode returns a draining node to service
+func (c *StorageNodeController) ActivateNode(ctx *gin.Context) {
+	nodeIndex, ok := parseNodeIndex(ctx)
+	if !ok {
+		return
+	}
+
+	if err := c.storageNodeModel.ActivateNode(nodeIndex); err != nil {
+		log.Printf("Error activating storage node %d: %v", nodeIndex, err)
+		respondNodeError(ctx, err)
+		return
+	}
+
+	c.rebalancer.Trigger()
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Node is active",
+	})
+}
+
+// RemoveNode retires a fully drained node
+func (c *StorageNodeController) RemoveNode(ctx *gin.Context) {
+	nodeIndex, ok := parseNodeIndex(ctx)
+	if !ok {
+		return
+	}
+
+	if err := c.storageNodeModel.RemoveNode(nodeIndex); err != nil {
+		log.Printf("Error removing storage node %d: %v", nodeIndex, err)
+		respondNodeError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Node removed",
+	})
+}
+
+// Rebalance schedules an immediate rebalancing pass
+func (c *StorageNodeController) Rebalance(ctx *gin.Context) {
+	c.rebalancer.Trigger()
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"status":  "success",
+		"message": "Rebalance scheduled",
+	})
+}
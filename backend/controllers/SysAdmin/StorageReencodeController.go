@@ -0,0 +1,101 @@
+package SysAdmin
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"safesplit/jobs"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StorageReencodeController moves existing files to a new Reed-Solomon profile
+type StorageReencodeController struct {
+	reencoder *jobs.Reencoder
+}
+
+// NewStorageReencodeController creates a new StorageReencodeController instance
+func NewStorageReencodeController(reencoder *jobs.Reencoder) *StorageReencodeController {
+	return &StorageReencodeController{
+		reencoder: reencoder,
+	}
+}
+
+// StartReencodeRequest is the target profile and the files it applies to.
+// Times are RFC 3339; sizes are in bytes.
+type StartReencodeRequest struct {
+	DataShards    int        `json:"data_shards" binding:"required,min=1"`
+	ParityShards  int        `json:"parity_shards" binding:"required,min=1"`
+	UserID        *uint      `json:"user_id"`
+	MinSize       int64      `json:"min_size" binding:"min=0"`
+	MaxSize       int64      `json:"max_size" binding:"min=0"`
+	CreatedBefore *time.Time `json:"created_before"`
+	CreatedAfter  *time.Time `json:"created_after"`
+	Limit         int        `json:"limit" binding:"min=0"`
+}
+
+// GetReencodeStatus returns whether a re-encode is running and its progress,
+// or the report of the last one
+func (c *StorageReencodeController) GetReencodeStatus(ctx *gin.Context) {
+	running, report := c.reencoder.Status()
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data": gin.H{
+			"running": running,
+			"report":  report,
+		},
+	})
+}
+
+// StartReencode re-encodes the matching hot files in the background
+func (c *StorageReencodeController) StartReencode(ctx *gin.Context) {
+	var req StartReencodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid request format",
+		})
+		return
+	}
+
+	opts := jobs.ReencodeOptions{
+		DataShards:    req.DataShards,
+		ParityShards:  req.ParityShards,
+		UserID:        req.UserID,
+		MinSize:       req.MinSize,
+		MaxSize:       req.MaxSize,
+		CreatedBefore: req.CreatedBefore,
+		CreatedAfter:  req.CreatedAfter,
+		Limit:         req.Limit,
+	}
+	if err := opts.Validate(); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	err := c.reencoder.Start(opts)
+	if errors.Is(err, jobs.ErrReencodeRunning) {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"status": "error",
+			"error":  "A re-encode is already running",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Error starting re-encode: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to start re-encode",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"status":  "success",
+		"message": "Re-encode started",
+	})
+}
@@ -0,0 +1,103 @@
+package SysAdmin
+
+import (
+	"log"
+	"net/http"
+	"safesplit/jobs"
+	"safesplit/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StorageScrubController exposes shard scrub progress and file durability
+type StorageScrubController struct {
+	fileDurabilityModel *models.FileDurabilityModel
+	scrubber            *jobs.Scrubber
+}
+
+// NewStorageScrubController creates a new StorageScrubController instance
+func NewStorageScrubController(fileDurabilityModel *models.FileDurabilityModel, scrubber *jobs.Scrubber) *StorageScrubController {
+	return &StorageScrubController{
+		fileDurabilityModel: fileDurabilityModel,
+		scrubber:            scrubber,
+	}
+}
+
+// ListProblemFilesRequest represents the pagination of the problem file list
+type ListProblemFilesRequest struct {
+	Page     int `form:"page,default=1" binding:"min=1"`
+	PageSize int `form:"page_size,default=20" binding:"min=1,max=100"`
+}
+
+// GetScrubStatus returns scrub progress and durability totals
+func (c *StorageScrubController) GetScrubStatus(ctx *gin.Context) {
+	counts, err := c.fileDurabilityModel.GetStatusCounts()
+	if err != nil {
+		log.Printf("Error fetching durability counts: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to fetch durability status",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data": gin.H{
+			"progress":   c.scrubber.Progress(),
+			"durability": counts,
+		},
+	})
+}
+
+// ListProblemFiles returns files that are degraded or could not be repaired
+func (c *StorageScrubController) ListProblemFiles(ctx *gin.Context) {
+	var req ListProblemFilesRequest
+	if err := ctx.ShouldBindQuery(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "Invalid request parameters",
+		})
+		return
+	}
+
+	files, total, err := c.fileDurabilityModel.ListProblemFiles(req.Page, req.PageSize)
+	if err != nil {
+		log.Printf("Error listing problem files: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "Failed to list problem files",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data": gin.H{
+			"files": files,
+			"meta": gin.H{
+				"total":       total,
+				"page":        req.Page,
+				"page_size":   req.PageSize,
+				"total_pages": (total + int64(req.PageSize) - 1) / int64(req.PageSize),
+			},
+		},
+	})
+}
+
+// StartScrub schedules an immediate scrub of all sharded files
+func (c *StorageScrubController) StartScrub(ctx *gin.Context) {
+	if c.scrubber.Progress().Running {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"status": "error",
+			"error":  "A scrub is already running",
+		})
+		return
+	}
+
+	c.scrubber.Trigger()
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"status":  "success",
+		"message": "Scrub scheduled",
+	})
+}
@@ -2,6 +2,9 @@ package jobs
 
 import (
     "log"
+    "safesplit/models"
+    "safesplit/services"
+    "sync"
     "time"
     "gorm.io/gorm"
 )
@@ -13,6 +16,8 @@ const (
     
     AccountProcessingInterval = 1 * time.Hour
     SubscriptionInterval     = 24 * time.Hour
+    CapacityRefreshInterval  = 15 * time.Minute
+    HealthCheckInterval      = 30 * time.Second
 )
 
 type User struct {
@@ -30,22 +35,169 @@ type JobManager struct {
     db               *gorm.DB
     accountManager   *AccountManager
     subHandler      *SubscriptionHandler
+    rebalancer      *Rebalancer
+    scrubber        *Scrubber
+    fsck            *Fsck
+    tierMigrator    *TierMigrator
+    reencoder       *Reencoder
+    keyRotator      *KeyRotator
+    storageNodes    *models.StorageNodeModel
+    storage         *services.DistributedStorageService
 }
 
-func NewJobManager(db *gorm.DB) *JobManager {
+func NewJobManager(db *gorm.DB, storage *services.DistributedStorageService, rsService *services.ReedSolomonService, keyProvider services.KeyProvider) *JobManager {
+    // Rebalancing and scrubbing both rewrite shards, so only one runs at a time
+    maintenance := &sync.Mutex{}
+    scrubber := NewScrubber(db, storage, rsService, maintenance)
     return &JobManager{
         db:              db,
         accountManager:  NewAccountManager(db),
         subHandler:     NewSubscriptionHandler(db),
+        rebalancer:     NewRebalancer(db, storage, maintenance),
+        scrubber:       scrubber,
+        fsck:           NewFsck(db, storage, scrubber, maintenance),
+        tierMigrator:   NewTierMigrator(db, storage, rsService, maintenance),
+        reencoder:      NewReencoder(db, storage, rsService, maintenance),
+        keyRotator:     NewKeyRotator(db, storage, rsService, keyProvider, maintenance),
+        storageNodes:   models.NewStorageNodeModel(db, storage),
+        storage:        storage,
     }
 }
 
+// Rebalancer gives controllers access to the shard rebalancer
+func (m *JobManager) Rebalancer() *Rebalancer {
+    return m.rebalancer
+}
+
+// Scrubber gives controllers access to the shard scrubber
+func (m *JobManager) Scrubber() *Scrubber {
+    return m.scrubber
+}
+
+// Fsck gives controllers access to the consistency checker
+func (m *JobManager) Fsck() *Fsck {
+    return m.fsck
+}
+
+// Reencoder gives controllers access to the Reed-Solomon re-encoder
+func (m *JobManager) Reencoder() *Reencoder {
+    return m.reencoder
+}
+
+// KeyRotator gives controllers access to the server key rotation
+func (m *JobManager) KeyRotator() *KeyRotator {
+    return m.keyRotator
+}
+
 func (m *JobManager) StartAllJobs() {
     m.StartAccountManagementJob()
     m.StartSubscriptionJob()
+    m.StartRebalanceJob()
+    m.StartScrubJob()
+    m.StartCapacityJob()
+    m.StartHealthJob()
+    m.StartTierMigrationJob()
+    m.StartKeyRotationJob()
     log.Println("All scheduled jobs started")
 }
 
+// StartCapacityJob measures node usage on start and then periodically, so
+// placement sees deletes and free space taken by others
+func (m *JobManager) StartCapacityJob() {
+    ticker := time.NewTicker(CapacityRefreshInterval)
+    go func() {
+        for {
+            if err := m.storageNodes.RefreshUsage(); err != nil {
+                log.Printf("Error in node capacity job: %v", err)
+            }
+            <-ticker.C
+        }
+    }()
+    log.Println("Node capacity job started")
+}
+
+// StartHealthJob probes every node on start and then periodically, so reads and
+// writes skip nodes that stopped answering
+func (m *JobManager) StartHealthJob() {
+    ticker := time.NewTicker(HealthCheckInterval)
+    go func() {
+        for {
+            m.storage.CheckHealth()
+            <-ticker.C
+        }
+    }()
+    log.Println("Node health job started")
+}
+
+// StartTierMigrationJob periodically moves archived files to the cold tier and
+// unarchived ones back
+func (m *JobManager) StartTierMigrationJob() {
+    ticker := time.NewTicker(TierMigrationInterval)
+    go func() {
+        for range ticker.C {
+            if _, err := m.tierMigrator.Run(); err != nil {
+                log.Printf("Error in tier migration job: %v", err)
+            }
+        }
+    }()
+    log.Println("Tier migration job started")
+}
+
+// StartKeyRotationJob resumes an interrupted server key rotation on start and
+// then periodically, e.g. once the server has been unsealed
+func (m *JobManager) StartKeyRotationJob() {
+    ticker := time.NewTicker(KeyRotationResumeInterval)
+    go func() {
+        for {
+            if err := m.keyRotator.Resume(); err != nil {
+                log.Printf("Error resuming server key rotation: %v", err)
+            }
+            <-ticker.C
+        }
+    }()
+    log.Println("Server key rotation job started")
+}
+
+// StartRebalanceJob runs the rebalancer periodically and whenever node membership changes
+func (m *JobManager) StartRebalanceJob() {
+    ticker := time.NewTicker(RebalanceInterval)
+    go func() {
+        for {
+            select {
+            case <-ticker.C:
+            case <-m.rebalancer.trigger:
+            }
+            result, err := m.rebalancer.Run()
+            if err != nil {
+                log.Printf("Error in storage rebalance job: %v", err)
+                continue
+            }
+            if result.Draining() {
+                // Keep moving data off draining nodes rather than waiting for the next interval
+                m.rebalancer.Trigger()
+            }
+        }
+    }()
+    log.Println("Storage rebalance job started")
+}
+
+// StartScrubJob verifies and repairs all shards daily, or on demand
+func (m *JobManager) StartScrubJob() {
+    ticker := time.NewTicker(ScrubInterval)
+    go func() {
+        for {
+            select {
+            case <-ticker.C:
+            case <-m.scrubber.trigger:
+            }
+            if err := m.scrubber.Run(); err != nil {
+                log.Printf("Error in shard scrub job: %v", err)
+            }
+        }
+    }()
+    log.Println("Shard scrub job started")
+}
+
 func (m *JobManager) StartAccountManagementJob() {
     ticker := time.NewTicker(AccountProcessingInterval)
     go func() {
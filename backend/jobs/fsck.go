@@ -0,0 +1,661 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"safesplit/models"
+	"safesplit/services"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// FsckOrphanGrace is how long objects must stay orphaned before they are
+	// collected, so uploads and fragment replacements still inside their
+	// transaction aren't mistaken for leftovers of failed ones
+	FsckOrphanGrace = 30 * time.Minute
+	MaxFsckIssues   = 1000
+)
+
+// Kinds of inconsistencies reported by fsck
+const (
+	FsckUnreadableNode    = "unreadable_node"    // node could not be listed; repair and gc are skipped
+	FsckUnderReplicated   = "under_replicated"   // file with shards that exist on no node
+	FsckMisplacedShard    = "misplaced_shard"    // shard found on another node than recorded
+	FsckMissingFragment   = "missing_fragment"   // key_fragments row whose fragment exists on no node
+	FsckMisplacedFragment = "misplaced_fragment" // fragment found on another node than recorded
+	FsckDanglingRow       = "dangling_row"       // shard_locations or key_fragments row of a file that no longer exists
+	FsckOrphanObject      = "orphan_object"      // object no row refers to
+)
+
+var ErrFsckRunning = errors.New("a consistency check is already running")
+
+// FsckOptions selects what a consistency check may change
+type FsckOptions struct {
+	Repair      bool          `json:"repair"` // repoint misplaced rows, drop dangling rows, rebuild missing shards
+	GC          bool          `json:"gc"`     // delete orphan objects
+	OrphanGrace time.Duration `json:"-"`
+}
+
+// FsckIssue is one inconsistency between the database and the storage nodes
+type FsckIssue struct {
+	Kind      string `json:"kind"`
+	FileID    uint   `json:"file_id"`
+	NodeIndex *int   `json:"node_index,omitempty"`
+	Key       string `json:"key,omitempty"`
+	Detail    string `json:"detail"`
+	Fixed     bool   `json:"fixed"`
+}
+
+// FsckReport summarizes a consistency check
+type FsckReport struct {
+	Options        FsckOptions    `json:"options"`
+	StartedAt      time.Time      `json:"started_at"`
+	FinishedAt     *time.Time     `json:"finished_at"`
+	FilesChecked   int            `json:"files_checked"`
+	ObjectsScanned int            `json:"objects_scanned"`
+	Counts         map[string]int `json:"counts"`
+	Fixed          int            `json:"fixed"`
+	Issues         []FsckIssue    `json:"issues"`
+	Truncated      bool           `json:"truncated"` // more than MaxFsckIssues issues; Counts has the totals
+	Error          string         `json:"error,omitempty"`
+}
+
+func (r *FsckReport) add(issue FsckIssue) {
+	r.Counts[issue.Kind]++
+	if issue.Fixed {
+		r.Fixed++
+	}
+	if len(r.Issues) < MaxFsckIssues {
+		r.Issues = append(r.Issues, issue)
+	} else {
+		r.Truncated = true
+	}
+}
+
+// Unresolved returns the number of issues that were not fixed
+func (r *FsckReport) Unresolved() int {
+	total := 0
+	for _, count := range r.Counts {
+		total += count
+	}
+	return total - r.Fixed
+}
+
+// shardID identifies a shard independently of the node holding it
+type shardID struct {
+	fileID uint
+	index  int
+}
+
+// nodeInventory indexes the objects found on the storage nodes
+type nodeInventory struct {
+	shards    map[shardID]map[int]services.StoredObject
+	fragments map[string]map[int]services.StoredObject // by fragment path
+	byFile    map[uint][]services.StoredObject
+}
+
+// fsckGarbage is what a check found to collect once the grace period is over
+type fsckGarbage struct {
+	missing []services.StoredObject // objects of files that don't exist
+	stale   []services.StoredObject // objects of existing files that no row refers to
+	rows    map[uint]string         // placement rows of files with stale objects, as checked
+}
+
+// Fsck cross-checks files, shard_locations and key_fragments against the
+// objects actually stored on the nodes. It can repoint rows at objects that
+// moved, rebuild missing shards through the scrubber and collect orphans.
+type Fsck struct {
+	db          *gorm.DB
+	storage     *services.DistributedStorageService
+	scrubber    *Scrubber
+	maintenance *sync.Mutex
+
+	mu      sync.Mutex
+	running bool
+	last    *FsckReport
+}
+
+func NewFsck(db *gorm.DB, storage *services.DistributedStorageService, scrubber *Scrubber, maintenance *sync.Mutex) *Fsck {
+	return &Fsck{
+		db:          db,
+		storage:     storage,
+		scrubber:    scrubber,
+		maintenance: maintenance,
+	}
+}
+
+// Status reports whether a check is running and returns the last finished report
+func (f *Fsck) Status() (bool, *FsckReport) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.running, f.last
+}
+
+// Start runs a check in the background
+func (f *Fsck) Start(opts FsckOptions) error {
+	if !f.begin() {
+		return ErrFsckRunning
+	}
+	go func() {
+		if _, err := f.run(opts); err != nil {
+			log.Printf("Error in consistency check: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Run performs a check and waits for it to finish
+func (f *Fsck) Run(opts FsckOptions) (*FsckReport, error) {
+	if !f.begin() {
+		return nil, ErrFsckRunning
+	}
+	return f.run(opts)
+}
+
+func (f *Fsck) begin() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.running {
+		return false
+	}
+	f.running = true
+	return true
+}
+
+func (f *Fsck) run(opts FsckOptions) (*FsckReport, error) {
+	report := &FsckReport{
+		Options:   opts,
+		StartedAt: time.Now(),
+		Counts:    make(map[string]int),
+	}
+	log.Printf("Starting consistency check (repair: %v, gc: %v)...", opts.Repair, opts.GC)
+
+	garbage, err := f.check(report)
+	if err == nil && report.Options.GC && len(garbage.missing)+len(garbage.stale) > 0 {
+		err = f.collect(report, garbage)
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	finishedAt := time.Now()
+	report.FinishedAt = &finishedAt
+	f.mu.Lock()
+	f.running = false
+	f.last = report
+	f.mu.Unlock()
+
+	log.Printf("Consistency check finished - Files: %d, Objects: %d, Issues: %d, Fixed: %d",
+		report.FilesChecked, report.ObjectsScanned, report.Unresolved()+report.Fixed, report.Fixed)
+	return report, err
+}
+
+// check compares the database with the nodes, applying repairs as it goes.
+// It returns the objects no row refers to, which are only collected after
+// the grace period.
+func (f *Fsck) check(report *FsckReport) (*fsckGarbage, error) {
+	f.maintenance.Lock()
+	defer f.maintenance.Unlock()
+
+	inventory, complete := f.scanNodes(report)
+	if !complete {
+		// Objects on an unreadable node would look missing or orphaned
+		report.Options.Repair = false
+		report.Options.GC = false
+	}
+	opts := report.Options
+
+	var files []models.File
+	if err := f.db.Select("id, is_sharded, data_shard_count, parity_shard_count").
+		Order("id asc").
+		Find(&files).Error; err != nil {
+		return nil, fmt.Errorf("failed to load files: %w", err)
+	}
+	known := make(map[uint]*models.File, len(files))
+	for i := range files {
+		known[files[i].ID] = &files[i]
+	}
+
+	var locations []models.ShardLocation
+	if err := f.db.Order("file_id asc, shard_index asc").Find(&locations).Error; err != nil {
+		return nil, fmt.Errorf("failed to load shard locations: %w", err)
+	}
+	locationsByFile := make(map[uint][]models.ShardLocation)
+	for _, location := range locations {
+		locationsByFile[location.FileID] = append(locationsByFile[location.FileID], location)
+	}
+
+	var fragments []models.KeyFragment
+	if err := f.db.Order("file_id asc, fragment_index asc").Find(&fragments).Error; err != nil {
+		return nil, fmt.Errorf("failed to load key fragments: %w", err)
+	}
+	fragmentsByFile := make(map[uint][]models.KeyFragment)
+	for _, fragment := range fragments {
+		fragmentsByFile[fragment.FileID] = append(fragmentsByFile[fragment.FileID], fragment)
+	}
+
+	if err := f.checkDanglingRows(report, known, locationsByFile, fragmentsByFile, opts); err != nil {
+		return nil, err
+	}
+
+	garbage := &fsckGarbage{rows: make(map[uint]string)}
+
+	for i := range files {
+		file := &files[i]
+		if !file.IsSharded {
+			continue
+		}
+		report.FilesChecked++
+
+		referenced := make(map[string]bool)
+		if err := f.checkShards(report, file, locationsByFile[file.ID], inventory, referenced, opts); err != nil {
+			return nil, err
+		}
+		if err := f.checkFragments(report, file, fragmentsByFile[file.ID], inventory, referenced, opts); err != nil {
+			return nil, err
+		}
+
+		// Anything else in the file's directories is a stale copy or leftover
+		for _, object := range inventory.byFile[file.ID] {
+			if object.Kind == services.ManifestObjectKind || referenced[objectRef(object)] {
+				continue
+			}
+			if !opts.GC || object.Kind == services.UnknownObjectKind {
+				f.reportOrphan(report, object, "not referenced by the file's rows", false)
+				continue
+			}
+			// The rows may be about to switch to it, e.g. while a recovery
+			// kit import replaces a fragment
+			garbage.stale = append(garbage.stale, object)
+			garbage.rows[file.ID] = placementRows(file, locationsByFile[file.ID], fragmentsByFile[file.ID])
+		}
+	}
+
+	// Objects of files that don't exist (or aren't sharded) are collected later
+	for fileID, objects := range inventory.byFile {
+		if file, ok := known[fileID]; ok && file.IsSharded {
+			continue
+		}
+		for _, object := range objects {
+			if _, ok := known[fileID]; ok {
+				f.reportOrphan(report, object, "file is not sharded", false)
+				continue
+			}
+			garbage.missing = append(garbage.missing, object)
+		}
+	}
+	sort.Slice(garbage.missing, func(i, j int) bool {
+		if garbage.missing[i].FileID != garbage.missing[j].FileID {
+			return garbage.missing[i].FileID < garbage.missing[j].FileID
+		}
+		return garbage.missing[i].Key < garbage.missing[j].Key
+	})
+	if !opts.GC {
+		for _, object := range garbage.missing {
+			f.reportOrphan(report, object, "file does not exist", false)
+		}
+		garbage.missing = nil
+	}
+	return garbage, nil
+}
+
+// placementRows describes the rows deciding which objects of a file are
+// referenced, so collect can tell whether they changed since the check
+func placementRows(file *models.File, locations []models.ShardLocation, fragments []models.KeyFragment) string {
+	var rows strings.Builder
+	fmt.Fprintf(&rows, "%v %d+%d", file.IsSharded, file.DataShardCount, file.ParityShardCount)
+	for _, location := range locations {
+		fmt.Fprintf(&rows, " s%d@%d", location.ShardIndex, location.NodeIndex)
+	}
+	for _, fragment := range fragments {
+		fmt.Fprintf(&rows, " f%d:%s@%d", fragment.ID, fragment.FragmentPath, fragment.NodeIndex)
+	}
+	return rows.String()
+}
+
+// scanNodes lists every attached node. It returns false when a node couldn't be listed.
+func (f *Fsck) scanNodes(report *FsckReport) (*nodeInventory, bool) {
+	inventory := &nodeInventory{
+		shards:    make(map[shardID]map[int]services.StoredObject),
+		fragments: make(map[string]map[int]services.StoredObject),
+		byFile:    make(map[uint][]services.StoredObject),
+	}
+	complete := true
+
+	for _, nodeIndex := range f.storage.AttachedNodes() {
+		objects, err := f.storage.ListObjects(nodeIndex)
+		if err != nil {
+			complete = false
+			report.add(FsckIssue{Kind: FsckUnreadableNode, NodeIndex: intPtr(nodeIndex), Detail: err.Error()})
+			continue
+		}
+
+		for _, object := range objects {
+			report.ObjectsScanned++
+			inventory.byFile[object.FileID] = append(inventory.byFile[object.FileID], object)
+			switch object.Kind {
+			case services.ShardObjectKind:
+				id := shardID{object.FileID, object.ShardIndex}
+				if inventory.shards[id] == nil {
+					inventory.shards[id] = make(map[int]services.StoredObject)
+				}
+				inventory.shards[id][nodeIndex] = object
+			case services.FragmentObjectKind:
+				if inventory.fragments[object.FragmentPath] == nil {
+					inventory.fragments[object.FragmentPath] = make(map[int]services.StoredObject)
+				}
+				inventory.fragments[object.FragmentPath][nodeIndex] = object
+			}
+		}
+	}
+	return inventory, complete
+}
+
+// checkDanglingRows reports placement rows of files that no longer exist
+func (f *Fsck) checkDanglingRows(report *FsckReport, known map[uint]*models.File,
+	locationsByFile map[uint][]models.ShardLocation, fragmentsByFile map[uint][]models.KeyFragment, opts FsckOptions) error {
+	dangling := make(map[uint]bool)
+	for fileID := range locationsByFile {
+		if known[fileID] == nil {
+			dangling[fileID] = true
+		}
+	}
+	for fileID := range fragmentsByFile {
+		if known[fileID] == nil {
+			dangling[fileID] = true
+		}
+	}
+
+	for fileID := range dangling {
+		issue := FsckIssue{
+			Kind:   FsckDanglingRow,
+			FileID: fileID,
+			Detail: fmt.Sprintf("%d shard_locations and %d key_fragments rows of a missing file",
+				len(locationsByFile[fileID]), len(fragmentsByFile[fileID])),
+		}
+		if opts.Repair {
+			err := f.db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Where("file_id = ?", fileID).Delete(&models.ShardLocation{}).Error; err != nil {
+					return err
+				}
+				return tx.Where("file_id = ?", fileID).Delete(&models.KeyFragment{}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("failed to delete dangling rows of file %d: %w", fileID, err)
+			}
+			issue.Fixed = true
+		}
+		report.add(issue)
+	}
+	return nil
+}
+
+// checkShards verifies that every shard of a file is on its recorded node
+func (f *Fsck) checkShards(report *FsckReport, file *models.File, locations []models.ShardLocation,
+	inventory *nodeInventory, referenced map[string]bool, opts FsckOptions) error {
+	totalShards := int(file.DataShardCount + file.ParityShardCount)
+
+	// Files never adopted by the rebalancer use the legacy placement
+	recorded := make([]*models.ShardLocation, totalShards)
+	for i := range locations {
+		if index := locations[i].ShardIndex; index >= 0 && index < totalShards {
+			recorded[index] = &locations[i]
+		}
+	}
+	shardNodes := models.LegacyShardNodes(totalShards)
+	for index, location := range recorded {
+		if location != nil {
+			shardNodes[index] = location.NodeIndex
+		}
+	}
+
+	var missing []int
+	for index, nodeIndex := range shardNodes {
+		copies := inventory.shards[shardID{file.ID, index}]
+		if object, ok := copies[nodeIndex]; ok {
+			referenced[objectRef(object)] = true
+			continue
+		}
+		if len(copies) == 0 {
+			missing = append(missing, index)
+			continue
+		}
+
+		found := lowestNode(copies)
+		referenced[objectRef(copies[found])] = true
+		issue := FsckIssue{
+			Kind:      FsckMisplacedShard,
+			FileID:    file.ID,
+			NodeIndex: intPtr(nodeIndex),
+			Key:       copies[found].Key,
+			Detail:    fmt.Sprintf("shard %d recorded on node %d, found on node %d", index, nodeIndex, found),
+		}
+		if opts.Repair && recorded[index] != nil {
+			fixed, err := f.repoint("shard_locations", recorded[index].ID, nodeIndex, found)
+			if err != nil {
+				return err
+			}
+			issue.Fixed = fixed
+		}
+		report.add(issue)
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+	available := totalShards - len(missing)
+	issue := FsckIssue{
+		Kind:   FsckUnderReplicated,
+		FileID: file.ID,
+		Detail: fmt.Sprintf("shards %v exist on no node; %d of %d available", missing, available, totalShards),
+	}
+	if available < int(file.DataShardCount) {
+		issue.Detail += fmt.Sprintf(", need %d to recover", file.DataShardCount)
+	} else if opts.Repair {
+		// The scrubber needs the full file row
+		var full models.File
+		if err := f.db.First(&full, file.ID).Error; err != nil {
+			return fmt.Errorf("failed to load file %d: %w", file.ID, err)
+		}
+		record, err := f.scrubber.ScrubFile(&full)
+		if err != nil {
+			issue.Detail += fmt.Sprintf("; rebuild failed: %v", err)
+		} else {
+			issue.Fixed = record.Status == models.DurabilityRepaired || record.Status == models.DurabilityHealthy
+			if !issue.Fixed {
+				issue.Detail += "; rebuild incomplete: " + record.Details
+			}
+		}
+	}
+	report.add(issue)
+	return nil
+}
+
+// checkFragments verifies that every key fragment of a file is on its recorded node
+func (f *Fsck) checkFragments(report *FsckReport, file *models.File, fragments []models.KeyFragment,
+	inventory *nodeInventory, referenced map[string]bool, opts FsckOptions) error {
+	for _, fragment := range fragments {
+		copies := inventory.fragments[filepath.ToSlash(fragment.FragmentPath)]
+		if object, ok := copies[fragment.NodeIndex]; ok {
+			referenced[objectRef(object)] = true
+			continue
+		}
+
+		if len(copies) == 0 {
+			report.add(FsckIssue{
+				Kind:      FsckMissingFragment,
+				FileID:    file.ID,
+				NodeIndex: intPtr(fragment.NodeIndex),
+				Key:       fragment.FragmentPath,
+				Detail:    fmt.Sprintf("%s fragment %d exists on no node", fragment.HolderType, fragment.FragmentIndex),
+			})
+			continue
+		}
+
+		found := lowestNode(copies)
+		referenced[objectRef(copies[found])] = true
+		issue := FsckIssue{
+			Kind:      FsckMisplacedFragment,
+			FileID:    file.ID,
+			NodeIndex: intPtr(fragment.NodeIndex),
+			Key:       copies[found].Key,
+			Detail:    fmt.Sprintf("fragment %d recorded on node %d, found on node %d", fragment.FragmentIndex, fragment.NodeIndex, found),
+		}
+		if opts.Repair {
+			fixed, err := f.repoint("key_fragments", fragment.ID, fragment.NodeIndex, found)
+			if err != nil {
+				return err
+			}
+			issue.Fixed = fixed
+		}
+		report.add(issue)
+	}
+	return nil
+}
+
+// repoint moves a placement row to the node that actually holds its object,
+// unless the row changed since it was read
+func (f *Fsck) repoint(table string, rowID uint, from, to int) (bool, error) {
+	result := f.db.Table(table).
+		Where("id = ? AND node_index = ?", rowID, from).
+		Update("node_index", to)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to update %s: %w", table, result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (f *Fsck) reportOrphan(report *FsckReport, object services.StoredObject, reason string, remove bool) {
+	issue := FsckIssue{
+		Kind:      FsckOrphanObject,
+		FileID:    object.FileID,
+		NodeIndex: intPtr(object.NodeIndex),
+		Key:       object.Key,
+		Detail:    fmt.Sprintf("%s: %s", object.Kind, reason),
+	}
+	if remove {
+		if err := f.storage.DeleteObject(object); err != nil {
+			issue.Detail += fmt.Sprintf("; delete failed: %v", err)
+		} else {
+			issue.Fixed = true
+		}
+	}
+	report.add(issue)
+}
+
+// collect waits out the grace period and deletes the objects of files that
+// still don't exist, and the stale objects of files whose rows haven't
+// changed since the check
+func (f *Fsck) collect(report *FsckReport, garbage *fsckGarbage) error {
+	grace := report.Options.OrphanGrace
+	if wait := time.Until(report.StartedAt.Add(grace)); wait > 0 {
+		log.Printf("Waiting %s before collecting %d orphan objects",
+			wait.Round(time.Second), len(garbage.missing)+len(garbage.stale))
+		time.Sleep(wait)
+	}
+
+	f.maintenance.Lock()
+	defer f.maintenance.Unlock()
+
+	if err := f.collectStale(report, garbage); err != nil {
+		return err
+	}
+	if len(garbage.missing) == 0 {
+		return nil
+	}
+
+	orphans := garbage.missing
+	var fileIDs []uint
+	for _, object := range orphans {
+		if len(fileIDs) == 0 || fileIDs[len(fileIDs)-1] != object.FileID {
+			fileIDs = append(fileIDs, object.FileID)
+		}
+	}
+	var existing []uint
+	if err := f.db.Model(&models.File{}).Where("id IN ?", fileIDs).Pluck("id", &existing).Error; err != nil {
+		return fmt.Errorf("failed to recheck orphan files: %w", err)
+	}
+	committed := make(map[uint]bool, len(existing))
+	for _, fileID := range existing {
+		committed[fileID] = true
+	}
+	// Journaled uploads are rolled back by the file model, not here
+	inFlight, err := models.JournaledUploadIDs(f.db)
+	if err != nil {
+		return err
+	}
+	journaled := make(map[uint]bool, len(inFlight))
+	for _, fileID := range inFlight {
+		journaled[fileID] = true
+	}
+
+	for _, object := range orphans {
+		if committed[object.FileID] || journaled[object.FileID] {
+			// The upload committed during the grace period or is still in progress
+			continue
+		}
+		f.reportOrphan(report, object, "file does not exist", true)
+	}
+	return nil
+}
+
+// collectStale deletes the stale objects of files whose rows are as the check
+// saw them. Objects of files whose rows changed are left for the next check.
+func (f *Fsck) collectStale(report *FsckReport, garbage *fsckGarbage) error {
+	current := make(map[uint]string, len(garbage.rows))
+	for fileID := range garbage.rows {
+		var file models.File
+		err := f.db.Select("id, is_sharded, data_shard_count, parity_shard_count").First(&file, fileID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to recheck file %d: %w", fileID, err)
+		}
+
+		var locations []models.ShardLocation
+		if err := f.db.Where("file_id = ?", fileID).Order("shard_index asc").Find(&locations).Error; err != nil {
+			return fmt.Errorf("failed to recheck shard locations of file %d: %w", fileID, err)
+		}
+		var fragments []models.KeyFragment
+		if err := f.db.Where("file_id = ?", fileID).Order("fragment_index asc").Find(&fragments).Error; err != nil {
+			return fmt.Errorf("failed to recheck key fragments of file %d: %w", fileID, err)
+		}
+		current[fileID] = placementRows(&file, locations, fragments)
+	}
+
+	for _, object := range garbage.stale {
+		if current[object.FileID] != garbage.rows[object.FileID] {
+			f.reportOrphan(report, object, "not referenced by the file's rows, which changed during the check", false)
+			continue
+		}
+		f.reportOrphan(report, object, "not referenced by the file's rows", true)
+	}
+	return nil
+}
+
+// objectRef identifies an object on a specific node
+func objectRef(object services.StoredObject) string {
+	return fmt.Sprintf("%d:%s", object.NodeIndex, object.Key)
+}
+
+func lowestNode(copies map[int]services.StoredObject) int {
+	lowest := -1
+	for nodeIndex := range copies {
+		if lowest < 0 || nodeIndex < lowest {
+			lowest = nodeIndex
+		}
+	}
+	return lowest
+}
+
+func intPtr(v int) *int {
+	return &v
+}
@@ -0,0 +1,331 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"safesplit/models"
+	"safesplit/services"
+	"safesplit/utils"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// KeyRotationResumeInterval is how often an interrupted rotation is picked up again
+	KeyRotationResumeInterval = 1 * time.Hour
+	// MaxKeyRotationFailures bounds the failures listed in a report
+	MaxKeyRotationFailures = 100
+
+	keyRotationBatchSize = 100
+)
+
+var ErrKeyRotationRunning = errors.New("a server key rotation is already running")
+
+// KeyRotationFailure is a file whose server fragments could not be re-wrapped
+type KeyRotationFailure struct {
+	FileID uint   `json:"file_id"`
+	Error  string `json:"error"`
+}
+
+// KeyRotationReport tracks the re-wrapping of server fragments under a new key
+type KeyRotationReport struct {
+	KeyID         string               `json:"key_id"`
+	StartedAt     time.Time            `json:"started_at"`
+	FinishedAt    *time.Time           `json:"finished_at"`
+	Files         int                  `json:"files"`
+	Fragments     int                  `json:"fragments"`
+	Skipped       int                  `json:"skipped"` // changed or deleted in the meantime
+	Failed        int                  `json:"failed"`
+	Failures      []KeyRotationFailure `json:"failures"`
+	RetiredKeyIDs []string             `json:"retired_key_ids"`
+	Error         string               `json:"error,omitempty"`
+}
+
+// KeyRotator re-wraps the server key fragments of every file under the
+// current key of the key provider after a rotation, one file at a time. Progress lives in
+// the key_fragments rows themselves, so an interrupted run resumes where it
+// stopped; keys that no fragment refers to any more are retired at the end.
+type KeyRotator struct {
+	db          *gorm.DB
+	storage     *services.DistributedStorageService
+	rsService   *services.ReedSolomonService
+	keyProvider services.KeyProvider
+	maintenance *sync.Mutex
+
+	mu      sync.Mutex
+	running bool
+	report  *KeyRotationReport
+}
+
+func NewKeyRotator(db *gorm.DB, storage *services.DistributedStorageService, rsService *services.ReedSolomonService,
+	keyProvider services.KeyProvider, maintenance *sync.Mutex) *KeyRotator {
+	return &KeyRotator{
+		db:          db,
+		storage:     storage,
+		rsService:   rsService,
+		keyProvider: keyProvider,
+		maintenance: maintenance,
+	}
+}
+
+// Status reports whether a rotation is running and returns a copy of its
+// report, or of the last finished one
+func (r *KeyRotator) Status() (bool, *KeyRotationReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.report == nil {
+		return r.running, nil
+	}
+	report := *r.report
+	report.Failures = append([]KeyRotationFailure(nil), r.report.Failures...)
+	report.RetiredKeyIDs = append([]string(nil), r.report.RetiredKeyIDs...)
+	return r.running, &report
+}
+
+// Rotate makes a new server key current and re-wraps the existing server
+// fragments under it in the background. It returns the new key ID.
+func (r *KeyRotator) Rotate() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running {
+		return "", ErrKeyRotationRunning
+	}
+	if services.ProviderSealed(r.keyProvider) {
+		return "", services.ErrSealed
+	}
+
+	keyID, err := r.keyProvider.Rotate()
+	if err != nil {
+		return "", err
+	}
+	r.start(keyID)
+	return keyID, nil
+}
+
+// Resume restarts the re-wrapping if fragments are left under an old key,
+// e.g. after a restart. It does nothing while the server is sealed.
+func (r *KeyRotator) Resume() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running {
+		return nil
+	}
+
+	// Fragments can't be re-wrapped until the server is unsealed
+	if services.ProviderSealed(r.keyProvider) {
+		return nil
+	}
+	keyID, err := r.keyProvider.KeyID()
+	if err != nil {
+		return err
+	}
+
+	var remaining int64
+	if err := r.db.Model(&models.KeyFragment{}).
+		Where("holder_type = ? AND server_key_id <> ?", models.ServerHolder, keyID).
+		Count(&remaining).Error; err != nil {
+		return fmt.Errorf("failed to count fragments to re-wrap: %w", err)
+	}
+	if remaining == 0 {
+		return nil
+	}
+
+	log.Printf("Resuming server key rotation: %d fragments are not wrapped under key %s", remaining, keyID)
+	r.start(keyID)
+	return nil
+}
+
+// start launches run; r.mu must be held
+func (r *KeyRotator) start(keyID string) {
+	r.running = true
+	r.report = &KeyRotationReport{KeyID: keyID, StartedAt: time.Now()}
+	go r.run(keyID)
+}
+
+func (r *KeyRotator) run(keyID string) {
+	log.Printf("Re-wrapping server fragments under server key %s...", keyID)
+
+	err := r.rewrapAll(keyID)
+	var retired []string
+	if retirer, ok := r.keyProvider.(services.KeyRetirer); ok && err == nil {
+		retired, err = retirer.RetireUnreferenced()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.report.Error = err.Error()
+	}
+	r.report.RetiredKeyIDs = retired
+	finishedAt := time.Now()
+	r.report.FinishedAt = &finishedAt
+	r.running = false
+	log.Printf("Server key rotation finished - Files: %d, Fragments: %d, Skipped: %d, Failed: %d, Retired keys: %d",
+		r.report.Files, r.report.Fragments, r.report.Skipped, r.report.Failed, len(retired))
+}
+
+// rewrapAll walks the files with server fragments under other keys in ID order
+func (r *KeyRotator) rewrapAll(keyID string) error {
+	var lastFileID uint
+	for {
+		var fileIDs []uint
+		if err := r.db.Model(&models.KeyFragment{}).
+			Where("holder_type = ? AND server_key_id <> ? AND file_id > ?", models.ServerHolder, keyID, lastFileID).
+			Distinct("file_id").Order("file_id asc").Limit(keyRotationBatchSize).
+			Pluck("file_id", &fileIDs).Error; err != nil {
+			return fmt.Errorf("failed to select fragments to re-wrap: %w", err)
+		}
+		if len(fileIDs) == 0 {
+			return nil
+		}
+
+		for _, fileID := range fileIDs {
+			count, err := r.rewrap(fileID, keyID)
+
+			r.mu.Lock()
+			switch {
+			case err == nil:
+				r.report.Files++
+				r.report.Fragments += count
+			case errors.Is(err, errFileChanged):
+				r.report.Skipped++
+			default:
+				log.Printf("Failed to re-wrap server fragments of file %d: %v", fileID, err)
+				r.report.Failed++
+				if len(r.report.Failures) < MaxKeyRotationFailures {
+					r.report.Failures = append(r.report.Failures, KeyRotationFailure{FileID: fileID, Error: err.Error()})
+				}
+			}
+			r.mu.Unlock()
+
+			if errors.Is(err, services.ErrSealed) {
+				return err
+			}
+		}
+		lastFileID = fileIDs[len(fileIDs)-1]
+	}
+}
+
+// rewrap re-wraps the server fragments of one file under keyID while
+// holding the maintenance lock. The new fragments are written next to the old
+// ones and the rows switched in one transaction before the old fragments are
+// deleted, so a crash in between leaves orphans for fsck rather than fragments
+// nobody can decrypt.
+func (r *KeyRotator) rewrap(fileID uint, keyID string) (int, error) {
+	r.maintenance.Lock()
+	defer r.maintenance.Unlock()
+
+	var fragments []models.KeyFragment
+	if err := r.db.Where("file_id = ? AND holder_type = ? AND server_key_id <> ?", fileID, models.ServerHolder, keyID).
+		Order("fragment_index asc").Find(&fragments).Error; err != nil {
+		return 0, fmt.Errorf("failed to load fragments: %w", err)
+	}
+	if len(fragments) == 0 {
+		return 0, errFileChanged
+	}
+
+	rewrapped := make([]models.KeyFragment, len(fragments))
+	var written []models.KeyFragment
+	cleanup := func(list []models.KeyFragment) {
+		for _, fragment := range list {
+			if err := r.storage.DeleteFragment(fragment.NodeIndex, fragment.FragmentPath); err != nil {
+				log.Printf("Warning: failed to delete fragment %s from node %d: %v", fragment.FragmentPath, fragment.NodeIndex, err)
+			}
+		}
+	}
+
+	for i, fragment := range fragments {
+		data, err := r.storage.RetrieveFragment(fragment.NodeIndex, fragment.FragmentPath)
+		if err != nil {
+			cleanup(written)
+			return 0, fmt.Errorf("failed to read fragment %d: %w", fragment.FragmentIndex, err)
+		}
+		share, err := models.UnwrapServerFragment(r.keyProvider, &fragment, data)
+		if err != nil {
+			cleanup(written)
+			return 0, fmt.Errorf("failed to unwrap fragment %d: %w", fragment.FragmentIndex, err)
+		}
+
+		nonce, err := utils.GenerateNonce()
+		if err != nil {
+			cleanup(written)
+			return 0, err
+		}
+		encrypted, wrappedKeyID, err := r.keyProvider.Wrap(share, nonce)
+		if err != nil {
+			cleanup(written)
+			return 0, fmt.Errorf("failed to wrap fragment %d: %w", fragment.FragmentIndex, err)
+		}
+		if wrappedKeyID != keyID {
+			// The key was rotated again in the meantime; the next run picks the file up
+			cleanup(written)
+			return 0, errFileChanged
+		}
+
+		rewrapped[i] = fragment
+		rewrapped[i].FragmentPath = fmt.Sprintf("file_%d/fragment_%d_%x", fileID, fragment.FragmentIndex, nonce[:4])
+		rewrapped[i].EncryptionNonce = nonce
+		rewrapped[i].ServerKeyID = &keyID
+		rewrapped[i].Checksum = services.ShardChecksum(encrypted)
+		if err := r.storage.StoreFragment(fragment.NodeIndex, rewrapped[i].FragmentPath, encrypted); err != nil {
+			cleanup(written)
+			return 0, fmt.Errorf("failed to store fragment %d: %w", fragment.FragmentIndex, err)
+		}
+		written = append(written, rewrapped[i])
+	}
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		for i, fragment := range rewrapped {
+			result := tx.Model(&models.KeyFragment{}).
+				Where("id = ? AND server_key_id = ? AND fragment_path = ?", fragment.ID, *fragments[i].ServerKeyID, fragments[i].FragmentPath).
+				Updates(map[string]interface{}{
+					"fragment_path":    fragment.FragmentPath,
+					"encryption_nonce": fragment.EncryptionNonce,
+					"server_key_id":    keyID,
+					"checksum":         fragment.Checksum,
+				})
+			if result.Error != nil {
+				return fmt.Errorf("failed to update fragment %d: %w", fragment.FragmentIndex, result.Error)
+			}
+			if result.RowsAffected == 0 {
+				return errFileChanged
+			}
+		}
+		if err := tx.Model(&models.File{}).Where("id = ?", fileID).Update("server_key_id", keyID).Error; err != nil {
+			return fmt.Errorf("failed to update file: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		cleanup(written)
+		return 0, err
+	}
+	cleanup(fragments)
+
+	r.refreshManifest(fileID)
+	return len(fragments), nil
+}
+
+// refreshManifest rewrites the manifest of a sharded file so it lists the new
+// fragment locations and key IDs. The scrubber catches up on failures.
+func (r *KeyRotator) refreshManifest(fileID uint) {
+	var file models.File
+	if err := r.db.Where("id = ? AND is_sharded = ?", fileID, true).First(&file).Error; err != nil {
+		return
+	}
+	shardNodes, _, err := models.LoadShardPlacement(r.db, &file)
+	if err == nil {
+		var manifest *services.ShardManifest
+		if manifest, err = r.rsService.ReadManifest(file.ID, shardNodes); err == nil {
+			if err = models.FillManifest(r.db, &file, manifest); err == nil {
+				_, err = r.rsService.WriteManifest(manifest)
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: server fragments of file %d were re-wrapped but its manifest was not updated: %v", file.ID, err)
+	}
+}
@@ -0,0 +1,591 @@
+package jobs
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"safesplit/models"
+	"safesplit/services"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	RebalanceInterval    = 1 * time.Hour
+	MaxMovesPerRebalance = 500
+)
+
+type objectKind string
+
+const (
+	shardObject    objectKind = "shard"
+	fragmentObject objectKind = "fragment"
+)
+
+// placedObject is a shard or key fragment together with the node holding it
+type placedObject struct {
+	kind         objectKind
+	rowID        uint
+	fileID       uint
+	index        int
+	fragmentPath string
+	checksum     string
+	nodeIndex    int
+}
+
+// placementPolicy is what balance needs to keep moves within the placement
+// policy: the zone, weight and tier of every node, how many of a file's
+// objects a single zone may hold and, for shards, which tier holds the file
+type placementPolicy struct {
+	zoneOf   map[int]string
+	weight   map[int]int
+	tierOf   map[int]string
+	limits   map[uint]int
+	fileTier map[uint]string // nil for key fragments, which may be on any tier
+}
+
+func (p *placementPolicy) limit(fileID uint) int {
+	if limit, ok := p.limits[fileID]; ok {
+		return limit
+	}
+	// Rows of a file that no longer exists; fsck cleans those up
+	return math.MaxInt
+}
+
+// onTier reports whether nodeIndex is on the tier holding the file
+func (p *placementPolicy) onTier(fileID uint, nodeIndex int) bool {
+	tier, ok := p.fileTier[fileID]
+	return !ok || p.tierOf[nodeIndex] == tier
+}
+
+// groups splits nodes into the sets objects may move between
+func (p *placementPolicy) groups(nodes []int) [][]int {
+	if p.fileTier == nil {
+		return [][]int{nodes}
+	}
+	byTier := make(map[string][]int)
+	var tiers []string
+	for _, nodeIndex := range nodes {
+		tier := p.tierOf[nodeIndex]
+		if byTier[tier] == nil {
+			tiers = append(tiers, tier)
+		}
+		byTier[tier] = append(byTier[tier], nodeIndex)
+	}
+	groups := make([][]int, len(tiers))
+	for i, tier := range tiers {
+		groups[i] = byTier[tier]
+	}
+	return groups
+}
+
+// RebalanceResult summarizes a single rebalancer run
+type RebalanceResult struct {
+	AdoptedFiles   int       `json:"adopted_files"`
+	ShardsMoved    int       `json:"shards_moved"`
+	FragmentsMoved int       `json:"fragments_moved"`
+	PolicyFixes    int       `json:"policy_fixes"` // moves out of zones holding too many of a file's objects
+	Failed         int       `json:"failed"`
+	DrainRemaining int64     `json:"drain_remaining"` // shards and fragments still on draining nodes
+	DrainedNodes   []int     `json:"drained_nodes"`   // draining nodes left with nothing on them
+	StartedAt      time.Time `json:"started_at"`
+	FinishedAt     time.Time `json:"finished_at"`
+}
+
+// Rebalancer moves shards and key fragments off draining nodes, out of zones
+// holding more of a file than the placement policy allows, and evens out
+// placement across active nodes by weight. Every move copies the object first, then
+// switches the metadata and only then deletes the source, so files stay
+// readable throughout.
+type Rebalancer struct {
+	db          *gorm.DB
+	storage     *services.DistributedStorageService
+	maintenance *sync.Mutex
+	trigger     chan struct{}
+
+	mu   sync.Mutex
+	last *RebalanceResult
+}
+
+func NewRebalancer(db *gorm.DB, storage *services.DistributedStorageService, maintenance *sync.Mutex) *Rebalancer {
+	return &Rebalancer{
+		db:          db,
+		storage:     storage,
+		maintenance: maintenance,
+		trigger:     make(chan struct{}, 1),
+	}
+}
+
+// Trigger schedules a run without waiting for it
+func (r *Rebalancer) Trigger() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+		// A run is already pending
+	}
+}
+
+// LastResult returns the outcome of the most recent run, if any
+func (r *Rebalancer) LastResult() *RebalanceResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// Run performs one rebalancing pass
+func (r *Rebalancer) Run() (*RebalanceResult, error) {
+	r.maintenance.Lock()
+	defer r.maintenance.Unlock()
+
+	result := &RebalanceResult{StartedAt: time.Now()}
+	log.Println("Starting storage rebalance...")
+
+	adopted, err := r.adoptLegacyFiles()
+	if err != nil {
+		return nil, err
+	}
+	result.AdoptedFiles = adopted
+
+	var nodes []models.StorageNode
+	if err := r.db.Where("status IN ?", []models.StorageNodeStatus{models.StorageNodeActive, models.StorageNodeDraining}).
+		Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to load storage nodes: %w", err)
+	}
+
+	var active []int
+	draining := make(map[int]bool)
+	policy := &placementPolicy{
+		zoneOf: make(map[int]string),
+		weight: make(map[int]int),
+		tierOf: make(map[int]string),
+	}
+	for _, node := range nodes {
+		if !r.storage.HasNode(node.NodeIndex) {
+			log.Printf("Skipping node %d: not attached", node.NodeIndex)
+			continue
+		}
+		policy.zoneOf[node.NodeIndex] = r.storage.ZoneOf(node.NodeIndex)
+		policy.weight[node.NodeIndex] = max(node.Weight, 1)
+		policy.tierOf[node.NodeIndex] = r.storage.TierOf(node.NodeIndex)
+		if r.storage.IsNodeDown(node.NodeIndex) {
+			// Still counted towards its zone, but nothing is moved to or off it
+			log.Printf("Skipping node %d: down", node.NodeIndex)
+			continue
+		}
+		if node.Status == models.StorageNodeActive {
+			active = append(active, node.NodeIndex)
+		} else {
+			draining[node.NodeIndex] = true
+		}
+	}
+	sort.Ints(active)
+	if len(active) == 0 {
+		return nil, fmt.Errorf("no active storage nodes to rebalance onto")
+	}
+
+	var files []models.File
+	if err := r.db.Select("id, parity_shard_count, threshold, storage_tier").Find(&files).Error; err != nil {
+		return nil, fmt.Errorf("failed to load files: %w", err)
+	}
+
+	budget := MaxMovesPerRebalance
+	for _, kind := range []objectKind{shardObject, fragmentObject} {
+		objects, err := r.loadObjects(kind)
+		if err != nil {
+			return nil, err
+		}
+
+		policy.limits = make(map[uint]int, len(files))
+		policy.fileTier = nil
+		if kind == shardObject {
+			policy.fileTier = make(map[uint]string, len(files))
+		}
+		for _, file := range files {
+			if kind == shardObject {
+				policy.limits[file.ID] = services.ShardZoneLimit(int(file.ParityShardCount))
+				policy.fileTier[file.ID] = file.StorageTier
+				if file.StorageTier == "" {
+					policy.fileTier[file.ID] = services.TierHot
+				}
+			} else {
+				policy.limits[file.ID] = services.FragmentZoneLimit(int(file.Threshold))
+			}
+		}
+
+		moved, fixes, failed := r.balance(objects, active, draining, policy, &budget)
+		result.PolicyFixes += fixes
+		result.Failed += failed
+		if kind == shardObject {
+			result.ShardsMoved = moved
+		} else {
+			result.FragmentsMoved = moved
+		}
+	}
+
+	if err := r.finishDrains(draining, result); err != nil {
+		return nil, err
+	}
+
+	result.FinishedAt = time.Now()
+	r.mu.Lock()
+	r.last = result
+	r.mu.Unlock()
+	log.Printf("Storage rebalance finished - Adopted files: %d, Shards moved: %d, Fragments moved: %d, Policy fixes: %d, Failed: %d, Left on draining nodes: %d",
+		result.AdoptedFiles, result.ShardsMoved, result.FragmentsMoved, result.PolicyFixes, result.Failed, result.DrainRemaining)
+	return result, nil
+}
+
+// Draining reports whether the last run left objects on draining nodes while
+// still making progress, so another run should follow straight away
+func (r *RebalanceResult) Draining() bool {
+	return r.DrainRemaining > 0 && r.ShardsMoved+r.FragmentsMoved > 0
+}
+
+// finishDrains counts what is left on draining nodes and clears nodes that no
+// row points at any more of leftover objects: manifest copies, and copies a
+// failed move or delete left behind. Objects of uploads still in progress are
+// kept, since their rows may not be committed yet.
+func (r *Rebalancer) finishDrains(draining map[int]bool, result *RebalanceResult) error {
+	if len(draining) == 0 {
+		return nil
+	}
+
+	var journaled map[uint]bool
+	for nodeIndex := range draining {
+		var shards, fragments int64
+		if err := r.db.Model(&models.ShardLocation{}).Where("node_index = ?", nodeIndex).Count(&shards).Error; err != nil {
+			return fmt.Errorf("failed to count shards on node %d: %w", nodeIndex, err)
+		}
+		if err := r.db.Model(&models.KeyFragment{}).Where("node_index = ?", nodeIndex).Count(&fragments).Error; err != nil {
+			return fmt.Errorf("failed to count fragments on node %d: %w", nodeIndex, err)
+		}
+		result.DrainRemaining += shards + fragments
+		if shards+fragments > 0 {
+			continue
+		}
+
+		if journaled == nil {
+			fileIDs, err := models.JournaledUploadIDs(r.db)
+			if err != nil {
+				return err
+			}
+			journaled = make(map[uint]bool, len(fileIDs))
+			for _, fileID := range fileIDs {
+				journaled[fileID] = true
+			}
+		}
+
+		objects, err := r.storage.ListObjects(nodeIndex)
+		if err != nil {
+			log.Printf("Cannot clear drained node %d: %v", nodeIndex, err)
+			continue
+		}
+		left := 0
+		for _, object := range objects {
+			if journaled[object.FileID] {
+				left++
+				continue
+			}
+			if err := r.storage.DeleteObject(object); err != nil {
+				log.Printf("Failed to clear %s from drained node %d: %v", object.Key, nodeIndex, err)
+				left++
+			}
+		}
+		if left == 0 {
+			log.Printf("Storage node %d is drained and can be removed", nodeIndex)
+			result.DrainedNodes = append(result.DrainedNodes, nodeIndex)
+		}
+	}
+	sort.Ints(result.DrainedNodes)
+	return nil
+}
+
+// adoptLegacyFiles records the implicit i % LegacyNodeCount placement of files
+// uploaded before shard locations were tracked, so they can be moved
+func (r *Rebalancer) adoptLegacyFiles() (int, error) {
+	var files []models.File
+	if err := r.db.Where("is_sharded = ? AND NOT EXISTS (SELECT 1 FROM shard_locations WHERE shard_locations.file_id = files.id)", true).
+		Find(&files).Error; err != nil {
+		return 0, fmt.Errorf("failed to find files without shard locations: %w", err)
+	}
+
+	for _, file := range files {
+		shardNodes := models.LegacyShardNodes(int(file.DataShardCount + file.ParityShardCount))
+		if err := models.SaveShardLocations(r.db, file.ID, shardNodes, nil); err != nil {
+			return 0, fmt.Errorf("failed to adopt file %d: %w", file.ID, err)
+		}
+	}
+
+	if len(files) > 0 {
+		log.Printf("Recorded legacy shard placement for %d files", len(files))
+	}
+	return len(files), nil
+}
+
+func (r *Rebalancer) loadObjects(kind objectKind) ([]placedObject, error) {
+	var objects []placedObject
+
+	switch kind {
+	case shardObject:
+		var locations []models.ShardLocation
+		if err := r.db.Order("id asc").Find(&locations).Error; err != nil {
+			return nil, fmt.Errorf("failed to load shard locations: %w", err)
+		}
+		for _, location := range locations {
+			objects = append(objects, placedObject{
+				kind:      shardObject,
+				rowID:     location.ID,
+				fileID:    location.FileID,
+				index:     location.ShardIndex,
+				checksum:  location.Checksum,
+				nodeIndex: location.NodeIndex,
+			})
+		}
+	case fragmentObject:
+		var fragments []models.KeyFragment
+		if err := r.db.Order("id asc").Find(&fragments).Error; err != nil {
+			return nil, fmt.Errorf("failed to load key fragments: %w", err)
+		}
+		for _, fragment := range fragments {
+			objects = append(objects, placedObject{
+				kind:         fragmentObject,
+				rowID:        fragment.ID,
+				fileID:       fragment.FileID,
+				index:        fragment.FragmentIndex,
+				fragmentPath: fragment.FragmentPath,
+				checksum:     fragment.Checksum,
+				nodeIndex:    fragment.NodeIndex,
+			})
+		}
+	}
+
+	return objects, nil
+}
+
+// balance empties draining nodes, moves objects out of zones that hold more of
+// their file than the policy allows or off nodes of another tier than their
+// file, and then moves objects from the fullest to the emptiest active node of
+// each tier, relative to their weights, until no move would narrow the gap. A
+// move never leaves the file's tier or takes a zone over its limit for the file, and
+// evening out never puts more of a file's objects on the target than remain on
+// the source, so the per-file spread that protects against node loss doesn't
+// get worse.
+func (r *Rebalancer) balance(objects []placedObject, active []int, draining map[int]bool,
+	policy *placementPolicy, budget *int) (moved, fixes, failed int) {
+	load := make(map[int]int)
+	for _, nodeIndex := range active {
+		load[nodeIndex] = 0
+	}
+	perFile := make(map[uint]map[int]int)
+	perZone := make(map[uint]map[string]int)
+	byNode := make(map[int][]*placedObject)
+
+	for i := range objects {
+		object := &objects[i]
+		load[object.nodeIndex]++
+		if perFile[object.fileID] == nil {
+			perFile[object.fileID] = make(map[int]int)
+			perZone[object.fileID] = make(map[string]int)
+		}
+		perFile[object.fileID][object.nodeIndex]++
+		perZone[object.fileID][policy.zoneOf[object.nodeIndex]]++
+		byNode[object.nodeIndex] = append(byNode[object.nodeIndex], object)
+	}
+
+	// allowed reports whether moving object to target keeps its file on its tier and within the zone limit
+	allowed := func(object *placedObject, target int) bool {
+		if !policy.onTier(object.fileID, target) {
+			return false
+		}
+		zone := policy.zoneOf[target]
+		return zone == policy.zoneOf[object.nodeIndex] ||
+			perZone[object.fileID][zone] < policy.limit(object.fileID)
+	}
+
+	// pick returns the allowed target that spreads the file best, or -1
+	pick := func(object *placedObject, otherZone bool) int {
+		target := -1
+		for _, candidate := range active {
+			if candidate == object.nodeIndex || !allowed(object, candidate) ||
+				(otherZone && policy.zoneOf[candidate] == policy.zoneOf[object.nodeIndex]) {
+				continue
+			}
+			if target < 0 {
+				target = candidate
+				continue
+			}
+			zones, nodes := perZone[object.fileID], perFile[object.fileID]
+			candidateZone, targetZone := zones[policy.zoneOf[candidate]], zones[policy.zoneOf[target]]
+			if candidateZone != targetZone {
+				if candidateZone < targetZone {
+					target = candidate
+				}
+				continue
+			}
+			if nodes[candidate] != nodes[target] {
+				if nodes[candidate] < nodes[target] {
+					target = candidate
+				}
+				continue
+			}
+			if load[candidate]*policy.weight[target] < load[target]*policy.weight[candidate] {
+				target = candidate
+			}
+		}
+		return target
+	}
+
+	apply := func(object *placedObject, target int) bool {
+		source := object.nodeIndex
+		if err := r.move(object, target); err != nil {
+			log.Printf("Failed to move %s %d of file %d from node %d to node %d: %v",
+				object.kind, object.index, object.fileID, source, target, err)
+			failed++
+			return false
+		}
+		load[source]--
+		load[target]++
+		perFile[object.fileID][source]--
+		perFile[object.fileID][target]++
+		perZone[object.fileID][policy.zoneOf[source]]--
+		perZone[object.fileID][policy.zoneOf[target]]++
+		moved++
+		return true
+	}
+
+	// Empty draining nodes first
+	for nodeIndex := range draining {
+		for _, object := range byNode[nodeIndex] {
+			if *budget <= 0 {
+				return moved, fixes, failed
+			}
+
+			target := pick(object, false)
+			if target < 0 {
+				log.Printf("Cannot move %s %d of file %d off node %d: no active node keeps its zones within the placement policy",
+					object.kind, object.index, object.fileID, nodeIndex)
+				failed++
+				continue
+			}
+			*budget--
+			apply(object, target)
+		}
+	}
+
+	// Spread files placed before the policy or before their nodes were labeled
+	for i := range objects {
+		object := &objects[i]
+		if draining[object.nodeIndex] || r.storage.IsNodeDown(object.nodeIndex) {
+			continue
+		}
+		crowded := perZone[object.fileID][policy.zoneOf[object.nodeIndex]] > policy.limit(object.fileID)
+		if !crowded && policy.onTier(object.fileID, object.nodeIndex) {
+			continue
+		}
+		if *budget <= 0 {
+			return moved, fixes, failed
+		}
+
+		target := pick(object, crowded)
+		if target < 0 {
+			continue
+		}
+		*budget--
+		if apply(object, target) {
+			fixes++
+		}
+	}
+
+	// Even out active nodes of each tier by weight
+	heavier := func(a, b int) bool {
+		return load[a]*policy.weight[b] > load[b]*policy.weight[a]
+	}
+	for _, nodes := range policy.groups(active) {
+		for *budget > 0 {
+			fullest, emptiest := nodes[0], nodes[0]
+			for _, nodeIndex := range nodes {
+				if heavier(nodeIndex, fullest) {
+					fullest = nodeIndex
+				}
+				if heavier(emptiest, nodeIndex) {
+					emptiest = nodeIndex
+				}
+			}
+			// Stop once moving one more object would leave the emptiest node the heavier one
+			if (load[emptiest]+1)*policy.weight[fullest] >= load[fullest]*policy.weight[emptiest] {
+				break
+			}
+
+			var candidate *placedObject
+			for _, object := range byNode[fullest] {
+				counts := perFile[object.fileID]
+				if object.nodeIndex == fullest && counts[emptiest] < counts[fullest]-1 && allowed(object, emptiest) {
+					candidate = object
+					break
+				}
+			}
+			if candidate == nil {
+				// Every remaining object would crowd its file onto the emptiest node
+				break
+			}
+
+			*budget--
+			if !apply(candidate, emptiest) {
+				// Don't spin on a node we can't move data off
+				break
+			}
+		}
+	}
+
+	return moved, fixes, failed
+}
+
+// move copies an object to target, switches its metadata and deletes the source copy
+func (r *Rebalancer) move(object *placedObject, target int) error {
+	source := object.nodeIndex
+
+	var copyErr error
+	var table string
+	if object.kind == shardObject {
+		copyErr = r.storage.CopyShard(object.fileID, object.index, source, target, object.checksum)
+		table = "shard_locations"
+	} else {
+		copyErr = r.storage.CopyFragment(object.fragmentPath, source, target, object.checksum)
+		table = "key_fragments"
+	}
+	if copyErr != nil {
+		return copyErr
+	}
+
+	// Only switch if nothing else changed the row in the meantime
+	result := r.db.Table(table).
+		Where("id = ? AND node_index = ?", object.rowID, source).
+		Update("node_index", target)
+	if result.Error != nil || result.RowsAffected == 0 {
+		r.deleteCopy(object, target)
+		if result.Error != nil {
+			return fmt.Errorf("failed to update %s: %w", table, result.Error)
+		}
+		return fmt.Errorf("%s row %d changed during move", table, object.rowID)
+	}
+
+	r.deleteCopy(object, source)
+	object.nodeIndex = target
+	return nil
+}
+
+func (r *Rebalancer) deleteCopy(object *placedObject, nodeIndex int) {
+	var err error
+	if object.kind == shardObject {
+		err = r.storage.DeleteShard(object.fileID, object.index, nodeIndex)
+	} else {
+		err = r.storage.DeleteFragment(nodeIndex, object.fragmentPath)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to delete %s %d of file %d from node %d: %v",
+			object.kind, object.index, object.fileID, nodeIndex, err)
+	}
+}
@@ -0,0 +1,411 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"safesplit/models"
+	"safesplit/services"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// MaxReencodeShards is the largest data plus parity shard count a file may be re-encoded to, as for uploads
+	MaxReencodeShards = 20
+	// MaxReencodeFailures bounds the failures listed in a report
+	MaxReencodeFailures = 100
+)
+
+var (
+	ErrReencodeRunning = errors.New("a re-encode is already running")
+
+	// errFileChanged is returned when a file was deleted or re-encoded by someone else in the meantime
+	errFileChanged = errors.New("file changed during re-encode")
+)
+
+// reencodeTarget is the encoding a file is moved to
+type reencodeTarget struct {
+	tier         string
+	dataShards   int
+	parityShards int
+	columns      map[string]interface{} // further file columns switched along with the shards
+}
+
+// reencodeFile reads the stored content of a file back and stripes it anew
+// with the target parameters. The new shards are written alongside the old
+// ones, never on the node holding the old shard of the same index, followed by
+// the manifest describing them. The metadata is then switched in a single
+// transaction and only then are the old shards and stale manifest copies
+// deleted, so the file stays readable throughout and the newest manifest never
+// lists deleted shards. Shards left behind by a crash in between are orphans
+// that fsck collects.
+func reencodeFile(db *gorm.DB, storage *services.DistributedStorageService, rsService *services.ReedSolomonService,
+	file *models.File, target reencodeTarget) error {
+	oldNodes, _, err := models.LoadShardPlacement(db, file)
+	if err != nil {
+		return err
+	}
+
+	// Spool the stored content so it isn't held in memory while it is re-encoded
+	spool, err := os.CreateTemp("", "safesplit-reencode-*")
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := models.ReadStoredContent(db, rsService, file, spool)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind spool file: %w", err)
+	}
+
+	layout := services.StripeLayout{
+		DataShards:   target.dataShards,
+		ParityShards: target.parityShards,
+		StripeSize:   services.DefaultStripeSize,
+		ContentSize:  size,
+	}
+	newNodes, manifest, index, err := rsService.StoreStriped(file.ID, spool, layout,
+		services.ShardPlacement{Tier: target.tier, Avoid: oldNodes})
+	if err != nil {
+		return err
+	}
+
+	// The manifest of the new layout goes out before the switch and has to
+	// survive as many node losses as the new shards
+	oldManifest, err := rsService.ReadManifest(file.ID, oldNodes)
+	if err != nil {
+		oldManifest = nil
+	}
+	switched := *file
+	switched.StorageTier = target.tier
+	switched.DataShardCount, switched.ParityShardCount = uint(target.dataShards), uint(target.parityShards)
+	switched.LayoutVersion = services.LayoutStriped
+	if err := models.FillManifest(db, &switched, manifest); err != nil {
+		deleteShards(storage, file.ID, newNodes)
+		return err
+	}
+	written, err := rsService.WriteManifest(manifest)
+	if err == nil {
+		if copies, needed := manifestCopiesOn(written, newNodes), manifestCopiesNeeded(newNodes, target.parityShards); copies < needed {
+			err = fmt.Errorf("manifest written to %d of the nodes holding the new shards, need %d", copies, needed)
+		}
+	}
+	if err != nil {
+		deleteShards(storage, file.ID, newNodes)
+		restoreManifest(rsService, oldManifest)
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	columns := map[string]interface{}{
+		"storage_tier":       target.tier,
+		"data_shard_count":   target.dataShards,
+		"parity_shard_count": target.parityShards,
+		"layout_version":     services.LayoutStriped,
+	}
+	for column, value := range target.columns {
+		columns[column] = value
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.File{}).
+			Where("id = ? AND is_deleted = ? AND storage_tier = ? AND data_shard_count = ? AND parity_shard_count = ? AND layout_version = ?",
+				file.ID, false, file.StorageTier, file.DataShardCount, file.ParityShardCount, file.LayoutVersion).
+			Updates(columns)
+		if result.Error != nil {
+			return fmt.Errorf("failed to update file: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return errFileChanged
+		}
+
+		if err := tx.Where("file_id = ?", file.ID).Delete(&models.ShardLocation{}).Error; err != nil {
+			return fmt.Errorf("failed to delete shard locations: %w", err)
+		}
+		if err := models.SaveShardLocations(tx, file.ID, newNodes, manifest.ShardChecksums); err != nil {
+			return err
+		}
+		if err := tx.Where("file_id = ?", file.ID).Delete(&models.StripeIndex{}).Error; err != nil {
+			return fmt.Errorf("failed to delete stripe index: %w", err)
+		}
+		return models.SaveStripeIndex(tx, file.ID, layout, index)
+	})
+	if err != nil {
+		deleteShards(storage, file.ID, newNodes)
+		restoreManifest(rsService, oldManifest)
+		return err
+	}
+	deleteShards(storage, file.ID, oldNodes)
+	deleteStaleManifests(storage, file.ID, oldNodes, written)
+	*file = switched
+
+	log.Printf("Re-encoded file %d as %d+%d shards on the %s tier", file.ID, target.dataShards, target.parityShards, target.tier)
+	return nil
+}
+
+// deleteShards removes shard i of a file from shardNodes[i]
+func deleteShards(storage *services.DistributedStorageService, fileID uint, shardNodes []int) {
+	for shardIndex, nodeIndex := range shardNodes {
+		if err := storage.DeleteShard(fileID, shardIndex, nodeIndex); err != nil {
+			log.Printf("Warning: failed to delete shard %d of file %d from node %d: %v", shardIndex, fileID, nodeIndex, err)
+		}
+	}
+}
+
+// restoreManifest writes back the manifest of a layout that stays in use after
+// a failed switch. Without one the scrubber rewrites it from the database.
+func restoreManifest(rsService *services.ReedSolomonService, manifest *services.ShardManifest) {
+	if manifest == nil {
+		return
+	}
+	if _, err := rsService.WriteManifest(manifest); err != nil {
+		log.Printf("Warning: failed to restore manifest of file %d: %v", manifest.FileID, err)
+	}
+}
+
+// manifestCopiesNeeded returns on how many of the nodes holding a file's
+// shards its manifest has to be for it to survive the loss of parityShards
+// of them
+func manifestCopiesNeeded(shardNodes []int, parityShards int) int {
+	return min(len(distinctNodes(shardNodes)), parityShards+1)
+}
+
+// manifestCopiesOn counts the nodes in written that hold shards of a file
+func manifestCopiesOn(written, shardNodes []int) int {
+	holding := distinctNodes(shardNodes)
+	copies := 0
+	for _, nodeIndex := range written {
+		if holding[nodeIndex] {
+			copies++
+		}
+	}
+	return copies
+}
+
+func distinctNodes(nodes []int) map[int]bool {
+	distinct := make(map[int]bool, len(nodes))
+	for _, nodeIndex := range nodes {
+		distinct[nodeIndex] = true
+	}
+	return distinct
+}
+
+// deleteStaleManifests removes the manifest copies that the write of the
+// current one didn't replace from the nodes that held the old shards
+func deleteStaleManifests(storage *services.DistributedStorageService, fileID uint, oldNodes, written []int) {
+	current := distinctNodes(written)
+	for nodeIndex := range distinctNodes(oldNodes) {
+		if current[nodeIndex] {
+			continue
+		}
+		if err := storage.DeleteManifest(fileID, nodeIndex); err != nil {
+			log.Printf("Warning: failed to delete stale manifest of file %d from node %d: %v", fileID, nodeIndex, err)
+		}
+	}
+}
+
+// ReencodeOptions selects the files to re-encode and the profile to move them to.
+// Only files on the hot tier are considered; archived files follow the cold tier.
+type ReencodeOptions struct {
+	DataShards    int        `json:"data_shards"`
+	ParityShards  int        `json:"parity_shards"`
+	UserID        *uint      `json:"user_id,omitempty"`
+	MinSize       int64      `json:"min_size"`
+	MaxSize       int64      `json:"max_size"` // 0 means no upper bound
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+	CreatedAfter  *time.Time `json:"created_after,omitempty"`
+	Limit         int        `json:"limit"` // 0 means every matching file
+}
+
+// Validate checks the target profile and filters
+func (o ReencodeOptions) Validate() error {
+	if o.DataShards < 1 || o.ParityShards < 1 {
+		return fmt.Errorf("data and parity shard counts must be at least 1")
+	}
+	if o.DataShards+o.ParityShards > MaxReencodeShards {
+		return fmt.Errorf("total shards cannot exceed %d", MaxReencodeShards)
+	}
+	if o.MinSize < 0 || o.MaxSize < 0 || o.Limit < 0 {
+		return fmt.Errorf("sizes and limit cannot be negative")
+	}
+	if o.MaxSize > 0 && o.MinSize > o.MaxSize {
+		return fmt.Errorf("min_size is larger than max_size")
+	}
+	return nil
+}
+
+// ReencodeFailure is a file that could not be re-encoded
+type ReencodeFailure struct {
+	FileID uint   `json:"file_id"`
+	Error  string `json:"error"`
+}
+
+// ReencodeReport tracks a re-encode batch
+type ReencodeReport struct {
+	Options    ReencodeOptions   `json:"options"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt *time.Time        `json:"finished_at"`
+	Matched    int               `json:"matched"`
+	Reencoded  int               `json:"reencoded"`
+	Skipped    int               `json:"skipped"` // changed or deleted since the batch started
+	Failed     int               `json:"failed"`
+	Failures   []ReencodeFailure `json:"failures"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// Reencoder re-splits existing files to a new Reed-Solomon profile in the
+// background, one file at a time, so scrubbing and rebalancing can run in
+// between
+type Reencoder struct {
+	db          *gorm.DB
+	storage     *services.DistributedStorageService
+	rsService   *services.ReedSolomonService
+	maintenance *sync.Mutex
+
+	mu      sync.Mutex
+	running bool
+	report  *ReencodeReport
+}
+
+func NewReencoder(db *gorm.DB, storage *services.DistributedStorageService, rsService *services.ReedSolomonService, maintenance *sync.Mutex) *Reencoder {
+	return &Reencoder{
+		db:          db,
+		storage:     storage,
+		rsService:   rsService,
+		maintenance: maintenance,
+	}
+}
+
+// Status reports whether a batch is running and returns a copy of its report,
+// or of the last finished one
+func (r *Reencoder) Status() (bool, *ReencodeReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.report == nil {
+		return r.running, nil
+	}
+	report := *r.report
+	report.Failures = append([]ReencodeFailure(nil), r.report.Failures...)
+	return r.running, &report
+}
+
+// Start validates opts and re-encodes the matching files in the background
+func (r *Reencoder) Start(opts ReencodeOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	if r.running {
+		r.mu.Unlock()
+		return ErrReencodeRunning
+	}
+	r.running = true
+	r.report = &ReencodeReport{Options: opts, StartedAt: time.Now()}
+	r.mu.Unlock()
+
+	go r.run(opts)
+	return nil
+}
+
+func (r *Reencoder) run(opts ReencodeOptions) {
+	log.Printf("Starting re-encode to %d+%d shards...", opts.DataShards, opts.ParityShards)
+
+	fileIDs, err := r.matchingFiles(opts)
+	r.mu.Lock()
+	r.report.Matched = len(fileIDs)
+	if err != nil {
+		r.report.Error = err.Error()
+	}
+	r.mu.Unlock()
+
+	for _, fileID := range fileIDs {
+		err := r.reencode(fileID, opts)
+
+		r.mu.Lock()
+		switch {
+		case err == nil:
+			r.report.Reencoded++
+		case errors.Is(err, errFileChanged):
+			r.report.Skipped++
+		default:
+			log.Printf("Failed to re-encode file %d: %v", fileID, err)
+			r.report.Failed++
+			if len(r.report.Failures) < MaxReencodeFailures {
+				r.report.Failures = append(r.report.Failures, ReencodeFailure{FileID: fileID, Error: err.Error()})
+			}
+		}
+		r.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	finishedAt := time.Now()
+	r.report.FinishedAt = &finishedAt
+	r.running = false
+	log.Printf("Re-encode finished - Matched: %d, Re-encoded: %d, Skipped: %d, Failed: %d",
+		r.report.Matched, r.report.Reencoded, r.report.Skipped, r.report.Failed)
+	r.mu.Unlock()
+}
+
+// matchingFiles returns the IDs of hot files matching the filters that aren't on the target profile yet
+func (r *Reencoder) matchingFiles(opts ReencodeOptions) ([]uint, error) {
+	query := r.db.Model(&models.File{}).
+		Where("is_sharded = ? AND is_deleted = ? AND is_archived = ? AND storage_tier = ?", true, false, false, services.TierHot).
+		Where("NOT (data_shard_count = ? AND parity_shard_count = ?)", opts.DataShards, opts.ParityShards)
+	if opts.UserID != nil {
+		query = query.Where("user_id = ?", *opts.UserID)
+	}
+	if opts.MinSize > 0 {
+		query = query.Where("size >= ?", opts.MinSize)
+	}
+	if opts.MaxSize > 0 {
+		query = query.Where("size <= ?", opts.MaxSize)
+	}
+	if opts.CreatedBefore != nil {
+		query = query.Where("created_at < ?", *opts.CreatedBefore)
+	}
+	if opts.CreatedAfter != nil {
+		query = query.Where("created_at >= ?", *opts.CreatedAfter)
+	}
+	if opts.Limit > 0 {
+		query = query.Limit(opts.Limit)
+	}
+
+	var fileIDs []uint
+	if err := query.Order("id asc").Pluck("id", &fileIDs).Error; err != nil {
+		return nil, fmt.Errorf("failed to select files to re-encode: %w", err)
+	}
+	return fileIDs, nil
+}
+
+// reencode moves a single file to the target profile while holding the maintenance lock
+func (r *Reencoder) reencode(fileID uint, opts ReencodeOptions) error {
+	r.maintenance.Lock()
+	defer r.maintenance.Unlock()
+
+	var file models.File
+	if err := r.db.Where("id = ? AND is_deleted = ? AND is_archived = ? AND storage_tier = ?",
+		fileID, false, false, services.TierHot).First(&file).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errFileChanged
+		}
+		return fmt.Errorf("failed to load file: %w", err)
+	}
+	if int(file.DataShardCount) == opts.DataShards && int(file.ParityShardCount) == opts.ParityShards {
+		return errFileChanged
+	}
+
+	return reencodeFile(r.db, r.storage, r.rsService, &file, reencodeTarget{
+		tier:         services.TierHot,
+		dataShards:   opts.DataShards,
+		parityShards: opts.ParityShards,
+	})
+}
@@ -0,0 +1,79 @@
+package jobs
+
+import (
+	"bytes"
+	"safesplit/models"
+	"safesplit/services"
+	"testing"
+)
+
+func TestReencodeReplacesManifest(t *testing.T) {
+	e := newTestEnv(t)
+	user, masterKey := e.createUser(t, "reencode", "correct horse battery")
+	file, content := e.createFile(t, user, masterKey)
+	oldNodes, _, err := models.LoadShardPlacement(e.db, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Node 5 is draining, so the new manifest doesn't reach it
+	const draining = 5
+	if err := e.storage.SetNodeWritable(draining, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := reencodeFile(e.db, e.storage, e.rsService, file, reencodeTarget{
+		tier:         services.TierHot,
+		dataShards:   3,
+		parityShards: 1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored models.File
+	if err := e.db.First(&stored, file.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	shardNodes, checksums, err := models.LoadShardPlacement(e.db, &stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := e.rsService.ReadManifest(file.ID, oldNodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.DataShards != 3 || manifest.ParityShards != 1 || manifest.Layout != services.LayoutStriped {
+		t.Fatalf("manifest describes %d+%d shards in layout %d", manifest.DataShards, manifest.ParityShards, manifest.Layout)
+	}
+	for i, checksum := range checksums {
+		if manifest.ShardChecksums[i] != checksum {
+			t.Fatalf("manifest has checksum %s for shard %d, the database %s", manifest.ShardChecksums[i], i, checksum)
+		}
+	}
+	if len(manifest.KeyFragments) != 4 {
+		t.Fatalf("manifest lists %d key fragments, want 4", len(manifest.KeyFragments))
+	}
+	for _, nodeIndex := range shardNodes {
+		if nodeIndex == draining {
+			t.Fatalf("new shard placed on draining node %d", draining)
+		}
+	}
+
+	// The draining node held old shards and the old manifest, which is stale now
+	objects, err := e.storage.ListObjects(draining)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range objects {
+		if object.FileID == file.ID && object.Kind == services.ManifestObjectKind {
+			t.Fatalf("stale manifest left on draining node %d", draining)
+		}
+	}
+
+	var out bytes.Buffer
+	if _, err := models.ReadStoredContent(e.db, e.rsService, &stored, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Fatal("content changed by the re-encode")
+	}
+}
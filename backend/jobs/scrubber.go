@@ -0,0 +1,408 @@
+package jobs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"safesplit/models"
+	"safesplit/services"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	ScrubInterval  = 24 * time.Hour
+	ScrubBatchSize = 100
+)
+
+// ScrubProgress reports the state of the current or most recent scrub
+type ScrubProgress struct {
+	Running        bool       `json:"running"`
+	StartedAt      *time.Time `json:"started_at"`
+	FinishedAt     *time.Time `json:"finished_at"`
+	FilesTotal     int64      `json:"files_total"`
+	FilesScanned   int64      `json:"files_scanned"`
+	Healthy        int64      `json:"healthy"`
+	Repaired       int64      `json:"repaired"`
+	Degraded       int64      `json:"degraded"`
+	Unrecoverable  int64      `json:"unrecoverable"`
+	ShardsRepaired int64      `json:"shards_repaired"`
+	Errors         int64      `json:"errors"`
+}
+
+// Scrubber walks every sharded file, verifies its shards and key fragments
+// against their recorded checksums, rebuilds damaged shards from parity and
+// records the outcome in file_durability.
+type Scrubber struct {
+	db          *gorm.DB
+	storage     *services.DistributedStorageService
+	rsService   *services.ReedSolomonService
+	maintenance *sync.Mutex
+	trigger     chan struct{}
+
+	mu       sync.Mutex
+	progress ScrubProgress
+}
+
+func NewScrubber(db *gorm.DB, storage *services.DistributedStorageService, rsService *services.ReedSolomonService, maintenance *sync.Mutex) *Scrubber {
+	return &Scrubber{
+		db:          db,
+		storage:     storage,
+		rsService:   rsService,
+		maintenance: maintenance,
+		trigger:     make(chan struct{}, 1),
+	}
+}
+
+// Trigger schedules a scrub without waiting for it
+func (s *Scrubber) Trigger() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+		// A scrub is already pending
+	}
+}
+
+// Progress returns a snapshot of the current or last scrub
+func (s *Scrubber) Progress() ScrubProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.progress
+}
+
+func (s *Scrubber) update(fn func(p *ScrubProgress)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.progress)
+}
+
+// Run scrubs every sharded file once. The maintenance lock is taken per file,
+// so other maintenance jobs interleave with a long scrub.
+func (s *Scrubber) Run() error {
+	var total int64
+	if err := s.db.Model(&models.File{}).Where("is_sharded = ?", true).Count(&total).Error; err != nil {
+		return fmt.Errorf("failed to count sharded files: %w", err)
+	}
+
+	startedAt := time.Now()
+	s.update(func(p *ScrubProgress) {
+		*p = ScrubProgress{Running: true, StartedAt: &startedAt, FilesTotal: total}
+	})
+	log.Printf("Starting scrub of %d sharded files...", total)
+
+	var lastID uint
+	for {
+		var fileIDs []uint
+		if err := s.db.Model(&models.File{}).
+			Where("is_sharded = ? AND id > ?", true, lastID).
+			Order("id asc").
+			Limit(ScrubBatchSize).
+			Pluck("id", &fileIDs).Error; err != nil {
+			s.finish()
+			return fmt.Errorf("failed to load files to scrub: %w", err)
+		}
+		if len(fileIDs) == 0 {
+			break
+		}
+
+		for _, fileID := range fileIDs {
+			lastID = fileID
+
+			record, err := s.scrub(fileID)
+			if errors.Is(err, errFileChanged) {
+				// Deleted or no longer sharded since the batch was loaded
+				s.update(func(p *ScrubProgress) { p.FilesScanned++ })
+				continue
+			}
+			if err != nil {
+				log.Printf("Error scrubbing file %d: %v", fileID, err)
+				s.update(func(p *ScrubProgress) { p.FilesScanned++; p.Errors++ })
+				continue
+			}
+
+			s.update(func(p *ScrubProgress) {
+				p.FilesScanned++
+				p.ShardsRepaired += int64(record.RepairedShards)
+				switch record.Status {
+				case models.DurabilityHealthy:
+					p.Healthy++
+				case models.DurabilityRepaired:
+					p.Repaired++
+				case models.DurabilityDegraded:
+					p.Degraded++
+				case models.DurabilityUnrecoverable:
+					p.Unrecoverable++
+				}
+			})
+		}
+	}
+
+	progress := s.finish()
+	log.Printf("Scrub finished - Scanned: %d, Healthy: %d, Repaired: %d, Degraded: %d, Unrecoverable: %d, Errors: %d",
+		progress.FilesScanned, progress.Healthy, progress.Repaired, progress.Degraded, progress.Unrecoverable, progress.Errors)
+	return nil
+}
+
+func (s *Scrubber) finish() ScrubProgress {
+	finishedAt := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.progress.Running = false
+	s.progress.FinishedAt = &finishedAt
+	return s.progress
+}
+
+// scrub checks and repairs one file while holding the maintenance lock, so
+// the rebalancer, re-encoding and tiering can't move its shards meanwhile.
+// The file is reloaded under the lock since it may have changed.
+func (s *Scrubber) scrub(fileID uint) (*models.FileDurability, error) {
+	s.maintenance.Lock()
+	defer s.maintenance.Unlock()
+
+	var file models.File
+	if err := s.db.Where("id = ? AND is_sharded = ?", fileID, true).First(&file).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errFileChanged
+		}
+		return nil, fmt.Errorf("failed to load file: %w", err)
+	}
+	return s.ScrubFile(&file)
+}
+
+// ScrubFile checks and repairs a single file and stores its durability record.
+// Callers hold the maintenance lock.
+func (s *Scrubber) ScrubFile(file *models.File) (*models.FileDurability, error) {
+	record := &models.FileDurability{
+		FileID:         file.ID,
+		LastScrubbedAt: time.Now(),
+	}
+	var problems []string
+
+	shardsOK, err := s.scrubShards(file, record, &problems)
+	if err != nil {
+		return nil, err
+	}
+	fragmentsOK, err := s.scrubFragments(file, record, &problems)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case !shardsOK || !fragmentsOK:
+		record.Status = models.DurabilityUnrecoverable
+	case len(problems) > 0:
+		record.Status = models.DurabilityDegraded
+	case record.RepairedShards > 0:
+		record.Status = models.DurabilityRepaired
+	default:
+		record.Status = models.DurabilityHealthy
+	}
+	record.Details = strings.Join(problems, "; ")
+
+	if record.Status != models.DurabilityHealthy {
+		log.Printf("Scrubbed file %d: %s (%s)", file.ID, record.Status, record.Details)
+	}
+
+	if err := models.SaveDurability(s.db, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// scrubShards rebuilds missing and corrupt shards in place. It returns false
+// when too few shards survive to reconstruct the file.
+func (s *Scrubber) scrubShards(file *models.File, record *models.FileDurability, problems *[]string) (bool, error) {
+	dataShards := int(file.DataShardCount)
+	parityShards := int(file.ParityShardCount)
+
+	shardNodes, checksums, err := models.LoadShardPlacement(s.db, file)
+	if err != nil {
+		return false, err
+	}
+
+	shards := make([][]byte, len(shardNodes))
+	var damaged []int
+	available := 0
+
+	for shardIndex, nodeIndex := range shardNodes {
+		data, err := s.storage.RetrieveShard(file.ID, shardIndex, nodeIndex)
+		switch {
+		case errors.Is(err, services.ErrObjectNotFound):
+			record.MissingShards++
+			damaged = append(damaged, shardIndex)
+			log.Printf("Missing shard %d of file %d on node %d", shardIndex, file.ID, nodeIndex)
+		case err != nil:
+			// Node unreachable: the shard may well be fine, so don't overwrite it
+			record.MissingShards++
+			*problems = append(*problems, fmt.Sprintf("shard %d unreadable on node %d: %v", shardIndex, nodeIndex, err))
+		case checksums[shardIndex] != "" && services.ShardChecksum(data) != checksums[shardIndex]:
+			record.CorruptShards++
+			damaged = append(damaged, shardIndex)
+			log.Printf("Corrupt shard %d of file %d on node %d", shardIndex, file.ID, nodeIndex)
+		default:
+			shards[shardIndex] = data
+			available++
+		}
+	}
+
+	if available < dataShards {
+		*problems = append(*problems, fmt.Sprintf("only %d of %d required shards available (%d missing, %d corrupt)",
+			available, dataShards, record.MissingShards, record.CorruptShards))
+		return false, nil
+	}
+
+	if available == len(shards) {
+		consistent, err := s.verifyComplete(file, shards, checksums, problems)
+		if err != nil || !consistent {
+			return true, err
+		}
+		return true, s.ensureManifest(file, shards, problems)
+	}
+
+	if err := s.rsService.RepairShards(shards, dataShards, parityShards); err != nil {
+		*problems = append(*problems, fmt.Sprintf("reconstruction failed: %v", err))
+		return false, nil
+	}
+
+	for _, shardIndex := range damaged {
+		nodeIndex := shardNodes[shardIndex]
+		if err := s.storage.StoreShard(file.ID, shardIndex, nodeIndex, shards[shardIndex]); err != nil {
+			*problems = append(*problems, fmt.Sprintf("failed to rewrite shard %d on node %d: %v", shardIndex, nodeIndex, err))
+			continue
+		}
+		if err := s.recordChecksum(file.ID, shardIndex, nodeIndex, shards[shardIndex]); err != nil {
+			return false, err
+		}
+		record.RepairedShards++
+		log.Printf("Repaired shard %d of file %d on node %d", shardIndex, file.ID, nodeIndex)
+	}
+	return true, s.ensureManifest(file, shards, problems)
+}
+
+// verifyComplete checks parity for a file with every shard present and fills in
+// checksums for legacy shards once the set is known to be consistent
+func (s *Scrubber) verifyComplete(file *models.File, shards [][]byte, checksums []string, problems *[]string) (bool, error) {
+	ok, err := s.rsService.VerifyShards(shards, int(file.DataShardCount), int(file.ParityShardCount))
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("parity verification failed: %v", err))
+		return false, nil
+	}
+	if !ok {
+		// Only possible for legacy shards without checksums: we can't tell which one is bad
+		*problems = append(*problems, "shards do not match parity")
+		return false, nil
+	}
+
+	for shardIndex, checksum := range checksums {
+		if checksum == "" {
+			if err := s.db.Model(&models.ShardLocation{}).
+				Where("file_id = ? AND shard_index = ?", file.ID, shardIndex).
+				Update("checksum", services.ShardChecksum(shards[shardIndex])).Error; err != nil {
+				return false, fmt.Errorf("failed to record checksum of shard %d: %w", shardIndex, err)
+			}
+		}
+	}
+	return true, nil
+}
+
+// ensureManifest rewrites manifest copies that are missing or out of date once
+// every shard is known to be good, which also gives legacy files a manifest
+func (s *Scrubber) ensureManifest(file *models.File, shards [][]byte, problems *[]string) error {
+	manifest := &services.ShardManifest{
+		FileID:         file.ID,
+		Layout:         file.LayoutVersion,
+		DataShards:     int(file.DataShardCount),
+		ParityShards:   int(file.ParityShardCount),
+		ShardSize:      int64(len(shards[0])),
+		ShardChecksums: services.ShardChecksums(shards),
+	}
+	if err := models.FillManifest(s.db, file, manifest); err != nil {
+		return err
+	}
+
+	if file.LayoutVersion == services.LayoutStriped {
+		var index models.StripeIndex
+		if err := s.db.Where("file_id = ?", file.ID).First(&index).Error; err != nil {
+			return fmt.Errorf("failed to load stripe index: %w", err)
+		}
+		manifest.OriginalSize = index.ContentSize
+		manifest.StripeSize = index.StripeSize
+		manifest.StripeIndexChecksum = services.StripeIndexChecksum(index.Checksums)
+	} else {
+		if len(shards[0]) < 8 {
+			*problems = append(*problems, "shard 0 too short to hold the file size")
+			return nil
+		}
+		manifest.OriginalSize = int64(binary.LittleEndian.Uint64(shards[0][:8]))
+	}
+
+	rewritten, err := s.rsService.RepairManifest(manifest)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("failed to write manifest: %v", err))
+		return nil
+	}
+	if rewritten > 0 {
+		log.Printf("Rewrote %d manifest copies of file %d", rewritten, file.ID)
+	}
+	return nil
+}
+
+func (s *Scrubber) recordChecksum(fileID uint, shardIndex, nodeIndex int, shard []byte) error {
+	location := models.ShardLocation{
+		FileID:     fileID,
+		ShardIndex: shardIndex,
+		NodeIndex:  nodeIndex,
+		Checksum:   services.ShardChecksum(shard),
+	}
+	result := s.db.Model(&models.ShardLocation{}).
+		Where("file_id = ? AND shard_index = ?", fileID, shardIndex).
+		Update("checksum", location.Checksum)
+	if result.Error != nil {
+		return fmt.Errorf("failed to record checksum of shard %d: %w", shardIndex, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		// Legacy file the rebalancer hasn't adopted yet
+		if err := s.db.Create(&location).Error; err != nil {
+			return fmt.Errorf("failed to record location of shard %d: %w", shardIndex, err)
+		}
+	}
+	return nil
+}
+
+// scrubFragments checks that every key fragment is present and intact. Fragments
+// are encrypted Shamir shares and cannot be rebuilt here, so damage is only
+// reported. It returns false when fewer than the threshold remain.
+func (s *Scrubber) scrubFragments(file *models.File, record *models.FileDurability, problems *[]string) (bool, error) {
+	var fragments []models.KeyFragment
+	if err := s.db.Where("file_id = ?", file.ID).Find(&fragments).Error; err != nil {
+		return false, fmt.Errorf("failed to load key fragments: %w", err)
+	}
+
+	intact := 0
+	for _, fragment := range fragments {
+		data, err := s.storage.RetrieveFragment(fragment.NodeIndex, fragment.FragmentPath)
+		switch {
+		case err != nil:
+			record.MissingFragments++
+			*problems = append(*problems, fmt.Sprintf("fragment %d unavailable on node %d: %v",
+				fragment.FragmentIndex, fragment.NodeIndex, err))
+		case fragment.Checksum != "" && services.ShardChecksum(data) != fragment.Checksum,
+			fragment.Checksum == "" && len(data) != 48:
+			record.CorruptFragments++
+			*problems = append(*problems, fmt.Sprintf("fragment %d corrupt on node %d",
+				fragment.FragmentIndex, fragment.NodeIndex))
+		default:
+			intact++
+		}
+	}
+
+	if intact < int(file.Threshold) {
+		*problems = append(*problems, fmt.Sprintf("only %d of %d required key fragments intact", intact, file.Threshold))
+		return false, nil
+	}
+	return true, nil
+}
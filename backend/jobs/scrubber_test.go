@@ -0,0 +1,238 @@
+package jobs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"path/filepath"
+	"safesplit/models"
+	"safesplit/services"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestDB opens an SQLite database with the tables of tables. MySQL enum
+// columns become text, which is all SQLite needs to store them.
+func newTestDB(t *testing.T, tables ...interface{}) *gorm.DB {
+	dsn := filepath.Join(t.TempDir(), "test.db") + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		Logger:                                   logger.Default.LogMode(logger.Silent),
+		DisableForeignKeyConstraintWhenMigrating: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(table); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if strings.HasPrefix(string(field.DataType), "enum(") {
+				field.DataType = "text"
+			}
+		}
+	}
+	if err := db.AutoMigrate(tables...); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func newTestStorage(t *testing.T, nodes int) (*services.DistributedStorageService, *services.ReedSolomonService) {
+	storage := services.NewDistributedStorageService()
+	for i := 0; i < nodes; i++ {
+		backend, err := services.NewLocalStorageBackend(fmt.Sprintf("%s/node_%d", t.TempDir(), i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.AddNode(i, backend, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signer, err := services.NewManifestSigner("a manifest signing key for the scrubber test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsService, err := services.NewReedSolomonService(storage, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage, rsService
+}
+
+// testContent is already encrypted file content
+type testContent []byte
+
+func (c testContent) Open() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(c)), nil
+}
+
+func (c testContent) Complete(file *models.File) error {
+	return nil
+}
+
+// testEnv is a database and six storage nodes with the models to put files on them
+type testEnv struct {
+	db               *gorm.DB
+	storage          *services.DistributedStorageService
+	rsService        *services.ReedSolomonService
+	keyProvider      *services.FileKeyProvider
+	encryption       *services.EncryptionService
+	keyFragmentModel *models.KeyFragmentModel
+	fileModel        *models.FileModel
+	userModel        *models.UserModel
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	db := newTestDB(t, &models.User{}, &models.File{}, &models.KeyFragment{}, &models.ShardLocation{},
+		&models.StripeIndex{}, &models.UploadJournalEntry{}, &models.ActivityLog{}, &models.FileDurability{},
+		&models.PasswordHistory{})
+	storage, rsService := newTestStorage(t, 6)
+	keyProvider, err := services.NewFileKeyProvider(filepath.Join(t.TempDir(), "server.keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryption := services.NewEncryptionService(services.NewShamirService(4))
+	keyFragmentModel := models.NewKeyFragmentModel(db, storage)
+	return &testEnv{
+		db:               db,
+		storage:          storage,
+		rsService:        rsService,
+		keyProvider:      keyProvider,
+		encryption:       encryption,
+		keyFragmentModel: keyFragmentModel,
+		fileModel:        models.NewFileModel(db, rsService, keyProvider, encryption, keyFragmentModel),
+		userModel:        models.NewUserModel(db, nil),
+	}
+}
+
+// createUser creates a user and returns it with its unlocked master key
+func (e *testEnv) createUser(t *testing.T, name, password string) (*models.User, []byte) {
+	user, err := e.userModel.Create(&models.User{Username: name, Email: name + "@example.com", Password: password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterKey, err := e.userModel.UnlockMasterKey(user, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, masterKey
+}
+
+// createFile uploads three segments of random content as 4+2 shards with
+// two of four key shares needed
+func (e *testEnv) createFile(t *testing.T, user *models.User, masterKey []byte) (*models.File, testContent) {
+	serverKeyID, err := e.keyProvider.KeyID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := e.encryption.NewFileKey(4, 2, 0, serverKeyID, services.StandardEncryption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv, err := key.NewIV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make(testContent, 3*services.StreamSegmentSize)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	file := &models.File{
+		UserID:            user.ID,
+		Name:              "test",
+		Size:              int64(len(content)),
+		EncryptionIV:      iv,
+		EncryptionSalt:    key.Salt,
+		EncryptionType:    services.StandardEncryption,
+		EncryptionVersion: services.EncryptionSegmented,
+		ShareCount:        4,
+		Threshold:         2,
+		DataShardCount:    4,
+		ParityShardCount:  2,
+		IsSharded:         true,
+		ServerKeyID:       serverKeyID,
+		MasterKeyVersion:  1,
+	}
+	if err := e.fileModel.CreateFileFromStream(file, key.Shares, content, e.keyFragmentModel, masterKey, e.keyProvider); err != nil {
+		t.Fatal(err)
+	}
+	return file, content
+}
+
+func TestScrubAfterPasswordChange(t *testing.T) {
+	e := newTestEnv(t)
+	db, storage, rsService := e.db, e.storage, e.rsService
+	keyFragmentModel, fileModel, userModel := e.keyFragmentModel, e.fileModel, e.userModel
+
+	const oldPassword, newPassword = "correct horse battery", "staple horse battery"
+	user, masterKey := e.createUser(t, "scrub", oldPassword)
+	file, _ := e.createFile(t, user, masterKey)
+
+	if err := userModel.ResetPasswordWithFragments(user.ID, oldPassword, newPassword,
+		models.NewPasswordHistoryModel(db), keyFragmentModel, fileModel); err != nil {
+		t.Fatal(err)
+	}
+
+	// The manifest follows the fragments before the scrub would repair it
+	shardNodes, _, err := models.LoadShardPlacement(db, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := rsService.ReadManifest(file.ID, shardNodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []models.KeyFragment
+	if err := db.Where("file_id = ?", file.ID).Order("fragment_index asc").Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.KeyFragments) != len(rows) {
+		t.Fatalf("manifest lists %d fragments, want %d", len(manifest.KeyFragments), len(rows))
+	}
+	for i, row := range rows {
+		entry := manifest.KeyFragments[i]
+		if entry.Path != row.FragmentPath || !bytes.Equal(entry.Nonce, row.EncryptionNonce) {
+			t.Fatalf("manifest has fragment %d at %s, the database at %s", row.FragmentIndex, entry.Path, row.FragmentPath)
+		}
+	}
+
+	var stored models.File
+	if err := db.First(&stored, file.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	record, err := NewScrubber(db, storage, rsService, &sync.Mutex{}).ScrubFile(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Status != models.DurabilityHealthy {
+		t.Fatalf("file is %s after a password change: %s", record.Status, record.Details)
+	}
+
+	// The user fragments open with the master key unlocked by the new password
+	if err := db.First(user, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if masterKey, err = userModel.UnlockMasterKey(user, newPassword); err != nil {
+		t.Fatal(err)
+	}
+	fragments, err := keyFragmentModel.GetUserFragmentsForFile(file.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fragments) != 2 {
+		t.Fatalf("%d user fragments readable, want 2", len(fragments))
+	}
+	for _, fragment := range fragments {
+		if _, err := services.DecryptMasterKey(fragment.Data, masterKey, fragment.EncryptionNonce); err != nil {
+			t.Fatalf("fragment %d: %v", fragment.FragmentIndex, err)
+		}
+	}
+}
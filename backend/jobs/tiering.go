@@ -0,0 +1,122 @@
+package jobs
+
+import (
+	"fmt"
+	"log"
+	"safesplit/models"
+	"safesplit/services"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	TierMigrationInterval   = 15 * time.Minute
+	MaxTierMigrationsPerRun = 20
+)
+
+// TierMigrationResult summarizes a single tier migration run
+type TierMigrationResult struct {
+	MovedToCold int       `json:"moved_to_cold"`
+	MovedToHot  int       `json:"moved_to_hot"`
+	Waiting     int       `json:"waiting"` // files whose target tier has no writable nodes
+	Failed      int       `json:"failed"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+}
+
+// TierMigrator moves archived files to the cold tier and unarchived files back
+// to the hot tier. A file is read back, re-encoded with the parameters of its
+// new tier onto that tier's nodes, switched over in a single transaction and
+// only then removed from the old nodes, so it stays readable throughout.
+// The stored content itself is left as it is, see services.ColdDataShards.
+type TierMigrator struct {
+	db          *gorm.DB
+	storage     *services.DistributedStorageService
+	rsService   *services.ReedSolomonService
+	maintenance *sync.Mutex
+}
+
+func NewTierMigrator(db *gorm.DB, storage *services.DistributedStorageService, rsService *services.ReedSolomonService, maintenance *sync.Mutex) *TierMigrator {
+	return &TierMigrator{
+		db:          db,
+		storage:     storage,
+		rsService:   rsService,
+		maintenance: maintenance,
+	}
+}
+
+// Run migrates up to MaxTierMigrationsPerRun files whose archive state doesn't match their tier
+func (t *TierMigrator) Run() (*TierMigrationResult, error) {
+	t.maintenance.Lock()
+	defer t.maintenance.Unlock()
+
+	result := &TierMigrationResult{StartedAt: time.Now()}
+
+	var files []models.File
+	if err := t.db.Where("is_sharded = ? AND is_deleted = ?", true, false).
+		Where("(is_archived = ? AND storage_tier = ?) OR (is_archived = ? AND storage_tier = ?)",
+			true, services.TierHot, false, services.TierCold).
+		Order("id asc").
+		Limit(MaxTierMigrationsPerRun).
+		Find(&files).Error; err != nil {
+		return nil, fmt.Errorf("failed to load files to migrate: %w", err)
+	}
+	if len(files) == 0 {
+		return result, nil
+	}
+
+	for i := range files {
+		file := &files[i]
+		tier := services.TierHot
+		if file.IsArchived {
+			tier = services.TierCold
+		}
+		if len(t.storage.TierNodes(tier)) == 0 {
+			result.Waiting++
+			continue
+		}
+
+		if err := t.migrate(file, tier); err != nil {
+			log.Printf("Failed to move file %d to the %s tier: %v", file.ID, tier, err)
+			result.Failed++
+			continue
+		}
+		if tier == services.TierCold {
+			result.MovedToCold++
+		} else {
+			result.MovedToHot++
+		}
+	}
+
+	result.FinishedAt = time.Now()
+	log.Printf("Tier migration finished - To cold: %d, To hot: %d, Waiting for tier nodes: %d, Failed: %d",
+		result.MovedToCold, result.MovedToHot, result.Waiting, result.Failed)
+	return result, nil
+}
+
+// migrate re-encodes a file onto the nodes of tier, remembering the hot
+// profile of files moved to the cold tier so they get it back
+func (t *TierMigrator) migrate(file *models.File, tier string) error {
+	dataShards, parityShards := services.ColdDataShards, services.ColdParityShards
+	hotData, hotParity := file.HotDataShards, file.HotParityShards
+	if tier == services.TierCold {
+		hotData, hotParity = file.DataShardCount, file.ParityShardCount
+	} else {
+		dataShards, parityShards = services.DefaultDataShards, services.DefaultParityShards
+		if file.HotDataShards > 0 && file.HotParityShards > 0 {
+			dataShards, parityShards = int(file.HotDataShards), int(file.HotParityShards)
+		}
+	}
+
+	return reencodeFile(t.db, t.storage, t.rsService, file, reencodeTarget{
+		tier:         tier,
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		columns: map[string]interface{}{
+			"hot_data_shards":   hotData,
+			"hot_parity_shards": hotParity,
+		},
+	})
+}
@@ -20,7 +20,7 @@ import (
 
 const (
 	baseStoragePath = "storage"
-	nodeCount       = 3
+	nodeCount       = 3 // nodes seeded into the storage node registry on first start
 )
 
 func init() {
@@ -56,22 +56,46 @@ func main() {
 	}
 	twoFactorService := services.NewTwoFactorAuthService(emailService)
 
-	// Initialize subscription handler and scheduler
-	jobManager := jobs.NewJobManager(db)
-	jobManager.StartAllJobs()
+	// Initialize distributed storage service from the node registry
+	storageService := services.NewDistributedStorageService()
+	storageNodeModel := models.NewStorageNodeModel(db, storageService)
+	if err := storageNodeModel.Seed(services.LoadStorageNodeConfigs(baseStoragePath, nodeCount)); err != nil {
+		log.Fatal("Failed to seed storage nodes:", err)
+	}
+	if err := storageNodeModel.Load(); err != nil {
+		log.Fatal("Failed to initialize distributed storage:", err)
+	}
+
+	shamirService := services.NewShamirService(nodeCount)
 
-	// Initialize distributed storage service
-	storageService, err := services.NewDistributedStorageService(baseStoragePath, nodeCount)
+	// Server master keys are wrapped by a key-encryption key that is never
+	// stored in the database. Without SERVER_KEK_FILE or SERVER_KEK the server
+	// starts sealed until operators submit enough unseal shares.
+	sealService := services.NewSealService(shamirService)
+	serverMasterKeyModel := models.NewServerMasterKeyModel(db, sealService)
+	kek, source, err := services.LoadKEK()
 	if err != nil {
-		log.Fatal("Failed to initialize distributed storage:", err)
+		log.Fatal("Failed to load key-encryption key:", err)
+	}
+	if kek == nil {
+		log.Println("Server is sealed; submit unseal shares to POST /api/system/seal/unseal")
+	} else if err := serverMasterKeyModel.Unseal(kek, source); err != nil {
+		log.Fatal("Failed to unseal server master keys:", err)
+	}
+
+	// Server fragments are wrapped by the provider chosen with SERVER_KEY_PROVIDER;
+	// fragments under the database keys stay readable while the server is unsealed
+	keyProvider, err := services.LoadKeyProvider(serverMasterKeyModel)
+	if err != nil {
+		log.Fatal("Failed to initialize server key provider:", err)
 	}
-	// Initialize subscription handler
 
-	// Initialize server master key
-	serverMasterKeyModel := models.NewServerMasterKeyModel(db)
-	if err := serverMasterKeyModel.Initialize(); err != nil {
-		log.Fatal("Failed to initialize server master key:", err)
+	// Users' master keys are unwrapped at login and only kept in memory for their session
+	sessionKeys, err := services.NewSessionKeyCacheFromEnv()
+	if err != nil {
+		log.Fatal("Failed to initialize session key cache:", err)
 	}
+	sessionKeys.StartSweeper(time.Minute)
 
 	// Initialize all required models
 	userModel := models.NewUserModel(db, twoFactorService)
@@ -80,11 +104,13 @@ func main() {
 	activityLogModel := models.NewActivityLogModel(db)
 	folderModel := models.NewFolderModel(db)
 	fileShareModel := models.NewFileShareModel(db)
+	socialRecoveryModel := models.NewSocialRecoveryModel(db, shamirService)
 	keyFragmentModel := models.NewKeyFragmentModel(db, storageService)
 	feedbackModel := models.NewFeedbackModel(db)
+	fileDurabilityModel := models.NewFileDurabilityModel(db)
+	durabilityProfileModel := models.NewDurabilityProfileModel(db)
 
 	// Initialize core services
-	shamirService := services.NewShamirService(nodeCount)
 	encryptionService := services.NewEncryptionService(shamirService)
 
 	// Initialize compression service
@@ -94,20 +120,36 @@ func main() {
 	}
 	defer compressionService.Close()
 
+	// Shard manifests are signed so nodes can't alter how shards are decoded
+	manifestSigner, err := services.NewManifestSigner(os.Getenv("MANIFEST_SIGNING_KEY"))
+	if err != nil {
+		log.Fatal("Failed to initialize manifest signer:", err)
+	}
+
 	// Initialize Reed-Solomon service with the same storage service
-	rsService, err := services.NewReedSolomonService(storageService)
+	rsService, err := services.NewReedSolomonService(storageService, manifestSigner)
 	if err != nil {
 		log.Fatal("Failed to initialize Reed-Solomon service:", err)
 	}
 
+	// Initialize subscription handler, scheduler and storage maintenance jobs
+	jobManager := jobs.NewJobManager(db, storageService, rsService, keyProvider)
+	jobManager.StartAllJobs()
+
 	// Initialize file model with server master key model
 	fileModel := models.NewFileModel(
 		db,
 		rsService,
-		serverMasterKeyModel,
+		keyProvider,
 		encryptionService,
 		keyFragmentModel,
 	)
+	// Roll back or complete uploads interrupted by a crash before accepting new ones
+	if resolved, err := fileModel.RecoverUploads(time.Now()); err != nil {
+		log.Printf("Error recovering interrupted uploads: %v", err)
+	} else if resolved > 0 {
+		log.Printf("Resolved %d interrupted uploads", resolved)
+	}
 	// Start cleanup scheduler for deleted files
 	go func() {
 		ticker := time.NewTicker(24 * time.Hour)
@@ -136,13 +178,26 @@ func main() {
 		fileModel,
 		folderModel,
 		fileShareModel,
+		socialRecoveryModel,
 		keyFragmentModel,
 		serverMasterKeyModel,
 		feedbackModel,
+		storageNodeModel,
+		fileDurabilityModel,
+		durabilityProfileModel,
+		jobManager.Rebalancer(),
+		jobManager.Scrubber(),
+		jobManager.Fsck(),
+		jobManager.Reencoder(),
+		jobManager.KeyRotator(),
 		encryptionService,
 		shamirService,
 		compressionService,
 		rsService,
+		storageService,
+		sealService,
+		keyProvider,
+		sessionKeys,
 		twoFactorService,
 		emailService,
 	)
@@ -177,7 +232,7 @@ func main() {
 	})
 
 	// Set up all application routes
-	routes.SetupRoutes(router, handlers, userModel)
+	routes.SetupRoutes(router, handlers, userModel, keyProvider)
 
 	// Log all registered routes for debugging purposes
 	log.Println("=== Registered Routes ===")
@@ -92,6 +92,9 @@ func AuthMiddleware(userModel *models.UserModel) gin.HandlerFunc {
 		fmt.Printf("Setting userID in context: %d\n", user.ID)
 		c.Set("user", user)
 		c.Set("user_id", user.ID)
+		// Tokens issued before sessions had IDs can't unlock a master key
+		sessionID, _ := claims["sid"].(string)
+		c.Set("session_id", sessionID)
 		fmt.Println("User successfully authenticated:", user)
 		c.Next()
 	}
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"net/http"
+	"safesplit/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UnsealedMiddleware refuses requests that need the server key provider while
+// it is sealed
+func UnsealedMiddleware(keyProvider services.KeyProvider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if services.ProviderSealed(keyProvider) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status": "error",
+				"error":  "Server is sealed; file encryption is unavailable until an administrator unseals it",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,321 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// MaxKeyShares is the largest number of Shamir shares a file key may be split into
+	MaxKeyShares = 10
+	// MaxTotalShards is the largest number of data plus parity shards of a file
+	MaxTotalShards = 20
+)
+
+var (
+	ErrDurabilityProfileNotFound   = errors.New("durability profile not found")
+	ErrDurabilityProfileNotAllowed = errors.New("durability profile is not available on your plan")
+	ErrDurabilityProfileIsDefault  = errors.New("the default durability profile cannot be deleted")
+)
+
+// DurabilityParams are the erasure coding and key splitting parameters of a file
+type DurabilityParams struct {
+	DataShards   int `json:"data_shards"`
+	ParityShards int `json:"parity_shards"`
+	Shares       int `json:"shares"`
+	Threshold    int `json:"threshold"`
+}
+
+// Validate checks the parameters against the hard limits of the storage layer
+func (p DurabilityParams) Validate() error {
+	if p.Shares < p.Threshold {
+		return fmt.Errorf("number of shares must be greater than or equal to threshold")
+	}
+	if p.Threshold < 2 {
+		return fmt.Errorf("threshold must be at least 2")
+	}
+	if p.Shares > MaxKeyShares {
+		return fmt.Errorf("number of shares cannot exceed %d", MaxKeyShares)
+	}
+	if p.DataShards < 1 {
+		return fmt.Errorf("data shards must be at least 1")
+	}
+	if p.ParityShards < 1 {
+		return fmt.Errorf("parity shards must be at least 1")
+	}
+	if p.DataShards+p.ParityShards > MaxTotalShards {
+		return fmt.Errorf("total number of shards cannot exceed %d", MaxTotalShards)
+	}
+	return nil
+}
+
+// DefaultDurabilityParams are used when no default profile has been defined
+var DefaultDurabilityParams = DurabilityParams{
+	DataShards:   4,
+	ParityShards: 2,
+	Shares:       5,
+	Threshold:    3,
+}
+
+// DurabilityProfile is an admin-defined set of durability parameters users
+// choose from when uploading
+type DurabilityProfile struct {
+	ID          uint   `json:"id" gorm:"primaryKey"`
+	Name        string `json:"name" gorm:"uniqueIndex;size:64;not null"` // identifier clients send, e.g. "standard"
+	DisplayName string `json:"display_name" gorm:"size:255;not null"`
+	Description string `json:"description" gorm:"type:text"`
+	DurabilityParams
+	PremiumOnly bool                        `json:"premium_only" gorm:"not null"`
+	IsDefault   bool                        `json:"is_default" gorm:"not null"`
+	IsActive    bool                        `json:"is_active" gorm:"not null"`
+	Overrides   []DurabilityProfileOverride `json:"overrides" gorm:"foreignKey:ProfileID;constraint:OnDelete:CASCADE"`
+	CreatedAt   time.Time                   `json:"created_at"`
+	UpdatedAt   time.Time                   `json:"updated_at"`
+}
+
+// DurabilityProfileOverride replaces the parameters of a profile for files of at least MinSize bytes
+type DurabilityProfileOverride struct {
+	ID        uint  `json:"id" gorm:"primaryKey"`
+	ProfileID uint  `json:"-" gorm:"not null;index"`
+	MinSize   int64 `json:"min_size" gorm:"not null"`
+	DurabilityParams
+}
+
+// Validate checks the parameters of the profile and of each override
+func (p *DurabilityProfile) Validate() error {
+	if p.Name == "" || p.DisplayName == "" {
+		return fmt.Errorf("name and display name are required")
+	}
+	if p.IsDefault && !p.IsActive {
+		return fmt.Errorf("the default profile must be active")
+	}
+	if err := p.DurabilityParams.Validate(); err != nil {
+		return err
+	}
+	seen := make(map[int64]bool)
+	for _, override := range p.Overrides {
+		if override.MinSize <= 0 {
+			return fmt.Errorf("override min_size must be positive")
+		}
+		if seen[override.MinSize] {
+			return fmt.Errorf("more than one override for files of %d bytes", override.MinSize)
+		}
+		seen[override.MinSize] = true
+		if err := override.DurabilityParams.Validate(); err != nil {
+			return fmt.Errorf("override for files of %d bytes: %w", override.MinSize, err)
+		}
+	}
+	return nil
+}
+
+// ParamsFor returns the parameters for a file of size bytes: those of the
+// override with the largest MinSize not above size, or the profile's own
+func (p *DurabilityProfile) ParamsFor(size int64) DurabilityParams {
+	params := p.DurabilityParams
+	var best int64
+	for _, override := range p.Overrides {
+		if override.MinSize <= size && override.MinSize > best {
+			params, best = override.DurabilityParams, override.MinSize
+		}
+	}
+	return params
+}
+
+// AvailableTo reports whether a user's plan allows the profile
+func (p *DurabilityProfile) AvailableTo(user *User) bool {
+	return p.IsActive && (!p.PremiumOnly || user.IsPremiumUser())
+}
+
+type DurabilityProfileModel struct {
+	db *gorm.DB
+}
+
+func NewDurabilityProfileModel(db *gorm.DB) *DurabilityProfileModel {
+	return &DurabilityProfileModel{db: db}
+}
+
+func (m *DurabilityProfileModel) withOverrides() *gorm.DB {
+	return m.db.Preload("Overrides", func(db *gorm.DB) *gorm.DB {
+		return db.Order("min_size asc")
+	})
+}
+
+// ListProfiles returns every profile, including inactive ones
+func (m *DurabilityProfileModel) ListProfiles() ([]DurabilityProfile, error) {
+	var profiles []DurabilityProfile
+	if err := m.withOverrides().Order("id asc").Find(&profiles).Error; err != nil {
+		return nil, fmt.Errorf("failed to list durability profiles: %w", err)
+	}
+	return profiles, nil
+}
+
+// ListAvailable returns the active profiles a user's plan allows
+func (m *DurabilityProfileModel) ListAvailable(user *User) ([]DurabilityProfile, error) {
+	var profiles []DurabilityProfile
+	if err := m.withOverrides().Where("is_active = ?", true).Order("id asc").Find(&profiles).Error; err != nil {
+		return nil, fmt.Errorf("failed to list durability profiles: %w", err)
+	}
+
+	available := make([]DurabilityProfile, 0, len(profiles))
+	for _, profile := range profiles {
+		if profile.AvailableTo(user) {
+			available = append(available, profile)
+		}
+	}
+	return available, nil
+}
+
+// GetProfile returns a profile by ID
+func (m *DurabilityProfileModel) GetProfile(id uint) (*DurabilityProfile, error) {
+	var profile DurabilityProfile
+	if err := m.withOverrides().First(&profile, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrDurabilityProfileNotFound
+		}
+		return nil, fmt.Errorf("failed to get durability profile: %w", err)
+	}
+	return &profile, nil
+}
+
+// GetForUser returns the named profile, or the default one if name is empty,
+// checking that the user's plan allows it. Without a default profile the
+// built-in DefaultDurabilityParams are used.
+func (m *DurabilityProfileModel) GetForUser(name string, user *User) (*DurabilityProfile, error) {
+	query := m.withOverrides().Where("is_active = ?", true)
+	if name == "" {
+		query = query.Where("is_default = ?", true)
+	} else {
+		query = query.Where("name = ?", name)
+	}
+
+	var profile DurabilityProfile
+	if err := query.First(&profile).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to get durability profile: %w", err)
+		}
+		if name != "" {
+			return nil, fmt.Errorf("%w: %s", ErrDurabilityProfileNotFound, name)
+		}
+		return &DurabilityProfile{
+			Name:             "standard",
+			DisplayName:      "Standard",
+			DurabilityParams: DefaultDurabilityParams,
+			IsDefault:        true,
+			IsActive:         true,
+		}, nil
+	}
+
+	if !profile.AvailableTo(user) {
+		return nil, fmt.Errorf("%w: %s", ErrDurabilityProfileNotAllowed, profile.Name)
+	}
+	return &profile, nil
+}
+
+// CreateProfile validates and stores a new profile with its overrides
+func (m *DurabilityProfileModel) CreateProfile(profile *DurabilityProfile) error {
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+	sortOverrides(profile.Overrides)
+
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if profile.IsDefault {
+			if err := clearDefault(tx); err != nil {
+				return err
+			}
+		}
+		if err := tx.Create(profile).Error; err != nil {
+			return fmt.Errorf("failed to create durability profile: %w", err)
+		}
+		return nil
+	})
+}
+
+// UpdateProfile replaces the settings and overrides of a profile. Files
+// already stored keep the parameters they were uploaded with.
+func (m *DurabilityProfileModel) UpdateProfile(id uint, update *DurabilityProfile) (*DurabilityProfile, error) {
+	if err := update.Validate(); err != nil {
+		return nil, err
+	}
+	sortOverrides(update.Overrides)
+
+	profile, err := m.GetProfile(id)
+	if err != nil {
+		return nil, err
+	}
+	if profile.IsDefault && (!update.IsDefault || !update.IsActive) {
+		return nil, fmt.Errorf("make another profile the default before unsetting or deactivating this one")
+	}
+
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		if update.IsDefault && !profile.IsDefault {
+			if err := clearDefault(tx); err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(profile).Updates(map[string]interface{}{
+			"name":          update.Name,
+			"display_name":  update.DisplayName,
+			"description":   update.Description,
+			"data_shards":   update.DataShards,
+			"parity_shards": update.ParityShards,
+			"shares":        update.Shares,
+			"threshold":     update.Threshold,
+			"premium_only":  update.PremiumOnly,
+			"is_default":    update.IsDefault,
+			"is_active":     update.IsActive,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to update durability profile: %w", err)
+		}
+
+		if err := tx.Where("profile_id = ?", profile.ID).Delete(&DurabilityProfileOverride{}).Error; err != nil {
+			return fmt.Errorf("failed to delete profile overrides: %w", err)
+		}
+		for i := range update.Overrides {
+			update.Overrides[i].ID = 0
+			update.Overrides[i].ProfileID = profile.ID
+		}
+		if len(update.Overrides) > 0 {
+			if err := tx.Create(&update.Overrides).Error; err != nil {
+				return fmt.Errorf("failed to save profile overrides: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m.GetProfile(id)
+}
+
+// DeleteProfile removes a profile other than the default one
+func (m *DurabilityProfileModel) DeleteProfile(id uint) error {
+	profile, err := m.GetProfile(id)
+	if err != nil {
+		return err
+	}
+	if profile.IsDefault {
+		return ErrDurabilityProfileIsDefault
+	}
+	if err := m.db.Select("Overrides").Delete(profile).Error; err != nil {
+		return fmt.Errorf("failed to delete durability profile: %w", err)
+	}
+	return nil
+}
+
+func clearDefault(tx *gorm.DB) error {
+	if err := tx.Model(&DurabilityProfile{}).Where("is_default = ?", true).Update("is_default", false).Error; err != nil {
+		return fmt.Errorf("failed to clear default durability profile: %w", err)
+	}
+	return nil
+}
+
+func sortOverrides(overrides []DurabilityProfileOverride) {
+	sort.Slice(overrides, func(i, j int) bool {
+		return overrides[i].MinSize < overrides[j].MinSize
+	})
+}
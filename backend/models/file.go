@@ -1,8 +1,10 @@
 package models
 
 import (
-	"encoding/hex"
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"safesplit/services"
@@ -39,6 +41,7 @@ type File struct {
 	EncryptionSalt    []byte                  `json:"encryption_salt" gorm:"type:binary(32);null"`
 	EncryptionType    services.EncryptionType `json:"encryption_type" gorm:"type:varchar(20);default:'standard'"`
 	EncryptionVersion int                     `json:"encryption_version" gorm:"default:1"`
+	LayoutVersion     int                     `json:"layout_version" gorm:"not null;default:1"` // services.LayoutSingleCodeword or services.LayoutStriped
 	ServerKeyID       string                  `json:"server_key_id" gorm:"type:varchar(64)"`
 	MasterKeyVersion  int                     `json:"master_key_version" gorm:"not null;default:1"`
 	FileHash          string                  `json:"file_hash"`
@@ -47,6 +50,10 @@ type File struct {
 	DataShardCount    uint                    `json:"data_shard_count" gorm:"not null;default:4"`
 	ParityShardCount  uint                    `json:"parity_shard_count" gorm:"not null;default:2"`
 	IsSharded         bool                    `json:"is_sharded" gorm:"default:false"`
+	DurabilityProfile string                  `json:"durability_profile" gorm:"type:varchar(64)"`
+	StorageTier       string                  `json:"storage_tier" gorm:"type:varchar(10);not null;default:'hot'"` // services.TierHot or services.TierCold
+	HotDataShards     uint                    `json:"-" gorm:"not null;default:0"`                                 // shard counts on the hot tier, restored when the file
+	HotParityShards   uint                    `json:"-" gorm:"not null;default:0"`                                 // leaves the cold tier; 0 until it first moves there
 	IsShared          bool                    `json:"is_shared" gorm:"default:false"`
 	CreatedAt         time.Time               `json:"created_at"`
 	UpdatedAt         time.Time               `json:"updated_at"`
@@ -54,7 +61,7 @@ type File struct {
 type FileModel struct {
 	db                *gorm.DB
 	rsService         *services.ReedSolomonService
-	serverKeyModel    *ServerMasterKeyModel
+	keyProvider       services.KeyProvider
 	encryptionService *services.EncryptionService
 	keyFragmentModel  *KeyFragmentModel
 }
@@ -62,14 +69,14 @@ type FileModel struct {
 func NewFileModel(
 	db *gorm.DB,
 	rsService *services.ReedSolomonService,
-	serverKeyModel *ServerMasterKeyModel,
+	keyProvider services.KeyProvider,
 	encryptionService *services.EncryptionService,
 	keyFragmentModel *KeyFragmentModel,
 ) *FileModel {
 	return &FileModel{
 		db:                db,
 		rsService:         rsService,
-		serverKeyModel:    serverKeyModel,
+		keyProvider:       keyProvider,
 		encryptionService: encryptionService,
 		keyFragmentModel:  keyFragmentModel,
 	}
@@ -120,28 +127,145 @@ func (m *FileModel) CreateFileWithShards(
 	shares []services.KeyShare,
 	shards [][]byte,
 	keyFragmentModel *KeyFragmentModel,
-	serverKeyModel *ServerMasterKeyModel,
+	userMasterKey []byte,
+	keyProvider services.KeyProvider,
 ) error {
+	file.LayoutVersion = services.LayoutSingleCodeword
+	file.StorageTier = services.TierHot
+	return m.createShardedFile(file, shares, len(shards), keyFragmentModel, userMasterKey, keyProvider,
+		func(fileID uint) ([]int, *services.ShardManifest, error) {
+			return m.rsService.StoreShards(fileID, &services.FileShards{Shards: shards},
+				int(file.DataShardCount), int(file.ParityShardCount))
+		}, nil)
+}
+
+// FileContent is the encrypted content of a file created with
+// CreateFileFromStream. Open produces it. After the reader it returned is
+// closed, Complete sets the fields of the file that are only known once the
+// content was produced, such as its hash.
+type FileContent interface {
+	Open() (io.ReadCloser, error)
+	Complete(file *File) error
+}
+
+// CreateFileFromStream is CreateFileWithShards for encrypted content that is
+// erasure coded while it is produced and streamed to the storage nodes, so
+// neither the content nor its shards have to be held in memory. The shards
+// use the striped layout. They are spooled to the temporary directory on their
+// way to the nodes, which needs room for TotalShards/DataShards times the
+// largest size file.Size bytes can compress and encrypt to; the upload fails
+// with services.ErrInsufficientSpoolSpace without it.
+func (m *FileModel) CreateFileFromStream(
+	file *File,
+	shares []services.KeyShare,
+	content FileContent,
+	keyFragmentModel *KeyFragmentModel,
+	userMasterKey []byte,
+	keyProvider services.KeyProvider,
+) error {
+	file.LayoutVersion = services.LayoutStriped
+	file.StorageTier = services.TierHot
+	layout := services.StripeLayout{
+		DataShards:     int(file.DataShardCount),
+		ParityShards:   int(file.ParityShardCount),
+		StripeSize:     services.DefaultStripeSize,
+		ContentSize:    services.UnknownContentSize,
+		MaxContentSize: services.SegmentedSize(services.CompressBound(file.Size)),
+	}
+
+	var index []byte
+	return m.createShardedFile(file, shares, layout.TotalShards(), keyFragmentModel, userMasterKey, keyProvider,
+		func(fileID uint) ([]int, *services.ShardManifest, error) {
+			r, err := content.Open()
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to open file content: %w", err)
+			}
+			shardNodes, manifest, stripeIndex, err := m.rsService.StoreStriped(fileID, r, layout,
+				services.ShardPlacement{Tier: file.StorageTier})
+			if closeErr := r.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := content.Complete(file); err != nil {
+				return nil, nil, err
+			}
+			layout.ContentSize = manifest.OriginalSize
+			index = stripeIndex
+			return shardNodes, manifest, nil
+		},
+		func(tx *gorm.DB) error {
+			return SaveStripeIndex(tx, file.ID, layout, index)
+		})
+}
+
+// createShardedFile stores the shards of a file through storeShards, its key
+// fragments and their manifest on the nodes, then creates the file record,
+// the rows describing its objects (saveLayout adds the ones specific to the
+// layout, if any) and charges the user's quota in a short transaction. The
+// file ID is reserved and the upload journaled before any object is written,
+// so the objects are removed if the transaction doesn't commit, even after a
+// crash.
+func (m *FileModel) createShardedFile(
+	file *File,
+	shares []services.KeyShare,
+	shardCount int,
+	keyFragmentModel *KeyFragmentModel,
+	userMasterKey []byte,
+	keyProvider services.KeyProvider,
+	storeShards func(fileID uint) ([]int, *services.ShardManifest, error),
+	saveLayout func(tx *gorm.DB) error,
+) error {
+	// 1. Reserve the file ID and journal the upload before touching the nodes
+	if err := m.reserveFileID(file); err != nil {
+		return err
+	}
+	entry, err := m.journalUpload(file.ID, file.UserID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Keep a committed upload and roll back the objects of a failed one
+		if err := m.resolveUpload(entry); err != nil {
+			log.Printf("Error resolving upload of file %d: %v", entry.FileID, err)
+		}
+	}()
+
+	// 2. Store shards and key fragments
+	shardNodes, manifest, err := storeShards(file.ID)
+	if err != nil {
+		return fmt.Errorf("failed to store shards: %w", err)
+	}
+	fragments, err := keyFragmentModel.StoreKeyFragments(file.ID, shares, int(file.Threshold), file.UserID, userMasterKey, keyProvider)
+	if err != nil {
+		return fmt.Errorf("failed to save key fragments: %w", err)
+	}
+
+	// 3. Write the manifest describing shards and key fragments to the nodes
+	fillManifest(file, manifest, fragments)
+	if _, err := m.rsService.WriteManifest(manifest); err != nil {
+		return err
+	}
+
 	return withTransactionRetry(m.db, 3, func(tx *gorm.DB) error {
-		// 1. Update user storage first to lock the user row
+		// 4. Charge the user's storage, create the file record and record its objects
 		if err := m.UpdateUserStorage(tx, file.UserID, file.Size); err != nil {
 			return fmt.Errorf("failed to update storage usage: %w", err)
 		}
-
-		// 2. Create file record
 		if err := m.CreateFile(tx, file); err != nil {
 			return fmt.Errorf("failed to create file record: %w", err)
 		}
-
-		// 3. Store shards
-		if err := m.rsService.StoreShards(file.ID, &services.FileShards{Shards: shards}); err != nil {
-			return fmt.Errorf("failed to store shards: %w", err)
+		if err := SaveShardLocations(tx, file.ID, shardNodes, manifest.ShardChecksums); err != nil {
+			return err
 		}
-
-		// 4. Save key fragments
-		if err := keyFragmentModel.SaveKeyFragments(tx, file.ID, shares, file.UserID, serverKeyModel); err != nil {
-			m.rsService.DeleteShards(file.ID) // clean up
-			return fmt.Errorf("failed to save key fragments: %w", err)
+		if err := tx.Create(&fragments).Error; err != nil {
+			return fmt.Errorf("failed to save fragment metadata: %w", err)
+		}
+		if saveLayout != nil {
+			if err := saveLayout(tx); err != nil {
+				return err
+			}
 		}
 
 		// 5. Log activity
@@ -151,10 +275,9 @@ func (m *FileModel) CreateFileWithShards(
 			FileID:       &file.ID,
 			Status:       "success",
 			Details: fmt.Sprintf("File uploaded with %s encryption, %d shards",
-				file.EncryptionType, len(shards)),
+				file.EncryptionType, shardCount),
 		}
 		if err := tx.Create(activity).Error; err != nil {
-			m.rsService.DeleteShards(file.ID)
 			return fmt.Errorf("failed to log activity: %w", err)
 		}
 
@@ -197,51 +320,82 @@ func withTransactionRetry(db *gorm.DB, maxRetries int, fn func(tx *gorm.DB) erro
 	return err
 }
 
-// ReadFileShards retrieves and reconstructs the file content from shards
-func (m *FileModel) ReadFileShards(file *File) ([]byte, error) {
-	log.Printf("Reading file shards - ID: %d, Encryption: %s", file.ID, file.EncryptionType)
-
-	// Get key fragments for decryption
-	fragmentsWithData, err := m.keyFragmentModel.GetKeyFragments(file.ID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get key fragments: %w", err)
+// OpenContent returns a reader of the original content of a file, decrypted
+// with shares and decompressed while it is read. Files encrypted with
+// services.EncryptionSegmented are streamed from the storage nodes. Older files
+// are a single ciphertext that only authenticates as a whole, so they are
+// still decrypted in memory. The first bytes are read before OpenContent
+// returns, so unreadable shards or wrong shares are reported here rather than
+// halfway through a response.
+func (m *FileModel) OpenContent(file *File, shares []services.KeyShare, compression *services.CompressionService) (io.ReadCloser, error) {
+	if file.EncryptionVersion != services.EncryptionSegmented {
+		data, err := m.readSingleAEADContent(file, shares, compression)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
 	}
 
-	// Convert FragmentData to KeyShare
-	keyShares := make([]services.KeyShare, len(fragmentsWithData))
-	for i, fragment := range fragmentsWithData {
-		keyShares[i] = services.KeyShare{
-			Index:      fragment.FragmentIndex,
-			Value:      hex.EncodeToString(fragment.Data),
-			HolderType: string(fragment.HolderType),
-			NodeIndex:  fragment.NodeIndex,
+	pr, pw := io.Pipe()
+	go func() {
+		var err error
+		if file.IsSharded {
+			_, err = m.ReconstructFileTo(file, pw)
+		} else {
+			var f *os.File
+			if f, err = os.Open(file.FilePath); err == nil {
+				_, err = io.Copy(pw, f)
+				f.Close()
+			}
 		}
-	}
+		pw.CloseWithError(err)
+	}()
 
-	// Retrieve all available shards
-	fileShards, err := m.rsService.RetrieveShards(file.ID, int(file.DataShardCount+file.ParityShardCount))
+	// Closing the pipe stops the reconstruction when the reader is abandoned
+	content := &contentReader{closers: []io.Closer{pr}}
+	plain, err := m.encryptionService.DecryptStream(pr, file.EncryptionIV, shares, int(file.Threshold), file.EncryptionType)
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve shards: %w", err)
+		content.Close()
+		return nil, fmt.Errorf("failed to decrypt file: %w", err)
+	}
+	content.r = plain
+	if file.IsCompressed {
+		decompressed, err := compression.NewReader(plain)
+		if err != nil {
+			content.Close()
+			return nil, fmt.Errorf("failed to decompress file: %w", err)
+		}
+		content.r = decompressed
+		content.closers = append([]io.Closer{decompressed}, content.closers...)
 	}
 
-	// Validate we have enough shards for reconstruction
-	if !m.rsService.ValidateShards(fileShards.Shards, int(file.DataShardCount)) {
-		return nil, fmt.Errorf("insufficient shards available for reconstruction")
+	buffered := bufio.NewReader(content.r)
+	if _, err := buffered.Peek(1); err != nil && err != io.EOF {
+		content.Close()
+		return nil, fmt.Errorf("failed to read file %d: %w", file.ID, err)
 	}
+	content.r = buffered
+	return content, nil
+}
 
-	// Reconstruct the original data
-	reconstructed, err := m.rsService.ReconstructFile(fileShards.Shards, int(file.DataShardCount), int(file.ParityShardCount))
+// readSingleAEADContent decrypts and decompresses a file encrypted with
+// services.EncryptionSingleAEAD
+func (m *FileModel) readSingleAEADContent(file *File, shares []services.KeyShare, compression *services.CompressionService) ([]byte, error) {
+	var encrypted []byte
+	var err error
+	if file.IsSharded {
+		encrypted, err = m.ReadShardedData(file)
+	} else {
+		encrypted, err = m.ReadFileContent(file.FilePath)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to reconstruct file: %w", err)
+		return nil, err
 	}
 
-	log.Printf("File reconstructed - Size: %d bytes", len(reconstructed))
-
-	// Use the unified DecryptFileWithType method
-	decrypted, err := m.encryptionService.DecryptFileWithType(
-		reconstructed,
+	data, err := m.encryptionService.DecryptFileWithType(
+		encrypted,
 		file.EncryptionIV,
-		keyShares,
+		shares,
 		int(file.Threshold),
 		file.EncryptionSalt,
 		file.EncryptionType,
@@ -250,9 +404,51 @@ func (m *FileModel) ReadFileShards(file *File) ([]byte, error) {
 		return nil, fmt.Errorf("failed to decrypt file: %w", err)
 	}
 
-	log.Printf("File decrypted successfully - Final size: %d bytes", len(decrypted))
-	return decrypted, nil
+	if file.IsCompressed {
+		if data, err = compression.Decompress(data); err != nil {
+			return nil, fmt.Errorf("failed to decompress file: %w", err)
+		}
+	}
+	return data, nil
+}
+
+// contentReader is the reader returned by OpenContent
+type contentReader struct {
+	r       io.Reader
+	closers []io.Closer
 }
+
+func (c *contentReader) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *contentReader) Close() error {
+	for _, closer := range c.closers {
+		closer.Close()
+	}
+	return nil
+}
+
+// RefreshManifest rewrites the manifest of a sharded file after its key
+// fragments moved. The scrubber catches up on failures.
+func (m *FileModel) RefreshManifest(file *File) {
+	if !file.IsSharded {
+		return
+	}
+	shardNodes, _, err := LoadShardPlacement(m.db, file)
+	if err == nil {
+		var manifest *services.ShardManifest
+		if manifest, err = m.rsService.ReadManifest(file.ID, shardNodes); err == nil {
+			if err = FillManifest(m.db, file, manifest); err == nil {
+				_, err = m.rsService.WriteManifest(manifest)
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: key fragments of file %d moved but its manifest was not updated: %v", file.ID, err)
+	}
+}
+
 func (m *FileModel) GetFileEncryptionInfo(fileID uint) (*struct {
 	Type      services.EncryptionType `json:"type"`
 	Version   int                     `json:"version"`
@@ -418,6 +614,8 @@ func (m *FileModel) DeleteFile(fileID, userID uint, ipAddress string) error {
 	log.Printf("Successfully completed file deletion - ID: %d", fileID)
 	return nil
 }
+// ArchiveFile hides a file from downloads; the tier migrator then moves its
+// shards to the cold tier
 func (m *FileModel) ArchiveFile(fileID, userID uint, ipAddress string) error {
 	tx := m.db.Begin()
 
@@ -456,6 +654,8 @@ func (m *FileModel) ArchiveFile(fileID, userID uint, ipAddress string) error {
 
 	return nil
 }
+// UnarchiveFile makes a file downloadable again; the tier migrator moves its
+// shards back to the hot tier
 func (m *FileModel) UnarchiveFile(fileID, userID uint, ipAddress string) error {
 	tx := m.db.Begin()
 
@@ -633,7 +833,7 @@ func (m *FileModel) RecoverFile(fileID, userID uint) error {
 
 	if file.IsSharded {
 		log.Printf("Verifying shards for file %d", file.ID)
-		fileShards, err := m.rsService.RetrieveShards(file.ID, int(file.DataShardCount+file.ParityShardCount))
+		fileShards, err := m.RetrieveFileShards(&file)
 		if err != nil {
 			tx.Rollback()
 			log.Printf("Failed to retrieve shards: %v", err)
@@ -787,6 +987,20 @@ func (m *FileModel) PermanentlyDeleteFile(fileID, userID uint, ipAddress string)
         return fmt.Errorf("failed to delete key fragments: %w", err)
     }
 
+    // Delete shard placement records
+    if err := tx.Where("file_id = ?", fileID).Delete(&ShardLocation{}).Error; err != nil {
+        tx.Rollback()
+        log.Printf("Failed to delete shard locations - File ID: %d, Error: %v", fileID, err)
+        return fmt.Errorf("failed to delete shard locations: %w", err)
+    }
+
+    // Delete the stripe index of striped files
+    if err := tx.Where("file_id = ?", fileID).Delete(&StripeIndex{}).Error; err != nil {
+        tx.Rollback()
+        log.Printf("Failed to delete stripe index - File ID: %d, Error: %v", fileID, err)
+        return fmt.Errorf("failed to delete stripe index: %w", err)
+    }
+
     // Delete related activity logs
     if err := tx.Where("file_id = ?", fileID).Delete(&ActivityLog{}).Error; err != nil {
         tx.Rollback()
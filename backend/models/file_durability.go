@@ -0,0 +1,108 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type DurabilityStatus string
+
+const (
+	DurabilityHealthy       DurabilityStatus = "healthy"       // every shard and fragment intact
+	DurabilityRepaired      DurabilityStatus = "repaired"      // damaged shards were rebuilt
+	DurabilityDegraded      DurabilityStatus = "degraded"      // readable, but something could not be fixed
+	DurabilityUnrecoverable DurabilityStatus = "unrecoverable" // too few shards or fragments left
+)
+
+// FileDurability is the outcome of the most recent scrub of a file
+type FileDurability struct {
+	FileID           uint             `json:"file_id" gorm:"primaryKey;autoIncrement:false"`
+	Status           DurabilityStatus `json:"status" gorm:"type:enum('healthy','repaired','degraded','unrecoverable');not null"`
+	MissingShards    int              `json:"missing_shards"`
+	CorruptShards    int              `json:"corrupt_shards"`
+	RepairedShards   int              `json:"repaired_shards"`
+	MissingFragments int              `json:"missing_fragments"`
+	CorruptFragments int              `json:"corrupt_fragments"`
+	Details          string           `json:"details" gorm:"type:text"`
+	LastScrubbedAt   time.Time        `json:"last_scrubbed_at"`
+}
+
+func (FileDurability) TableName() string {
+	return "file_durability"
+}
+
+// FileDurabilityDetails adds the file owner and name to a durability record
+type FileDurabilityDetails struct {
+	FileDurability
+	UserID       uint   `json:"user_id"`
+	OriginalName string `json:"original_name"`
+	IsDeleted    bool   `json:"is_deleted"`
+}
+
+type FileDurabilityModel struct {
+	db *gorm.DB
+}
+
+func NewFileDurabilityModel(db *gorm.DB) *FileDurabilityModel {
+	return &FileDurabilityModel{db: db}
+}
+
+// SaveDurability inserts or replaces the durability record of a file
+func SaveDurability(db *gorm.DB, record *FileDurability) error {
+	if err := db.Clauses(clause.OnConflict{UpdateAll: true}).Create(record).Error; err != nil {
+		return fmt.Errorf("failed to save durability of file %d: %w", record.FileID, err)
+	}
+	return nil
+}
+
+// GetStatusCounts returns how many files are in each durability status
+func (m *FileDurabilityModel) GetStatusCounts() (map[DurabilityStatus]int64, error) {
+	var rows []struct {
+		Status DurabilityStatus
+		Count  int64
+	}
+	if err := m.db.Model(&FileDurability{}).
+		Select("status, COUNT(*) as count").
+		Group("status").
+		Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to count durability statuses: %w", err)
+	}
+
+	counts := map[DurabilityStatus]int64{
+		DurabilityHealthy:       0,
+		DurabilityRepaired:      0,
+		DurabilityDegraded:      0,
+		DurabilityUnrecoverable: 0,
+	}
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+// ListProblemFiles returns degraded and unrecoverable files, worst first
+func (m *FileDurabilityModel) ListProblemFiles(page, pageSize int) ([]FileDurabilityDetails, int64, error) {
+	query := m.db.Table("file_durability").
+		Joins("JOIN files ON files.id = file_durability.file_id").
+		Where("file_durability.status IN ?", []DurabilityStatus{DurabilityDegraded, DurabilityUnrecoverable})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count problem files: %w", err)
+	}
+
+	var records []FileDurabilityDetails
+	if err := query.
+		Select("file_durability.*, files.user_id, files.original_name, files.is_deleted").
+		Order("file_durability.status = 'unrecoverable' DESC, file_durability.last_scrubbed_at DESC").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Scan(&records).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to list problem files: %w", err)
+	}
+
+	return records, total, nil
+}
@@ -4,6 +4,8 @@ import (
    "crypto/rand"
    "encoding/base64"
    "fmt"
+   "log"
+   "safesplit/services"
    "time"
    "golang.org/x/crypto/bcrypt"
    "gorm.io/gorm"
@@ -24,6 +26,7 @@ type FileShare struct {
    PasswordHash         string     `json:"-"`
    PasswordSalt         string     `json:"-"`
    EncryptedKeyFragment []byte     `json:"-" gorm:"type:mediumblob"`
+   KDFParams            string     `json:"-" gorm:"column:kdf_params;type:varchar(64)"` // empty for PBKDF2 with 4096 iterations
    FragmentIndex        int        `json:"-" gorm:"not null"`
    ExpiresAt            *time.Time `json:"expires_at"`
    MaxDownloads         *int       `json:"max_downloads"`
@@ -185,4 +188,43 @@ func (m *FileShareModel) GetShareByLink(shareLink string) (*FileShare, error) {
         return nil, fmt.Errorf("share not found or inactive")
     }
     return &share, nil
-}
\ No newline at end of file
+}
+
+// OpenKeyFragment decrypts the key fragment of a share with its password. A
+// fragment encrypted with older KDF parameters is re-encrypted with the
+// current ones, so each share is upgraded the first time it is accessed.
+func (m *FileShareModel) OpenKeyFragment(share *FileShare, password string, encryptionService *services.EncryptionService) ([]byte, error) {
+	params, err := services.ParseKDFParams(share.KDFParams, services.LegacyShareIterations)
+	if err != nil {
+		return nil, err
+	}
+	fragment, err := encryptionService.DecryptKeyFragment(share.EncryptedKeyFragment, []byte(password), params)
+	if err != nil {
+		return nil, err
+	}
+	if !params.NeedsUpgrade() {
+		return fragment, nil
+	}
+
+	current := services.DefaultKDFParams()
+	encrypted, err := encryptionService.EncryptKeyFragment(fragment, []byte(password), current)
+	if err != nil {
+		log.Printf("Warning: failed to upgrade key fragment of share %d: %v", share.ID, err)
+		return fragment, nil
+	}
+	// Leave the share alone if a concurrent access upgraded it first
+	result := m.db.Model(&FileShare{}).
+		Where("id = ? AND encrypted_key_fragment = ?", share.ID, share.EncryptedKeyFragment).
+		Updates(map[string]interface{}{
+			"encrypted_key_fragment": encrypted,
+			"kdf_params":             current.String(),
+		})
+	if result.Error != nil {
+		log.Printf("Warning: failed to upgrade key fragment of share %d: %v", share.ID, result.Error)
+	} else if result.RowsAffected > 0 {
+		share.EncryptedKeyFragment = encrypted
+		share.KDFParams = current.String()
+		log.Printf("Upgraded key fragment of share %d to %s", share.ID, share.KDFParams)
+	}
+	return fragment, nil
+}
@@ -28,6 +28,7 @@ type KeyFragment struct {
 	HolderType       HolderType `gorm:"type:enum('user','server');not null"`
 	MasterKeyVersion *int
 	ServerKeyID      *string
+	Checksum         string     `gorm:"type:char(64)"` // SHA-256 of the stored fragment, empty for legacy fragments
 }
 
 // FragmentData represents a fragment with its data loaded from node storage
@@ -72,7 +73,8 @@ func (m *KeyFragmentModel) GetKeyFragments(fileID uint) ([]FragmentData, error)
 			)
 			continue
 		}
-		if len(data) != 48 {
+		// Server fragments wrapped by an external key provider have their own format
+		if fragment.HolderType == UserHolder && len(data) != 48 {
 			log.Printf("Invalid fragment length for file %d, index %d: got %d bytes, expected 48",
 				fileID, fragment.FragmentIndex, len(data))
 			continue
@@ -91,52 +93,35 @@ func (m *KeyFragmentModel) GetKeyFragments(fileID uint) ([]FragmentData, error)
 	return fragmentsWithData, nil
 }
 
-func (m *KeyFragmentModel) SaveKeyFragments(tx *gorm.DB, fileID uint, shares []services.KeyShare, userID uint, serverKeyModel *ServerMasterKeyModel) error {
-    // Get server key for server fragments
-    serverKey, err := serverKeyModel.GetActive()
-    if err != nil {
-        return fmt.Errorf("failed to get server key: %w", err)
-    }
-
-    decryptedServerKey, err := serverKeyModel.GetServerKey(serverKey.KeyID)
-    if err != nil {
-        return fmt.Errorf("failed to get decrypted server key: %w", err)
-    }
-
-    // Get user for user fragments
+// StoreKeyFragments encrypts the key shares of a file and stores them on the
+// nodes so that no zone holds threshold of them. Server fragments are wrapped
+// by keyProvider, user fragments by the user's master key as unlocked for
+// their session. It returns the rows describing them, for the caller to save
+// along with the file.
+func (m *KeyFragmentModel) StoreKeyFragments(fileID uint, shares []services.KeyShare, threshold int, userID uint, userMasterKey []byte, keyProvider services.KeyProvider) ([]KeyFragment, error) {
+    // Get user for the master key version of user fragments
     var user User
-    if err := tx.First(&user, userID).Error; err != nil {
-        return fmt.Errorf("failed to get user: %w", err)
+    if err := m.db.First(&user, userID).Error; err != nil {
+        return nil, fmt.Errorf("failed to get user: %w", err)
     }
-
-    // Derive KEK using hashed password (consistent with BeforeCreate)
-    kek, err := services.DeriveKeyEncryptionKey(user.Password, user.MasterKeySalt)
-    if err != nil {
-        return fmt.Errorf("failed to derive key encryption key: %w", err)
-    }
-
-    // Decrypt the master key using derived KEK
-    decryptedMasterKey, err := services.DecryptMasterKey(
-        user.EncryptedMasterKey,
-        kek,
-        user.MasterKeyNonce,
-    )
-    if err != nil {
-        return fmt.Errorf("failed to decrypt master key: %w", err)
+    if len(userMasterKey) != services.MasterKeySize {
+        return nil, services.ErrSessionLocked
     }
 
-    // Use first 32 bytes of decrypted master key for fragment encryption
-    userMasterKey := decryptedMasterKey[:32]
-
-    log.Printf("SaveKeyFragments - Number of shares to save: %d", len(shares))
+    log.Printf("StoreKeyFragments - Number of shares to store: %d", len(shares))
     for i, share := range shares {
-        log.Printf("Share %d: Index=%d, Value=%s, Length=%d bytes",
-            i, share.Index, share.Value, len(share.Value))
+        log.Printf("Share %d: Index=%d, Length=%d bytes",
+            i, share.Index, len(share.Value))
     }
 
     serverFragmentCount := (len(shares) + 1) / 2
     fragments := make([]KeyFragment, len(shares))
 
+    fragmentNodes, err := m.storage.PlaceFragments(fileID, len(shares), threshold)
+    if err != nil {
+        return nil, fmt.Errorf("failed to place key fragments: %w", err)
+    }
+
     log.Printf("Server will store %d fragments", serverFragmentCount)
 
     for i, share := range shares {
@@ -148,26 +133,26 @@ func (m *KeyFragmentModel) SaveKeyFragments(tx *gorm.DB, fileID uint, shares []s
 
         nonce, err := utils.GenerateNonce()
         if err != nil {
-            return fmt.Errorf("failed to generate nonce for fragment %d: %w", i, err)
+            return nil, fmt.Errorf("failed to generate nonce for fragment %d: %w", i, err)
         }
 
         shareBytes, err := hex.DecodeString(share.Value)
         if err != nil {
-            return fmt.Errorf("failed to decode share value: %w", err)
+            return nil, fmt.Errorf("failed to decode share value: %w", err)
         }
 
-        log.Printf("Fragment %d: Type=%s, Share bytes before encryption=%x (length=%d)",
-            i, holderType, shareBytes, len(shareBytes))
+        log.Printf("Fragment %d: Index=%d, Type=%s, Length=%d bytes",
+            i, share.Index, holderType, len(shareBytes))
 
         var encryptedFragment []byte
         var masterKeyVersion *int
         var serverKeyID *string
 
         if isServerFragment {
-            log.Printf("Using server key (length: %d) to encrypt fragment %d",
-                len(decryptedServerKey), i)
-            encryptedFragment, err = services.EncryptMasterKey(shareBytes, decryptedServerKey, nonce)
-            serverKeyID = &serverKey.KeyID
+            log.Printf("Wrapping fragment %d with the server key provider", i)
+            var keyID string
+            encryptedFragment, keyID, err = keyProvider.Wrap(shareBytes, nonce)
+            serverKeyID = &keyID
         } else {
             log.Printf("Using decrypted user master key to encrypt fragment %d",
                 i)
@@ -177,17 +162,15 @@ func (m *KeyFragmentModel) SaveKeyFragments(tx *gorm.DB, fileID uint, shares []s
         }
 
         if err != nil {
-            return fmt.Errorf("failed to encrypt fragment %d: %w", i, err)
+            return nil, fmt.Errorf("failed to encrypt fragment %d: %w", i, err)
         }
 
-        log.Printf("Fragment %d encrypted result: %x", i, encryptedFragment)
-
         // Store fragment in node
-        nodeIndex := i % m.storage.NodeCount()
+        nodeIndex := fragmentNodes[i]
         fragmentPath := fmt.Sprintf("file_%d/fragment_%d", fileID, share.Index)
 
         if err := m.storage.StoreFragment(nodeIndex, fragmentPath, encryptedFragment); err != nil {
-            return fmt.Errorf("failed to store fragment in node: %w", err)
+            return nil, fmt.Errorf("failed to store fragment in node: %w", err)
         }
 
         // Create database record
@@ -200,18 +183,14 @@ func (m *KeyFragmentModel) SaveKeyFragments(tx *gorm.DB, fileID uint, shares []s
             HolderType:       holderType,
             MasterKeyVersion: masterKeyVersion,
             ServerKeyID:      serverKeyID,
+            Checksum:         services.ShardChecksum(encryptedFragment),
         }
 
         log.Printf("Created fragment %d - Index: %d, Type: %s, Node: %d",
             i, share.Index, holderType, nodeIndex)
     }
 
-    // Save metadata to database
-    if err := tx.Create(&fragments).Error; err != nil {
-        return fmt.Errorf("failed to save fragment metadata: %w", err)
-    }
-
-    return nil
+    return fragments, nil
 }
 
 func (m *KeyFragmentModel) GetFragmentsByType(fileID uint, holderType HolderType) ([]FragmentData, error) {
@@ -270,3 +249,11 @@ func (m *KeyFragmentModel) DeleteFragments(fileID uint) error {
 
 	return nil
 }
+
+// UnwrapServerFragment decrypts a server fragment with the key it was wrapped under
+func UnwrapServerFragment(keyProvider services.KeyProvider, fragment *KeyFragment, data []byte) ([]byte, error) {
+	if fragment.ServerKeyID == nil {
+		return nil, fmt.Errorf("server fragment %d of file %d has no server key ID", fragment.FragmentIndex, fragment.FileID)
+	}
+	return keyProvider.Unwrap(*fragment.ServerKeyID, data, fragment.EncryptionNonce)
+}
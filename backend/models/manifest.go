@@ -0,0 +1,58 @@
+package models
+
+import (
+	"cmp"
+	"fmt"
+	"safesplit/services"
+	"slices"
+
+	"gorm.io/gorm"
+)
+
+// FillManifest copies the encryption settings and key fragment locations of a
+// file into its shard manifest, so the file can be decrypted from the storage
+// nodes alone. The key fragments must already be saved.
+func FillManifest(db *gorm.DB, file *File, manifest *services.ShardManifest) error {
+	var fragments []KeyFragment
+	if err := db.Where("file_id = ?", file.ID).
+		Order("fragment_index asc").
+		Find(&fragments).Error; err != nil {
+		return fmt.Errorf("failed to load key fragments: %w", err)
+	}
+	fillManifest(file, manifest, fragments)
+	return nil
+}
+
+// fillManifest is FillManifest for key fragments that aren't saved yet. They
+// are listed by index, as FillManifest lists them.
+func fillManifest(file *File, manifest *services.ShardManifest, fragments []KeyFragment) {
+	fragments = slices.Clone(fragments)
+	slices.SortFunc(fragments, func(a, b KeyFragment) int {
+		return cmp.Compare(a.FragmentIndex, b.FragmentIndex)
+	})
+
+	manifest.EncryptionType = string(file.EncryptionType)
+	manifest.EncryptionIV = file.EncryptionIV
+	manifest.EncryptionVersion = file.EncryptionVersion
+	manifest.OwnerID = file.UserID
+	manifest.Threshold = int(file.Threshold)
+	manifest.Compressed = file.IsCompressed
+
+	manifest.KeyFragments = make([]services.ManifestFragment, len(fragments))
+	for i, fragment := range fragments {
+		entry := services.ManifestFragment{
+			Index:      fragment.FragmentIndex,
+			HolderType: string(fragment.HolderType),
+			NodeIndex:  fragment.NodeIndex,
+			Path:       fragment.FragmentPath,
+			Nonce:      fragment.EncryptionNonce,
+		}
+		if fragment.ServerKeyID != nil {
+			entry.ServerKeyID = *fragment.ServerKeyID
+		}
+		if fragment.MasterKeyVersion != nil {
+			entry.MasterKeyVersion = *fragment.MasterKeyVersion
+		}
+		manifest.KeyFragments[i] = entry
+	}
+}
@@ -0,0 +1,315 @@
+package models
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"safesplit/services"
+	"safesplit/utils"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// ErrRecoveryKitFileNotFound is returned when no file of the user matches an
+// entry of a fragments kit
+var ErrRecoveryKitFileNotFound = errors.New("no matching file")
+
+// ExportUserShares decrypts the user-held key shares of a file for a recovery kit
+func (m *KeyFragmentModel) ExportUserShares(file *File, userMasterKey []byte) (services.RecoveryKitFile, error) {
+	entry := services.RecoveryKitFile{
+		FileID:       file.ID,
+		FileHash:     file.FileHash,
+		OriginalName: file.OriginalName,
+		Threshold:    file.Threshold,
+		ShareCount:   file.ShareCount,
+	}
+
+	fragments, err := m.GetUserFragmentsForFile(file.ID)
+	if err != nil {
+		return entry, err
+	}
+	for _, fragment := range fragments {
+		if len(fragment.Data) != 48 {
+			log.Printf("Warning: leaving damaged fragment %d of file %d out of recovery kit", fragment.FragmentIndex, file.ID)
+			continue
+		}
+		share, err := services.DecryptMasterKey(fragment.Data, userMasterKey, fragment.EncryptionNonce)
+		if err != nil {
+			log.Printf("Warning: leaving unreadable fragment %d of file %d out of recovery kit: %v",
+				fragment.FragmentIndex, file.ID, err)
+			continue
+		}
+		entry.Shares = append(entry.Shares, services.RecoveryKitShare{
+			Index: fragment.FragmentIndex,
+			Value: hex.EncodeToString(share),
+		})
+	}
+	if len(entry.Shares) == 0 {
+		return entry, fmt.Errorf("no readable user fragments for file %d", file.ID)
+	}
+	return entry, nil
+}
+
+// ImportUserShares restores the user-held fragments of a file from a recovery
+// kit entry, encrypting the shares under the user's current master key. The
+// file is matched by hash among the user's files, preferring the one with the
+// entry's ID, so kits work on another instance too. Only fragments that are
+// missing, damaged or no longer open are rewritten; it returns the file and
+// how many were.
+func (m *KeyFragmentModel) ImportUserShares(userID uint, userMasterKey []byte, entry services.RecoveryKitFile) (*File, int, error) {
+	if entry.FileHash == "" {
+		return nil, 0, ErrRecoveryKitFileNotFound
+	}
+	var file File
+	if err := m.db.Where("user_id = ? AND file_hash = ? AND is_deleted = ?", userID, entry.FileHash, false).
+		Order(gorm.Expr("id = ? DESC", entry.FileID)).Order("id asc").
+		First(&file).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, 0, ErrRecoveryKitFileNotFound
+		}
+		return nil, 0, fmt.Errorf("failed to find file: %w", err)
+	}
+
+	var user User
+	if err := m.db.First(&user, userID).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to get user: %w", err)
+	}
+	var fragments []KeyFragment
+	if err := m.db.Where("file_id = ? AND holder_type = ?", file.ID, UserHolder).Find(&fragments).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to retrieve fragments: %w", err)
+	}
+	byIndex := make(map[int]*KeyFragment, len(fragments))
+	for i := range fragments {
+		byIndex[fragments[i].FragmentIndex] = &fragments[i]
+	}
+
+	var replaced []*KeyFragment
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		for _, kitShare := range entry.Shares {
+			share, err := hex.DecodeString(kitShare.Value)
+			if err != nil || len(share) != services.MasterKeySize {
+				return fmt.Errorf("invalid share %d in recovery kit", kitShare.Index)
+			}
+			fragment, ok := byIndex[kitShare.Index]
+			if !ok {
+				// Held by the server on this instance
+				continue
+			}
+			if data, err := m.storage.RetrieveFragment(fragment.NodeIndex, fragment.FragmentPath); err == nil && len(data) == 48 {
+				if current, err := services.DecryptMasterKey(data, userMasterKey, fragment.EncryptionNonce); err == nil {
+					if !bytes.Equal(current, share) {
+						// Most likely the same content uploaded again under another file key
+						log.Printf("Warning: not overwriting readable fragment %d of file %d with a different share from a recovery kit",
+							fragment.FragmentIndex, file.ID)
+					}
+					continue
+				}
+			}
+
+			old, err := m.ReplaceUserFragment(tx, fragment, share, userMasterKey, user.MasterKeyVersion)
+			if err != nil {
+				return err
+			}
+			replaced = append(replaced, old)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	m.deleteReplaced(replaced)
+	return &file, len(replaced), nil
+}
+
+// ReplaceUserFragment encrypts share under the user's master key into a new
+// fragment next to the stored one and points the row at it within tx. The
+// superseded fragment is returned to be deleted once tx commits; if it never
+// does, the new fragment is left as an orphan for fsck.
+func (m *KeyFragmentModel) ReplaceUserFragment(tx *gorm.DB, fragment *KeyFragment, share, userMasterKey []byte, masterKeyVersion int) (*KeyFragment, error) {
+	nonce, err := utils.GenerateNonce()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce for fragment %d: %w", fragment.FragmentIndex, err)
+	}
+	encrypted, err := services.EncryptMasterKey(share, userMasterKey, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt fragment %d: %w", fragment.FragmentIndex, err)
+	}
+
+	path := fmt.Sprintf("file_%d/fragment_%d_%x", fragment.FileID, fragment.FragmentIndex, nonce[:4])
+	if err := m.storage.StoreFragment(fragment.NodeIndex, path, encrypted); err != nil {
+		return nil, fmt.Errorf("failed to store fragment %d: %w", fragment.FragmentIndex, err)
+	}
+
+	result := tx.Model(&KeyFragment{}).
+		Where("id = ? AND fragment_path = ?", fragment.ID, fragment.FragmentPath).
+		Updates(map[string]interface{}{
+			"fragment_path":      path,
+			"encryption_nonce":   nonce,
+			"master_key_version": masterKeyVersion,
+			"checksum":           services.ShardChecksum(encrypted),
+		})
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to update fragment %d: %w", fragment.FragmentIndex, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, fmt.Errorf("fragment %d of file %d changed in the meantime", fragment.FragmentIndex, fragment.FileID)
+	}
+
+	old := *fragment
+	return &old, nil
+}
+
+func (m *KeyFragmentModel) deleteReplaced(fragments []*KeyFragment) {
+	for _, fragment := range fragments {
+		if err := m.storage.DeleteFragment(fragment.NodeIndex, fragment.FragmentPath); err != nil {
+			log.Printf("Warning: failed to delete fragment %s from node %d: %v", fragment.FragmentPath, fragment.NodeIndex, err)
+		}
+	}
+}
+
+// RestoreMasterKey makes the master key of a recovery kit the user's master
+// key again, wrapped under their password. User fragments that only the
+// current master key opens, e.g. of files uploaded since the key was lost,
+// are moved under the restored key. It returns how many were moved.
+func (m *UserModel) RestoreMasterKey(userID uint, password string, restoredKey []byte,
+	keyFragmentModel *KeyFragmentModel, fileModel *FileModel) (int, error) {
+	if len(restoredKey) != services.MasterKeySize {
+		return 0, errors.New("invalid master key length")
+	}
+
+	var user User
+	if err := m.db.First(&user, userID).Error; err != nil {
+		return 0, fmt.Errorf("user not found: %w", err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return 0, fmt.Errorf("current password is incorrect")
+	}
+
+	// The current key may be the one that was lost
+	currentKey, err := user.unwrapMasterKey(password)
+	if err != nil {
+		log.Printf("Restoring master key of user %d whose current master key does not unwrap: %v", userID, err)
+		currentKey = nil
+	}
+	if bytes.Equal(currentKey, restoredKey) {
+		return 0, nil
+	}
+
+	files, err := fileModel.ListAllUserFiles(userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get user files: %w", err)
+	}
+
+	newVersion := user.MasterKeyVersion + 1
+	var replaced []*KeyFragment
+	var changedFiles []*File
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		for i, file := range files {
+			fragments, err := keyFragmentModel.GetUserFragmentsForFile(file.ID)
+			if err != nil {
+				return fmt.Errorf("failed to get key fragments for file %d: %w", file.ID, err)
+			}
+
+			changed := false
+			for _, fragment := range fragments {
+				if len(fragment.Data) != 48 {
+					continue
+				}
+				if _, err := services.DecryptMasterKey(fragment.Data, restoredKey, fragment.EncryptionNonce); err == nil {
+					continue
+				}
+				if currentKey == nil {
+					continue
+				}
+				share, err := services.DecryptMasterKey(fragment.Data, currentKey, fragment.EncryptionNonce)
+				if err != nil {
+					log.Printf("Warning: fragment %d of file %d opens with neither master key",
+						fragment.FragmentIndex, file.ID)
+					continue
+				}
+				old, err := keyFragmentModel.ReplaceUserFragment(tx, &fragment.KeyFragment, share, restoredKey, newVersion)
+				if err != nil {
+					return err
+				}
+				replaced = append(replaced, old)
+				changed = true
+			}
+			if changed {
+				changedFiles = append(changedFiles, &files[i])
+			}
+		}
+
+		encryptedKey, nonce, kdfParams, err := user.wrapMasterKey(restoredKey, password)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		result := tx.Model(&User{}).
+			Where("id = ? AND master_key_nonce = ?", user.ID, user.MasterKeyNonce).
+			Updates(map[string]interface{}{
+				"encrypted_master_key":    encryptedKey,
+				"master_key_nonce":        nonce,
+				"master_key_wrap_version": MasterKeyWrapPassword,
+				"kdf_params":              kdfParams,
+				"master_key_version":      newVersion,
+				"key_last_rotated":        now,
+			})
+		if result.Error != nil {
+			return fmt.Errorf("failed to update master key: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("master key changed in the meantime")
+		}
+
+		// Keep the recovery key pair, which is encrypted under the master key,
+		// and drop the social recovery shares of the replaced key
+		if err := rewrapRecoveryKey(tx, &user, currentKey, restoredKey); err != nil {
+			return err
+		}
+		return deleteSocialRecovery(tx, user.ID)
+	})
+	if err != nil {
+		return 0, err
+	}
+	keyFragmentModel.deleteReplaced(replaced)
+	for _, file := range changedFiles {
+		fileModel.RefreshManifest(file)
+	}
+
+	log.Printf("Restored master key of user %d from a recovery kit, %d fragments moved under it", userID, len(replaced))
+	return len(replaced), nil
+}
+
+// rewrapRecoveryKey moves the recovery private key of a user under a restored
+// master key, or replaces the key pair if neither master key opens it
+func rewrapRecoveryKey(tx *gorm.DB, user *User, currentKey, restoredKey []byte) error {
+	if _, err := user.OpenRecoveryKey(restoredKey); err == nil {
+		return nil
+	}
+	updated := *user
+	if privateKey, err := user.OpenRecoveryKey(currentKey); err == nil {
+		nonce, err := utils.GenerateNonce()
+		if err != nil {
+			return fmt.Errorf("failed to generate nonce: %w", err)
+		}
+		if updated.EncryptedRecoveryKey, err = services.EncryptMasterKey(privateKey, restoredKey, nonce); err != nil {
+			return fmt.Errorf("failed to encrypt recovery key: %w", err)
+		}
+		updated.RecoveryKeyNonce = nonce
+	} else if err := updated.setRecoveryKeyPair(restoredKey); err != nil {
+		return err
+	}
+
+	if err := tx.Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+		"recovery_public_key":    updated.RecoveryPublicKey,
+		"encrypted_recovery_key": updated.EncryptedRecoveryKey,
+		"recovery_key_nonce":     updated.RecoveryKeyNonce,
+	}).Error; err != nil {
+		return fmt.Errorf("failed to update recovery key: %w", err)
+	}
+	return nil
+}
@@ -3,18 +3,27 @@ package models
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"safesplit/utils"
+	"log"
+	"safesplit/services"
 	"time"
 
 	"gorm.io/gorm"
 )
 
+// Server key wrap versions
+const (
+	KeyUnwrapped = 0 // raw key, as stored before key wrapping; wrapped on the next unseal
+	KeyWrappedV1 = 1 // AES-256-GCM under the key-encryption key, bound to the key ID
+)
+
 type ServerMasterKey struct {
 	ID           uint       `json:"id" gorm:"primaryKey"`
 	KeyID        string     `json:"key_id" gorm:"type:varchar(64);unique;not null"`
-	EncryptedKey []byte     `json:"-" gorm:"type:binary(32);not null"`
+	EncryptedKey []byte     `json:"-" gorm:"type:varbinary(64);not null"`
 	KeyNonce     []byte     `json:"-" gorm:"type:binary(16);not null"`
+	WrapVersion  int        `json:"wrap_version" gorm:"not null;default:0"`
 	IsActive     bool       `json:"is_active" gorm:"default:true"`
 	CreatedAt    time.Time  `json:"created_at" gorm:"autoCreateTime"`
 	ActivatedAt  *time.Time `json:"activated_at"`
@@ -22,11 +31,12 @@ type ServerMasterKey struct {
 }
 
 type ServerMasterKeyModel struct {
-	db *gorm.DB
+	db   *gorm.DB
+	seal *services.SealService
 }
 
-func NewServerMasterKeyModel(db *gorm.DB) *ServerMasterKeyModel {
-	return &ServerMasterKeyModel{db: db}
+func NewServerMasterKeyModel(db *gorm.DB, seal *services.SealService) *ServerMasterKeyModel {
+	return &ServerMasterKeyModel{db: db, seal: seal}
 }
 
 func generateKeyID() (string, error) {
@@ -37,7 +47,83 @@ func generateKeyID() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-// Initialize generates and stores the first server master key if none exists
+// Unseal checks kek against the stored server keys and, if it unwraps them,
+// makes the keys usable. Keys stored before wrapping was introduced are
+// wrapped under kek, and the first server key is created if none exists. With
+// no wrapped key stored yet there is nothing to check kek against, so the
+// first unseal decides the KEK.
+func (m *ServerMasterKeyModel) Unseal(kek []byte, source string) error {
+	var wrapped ServerMasterKey
+	err := m.db.Where("wrap_version = ?", KeyWrappedV1).Order("is_active DESC, id DESC").First(&wrapped).Error
+	switch {
+	case err == nil:
+		if _, err := services.UnwrapKey(kek, wrapped.EncryptedKey, wrapped.KeyNonce, []byte(wrapped.KeyID)); err != nil {
+			return err
+		}
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		log.Printf("No wrapped server key found; the key-encryption key from %s becomes the server KEK", source)
+	default:
+		return fmt.Errorf("failed to load server keys: %w", err)
+	}
+
+	if err := m.seal.Unseal(kek, source); err != nil {
+		return err
+	}
+	if err := m.wrapLegacyKeys(); err != nil {
+		return err
+	}
+	if err := m.Initialize(); err != nil {
+		return err
+	}
+
+	log.Printf("Server unsealed from %s", source)
+	return nil
+}
+
+// SubmitUnsealShare adds an operator's unseal share and unseals the server
+// once enough shares have been submitted
+func (m *ServerMasterKeyModel) SubmitUnsealShare(share string) (services.SealStatus, error) {
+	kek, err := m.seal.AddUnsealShare(share)
+	if err != nil {
+		return m.seal.Status(), err
+	}
+	if kek != nil {
+		if err := m.Unseal(kek, services.UnsealFromShares); err != nil {
+			return m.seal.Status(), err
+		}
+	}
+	return m.seal.Status(), nil
+}
+
+// wrapLegacyKeys wraps keys still stored raw under the KEK
+func (m *ServerMasterKeyModel) wrapLegacyKeys() error {
+	var keys []ServerMasterKey
+	if err := m.db.Where("wrap_version = ?", KeyUnwrapped).Find(&keys).Error; err != nil {
+		return fmt.Errorf("failed to load unwrapped server keys: %w", err)
+	}
+
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		for _, key := range keys {
+			wrapped, nonce, err := m.seal.Wrap(key.EncryptedKey, []byte(key.KeyID))
+			if err != nil {
+				return fmt.Errorf("failed to wrap server key %s: %w", key.KeyID, err)
+			}
+			if err := tx.Model(&ServerMasterKey{}).Where("id = ? AND wrap_version = ?", key.ID, KeyUnwrapped).
+				Updates(map[string]interface{}{
+					"encrypted_key": wrapped,
+					"key_nonce":     nonce,
+					"wrap_version":  KeyWrappedV1,
+				}).Error; err != nil {
+				return fmt.Errorf("failed to store wrapped server key %s: %w", key.KeyID, err)
+			}
+			log.Printf("Wrapped server key %s under the key-encryption key", key.KeyID)
+		}
+		return nil
+	})
+}
+
+// Initialize generates and stores the first server master key if none exists.
+// The server must be unsealed.
 func (m *ServerMasterKeyModel) Initialize() error {
 	var count int64
 	if err := m.db.Model(&ServerMasterKey{}).Where("is_active = ?", true).Count(&count).Error; err != nil {
@@ -48,45 +134,125 @@ func (m *ServerMasterKeyModel) Initialize() error {
 		return nil
 	}
 
+	_, err := m.createKey(m.db)
+	return err
+}
+
+// createKey generates a new server master key, wraps it under the KEK and
+// stores it as the active key
+func (m *ServerMasterKeyModel) createKey(tx *gorm.DB) (*ServerMasterKey, error) {
 	masterKey := make([]byte, 32)
 	if _, err := rand.Read(masterKey); err != nil {
-		return fmt.Errorf("failed to generate master key: %w", err)
+		return nil, fmt.Errorf("failed to generate master key: %w", err)
 	}
 
 	keyID, err := generateKeyID()
 	if err != nil {
-		return fmt.Errorf("failed to generate key ID: %w", err)
+		return nil, fmt.Errorf("failed to generate key ID: %w", err)
 	}
 
-	nonce, err := utils.GenerateNonce()
+	wrapped, nonce, err := m.seal.Wrap(masterKey, []byte(keyID))
 	if err != nil {
-		return fmt.Errorf("failed to generate nonce: %w", err)
+		return nil, fmt.Errorf("failed to wrap master key: %w", err)
 	}
 
 	now := time.Now()
 	serverKey := &ServerMasterKey{
 		KeyID:        keyID,
-		EncryptedKey: masterKey,
+		EncryptedKey: wrapped,
 		KeyNonce:     nonce,
+		WrapVersion:  KeyWrappedV1,
 		IsActive:     true,
 		ActivatedAt:  &now,
 	}
 
-	return m.db.Create(serverKey).Error
+	if err := tx.Create(serverKey).Error; err != nil {
+		return nil, fmt.Errorf("failed to store master key: %w", err)
+	}
+	return serverKey, nil
+}
+
+// Rotate creates a new active server key and returns its ID. New fragments
+// are wrapped under it; the previous key stays available for the fragments
+// still wrapped under it until they are re-wrapped and the key is retired.
+func (m *ServerMasterKeyModel) Rotate() (string, error) {
+	var serverKey *ServerMasterKey
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&ServerMasterKey{}).Where("is_active = ?", true).
+			Update("is_active", false).Error; err != nil {
+			return fmt.Errorf("failed to deactivate server key: %w", err)
+		}
+		var err error
+		serverKey, err = m.createKey(tx)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Rotated server master key; new active key %s", serverKey.KeyID)
+	return serverKey.KeyID, nil
 }
 
-// GetServerKey retrieves and processes the server key for encryption
+// RetireUnreferenced retires inactive keys that no key fragment is encrypted
+// under any more and returns their IDs. Retired keys are kept so manifests and
+// backups written before the rotation can still be read with safesplit-recover.
+func (m *ServerMasterKeyModel) RetireUnreferenced() ([]string, error) {
+	var keys []ServerMasterKey
+	if err := m.db.Where("is_active = ? AND retired_at IS NULL", false).Find(&keys).Error; err != nil {
+		return nil, fmt.Errorf("failed to list inactive server keys: %w", err)
+	}
+
+	var retired []string
+	for _, key := range keys {
+		var count int64
+		if err := m.db.Model(&KeyFragment{}).Where("server_key_id = ?", key.KeyID).Count(&count).Error; err != nil {
+			return retired, fmt.Errorf("failed to count fragments of server key %s: %w", key.KeyID, err)
+		}
+		if count > 0 {
+			continue
+		}
+
+		result := m.db.Model(&ServerMasterKey{}).
+			Where("id = ? AND is_active = ? AND retired_at IS NULL", key.ID, false).
+			Update("retired_at", time.Now())
+		if result.Error != nil {
+			return retired, fmt.Errorf("failed to retire server key %s: %w", key.KeyID, result.Error)
+		}
+		if result.RowsAffected > 0 {
+			log.Printf("Retired server key %s", key.KeyID)
+			retired = append(retired, key.KeyID)
+		}
+	}
+	return retired, nil
+}
+
+// GetServerKey unwraps a server key for encrypting or decrypting fragments.
+// It fails with services.ErrSealed while the server is sealed.
 func (m *ServerMasterKeyModel) GetServerKey(keyID string) ([]byte, error) {
+	if m.seal.IsSealed() {
+		return nil, services.ErrSealed
+	}
+
 	var key ServerMasterKey
 	if err := m.db.Where("key_id = ?", keyID).First(&key).Error; err != nil {
 		return nil, fmt.Errorf("failed to get server key: %w", err)
 	}
 
-	if len(key.EncryptedKey) != 32 {
-		return nil, fmt.Errorf("invalid key length: got %d, expected 32 bytes", len(key.EncryptedKey))
+	if key.WrapVersion != KeyWrappedV1 {
+		return nil, fmt.Errorf("server key %s is not wrapped (version %d)", keyID, key.WrapVersion)
+	}
+
+	serverKey, err := m.seal.Unwrap(key.EncryptedKey, key.KeyNonce, []byte(key.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap server key: %w", err)
+	}
+
+	if len(serverKey) != 32 {
+		return nil, fmt.Errorf("invalid key length: got %d, expected 32 bytes", len(serverKey))
 	}
 
-	return key.EncryptedKey, nil
+	return serverKey, nil
 }
 
 // GetActive retrieves the current active server master key
@@ -115,3 +281,49 @@ func (m *ServerMasterKeyModel) ListAll() ([]ServerMasterKey, error) {
 	}
 	return keys, nil
 }
+
+// IsSealed reports whether the server keys can't be unwrapped until the server is unsealed
+func (m *ServerMasterKeyModel) IsSealed() bool {
+	return m.seal.IsSealed()
+}
+
+// KeyID returns the ID of the active server key, implementing services.KeyProvider
+func (m *ServerMasterKeyModel) KeyID() (string, error) {
+	if m.seal.IsSealed() {
+		return "", services.ErrSealed
+	}
+	key, err := m.GetActive()
+	if err != nil {
+		return "", err
+	}
+	return key.KeyID, nil
+}
+
+// Wrap encrypts a fragment under the active server key
+func (m *ServerMasterKeyModel) Wrap(plaintext, nonce []byte) ([]byte, string, error) {
+	keyID, err := m.KeyID()
+	if err != nil {
+		return nil, "", err
+	}
+	serverKey, err := m.GetServerKey(keyID)
+	if err != nil {
+		return nil, "", err
+	}
+	wrapped, err := services.EncryptMasterKey(plaintext, serverKey, nonce)
+	if err != nil {
+		return nil, "", err
+	}
+	return wrapped, keyID, nil
+}
+
+// Unwrap decrypts a fragment wrapped under the server key keyID
+func (m *ServerMasterKeyModel) Unwrap(keyID string, wrapped, nonce []byte) ([]byte, error) {
+	serverKey, err := m.GetServerKey(keyID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %s", services.ErrUnknownKeyID, keyID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return services.DecryptMasterKey(wrapped, serverKey, nonce)
+}
@@ -0,0 +1,149 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"safesplit/services"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LegacyNodeCount is the fixed node count used before shard placement was
+// recorded. Shards without a shard_locations row live on shardIndex % LegacyNodeCount.
+const LegacyNodeCount = 3
+
+// ShardLocation records which storage node holds a shard of a file
+type ShardLocation struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	FileID     uint      `json:"file_id" gorm:"not null"`
+	ShardIndex int       `json:"shard_index" gorm:"not null"`
+	NodeIndex  int       `json:"node_index" gorm:"not null"`
+	Checksum   string    `json:"checksum" gorm:"type:char(64)"` // SHA-256 of the shard, empty for legacy shards
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// LegacyShardNodes returns the placement used for files stored before the node registry
+func LegacyShardNodes(totalShards int) []int {
+	nodes := make([]int, totalShards)
+	for i := range nodes {
+		nodes[i] = i % LegacyNodeCount
+	}
+	return nodes
+}
+
+// SaveShardLocations records the node and checksum of each shard of a file.
+// checksums may be nil when the shard contents are unknown.
+func SaveShardLocations(tx *gorm.DB, fileID uint, shardNodes []int, checksums []string) error {
+	locations := make([]ShardLocation, len(shardNodes))
+	for i, nodeIndex := range shardNodes {
+		locations[i] = ShardLocation{
+			FileID:     fileID,
+			ShardIndex: i,
+			NodeIndex:  nodeIndex,
+		}
+		if i < len(checksums) {
+			locations[i].Checksum = checksums[i]
+		}
+	}
+
+	if err := tx.Create(&locations).Error; err != nil {
+		return fmt.Errorf("failed to save shard locations: %w", err)
+	}
+	return nil
+}
+
+// GetShardNodes returns the node index and expected checksum of every shard of a file
+func (m *FileModel) GetShardNodes(file *File) ([]int, []string, error) {
+	return LoadShardPlacement(m.db, file)
+}
+
+// LoadShardPlacement returns the node index and expected checksum of every shard
+// of a file, falling back to the legacy placement for unrecorded shards
+func LoadShardPlacement(db *gorm.DB, file *File) ([]int, []string, error) {
+	totalShards := int(file.DataShardCount + file.ParityShardCount)
+
+	var locations []ShardLocation
+	if err := db.Where("file_id = ?", file.ID).Find(&locations).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to get shard locations: %w", err)
+	}
+
+	shardNodes := LegacyShardNodes(totalShards)
+	checksums := make([]string, totalShards)
+	for _, location := range locations {
+		if location.ShardIndex < 0 || location.ShardIndex >= totalShards {
+			log.Printf("Ignoring out of range shard location %d for file %d", location.ShardIndex, file.ID)
+			continue
+		}
+		shardNodes[location.ShardIndex] = location.NodeIndex
+		checksums[location.ShardIndex] = location.Checksum
+	}
+	return shardNodes, checksums, nil
+}
+
+// RetrieveFileShards reads the shards of a file from wherever they are placed.
+// Corrupt shards come back as nil and are listed in FileShards.Corrupted.
+func (m *FileModel) RetrieveFileShards(file *File) (*services.FileShards, error) {
+	shardNodes, checksums, err := m.GetShardNodes(file)
+	if err != nil {
+		return nil, err
+	}
+
+	fileShards, err := m.rsService.RetrieveShards(file.ID, shardNodes, checksums, int(file.DataShardCount))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, corrupt := range fileShards.Corrupted {
+		log.Printf("File %d: shard %d on node %d is corrupt and will be rebuilt from parity",
+			file.ID, corrupt.ShardIndex, corrupt.NodeIndex)
+	}
+	return fileShards, nil
+}
+
+// ReconstructFileTo streams the stored (still encrypted) content of a sharded
+// file to w, rebuilding missing and corrupt data shards from parity
+func (m *FileModel) ReconstructFileTo(file *File, w io.Writer) (int64, error) {
+	return ReadStoredContent(m.db, m.rsService, file, w)
+}
+
+// ReadStoredContent is ReconstructFileTo for callers without a FileModel
+func ReadStoredContent(db *gorm.DB, rsService *services.ReedSolomonService, file *File, w io.Writer) (int64, error) {
+	shardNodes, checksums, err := LoadShardPlacement(db, file)
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	var corrupted []services.CorruptShard
+	if file.LayoutVersion == services.LayoutStriped {
+		var index *StripeIndex
+		if index, err = LoadStripeIndex(db, file.ID); err != nil {
+			return 0, err
+		}
+		written, corrupted, err = rsService.ReconstructStriped(file.ID, shardNodes, checksums, index.Layout(file), index.Checksums, w)
+	} else {
+		written, corrupted, err = rsService.ReconstructStream(file.ID, shardNodes, checksums,
+			int(file.DataShardCount), int(file.ParityShardCount), w)
+	}
+	for _, corrupt := range corrupted {
+		log.Printf("File %d: shard %d on node %d is corrupt and was rebuilt from parity",
+			file.ID, corrupt.ShardIndex, corrupt.NodeIndex)
+	}
+	return written, err
+}
+
+// ReadShardedData reconstructs the encrypted content of a sharded file in
+// memory, without also holding every shard. Only files encrypted with
+// services.EncryptionSingleAEAD need it; OpenContent streams the others.
+func (m *FileModel) ReadShardedData(file *File) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(int(file.Size))
+	if _, err := m.ReconstructFileTo(file, &buf); err != nil {
+		return nil, fmt.Errorf("failed to reconstruct file: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,705 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"safesplit/services"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// MaxRecoveryContacts bounds the number of trusted contacts of a user
+	MaxRecoveryContacts = 10
+	// RecoveryRequestLifetime is how long contacts have to approve a recovery request
+	RecoveryRequestLifetime = 72 * time.Hour
+	// RecoveryConfirmationLifetime is how long the link confirming a recovery request is valid
+	RecoveryConfirmationLifetime = time.Hour
+)
+
+// Recovery request states; pending requests past ExpiresAt count as expired
+const (
+	RecoveryRequestPending   = "pending"
+	RecoveryRequestCompleted = "completed"
+	RecoveryRequestCancelled = "cancelled"
+	RecoveryRequestExpired   = "expired"
+)
+
+// Recovery approval states
+const (
+	RecoveryApprovalPending  = "pending"
+	RecoveryApprovalApproved = "approved"
+	RecoveryApprovalDeclined = "declined"
+)
+
+var (
+	ErrInvalidRecoveryContacts  = errors.New("invalid recovery contacts")
+	ErrSocialRecoveryNotSetUp   = errors.New("social recovery is not set up for this account")
+	ErrRecoveryRequestNotFound  = errors.New("recovery request not found")
+	ErrRecoveryConfirmation     = errors.New("recovery link is invalid or has expired")
+	ErrRecoveryRequestClosed    = errors.New("recovery request is no longer pending")
+	ErrRecoveryCode             = errors.New("recovery code does not match the request")
+	ErrRecoveryThresholdNotMet  = errors.New("not enough contacts have approved the request yet")
+	ErrRecoveryApprovalNotFound = errors.New("recovery approval not found")
+	ErrRecoveredKeyMismatch     = errors.New("recovered master key does not match, the recovery setup is out of date")
+	ErrRecoveryPasswordReused   = errors.New("Cannot reuse any of your last 5 passwords")
+)
+
+// SocialRecoverySetup records that a user's master key is split into one
+// share per trusted contact, Threshold of which recombine it. KeyCheck
+// identifies the master key the shares belong to.
+type SocialRecoverySetup struct {
+	ID         uint              `json:"id" gorm:"primaryKey"`
+	UserID     uint              `json:"user_id" gorm:"uniqueIndex;not null"`
+	Threshold  int               `json:"threshold" gorm:"not null"`
+	ShareCount int               `json:"share_count" gorm:"not null"`
+	KeyCheck   string            `json:"-" gorm:"type:char(64);not null"`
+	Contacts   []RecoveryContact `json:"contacts" gorm:"foreignKey:SetupID"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+// RecoveryContact holds the share of one trusted contact, sealed to their
+// recovery public key so only they can open it while logged in
+type RecoveryContact struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	SetupID      uint      `json:"-" gorm:"not null"`
+	ContactID    uint      `json:"contact_id" gorm:"not null"`
+	ShareIndex   int       `json:"share_index" gorm:"not null"`
+	WrappedShare []byte    `json:"-" gorm:"type:varbinary(128);not null"`
+	Username     string    `json:"username" gorm:"-"`
+	Email        string    `json:"email" gorm:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// RecoveryRequest is a locked-out user's request to recover their master key.
+// Contacts release their shares sealed to PublicKey, whose private key the
+// requester holds as the recovery code.
+type RecoveryRequest struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	UserID      uint       `json:"user_id" gorm:"not null"`
+	SetupID     uint       `json:"-" gorm:"not null"`
+	PublicKey   []byte     `json:"-" gorm:"type:binary(32);not null"`
+	Status      string     `json:"status" gorm:"type:enum('pending','completed','cancelled','expired');not null;default:'pending'"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// RecoveryConfirmation is a link emailed to the owner of an account when
+// someone asks to recover it. Only whoever follows the link opens a request,
+// so knowing an email address is not enough to alert its contacts or hold
+// up the owner's own recovery.
+type RecoveryConfirmation struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"not null"`
+	TokenHash string     `json:"-" gorm:"type:char(64);uniqueIndex;not null"` // SHA-256 of the emailed token
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// RecoveryApproval is one contact's answer to a recovery request
+type RecoveryApproval struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	RequestID     uint       `json:"request_id" gorm:"not null"`
+	ContactID     uint       `json:"contact_id" gorm:"not null"`
+	Status        string     `json:"status" gorm:"type:enum('pending','approved','declined');not null;default:'pending'"`
+	ReleasedShare []byte     `json:"-" gorm:"type:varbinary(128)"`
+	DecidedAt     *time.Time `json:"decided_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// RecoveryRequestStatus summarises a request for the requester or its owner
+type RecoveryRequestStatus struct {
+	RequestID uint      `json:"request_id"`
+	Status    string    `json:"status"`
+	Threshold int       `json:"threshold"`
+	Approved  int       `json:"approved"`
+	Declined  int       `json:"declined"`
+	Contacts  int       `json:"contacts"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PendingRecoveryApproval is a request a contact has yet to answer
+type PendingRecoveryApproval struct {
+	ApprovalID uint      `json:"approval_id"`
+	RequestID  uint      `json:"request_id"`
+	Username   string    `json:"username"`
+	Email      string    `json:"email"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type SocialRecoveryModel struct {
+	db            *gorm.DB
+	shamirService *services.ShamirService
+}
+
+func NewSocialRecoveryModel(db *gorm.DB, shamirService *services.ShamirService) *SocialRecoveryModel {
+	return &SocialRecoveryModel{
+		db:            db,
+		shamirService: shamirService,
+	}
+}
+
+// Setup splits the owner's master key into one share per contact, threshold
+// of which recombine it, and seals each share to its contact. It replaces any
+// earlier setup and cancels its pending requests.
+func (m *SocialRecoveryModel) Setup(owner *User, masterKey []byte, contactEmails []string, threshold int) (*SocialRecoverySetup, error) {
+	if len(contactEmails) < 2 || len(contactEmails) > MaxRecoveryContacts {
+		return nil, fmt.Errorf("%w: choose between 2 and %d contacts", ErrInvalidRecoveryContacts, MaxRecoveryContacts)
+	}
+	if threshold < 2 || threshold > len(contactEmails) {
+		return nil, fmt.Errorf("%w: the threshold must be between 2 and the number of contacts", ErrInvalidRecoveryContacts)
+	}
+
+	contacts := make([]User, 0, len(contactEmails))
+	seen := make(map[string]bool, len(contactEmails))
+	for _, email := range contactEmails {
+		email = strings.ToLower(strings.TrimSpace(email))
+		if seen[email] {
+			return nil, fmt.Errorf("%w: %s is listed twice", ErrInvalidRecoveryContacts, email)
+		}
+		seen[email] = true
+
+		var contact User
+		if err := m.db.Where("email = ? AND is_active = ? AND role IN ?", email, true,
+			[]string{RoleEndUser, RolePremiumUser}).First(&contact).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, fmt.Errorf("%w: %s is not a SafeSplit user", ErrInvalidRecoveryContacts, email)
+			}
+			return nil, fmt.Errorf("failed to find contact: %w", err)
+		}
+		if contact.ID == owner.ID {
+			return nil, fmt.Errorf("%w: you cannot be your own recovery contact", ErrInvalidRecoveryContacts)
+		}
+		if len(contact.RecoveryPublicKey) != services.RecoveryKeySize {
+			return nil, fmt.Errorf("%w: %s has to log in once before they can be a recovery contact", ErrInvalidRecoveryContacts, email)
+		}
+		contacts = append(contacts, contact)
+	}
+
+	shares, err := m.shamirService.SplitSecret(masterKey, len(contacts), threshold)
+	if err != nil {
+		return nil, err
+	}
+	setup := &SocialRecoverySetup{
+		UserID:     owner.ID,
+		Threshold:  threshold,
+		ShareCount: len(contacts),
+		KeyCheck:   services.MasterKeyCheck(masterKey),
+	}
+	for i, contact := range contacts {
+		wrapped, err := services.SealToRecoveryKey(contact.RecoveryPublicKey, shares[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to seal share to %s: %w", contact.Email, err)
+		}
+		setup.Contacts = append(setup.Contacts, RecoveryContact{
+			ContactID:    contact.ID,
+			ShareIndex:   i + 1,
+			WrappedShare: wrapped,
+			Username:     contact.Username,
+			Email:        contact.Email,
+		})
+	}
+
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		if err := deleteSocialRecovery(tx, owner.ID); err != nil {
+			return err
+		}
+		if err := tx.Create(setup).Error; err != nil {
+			return fmt.Errorf("failed to save social recovery setup: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("User %d set up social recovery with %d of %d contacts", owner.ID, threshold, len(contacts))
+	return setup, nil
+}
+
+// GetSetup returns the social recovery setup of a user with its contacts
+func (m *SocialRecoveryModel) GetSetup(userID uint) (*SocialRecoverySetup, error) {
+	var setup SocialRecoverySetup
+	if err := m.db.Where("user_id = ?", userID).Preload("Contacts", func(db *gorm.DB) *gorm.DB {
+		return db.Order("share_index asc")
+	}).First(&setup).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSocialRecoveryNotSetUp
+		}
+		return nil, fmt.Errorf("failed to get social recovery setup: %w", err)
+	}
+
+	for i := range setup.Contacts {
+		var contact User
+		if err := m.db.Select("username", "email").First(&contact, setup.Contacts[i].ContactID).Error; err == nil {
+			setup.Contacts[i].Username = contact.Username
+			setup.Contacts[i].Email = contact.Email
+		}
+	}
+	return &setup, nil
+}
+
+// Remove deletes the social recovery setup of a user and cancels its pending requests
+func (m *SocialRecoveryModel) Remove(userID uint) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		return deleteSocialRecovery(tx, userID)
+	})
+}
+
+// deleteSocialRecovery removes a user's setup within tx, e.g. when their
+// master key is replaced and the shares no longer recombine it
+func deleteSocialRecovery(tx *gorm.DB, userID uint) error {
+	var setup SocialRecoverySetup
+	if err := tx.Where("user_id = ?", userID).First(&setup).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to get social recovery setup: %w", err)
+	}
+	if err := tx.Model(&RecoveryRequest{}).
+		Where("setup_id = ? AND status = ?", setup.ID, RecoveryRequestPending).
+		Update("status", RecoveryRequestCancelled).Error; err != nil {
+		return fmt.Errorf("failed to cancel recovery requests: %w", err)
+	}
+	if err := tx.Where("setup_id = ?", setup.ID).Delete(&RecoveryContact{}).Error; err != nil {
+		return fmt.Errorf("failed to delete recovery contacts: %w", err)
+	}
+	if err := tx.Delete(&setup).Error; err != nil {
+		return fmt.Errorf("failed to delete social recovery setup: %w", err)
+	}
+	return nil
+}
+
+// RequestConfirmation creates the link confirming a recovery request for the
+// account with the given email and returns its token and the owner. It fails
+// with ErrSocialRecoveryNotSetUp for unknown accounts and accounts without
+// social recovery, which callers must not reveal.
+func (m *SocialRecoveryModel) RequestConfirmation(email string) (string, *User, error) {
+	var user User
+	if err := m.db.Where("email = ? AND is_active = ?", strings.ToLower(strings.TrimSpace(email)), true).
+		First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", nil, ErrSocialRecoveryNotSetUp
+		}
+		return "", nil, fmt.Errorf("failed to find user: %w", err)
+	}
+	var setups int64
+	if err := m.db.Model(&SocialRecoverySetup{}).Where("user_id = ?", user.ID).Count(&setups).Error; err != nil {
+		return "", nil, fmt.Errorf("failed to get social recovery setup: %w", err)
+	}
+	if setups == 0 {
+		return "", nil, ErrSocialRecoveryNotSetUp
+	}
+
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", nil, fmt.Errorf("failed to generate recovery link: %w", err)
+	}
+	confirmation := &RecoveryConfirmation{
+		UserID:    user.ID,
+		TokenHash: recoveryTokenHash(hex.EncodeToString(token)),
+		ExpiresAt: time.Now().Add(RecoveryConfirmationLifetime),
+	}
+	if err := m.db.Create(confirmation).Error; err != nil {
+		return "", nil, fmt.Errorf("failed to save recovery link: %w", err)
+	}
+	return hex.EncodeToString(token), &user, nil
+}
+
+func recoveryTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	return hex.EncodeToString(sum[:])
+}
+
+// StartRequest uses a confirmation link to open a recovery request for its
+// account. Contacts will release their shares sealed to publicKey. Pending
+// requests of the account are superseded: whoever follows the link controls
+// the owner's email, so an earlier request, perhaps opened by someone else,
+// must not stand in the way. It returns the request and its owner.
+func (m *SocialRecoveryModel) StartRequest(token string, publicKey []byte) (*RecoveryRequest, *User, error) {
+	now := time.Now()
+	var request *RecoveryRequest
+	var user User
+	var superseded int64
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		var confirmation RecoveryConfirmation
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", recoveryTokenHash(token)).First(&confirmation).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRecoveryConfirmation
+			}
+			return fmt.Errorf("failed to get recovery link: %w", err)
+		}
+		if confirmation.UsedAt != nil || now.After(confirmation.ExpiresAt) {
+			return ErrRecoveryConfirmation
+		}
+		if err := tx.Model(&confirmation).Update("used_at", now).Error; err != nil {
+			return fmt.Errorf("failed to use recovery link: %w", err)
+		}
+
+		// Lock the user row so two links can't both open a request
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND is_active = ?", confirmation.UserID, true).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRecoveryConfirmation
+			}
+			return fmt.Errorf("failed to lock user: %w", err)
+		}
+		var setup SocialRecoverySetup
+		if err := tx.Where("user_id = ?", user.ID).Preload("Contacts").First(&setup).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrSocialRecoveryNotSetUp
+			}
+			return fmt.Errorf("failed to get social recovery setup: %w", err)
+		}
+
+		if err := tx.Model(&RecoveryRequest{}).
+			Where("user_id = ? AND status = ? AND expires_at <= ?", user.ID, RecoveryRequestPending, now).
+			Update("status", RecoveryRequestExpired).Error; err != nil {
+			return fmt.Errorf("failed to expire recovery requests: %w", err)
+		}
+		result := tx.Model(&RecoveryRequest{}).
+			Where("user_id = ? AND status = ?", user.ID, RecoveryRequestPending).
+			Update("status", RecoveryRequestCancelled)
+		if result.Error != nil {
+			return fmt.Errorf("failed to supersede recovery requests: %w", result.Error)
+		}
+		superseded = result.RowsAffected
+
+		request = &RecoveryRequest{
+			UserID:    user.ID,
+			SetupID:   setup.ID,
+			PublicKey: publicKey,
+			Status:    RecoveryRequestPending,
+			ExpiresAt: now.Add(RecoveryRequestLifetime),
+		}
+		if err := tx.Create(request).Error; err != nil {
+			return fmt.Errorf("failed to create recovery request: %w", err)
+		}
+		approvals := make([]RecoveryApproval, len(setup.Contacts))
+		for i, contact := range setup.Contacts {
+			approvals[i] = RecoveryApproval{
+				RequestID: request.ID,
+				ContactID: contact.ContactID,
+				Status:    RecoveryApprovalPending,
+			}
+		}
+		if err := tx.Create(&approvals).Error; err != nil {
+			return fmt.Errorf("failed to create recovery approvals: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Recovery request %d opened for user %d, superseding %d pending requests", request.ID, user.ID, superseded)
+	return request, &user, nil
+}
+
+// ContactsOf returns the contacts asked to approve a request
+func (m *SocialRecoveryModel) ContactsOf(request *RecoveryRequest) ([]User, error) {
+	var contacts []User
+	if err := m.db.Joins("JOIN recovery_approvals ON recovery_approvals.contact_id = users.id").
+		Where("recovery_approvals.request_id = ?", request.ID).
+		Find(&contacts).Error; err != nil {
+		return nil, fmt.Errorf("failed to get recovery contacts: %w", err)
+	}
+	return contacts, nil
+}
+
+// RequestStatus reports the progress of a request to the holder of its recovery code
+func (m *SocialRecoveryModel) RequestStatus(requestID uint, privateKey []byte) (*RecoveryRequestStatus, error) {
+	request, err := m.requestForCode(requestID, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return m.status(request)
+}
+
+// ListRequests returns the recovery requests opened for a user, newest first
+func (m *SocialRecoveryModel) ListRequests(userID uint) ([]RecoveryRequestStatus, error) {
+	var requests []RecoveryRequest
+	if err := m.db.Where("user_id = ?", userID).Order("created_at desc").Limit(20).Find(&requests).Error; err != nil {
+		return nil, fmt.Errorf("failed to list recovery requests: %w", err)
+	}
+	statuses := make([]RecoveryRequestStatus, 0, len(requests))
+	for i := range requests {
+		status, err := m.status(&requests[i])
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, *status)
+	}
+	return statuses, nil
+}
+
+func (m *SocialRecoveryModel) status(request *RecoveryRequest) (*RecoveryRequestStatus, error) {
+	var approvals []RecoveryApproval
+	if err := m.db.Where("request_id = ?", request.ID).Find(&approvals).Error; err != nil {
+		return nil, fmt.Errorf("failed to get recovery approvals: %w", err)
+	}
+	status := &RecoveryRequestStatus{
+		RequestID: request.ID,
+		Status:    request.Status,
+		Contacts:  len(approvals),
+		ExpiresAt: request.ExpiresAt,
+		CreatedAt: request.CreatedAt,
+	}
+	if request.Status == RecoveryRequestPending && time.Now().After(request.ExpiresAt) {
+		status.Status = RecoveryRequestExpired
+	}
+	var setup SocialRecoverySetup
+	if err := m.db.First(&setup, request.SetupID).Error; err == nil {
+		status.Threshold = setup.Threshold
+	}
+	for _, approval := range approvals {
+		switch approval.Status {
+		case RecoveryApprovalApproved:
+			status.Approved++
+		case RecoveryApprovalDeclined:
+			status.Declined++
+		}
+	}
+	return status, nil
+}
+
+// CancelRequest cancels a pending request for the owner's account, e.g. one
+// they did not open themselves
+func (m *SocialRecoveryModel) CancelRequest(requestID, ownerID uint) error {
+	result := m.db.Model(&RecoveryRequest{}).
+		Where("id = ? AND user_id = ? AND status = ?", requestID, ownerID, RecoveryRequestPending).
+		Update("status", RecoveryRequestCancelled)
+	if result.Error != nil {
+		return fmt.Errorf("failed to cancel recovery request: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrRecoveryRequestNotFound
+	}
+	return nil
+}
+
+// PendingApprovals lists the open requests a contact is asked to approve
+func (m *SocialRecoveryModel) PendingApprovals(contactID uint) ([]PendingRecoveryApproval, error) {
+	var pending []PendingRecoveryApproval
+	if err := m.db.Table("recovery_approvals").
+		Select("recovery_approvals.id AS approval_id, recovery_requests.id AS request_id, users.username, users.email, "+
+			"recovery_requests.expires_at, recovery_requests.created_at").
+		Joins("JOIN recovery_requests ON recovery_requests.id = recovery_approvals.request_id").
+		Joins("JOIN users ON users.id = recovery_requests.user_id").
+		Where("recovery_approvals.contact_id = ? AND recovery_approvals.status = ? AND recovery_requests.status = ? AND recovery_requests.expires_at > ?",
+			contactID, RecoveryApprovalPending, RecoveryRequestPending, time.Now()).
+		Order("recovery_requests.created_at desc").
+		Scan(&pending).Error; err != nil {
+		return nil, fmt.Errorf("failed to list recovery approvals: %w", err)
+	}
+	return pending, nil
+}
+
+// Approve opens the contact's share with their master key, as unlocked for
+// their session, and releases it sealed to the request's key
+func (m *SocialRecoveryModel) Approve(approvalID uint, contact *User, contactMasterKey []byte) error {
+	approval, request, err := m.openApproval(approvalID, contact.ID)
+	if err != nil {
+		return err
+	}
+
+	var holder RecoveryContact
+	if err := m.db.Where("setup_id = ? AND contact_id = ?", request.SetupID, contact.ID).First(&holder).Error; err != nil {
+		return fmt.Errorf("failed to get recovery share: %w", err)
+	}
+	privateKey, err := contact.OpenRecoveryKey(contactMasterKey)
+	if err != nil {
+		return err
+	}
+	share, err := services.OpenWithRecoveryKey(privateKey, holder.WrappedShare)
+	if err != nil {
+		return err
+	}
+	released, err := services.SealToRecoveryKey(request.PublicKey, share)
+	if err != nil {
+		return err
+	}
+
+	return m.decide(approval, RecoveryApprovalApproved, released)
+}
+
+// Decline records that a contact refuses a request
+func (m *SocialRecoveryModel) Decline(approvalID, contactID uint) error {
+	approval, _, err := m.openApproval(approvalID, contactID)
+	if err != nil {
+		return err
+	}
+	return m.decide(approval, RecoveryApprovalDeclined, nil)
+}
+
+func (m *SocialRecoveryModel) openApproval(approvalID, contactID uint) (*RecoveryApproval, *RecoveryRequest, error) {
+	var approval RecoveryApproval
+	if err := m.db.Where("id = ? AND contact_id = ?", approvalID, contactID).First(&approval).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrRecoveryApprovalNotFound
+		}
+		return nil, nil, fmt.Errorf("failed to get recovery approval: %w", err)
+	}
+	var request RecoveryRequest
+	if err := m.db.First(&request, approval.RequestID).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to get recovery request: %w", err)
+	}
+	if approval.Status != RecoveryApprovalPending || request.Status != RecoveryRequestPending ||
+		time.Now().After(request.ExpiresAt) {
+		return nil, nil, ErrRecoveryRequestClosed
+	}
+	return &approval, &request, nil
+}
+
+func (m *SocialRecoveryModel) decide(approval *RecoveryApproval, status string, released []byte) error {
+	now := time.Now()
+	result := m.db.Model(&RecoveryApproval{}).
+		Where("id = ? AND status = ?", approval.ID, RecoveryApprovalPending).
+		Updates(map[string]interface{}{
+			"status":         status,
+			"released_share": released,
+			"decided_at":     now,
+		})
+	if result.Error != nil {
+		return fmt.Errorf("failed to record recovery approval: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrRecoveryRequestClosed
+	}
+	log.Printf("Contact %d %s recovery request %d", approval.ContactID, status, approval.RequestID)
+	return nil
+}
+
+// Complete recombines the master key from the shares released for a request,
+// checks it against the setup and wraps it under newPassword, so the owner
+// regains their account and files. It returns the owner.
+func (m *SocialRecoveryModel) Complete(requestID uint, privateKey []byte, newPassword string,
+	passwordHistoryModel *PasswordHistoryModel) (*User, error) {
+	request, err := m.requestForCode(requestID, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if request.Status != RecoveryRequestPending || time.Now().After(request.ExpiresAt) {
+		return nil, ErrRecoveryRequestClosed
+	}
+
+	var setup SocialRecoverySetup
+	if err := m.db.First(&setup, request.SetupID).Error; err != nil {
+		return nil, fmt.Errorf("failed to get social recovery setup: %w", err)
+	}
+	var approvals []RecoveryApproval
+	if err := m.db.Where("request_id = ? AND status = ?", request.ID, RecoveryApprovalApproved).
+		Find(&approvals).Error; err != nil {
+		return nil, fmt.Errorf("failed to get recovery approvals: %w", err)
+	}
+	if len(approvals) < setup.Threshold {
+		return nil, ErrRecoveryThresholdNotMet
+	}
+
+	shares := make([][]byte, 0, len(approvals))
+	for _, approval := range approvals {
+		share, err := services.OpenWithRecoveryKey(privateKey, approval.ReleasedShare)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open share released by contact %d: %w", approval.ContactID, err)
+		}
+		shares = append(shares, share)
+	}
+	masterKey, err := m.shamirService.CombineSecret(shares)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(services.MasterKeyCheck(masterKey)), []byte(setup.KeyCheck)) != 1 {
+		return nil, ErrRecoveredKeyMismatch
+	}
+
+	var user User
+	if err := m.db.First(&user, request.UserID).Error; err != nil {
+		return nil, fmt.Errorf("user not found: %w", err)
+	}
+	recentPasswords, err := passwordHistoryModel.GetRecentPasswords(user.ID, 5)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check password history: %w", err)
+	}
+	for _, oldHash := range append(recentPasswords, user.Password) {
+		if bcrypt.CompareHashAndPassword([]byte(oldHash), []byte(newPassword)) == nil {
+			return nil, ErrRecoveryPasswordReused
+		}
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash new password: %w", err)
+	}
+	encryptedKey, nonce, kdfParams, err := user.wrapMasterKey(masterKey, newPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&RecoveryRequest{}).
+			Where("id = ? AND status = ?", request.ID, RecoveryRequestPending).
+			Updates(map[string]interface{}{
+				"status":       RecoveryRequestCompleted,
+				"completed_at": now,
+			})
+		if result.Error != nil {
+			return fmt.Errorf("failed to complete recovery request: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrRecoveryRequestClosed
+		}
+
+		if err := tx.Create(&PasswordHistory{UserID: user.ID, PasswordHash: user.Password}).Error; err != nil {
+			return fmt.Errorf("failed to store password history: %w", err)
+		}
+		if err := tx.Model(&user).Updates(map[string]interface{}{
+			"password":                string(hashedPassword),
+			"encrypted_master_key":    encryptedKey,
+			"master_key_nonce":        nonce,
+			"master_key_wrap_version": MasterKeyWrapPassword,
+			"kdf_params":              kdfParams,
+			"last_password_change":    now,
+			"force_password_change":   false,
+			"failed_login_attempts":   0,
+			"account_locked_until":    nil,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to update user: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("User %d recovered their account through recovery request %d", user.ID, request.ID)
+	return &user, nil
+}
+
+// requestForCode loads a request and checks that privateKey is its recovery code
+func (m *SocialRecoveryModel) requestForCode(requestID uint, privateKey []byte) (*RecoveryRequest, error) {
+	var request RecoveryRequest
+	if err := m.db.First(&request, requestID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRecoveryRequestNotFound
+		}
+		return nil, fmt.Errorf("failed to get recovery request: %w", err)
+	}
+	publicKey, err := services.RecoveryPublicKey(privateKey)
+	if err != nil || subtle.ConstantTimeCompare(publicKey, request.PublicKey) != 1 {
+		return nil, ErrRecoveryCode
+	}
+	return &request, nil
+}
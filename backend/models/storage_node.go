@@ -0,0 +1,627 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"safesplit/services"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type StorageNodeStatus string
+
+const (
+	StorageNodeActive   StorageNodeStatus = "active"   // accepts new shards and fragments
+	StorageNodeDraining StorageNodeStatus = "draining" // readable, data is being moved off
+	StorageNodeRemoved  StorageNodeStatus = "removed"  // retired, index is never reused
+)
+
+var (
+	ErrStorageNodeNotFound = errors.New("storage node not found")
+	ErrStorageNodeInUse    = errors.New("storage node still holds shards or fragments")
+)
+
+// StorageNode is an entry of the node registry. NodeIndex is the stable
+// identifier recorded in key_fragments.node_index and shard_locations.node_index.
+type StorageNode struct {
+	ID        uint              `json:"id" gorm:"primaryKey"`
+	NodeIndex int               `json:"node_index" gorm:"unique;not null"`
+	Name      string            `json:"name" gorm:"type:varchar(255);not null"`
+	Backend   string            `json:"backend" gorm:"type:varchar(20);not null"`
+	Config    string            `json:"-" gorm:"type:text;not null"`
+	Status    StorageNodeStatus `json:"status" gorm:"type:enum('active','draining','removed');default:'active'"`
+	Zone      string            `json:"zone" gorm:"type:varchar(64);not null;default:''"`
+	Rack      string            `json:"rack" gorm:"type:varchar(64);not null;default:''"`
+	Host      string            `json:"host" gorm:"type:varchar(255);not null;default:''"`
+	Weight    int               `json:"weight" gorm:"not null;default:1"`
+	Tier      string            `json:"tier" gorm:"type:enum('hot','cold');not null;default:'hot'"`
+	// CapacityLimit caps the bytes placed on the node; 0 means the free space of its device
+	CapacityLimit  int64      `json:"capacity_limit" gorm:"not null;default:0"`
+	CapacityBytes  int64      `json:"-" gorm:"not null;default:0"` // effective capacity at the last measurement, 0 if unknown
+	UsedBytes      int64      `json:"-" gorm:"not null;default:0"`
+	ObjectCount    int64      `json:"-" gorm:"not null;default:0"`
+	UsageCheckedAt *time.Time `json:"usage_checked_at"`
+	// DrainStartedAt and DrainObjects record when draining began and how many
+	// shards and fragments the node held then, to report drain progress
+	DrainStartedAt *time.Time `json:"drain_started_at"`
+	DrainObjects   int64      `json:"drain_objects" gorm:"not null;default:0"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// Health of a node as shown to sysadmins
+const (
+	NodeHealthOK       = "ok"
+	NodeHealthFull     = "full"     // less than NodeFullPercent of its capacity left
+	NodeHealthDegraded = "degraded" // slow, read-only or failed its last probe
+	NodeHealthDown     = "down"     // failed repeated probes; reads and writes skip it
+	NodeHealthOffline  = "offline"  // not attached to the storage service
+)
+
+// NodeFullPercent is the share of free space below which a node counts as full
+const NodeFullPercent = 1
+
+// StorageNodeSummary is a registry entry together with the objects placed on it
+type StorageNodeSummary struct {
+	StorageNode
+	Online        bool                `json:"online"`
+	Health        string              `json:"health"`
+	Probe         services.NodeHealth `json:"probe"`
+	ShardCount    int64               `json:"shard_count"`
+	FragmentCount int64               `json:"fragment_count"`
+	ObjectCount   int64               `json:"object_count"`   // objects on the node at the last measurement
+	CapacityBytes int64               `json:"capacity_bytes"` // 0 if unlimited or unknown
+	UsedBytes     int64               `json:"used_bytes"`
+	FreeBytes     int64               `json:"free_bytes"` // -1 if unlimited or unknown
+	UsagePercent  float64             `json:"usage_percent"`
+}
+
+// StorageConfig decodes the backend settings of the node and adds its secrets
+func (n *StorageNode) StorageConfig() (services.StorageNodeConfig, error) {
+	var cfg services.StorageNodeConfig
+	if err := json.Unmarshal([]byte(n.Config), &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to decode config of node %d: %w", n.NodeIndex, err)
+	}
+	services.ApplyStorageNodeSecrets(&cfg, n.NodeIndex)
+	return cfg, nil
+}
+
+// Topology returns the failure domains, weight and tier used for placement
+func (n *StorageNode) Topology() services.NodeTopology {
+	return services.NodeTopology{
+		Zone:   n.Zone,
+		Rack:   n.Rack,
+		Host:   n.Host,
+		Weight: n.Weight,
+		Tier:   n.Tier,
+	}
+}
+
+func validateTopology(topology services.NodeTopology) error {
+	if topology.Weight < 1 || topology.Weight > services.MaxNodeWeight {
+		return fmt.Errorf("weight must be between 1 and %d", services.MaxNodeWeight)
+	}
+	if len(topology.Zone) > 64 || len(topology.Rack) > 64 || len(topology.Host) > 255 {
+		return fmt.Errorf("zone, rack or host label is too long")
+	}
+	if !services.ValidTier(topology.Tier) {
+		return fmt.Errorf("tier must be %q or %q", services.TierHot, services.TierCold)
+	}
+	return nil
+}
+
+type StorageNodeModel struct {
+	db      *gorm.DB
+	storage *services.DistributedStorageService
+}
+
+func NewStorageNodeModel(db *gorm.DB, storage *services.DistributedStorageService) *StorageNodeModel {
+	return &StorageNodeModel{
+		db:      db,
+		storage: storage,
+	}
+}
+
+// Seed creates the registry from the static node configuration on first start.
+// Node i keeps index i so that placements written before the registry existed
+// remain valid.
+func (m *StorageNodeModel) Seed(configs []services.StorageNodeConfig) error {
+	var count int64
+	if err := m.db.Model(&StorageNode{}).Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to check storage nodes: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	for i, cfg := range configs {
+		encoded, err := json.Marshal(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to encode config of node %d: %w", i, err)
+		}
+
+		node := &StorageNode{
+			NodeIndex: i,
+			Name:      fmt.Sprintf("node_%d", i),
+			Backend:   cfg.Backend,
+			Config:    string(encoded),
+			Status:    StorageNodeActive,
+			Weight:    1,
+		}
+		if err := m.db.Create(node).Error; err != nil {
+			return fmt.Errorf("failed to register node %d: %w", i, err)
+		}
+	}
+
+	log.Printf("Seeded storage node registry with %d nodes", len(configs))
+	return nil
+}
+
+// Load registers every active and draining node with the storage service
+func (m *StorageNodeModel) Load() error {
+	var nodes []StorageNode
+	if err := m.db.Where("status <> ?", StorageNodeRemoved).
+		Order("node_index asc").
+		Find(&nodes).Error; err != nil {
+		return fmt.Errorf("failed to load storage nodes: %w", err)
+	}
+
+	for _, node := range nodes {
+		if err := m.attach(&node); err != nil {
+			return err
+		}
+	}
+
+	if len(m.storage.WritableNodes()) == 0 {
+		return fmt.Errorf("no active storage nodes configured")
+	}
+
+	log.Printf("Loaded %d storage nodes from registry", len(nodes))
+	return nil
+}
+
+func (m *StorageNodeModel) attach(node *StorageNode) error {
+	cfg, err := node.StorageConfig()
+	if err != nil {
+		return err
+	}
+
+	backend, err := services.NewStorageBackend(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize node %d: %w", node.NodeIndex, err)
+	}
+
+	if err := m.storage.AddNode(node.NodeIndex, backend, node.Status == StorageNodeActive); err != nil {
+		return err
+	}
+	if err := m.storage.SetNodeTopology(node.NodeIndex, node.Topology()); err != nil {
+		return err
+	}
+
+	// Place by the last measurement until the capacity job measures again
+	usage := services.NodeUsage{CapacityBytes: node.CapacityBytes, UsedBytes: node.UsedBytes}
+	if usage.CapacityBytes == 0 {
+		usage.CapacityBytes = node.CapacityLimit
+	}
+	if node.UsageCheckedAt != nil {
+		usage.UpdatedAt = *node.UsageCheckedAt
+	}
+	m.storage.SetNodeUsage(node.NodeIndex, usage)
+	return nil
+}
+
+// RefreshUsage measures every attached node and stores the result, so
+// placement sees deletes and writes made by other processes. A node that
+// can't be measured keeps its previous figures.
+func (m *StorageNodeModel) RefreshUsage() error {
+	var nodes []StorageNode
+	if err := m.db.Where("status <> ?", StorageNodeRemoved).Find(&nodes).Error; err != nil {
+		return fmt.Errorf("failed to load storage nodes: %w", err)
+	}
+
+	for i := range nodes {
+		if !m.storage.HasNode(nodes[i].NodeIndex) {
+			continue
+		}
+		if err := m.refreshNode(&nodes[i]); err != nil {
+			log.Printf("Error measuring storage node %d: %v", nodes[i].NodeIndex, err)
+		}
+	}
+	return nil
+}
+
+func (m *StorageNodeModel) refreshNode(node *StorageNode) error {
+	measured, err := m.storage.MeasureUsage(node.NodeIndex)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	node.CapacityBytes = services.EffectiveCapacity(node.CapacityLimit, measured)
+	node.UsedBytes = measured.UsedBytes
+	node.ObjectCount = measured.ObjectCount
+	node.UsageCheckedAt = &now
+	if err := m.db.Model(node).Updates(map[string]interface{}{
+		"capacity_bytes":   node.CapacityBytes,
+		"used_bytes":       node.UsedBytes,
+		"object_count":     node.ObjectCount,
+		"usage_checked_at": now,
+	}).Error; err != nil {
+		return fmt.Errorf("failed to save usage of node %d: %w", node.NodeIndex, err)
+	}
+
+	m.storage.SetNodeUsage(node.NodeIndex, services.NodeUsage{
+		CapacityBytes: node.CapacityBytes,
+		UsedBytes:     node.UsedBytes,
+		UpdatedAt:     now,
+	})
+	return nil
+}
+
+// SetCapacityLimit caps the bytes placed on a node; 0 removes the cap
+func (m *StorageNodeModel) SetCapacityLimit(nodeIndex int, limit int64) (*StorageNode, error) {
+	if limit < 0 {
+		return nil, fmt.Errorf("capacity limit cannot be negative")
+	}
+	node, err := m.GetNode(nodeIndex)
+	if err != nil {
+		return nil, err
+	}
+	if node.Status == StorageNodeRemoved {
+		return nil, fmt.Errorf("node %d is %s", nodeIndex, node.Status)
+	}
+
+	if err := m.db.Model(node).Update("capacity_limit", limit).Error; err != nil {
+		return nil, fmt.Errorf("failed to update node %d: %w", nodeIndex, err)
+	}
+	node.CapacityLimit = limit
+	if m.storage.HasNode(nodeIndex) {
+		if err := m.refreshNode(node); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Storage node %d capacity limit set to %d bytes", nodeIndex, limit)
+	return node, nil
+}
+
+// GetNode returns a registry entry by node index
+func (m *StorageNodeModel) GetNode(nodeIndex int) (*StorageNode, error) {
+	var node StorageNode
+	if err := m.db.Where("node_index = ?", nodeIndex).First(&node).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrStorageNodeNotFound
+		}
+		return nil, fmt.Errorf("failed to get storage node: %w", err)
+	}
+	return &node, nil
+}
+
+// ListNodes returns every registered node with its placement counts
+func (m *StorageNodeModel) ListNodes() ([]StorageNodeSummary, error) {
+	var nodes []StorageNode
+	if err := m.db.Order("node_index asc").Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to list storage nodes: %w", err)
+	}
+
+	summaries := make([]StorageNodeSummary, 0, len(nodes))
+	for _, node := range nodes {
+		shards, fragments, err := m.CountObjects(node.NodeIndex)
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, m.summarize(node, shards, fragments))
+	}
+	return summaries, nil
+}
+
+func (m *StorageNodeModel) summarize(node StorageNode, shards, fragments int64) StorageNodeSummary {
+	summary := StorageNodeSummary{
+		StorageNode:   node,
+		Online:        m.storage.HasNode(node.NodeIndex),
+		Health:        NodeHealthOK,
+		ShardCount:    shards,
+		FragmentCount: fragments,
+		ObjectCount:   node.ObjectCount,
+	}
+
+	// Attached nodes include writes made since the last measurement
+	usage := services.NodeUsage{CapacityBytes: node.CapacityBytes, UsedBytes: node.UsedBytes}
+	if summary.Online {
+		usage = m.storage.NodeUsage(node.NodeIndex)
+		summary.Probe = m.storage.NodeHealth(node.NodeIndex)
+	} else {
+		summary.Health = NodeHealthOffline
+	}
+	summary.CapacityBytes = usage.CapacityBytes
+	summary.UsedBytes = usage.UsedBytes
+	summary.FreeBytes = usage.FreeBytes()
+	if usage.CapacityBytes > 0 {
+		summary.UsagePercent = float64(usage.UsedBytes) * 100 / float64(usage.CapacityBytes)
+		if summary.Online && summary.FreeBytes*100 < usage.CapacityBytes*NodeFullPercent {
+			summary.Health = NodeHealthFull
+		}
+	}
+
+	// A failing node is reported as such even if it is also full
+	switch summary.Probe.State {
+	case services.NodeDown:
+		summary.Health = NodeHealthDown
+	case services.NodeDegraded:
+		summary.Health = NodeHealthDegraded
+	}
+	return summary
+}
+
+// CountObjects returns how many shards and key fragments are placed on a node
+func (m *StorageNodeModel) CountObjects(nodeIndex int) (shards int64, fragments int64, err error) {
+	if err = m.db.Model(&ShardLocation{}).Where("node_index = ?", nodeIndex).Count(&shards).Error; err != nil {
+		return 0, 0, fmt.Errorf("failed to count shards on node %d: %w", nodeIndex, err)
+	}
+	if err = m.db.Model(&KeyFragment{}).Where("node_index = ?", nodeIndex).Count(&fragments).Error; err != nil {
+		return 0, 0, fmt.Errorf("failed to count fragments on node %d: %w", nodeIndex, err)
+	}
+	return shards, fragments, nil
+}
+
+// AddNode registers a new node under the next unused index and makes it
+// available for new placements immediately
+func (m *StorageNodeModel) AddNode(name string, cfg services.StorageNodeConfig, topology services.NodeTopology, capacityLimit int64) (*StorageNode, error) {
+	if err := validateTopology(topology); err != nil {
+		return nil, err
+	}
+	if capacityLimit < 0 {
+		return nil, fmt.Errorf("capacity limit cannot be negative")
+	}
+
+	var node *StorageNode
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		var maxIndex int
+		if err := tx.Model(&StorageNode{}).Select("COALESCE(MAX(node_index), -1)").Row().Scan(&maxIndex); err != nil {
+			return fmt.Errorf("failed to allocate node index: %w", err)
+		}
+		nodeIndex := maxIndex + 1
+
+		if name == "" {
+			name = fmt.Sprintf("node_%d", nodeIndex)
+		}
+
+		encoded, err := json.Marshal(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to encode node config: %w", err)
+		}
+
+		node = &StorageNode{
+			NodeIndex:     nodeIndex,
+			Name:          name,
+			Backend:       cfg.Backend,
+			Config:        string(encoded),
+			Status:        StorageNodeActive,
+			Zone:          topology.Zone,
+			Rack:          topology.Rack,
+			Host:          topology.Host,
+			Weight:        topology.Weight,
+			Tier:          topology.Tier,
+			CapacityLimit: capacityLimit,
+		}
+		if err := tx.Create(node).Error; err != nil {
+			return fmt.Errorf("failed to register node: %w", err)
+		}
+
+		// Attach before committing so a misconfigured node never lands in the registry
+		return m.attach(node)
+	})
+	if err != nil {
+		if node != nil && m.storage.HasNode(node.NodeIndex) {
+			m.storage.RemoveNode(node.NodeIndex)
+		}
+		return nil, err
+	}
+
+	if err := m.refreshNode(node); err != nil {
+		log.Printf("Error measuring storage node %d: %v", node.NodeIndex, err)
+	}
+
+	log.Printf("Added storage node %d (%s, %s)", node.NodeIndex, node.Name, node.Backend)
+	return node, nil
+}
+
+// SetTopology relabels a node. New placements use the labels right away; the
+// rebalancer moves existing objects that now break the placement policy.
+func (m *StorageNodeModel) SetTopology(nodeIndex int, topology services.NodeTopology) (*StorageNode, error) {
+	if err := validateTopology(topology); err != nil {
+		return nil, err
+	}
+	node, err := m.GetNode(nodeIndex)
+	if err != nil {
+		return nil, err
+	}
+	if node.Status == StorageNodeRemoved {
+		return nil, fmt.Errorf("node %d is %s", nodeIndex, node.Status)
+	}
+
+	if err := m.db.Model(node).Updates(map[string]interface{}{
+		"zone":   topology.Zone,
+		"rack":   topology.Rack,
+		"host":   topology.Host,
+		"weight": topology.Weight,
+		"tier":   topology.Tier,
+	}).Error; err != nil {
+		return nil, fmt.Errorf("failed to update node %d: %w", nodeIndex, err)
+	}
+	node.Zone, node.Rack, node.Host, node.Weight = topology.Zone, topology.Rack, topology.Host, topology.Weight
+	node.Tier = topology.Tier
+	if m.storage.HasNode(nodeIndex) {
+		if err := m.storage.SetNodeTopology(nodeIndex, topology); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Storage node %d is now in zone %q, rack %q, host %q with weight %d on the %s tier",
+		nodeIndex, topology.Zone, topology.Rack, topology.Host, topology.Weight, topology.Tier)
+	return node, nil
+}
+
+// DrainProgress reports how far a node is from holding nothing
+type DrainProgress struct {
+	NodeIndex      int               `json:"node_index"`
+	Status         StorageNodeStatus `json:"status"`
+	StartedAt      *time.Time        `json:"started_at"`
+	TotalObjects   int64             `json:"total_objects"` // shards and fragments on the node when draining started
+	ShardsLeft     int64             `json:"shards_left"`
+	FragmentsLeft  int64             `json:"fragments_left"`
+	StoredObjects  int               `json:"stored_objects"` // objects of any kind still on the node, -1 if it can't be listed
+	PercentDone    float64           `json:"percent_done"`
+	Removable      bool              `json:"removable"`
+	RemovableError string            `json:"removable_error,omitempty"`
+}
+
+// DrainProgress returns the drain state of a node. A node is removable once it
+// is draining, no rows point at it and its storage holds no objects at all.
+func (m *StorageNodeModel) DrainProgress(nodeIndex int) (*DrainProgress, error) {
+	node, err := m.GetNode(nodeIndex)
+	if err != nil {
+		return nil, err
+	}
+	shards, fragments, err := m.CountObjects(nodeIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	progress := &DrainProgress{
+		NodeIndex:     nodeIndex,
+		Status:        node.Status,
+		StartedAt:     node.DrainStartedAt,
+		TotalObjects:  node.DrainObjects,
+		ShardsLeft:    shards,
+		FragmentsLeft: fragments,
+		StoredObjects: -1,
+	}
+	if objects, err := m.storage.ListObjects(nodeIndex); err == nil {
+		progress.StoredObjects = len(objects)
+	}
+
+	left := shards + fragments
+	switch {
+	case left == 0:
+		progress.PercentDone = 100
+	case node.DrainObjects > left:
+		progress.PercentDone = float64(node.DrainObjects-left) * 100 / float64(node.DrainObjects)
+	}
+
+	if err := m.checkRemovable(node, shards, fragments); err != nil {
+		progress.RemovableError = err.Error()
+	} else {
+		progress.Removable = true
+	}
+	return progress, nil
+}
+
+// checkRemovable fails unless a node is draining and holds nothing, neither in
+// the database nor on its storage. Nodes that aren't attached can't be listed,
+// so only the database is checked for them.
+func (m *StorageNodeModel) checkRemovable(node *StorageNode, shards, fragments int64) error {
+	if node.Status != StorageNodeDraining {
+		return fmt.Errorf("node %d must be drained before removal", node.NodeIndex)
+	}
+	if shards > 0 || fragments > 0 {
+		return fmt.Errorf("%w: %d shards, %d fragments", ErrStorageNodeInUse, shards, fragments)
+	}
+	if !m.storage.HasNode(node.NodeIndex) {
+		return nil
+	}
+
+	objects, err := m.storage.ListObjects(node.NodeIndex)
+	if err != nil {
+		return fmt.Errorf("cannot verify node %d is empty: %w", node.NodeIndex, err)
+	}
+	if len(objects) > 0 {
+		return fmt.Errorf("%w: %d objects left on its storage", ErrStorageNodeInUse, len(objects))
+	}
+	return nil
+}
+
+// DrainNode stops new placements on a node; the rebalancer then moves its data away
+func (m *StorageNodeModel) DrainNode(nodeIndex int) error {
+	node, err := m.GetNode(nodeIndex)
+	if err != nil {
+		return err
+	}
+	if node.Status != StorageNodeActive {
+		return fmt.Errorf("node %d is %s", nodeIndex, node.Status)
+	}
+
+	writable := m.storage.WritableNodes()
+	if len(writable) == 1 && writable[0] == nodeIndex {
+		return fmt.Errorf("cannot drain the last active storage node")
+	}
+
+	shards, fragments, err := m.CountObjects(nodeIndex)
+	if err != nil {
+		return err
+	}
+	if err := m.setStatus(node, StorageNodeDraining, map[string]interface{}{
+		"drain_started_at": time.Now(),
+		"drain_objects":    shards + fragments,
+	}); err != nil {
+		return err
+	}
+	return m.storage.SetNodeWritable(nodeIndex, false)
+}
+
+// ActivateNode returns a draining node to service
+func (m *StorageNodeModel) ActivateNode(nodeIndex int) error {
+	node, err := m.GetNode(nodeIndex)
+	if err != nil {
+		return err
+	}
+	if node.Status != StorageNodeDraining {
+		return fmt.Errorf("node %d is %s", nodeIndex, node.Status)
+	}
+
+	if err := m.setStatus(node, StorageNodeActive, map[string]interface{}{
+		"drain_started_at": nil,
+		"drain_objects":    0,
+	}); err != nil {
+		return err
+	}
+	return m.storage.SetNodeWritable(nodeIndex, true)
+}
+
+// RemoveNode retires a drained node. The registry row is kept so the index is
+// never handed out again.
+func (m *StorageNodeModel) RemoveNode(nodeIndex int) error {
+	node, err := m.GetNode(nodeIndex)
+	if err != nil {
+		return err
+	}
+	shards, fragments, err := m.CountObjects(nodeIndex)
+	if err != nil {
+		return err
+	}
+	if err := m.checkRemovable(node, shards, fragments); err != nil {
+		return err
+	}
+
+	if err := m.setStatus(node, StorageNodeRemoved, nil); err != nil {
+		return err
+	}
+	m.storage.RemoveNode(nodeIndex)
+	return nil
+}
+
+// setStatus changes the status of a node together with any other columns given
+func (m *StorageNodeModel) setStatus(node *StorageNode, status StorageNodeStatus, fields map[string]interface{}) error {
+	updates := map[string]interface{}{"status": status}
+	for column, value := range fields {
+		updates[column] = value
+	}
+	if err := m.db.Model(node).Updates(updates).Error; err != nil {
+		return fmt.Errorf("failed to update node %d: %w", node.NodeIndex, err)
+	}
+	log.Printf("Storage node %d is now %s", node.NodeIndex, status)
+	return nil
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"fmt"
+	"safesplit/services"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// StripeIndex records how a file stored with services.LayoutStriped was cut
+// into stripes, along with the checksum of every piece. The manifest covers it
+// through ShardManifest.StripeIndexChecksum.
+type StripeIndex struct {
+	FileID      uint      `json:"file_id" gorm:"primaryKey;autoIncrement:false"`
+	StripeSize  int64     `json:"stripe_size" gorm:"not null"`
+	ContentSize int64     `json:"content_size" gorm:"not null"`
+	Checksums   []byte    `json:"-" gorm:"type:longblob;not null"` // SHA-256 per piece, stripe by stripe
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (StripeIndex) TableName() string {
+	return "stripe_indexes"
+}
+
+// Layout returns the stripe layout of file described by the index
+func (i *StripeIndex) Layout(file *File) services.StripeLayout {
+	return services.StripeLayout{
+		DataShards:   int(file.DataShardCount),
+		ParityShards: int(file.ParityShardCount),
+		StripeSize:   i.StripeSize,
+		ContentSize:  i.ContentSize,
+	}
+}
+
+// SaveStripeIndex stores the stripe index produced by StoreStriped
+func SaveStripeIndex(tx *gorm.DB, fileID uint, layout services.StripeLayout, checksums []byte) error {
+	index := &StripeIndex{
+		FileID:      fileID,
+		StripeSize:  layout.StripeSize,
+		ContentSize: layout.ContentSize,
+		Checksums:   checksums,
+	}
+	if err := tx.Create(index).Error; err != nil {
+		return fmt.Errorf("failed to save stripe index: %w", err)
+	}
+	return nil
+}
+
+// GetStripeIndex returns the stripe index of a striped file
+func (m *FileModel) GetStripeIndex(fileID uint) (*StripeIndex, error) {
+	return LoadStripeIndex(m.db, fileID)
+}
+
+// LoadStripeIndex is GetStripeIndex for callers without a FileModel
+func LoadStripeIndex(db *gorm.DB, fileID uint) (*StripeIndex, error) {
+	var index StripeIndex
+	if err := db.Where("file_id = ?", fileID).First(&index).Error; err != nil {
+		return nil, fmt.Errorf("failed to get stripe index: %w", err)
+	}
+	return &index, nil
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UploadJournalEntry records the intent to write the shards and key fragments
+// of a file before its row is committed. It is written outside the upload
+// transaction, so after a crash it names the file ID whose objects may be on
+// the nodes without a committed row.
+type UploadJournalEntry struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	FileID    uint      `json:"file_id" gorm:"not null;uniqueIndex"`
+	UserID    uint      `json:"user_id" gorm:"not null"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (UploadJournalEntry) TableName() string {
+	return "upload_journal"
+}
+
+// reserveFileID assigns file the next file ID without creating its row, so
+// its objects can be stored under the ID before the transaction that creates
+// it. The row is inserted and rolled back: the database never hands out an
+// auto-increment value twice, even when the insert taking it didn't commit.
+// After a restart it may, but by then the upload is journaled and its objects
+// are removed by RecoverUploads before new uploads are accepted.
+func (m *FileModel) reserveFileID(file *File) error {
+	tx := m.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	defer tx.Rollback()
+	if err := m.CreateFile(tx, file); err != nil {
+		return fmt.Errorf("failed to reserve file ID: %w", err)
+	}
+	return nil
+}
+
+// journalUpload records that objects of fileID are about to be written
+func (m *FileModel) journalUpload(fileID, userID uint) (*UploadJournalEntry, error) {
+	// m.db rather than the upload transaction, so the entry commits right away
+	entry := &UploadJournalEntry{FileID: fileID, UserID: userID}
+	if err := m.db.Create(entry).Error; err != nil {
+		return nil, fmt.Errorf("failed to journal upload: %w", err)
+	}
+	return entry, nil
+}
+
+// resolveUpload completes or rolls back a journaled upload once its
+// transaction has ended. If the file row committed the entry is dropped,
+// otherwise the objects written for it are deleted first.
+func (m *FileModel) resolveUpload(entry *UploadJournalEntry) error {
+	var count int64
+	if err := m.db.Model(&File{}).Where("id = ?", entry.FileID).Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to check file %d: %w", entry.FileID, err)
+	}
+	if count == 0 {
+		log.Printf("Rolling back incomplete upload of file %d", entry.FileID)
+		if err := m.rsService.DeleteShards(entry.FileID); err != nil {
+			return fmt.Errorf("failed to roll back upload of file %d: %w", entry.FileID, err)
+		}
+	}
+
+	if err := m.db.Delete(entry).Error; err != nil {
+		return fmt.Errorf("failed to clear upload journal entry %d: %w", entry.ID, err)
+	}
+	return nil
+}
+
+// RecoverUploads resolves uploads journaled before the given time that were
+// interrupted by a crash. It should run at startup, before new uploads are
+// accepted, and returns the number of uploads resolved.
+func (m *FileModel) RecoverUploads(before time.Time) (int, error) {
+	var entries []UploadJournalEntry
+	if err := m.db.Where("created_at < ?", before).Order("id asc").Find(&entries).Error; err != nil {
+		return 0, fmt.Errorf("failed to load upload journal: %w", err)
+	}
+
+	resolved := 0
+	for i := range entries {
+		if err := m.resolveUpload(&entries[i]); err != nil {
+			log.Printf("Error recovering upload of file %d: %v", entries[i].FileID, err)
+			continue
+		}
+		resolved++
+	}
+	return resolved, nil
+}
+
+// JournaledUploadIDs returns the file IDs of uploads that haven't been resolved yet
+func JournaledUploadIDs(db *gorm.DB) ([]uint, error) {
+	var fileIDs []uint
+	if err := db.Model(&UploadJournalEntry{}).Pluck("file_id", &fileIDs).Error; err != nil {
+		return nil, fmt.Errorf("failed to load upload journal: %w", err)
+	}
+	return fileIDs, nil
+}
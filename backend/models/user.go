@@ -44,6 +44,17 @@ type UserStorageDetails struct {
 	StorageTotal       int64  `json:"storage_total"`
 }
 
+// Master key wrapping versions, see User.MasterKeyWrapVersion
+const (
+	// MasterKeyWrapLegacy master keys are wrapped under a KEK derived from the
+	// stored password hash, so the server could unwrap them on its own. They are
+	// re-wrapped at the user's next login.
+	MasterKeyWrapLegacy = 0
+	// MasterKeyWrapPassword master keys are wrapped under a KEK derived from the
+	// plaintext password, which the server only sees at login
+	MasterKeyWrapPassword = 1
+)
+
 // DefaultStorageQuota represents 5GB in bytes for free users
 const DefaultStorageQuota = int64(5 * 1024 * 1024 * 1024)
 
@@ -51,31 +62,36 @@ const DefaultStorageQuota = int64(5 * 1024 * 1024 * 1024)
 const PremiumStorageQuota = int64(50 * 1024 * 1024 * 1024)
 
 type User struct {
-	ID                  uint       `json:"id" gorm:"primaryKey"`
-	Username            string     `json:"username" gorm:"unique;not null"`
-	Email               string     `json:"email" gorm:"unique;not null"`
-	Password            string     `json:"-" gorm:"not null"`
-	MasterKeySalt       []byte     `json:"-" gorm:"type:binary(32);not null"`
-	MasterKeyNonce      []byte     `json:"-" gorm:"type:binary(16);not null"`
-	EncryptedMasterKey  []byte     `json:"-" gorm:"type:binary(64);not null"`
-	MasterKeyVersion    int        `json:"-" gorm:"not null;default:1"`
-	KeyLastRotated      *time.Time `json:"-"`
-	Role                string     `json:"role" gorm:"type:enum('end_user','premium_user','sys_admin','super_admin');default:'end_user'"`
-	ReadAccess          bool       `json:"read_access" gorm:"default:true"`
-	WriteAccess         bool       `json:"write_access" gorm:"default:true"`
-	TwoFactorEnabled    bool       `json:"two_factor_enabled" gorm:"default:false"`
-	TwoFactorSecret     string     `json:"-" gorm:"column:two_factor_secret"`
-	StorageQuota        int64      `json:"storage_quota" gorm:"default:5368709120"` // 5GB default
-	StorageUsed         int64      `json:"storage_used" gorm:"default:0"`
-	SubscriptionStatus  string     `json:"subscription_status" gorm:"type:enum('free','premium','cancelled');default:'free'"`
-	IsActive            bool       `json:"is_active" gorm:"default:true"`
-	LastLogin           *time.Time `json:"last_login"`
-	LastPasswordChange  time.Time  `json:"last_password_change" gorm:"autoCreateTime"`
-	FailedLoginAttempts int        `json:"failed_login_attempts" gorm:"default:0"`
-	AccountLockedUntil  *time.Time `json:"account_locked_until"`
-	ForcePasswordChange bool       `json:"force_password_change" gorm:"default:false"`
-	CreatedAt           time.Time  `json:"created_at" gorm:"autoCreateTime"`
-	UpdatedAt           time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
+	ID                   uint       `json:"id" gorm:"primaryKey"`
+	Username             string     `json:"username" gorm:"unique;not null"`
+	Email                string     `json:"email" gorm:"unique;not null"`
+	Password             string     `json:"-" gorm:"not null"`
+	MasterKeySalt        []byte     `json:"-" gorm:"type:binary(32);not null"`
+	MasterKeyNonce       []byte     `json:"-" gorm:"type:binary(16);not null"`
+	EncryptedMasterKey   []byte     `json:"-" gorm:"type:binary(64);not null"`
+	MasterKeyVersion     int        `json:"-" gorm:"not null;default:1"`
+	MasterKeyWrapVersion int        `json:"-" gorm:"not null;default:0"`
+	KDFParams            string     `json:"-" gorm:"column:kdf_params;type:varchar(64)"` // empty for PBKDF2 with services.PBKDF2Iterations
+	KeyLastRotated       *time.Time `json:"-"`
+	RecoveryPublicKey    []byte     `json:"-" gorm:"type:binary(32)"`    // X25519 key that social recovery shares are sealed to
+	EncryptedRecoveryKey []byte     `json:"-" gorm:"type:varbinary(48)"` // its private key, encrypted under the master key
+	RecoveryKeyNonce     []byte     `json:"-" gorm:"type:binary(16)"`
+	Role                 string     `json:"role" gorm:"type:enum('end_user','premium_user','sys_admin','super_admin');default:'end_user'"`
+	ReadAccess           bool       `json:"read_access" gorm:"default:true"`
+	WriteAccess          bool       `json:"write_access" gorm:"default:true"`
+	TwoFactorEnabled     bool       `json:"two_factor_enabled" gorm:"default:false"`
+	TwoFactorSecret      string     `json:"-" gorm:"column:two_factor_secret"`
+	StorageQuota         int64      `json:"storage_quota" gorm:"default:5368709120"` // 5GB default
+	StorageUsed          int64      `json:"storage_used" gorm:"default:0"`
+	SubscriptionStatus   string     `json:"subscription_status" gorm:"type:enum('free','premium','cancelled');default:'free'"`
+	IsActive             bool       `json:"is_active" gorm:"default:true"`
+	LastLogin            *time.Time `json:"last_login"`
+	LastPasswordChange   time.Time  `json:"last_password_change" gorm:"autoCreateTime"`
+	FailedLoginAttempts  int        `json:"failed_login_attempts" gorm:"default:0"`
+	AccountLockedUntil   *time.Time `json:"account_locked_until"`
+	ForcePasswordChange  bool       `json:"force_password_change" gorm:"default:false"`
+	CreatedAt            time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt            time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
 }
 
 type UserModel struct {
@@ -92,6 +108,7 @@ func NewUserModel(db *gorm.DB, twoFactorService *services.TwoFactorAuthService)
 
 // BeforeCreate hook to set up user security fields
 func (u *User) BeforeCreate(tx *gorm.DB) error {
+	password := u.Password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return fmt.Errorf("failed to hash password: %w", err)
@@ -109,26 +126,18 @@ func (u *User) BeforeCreate(tx *gorm.DB) error {
 	}
 	u.MasterKeySalt = salt
 
-	nonce, err := utils.GenerateNonce()
+	// Derive the KEK from the plaintext password so only the user can unwrap the master key
+	encryptedKey, nonce, kdfParams, err := u.wrapMasterKey(masterKey, password)
 	if err != nil {
 		return err
 	}
-	u.MasterKeyNonce = nonce
-
-	// Use hashed password for KEK derivation
-	kek, err := services.DeriveKeyEncryptionKey(string(hashedPassword), salt)
-	if err != nil {
-		return fmt.Errorf("failed to derive key encryption key: %w", err)
-	}
-
-	encryptedKey, err := services.EncryptMasterKey(masterKey, kek, nonce)
-	if err != nil {
-		return fmt.Errorf("failed to encrypt master key: %w", err)
-	}
 	u.EncryptedMasterKey = encryptedKey
+	u.MasterKeyNonce = nonce
+	u.KDFParams = kdfParams
 	u.MasterKeyVersion = 1
+	u.MasterKeyWrapVersion = MasterKeyWrapPassword
 
-	return nil
+	return u.setRecoveryKeyPair(masterKey)
 }
 
 // Create creates a new user with master key generation
@@ -223,6 +232,172 @@ func (m *UserModel) handleFailedLogin(user *User) error {
 	return nil
 }
 
+// VerifyPassword re-checks the password of a logged-in user before a
+// sensitive action, counting failures like failed logins
+func (m *UserModel) VerifyPassword(user *User, password string) error {
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		if lockErr := m.handleFailedLogin(user); lockErr != nil {
+			return lockErr
+		}
+		return errors.New("current password is incorrect")
+	}
+	return nil
+}
+
+// unwrapMasterKey decrypts the user's master key with the KEK derived from
+// their plaintext password, or from the stored hash for legacy master keys
+func (u *User) unwrapMasterKey(password string) ([]byte, error) {
+	var kek []byte
+	var err error
+	if u.MasterKeyWrapVersion == MasterKeyWrapLegacy {
+		kek, err = services.DeriveKeyEncryptionKey(u.Password, u.MasterKeySalt)
+	} else {
+		var params services.KDFParams
+		if params, err = services.ParseKDFParams(u.KDFParams, services.PBKDF2Iterations); err == nil {
+			kek, err = params.DeriveKey([]byte(password), u.MasterKeySalt)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key encryption key: %w", err)
+	}
+	masterKey, err := services.DecryptMasterKey(u.EncryptedMasterKey, kek, u.MasterKeyNonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt master key: %w", err)
+	}
+	return masterKey[:services.MasterKeySize], nil
+}
+
+// wrapMasterKey encrypts a master key under the KEK derived from the plaintext
+// password with the current KDF parameters, returning the wrapped key, its new
+// nonce and the encoded parameters
+func (u *User) wrapMasterKey(masterKey []byte, password string) ([]byte, []byte, string, error) {
+	params := services.DefaultKDFParams()
+	kek, err := params.DeriveKey([]byte(password), u.MasterKeySalt)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to derive key encryption key: %w", err)
+	}
+	nonce, err := utils.GenerateNonce()
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	encryptedKey, err := services.EncryptMasterKey(masterKey, kek, nonce)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to encrypt master key: %w", err)
+	}
+	return encryptedKey, nonce, params.String(), nil
+}
+
+// needsRewrap reports whether the master key is wrapped under the password
+// hash or with KDF parameters older than the current ones
+func (u *User) needsRewrap() bool {
+	if u.MasterKeyWrapVersion == MasterKeyWrapLegacy {
+		return true
+	}
+	params, err := services.ParseKDFParams(u.KDFParams, services.PBKDF2Iterations)
+	return err == nil && params.NeedsUpgrade()
+}
+
+// UnlockMasterKey unwraps the master key of a user who just logged in with
+// password. Legacy master keys and keys derived with older KDF parameters are
+// re-wrapped under the password with the current parameters on the way.
+func (m *UserModel) UnlockMasterKey(user *User, password string) ([]byte, error) {
+	masterKey, err := user.unwrapMasterKey(password)
+	if err != nil {
+		return nil, err
+	}
+	if len(user.RecoveryPublicKey) == 0 {
+		if err := m.ensureRecoveryKeyPair(user, masterKey); err != nil {
+			log.Printf("Warning: failed to create recovery key pair of user %d: %v", user.ID, err)
+		}
+	}
+	if !user.needsRewrap() {
+		return masterKey, nil
+	}
+
+	encryptedKey, nonce, kdfParams, err := user.wrapMasterKey(masterKey, password)
+	if err != nil {
+		return nil, err
+	}
+	// Only replace the key this login unwrapped, in case a password change got there first
+	result := m.db.Model(&User{}).
+		Where("id = ? AND master_key_nonce = ?", user.ID, user.MasterKeyNonce).
+		Updates(map[string]interface{}{
+			"encrypted_master_key":    encryptedKey,
+			"master_key_nonce":        nonce,
+			"master_key_wrap_version": MasterKeyWrapPassword,
+			"kdf_params":              kdfParams,
+		})
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to re-wrap master key: %w", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		user.EncryptedMasterKey = encryptedKey
+		user.MasterKeyNonce = nonce
+		user.MasterKeyWrapVersion = MasterKeyWrapPassword
+		user.KDFParams = kdfParams
+		log.Printf("Re-wrapped master key of user %d under their password with %s", user.ID, kdfParams)
+	}
+	return masterKey, nil
+}
+
+// setRecoveryKeyPair gives the user a new recovery key pair, the private key
+// encrypted under their master key
+func (u *User) setRecoveryKeyPair(masterKey []byte) error {
+	privateKey, publicKey, err := services.GenerateRecoveryKeyPair()
+	if err != nil {
+		return err
+	}
+	nonce, err := utils.GenerateNonce()
+	if err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	encryptedKey, err := services.EncryptMasterKey(privateKey, masterKey, nonce)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt recovery key: %w", err)
+	}
+	u.RecoveryPublicKey = publicKey
+	u.EncryptedRecoveryKey = encryptedKey
+	u.RecoveryKeyNonce = nonce
+	return nil
+}
+
+// ensureRecoveryKeyPair creates the recovery key pair of a user who signed up
+// before users had one
+func (m *UserModel) ensureRecoveryKeyPair(user *User, masterKey []byte) error {
+	pending := *user
+	if err := pending.setRecoveryKeyPair(masterKey); err != nil {
+		return err
+	}
+	result := m.db.Model(&User{}).
+		Where("id = ? AND recovery_public_key IS NULL", user.ID).
+		Updates(map[string]interface{}{
+			"recovery_public_key":    pending.RecoveryPublicKey,
+			"encrypted_recovery_key": pending.EncryptedRecoveryKey,
+			"recovery_key_nonce":     pending.RecoveryKeyNonce,
+		})
+	if result.Error != nil {
+		return fmt.Errorf("failed to store recovery key pair: %w", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		user.RecoveryPublicKey = pending.RecoveryPublicKey
+		user.EncryptedRecoveryKey = pending.EncryptedRecoveryKey
+		user.RecoveryKeyNonce = pending.RecoveryKeyNonce
+	}
+	return nil
+}
+
+// OpenRecoveryKey decrypts the recovery private key of the user with their master key
+func (u *User) OpenRecoveryKey(masterKey []byte) ([]byte, error) {
+	if len(u.EncryptedRecoveryKey) != 48 {
+		return nil, errors.New("user has no recovery key pair")
+	}
+	privateKey, err := services.DecryptMasterKey(u.EncryptedRecoveryKey, masterKey, u.RecoveryKeyNonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt recovery key: %w", err)
+	}
+	return privateKey, nil
+}
+
 // UpdateMasterKey updates the user's master key material
 func (u *User) UpdateMasterKey(db *gorm.DB, newEncryptedKey []byte) error {
 	if len(newEncryptedKey) != 64 {
@@ -707,7 +882,9 @@ func (m *UserModel) ResetPasswordWithFragments(
 	keyFragmentModel *KeyFragmentModel,
 	fileModel *FileModel,
 ) error {
-	return m.db.Transaction(func(tx *gorm.DB) error {
+	var replaced []*KeyFragment
+	var changedFiles []*File
+	err := m.db.Transaction(func(tx *gorm.DB) error {
 		var user User
 		if err := tx.First(&user, userID).Error; err != nil {
 			return fmt.Errorf("user not found: %w", err)
@@ -738,49 +915,22 @@ func (m *UserModel) ResetPasswordWithFragments(
 			}
 		}
 
-		// Store current password in history BEFORE updating to new one
-		if err := passwordHistoryModel.AddEntry(user.ID, user.Password); err != nil {
-			return fmt.Errorf("failed to store password history: %w", err)
-		}
-
-		// Get original encrypted master key
-		originalEncryptedKey := user.EncryptedMasterKey
-		log.Printf("Current encrypted master key: %x", originalEncryptedKey)
-
-		// Derive current KEK
-		currentKEK, err := services.DeriveKeyEncryptionKey(user.Password, user.MasterKeySalt)
-		if err != nil {
-			return fmt.Errorf("failed to derive current KEK: %w", err)
-		}
-
-		// First decrypt master key with current KEK
-		decryptedMasterKey, err := services.DecryptMasterKey(originalEncryptedKey, currentKEK, user.MasterKeyNonce)
-		if err != nil {
-			return fmt.Errorf("failed to decrypt master key: %w", err)
-		}
-
-		// Derive new KEK using already hashed password
-		newKEK, err := services.DeriveKeyEncryptionKey(string(hashedNewPassword), user.MasterKeySalt)
+		// Unwrap the master key with the current password
+		decryptedMasterKey, err := user.unwrapMasterKey(currentPassword)
 		if err != nil {
-			return fmt.Errorf("failed to derive new KEK: %w", err)
+			return err
 		}
 
-		// Generate new nonce for master key
-		masterKeyNonce, err := utils.GenerateNonce()
-		if err != nil {
-			return fmt.Errorf("failed to generate nonce: %w", err)
-		}
-
-		// Re-encrypt master key with new KEK
-		newEncryptedMasterKey, err := services.EncryptMasterKey(decryptedMasterKey, newKEK, masterKeyNonce)
+		// Re-wrap it under a KEK derived from the new plaintext password
+		newEncryptedMasterKey, masterKeyNonce, kdfParams, err := user.wrapMasterKey(decryptedMasterKey, newPassword)
 		if err != nil {
 			return fmt.Errorf("failed to re-encrypt master key: %w", err)
 		}
 
-		log.Printf("New encrypted master key: %x", newEncryptedMasterKey)
+		log.Printf("Re-wrapped master key of user %d (%d bytes)", user.ID, len(newEncryptedMasterKey))
 
-		// Store old password in history BEFORE updating
-		if err := passwordHistoryModel.AddEntry(user.ID, user.Password); err != nil {
+		// Store old password in history, within the transaction so a failed change doesn't record it
+		if err := tx.Create(&PasswordHistory{UserID: user.ID, PasswordHash: user.Password}).Error; err != nil {
 			return fmt.Errorf("failed to store password history: %w", err)
 		}
 
@@ -793,7 +943,7 @@ func (m *UserModel) ResetPasswordWithFragments(
 		// Use decrypted master key for fragments
 		userMasterKey := decryptedMasterKey[:32]
 
-		for _, file := range files {
+		for i, file := range files {
 			fragments, err := keyFragmentModel.GetUserFragmentsForFile(file.ID)
 			if err != nil {
 				if err.Error() == "record not found" {
@@ -803,6 +953,7 @@ func (m *UserModel) ResetPasswordWithFragments(
 				return fmt.Errorf("failed to get key fragments for file %d: %w", file.ID, err)
 			}
 
+			changed := false
 			for _, fragment := range fragments {
 				log.Printf("Processing fragment %d for file %d", fragment.FragmentIndex, file.ID)
 
@@ -818,51 +969,31 @@ func (m *UserModel) ResetPasswordWithFragments(
 					continue
 				}
 
-				// Generate new nonce for fragment
-				newFragmentNonce, err := utils.GenerateNonce()
-				if err != nil {
-					return fmt.Errorf("failed to generate nonce for fragment: %w", err)
-				}
-
-				// Re-encrypt with same decrypted master key
-				newEncryptedFragment, err := services.EncryptMasterKey(
-					decryptedFragment,
-					userMasterKey,
-					newFragmentNonce,
-				)
+				// Re-encrypt it under a new nonce next to the stored fragment
+				old, err := keyFragmentModel.ReplaceUserFragment(tx, &fragment.KeyFragment, decryptedFragment,
+					userMasterKey, user.MasterKeyVersion+1)
 				if err != nil {
-					return fmt.Errorf("failed to re-encrypt fragment: %w", err)
-				}
-
-				// Store re-encrypted fragment
-				if err := keyFragmentModel.storage.StoreFragment(
-					fragment.NodeIndex,
-					fragment.FragmentPath,
-					newEncryptedFragment,
-				); err != nil {
-					return fmt.Errorf("failed to store fragment: %w", err)
-				}
-
-				// Update fragment metadata
-				newVersion := user.MasterKeyVersion + 1
-				if err := tx.Model(&fragment.KeyFragment).Updates(map[string]interface{}{
-					"encryption_nonce":   newFragmentNonce,
-					"master_key_version": newVersion,
-				}).Error; err != nil {
-					return fmt.Errorf("failed to update fragment metadata: %w", err)
+					return err
 				}
+				replaced = append(replaced, old)
+				changed = true
+			}
+			if changed {
+				changedFiles = append(changedFiles, &files[i])
 			}
 		}
 
 		now := time.Now()
 		updates := map[string]interface{}{
-			"password":              string(hashedNewPassword),
-			"encrypted_master_key":  newEncryptedMasterKey,
-			"master_key_nonce":      masterKeyNonce,
-			"master_key_version":    user.MasterKeyVersion + 1,
-			"key_last_rotated":      now,
-			"last_password_change":  now,
-			"force_password_change": false,
+			"password":                string(hashedNewPassword),
+			"encrypted_master_key":    newEncryptedMasterKey,
+			"master_key_nonce":        masterKeyNonce,
+			"master_key_wrap_version": MasterKeyWrapPassword,
+			"kdf_params":              kdfParams,
+			"master_key_version":      user.MasterKeyVersion + 1,
+			"key_last_rotated":        now,
+			"last_password_change":    now,
+			"force_password_change":   false,
 		}
 
 		if err := tx.Model(&user).Updates(updates).Error; err != nil {
@@ -871,7 +1002,21 @@ func (m *UserModel) ResetPasswordWithFragments(
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	keyFragmentModel.deleteReplaced(replaced)
+	// The manifests record the fragment paths and nonces
+	for _, file := range changedFiles {
+		fileModel.RefreshManifest(file)
+	}
+	return nil
 }
+
+// updateKeyFragments moves the user fragments of every file of a user from
+// oldMasterKey to newMasterKey within tx. The superseded fragments are
+// returned to be deleted and the files to have their manifest refreshed once
+// tx commits.
 func (m *UserModel) updateKeyFragments(
 	tx *gorm.DB,
 	userID uint,
@@ -879,18 +1024,18 @@ func (m *UserModel) updateKeyFragments(
 	newMasterKey []byte,
 	keyFragmentModel *KeyFragmentModel,
 	fileModel *FileModel,
-) error {
+) ([]*KeyFragment, []*File, error) {
 	files, err := fileModel.ListAllUserFiles(userID)
 	if err != nil {
-		return fmt.Errorf("failed to get user files: %w", err)
+		return nil, nil, fmt.Errorf("failed to get user files: %w", err)
 	}
 
-	// Get the decrypted master key for the user
-	decryptedMasterKey := newMasterKey
-	for _, file := range files {
+	var replaced []*KeyFragment
+	var changedFiles []*File
+	for i, file := range files {
 		fragments, err := keyFragmentModel.GetUserFragmentsForFile(file.ID)
 		if err != nil {
-			return fmt.Errorf("failed to get key fragments for file %d: %w", file.ID, err)
+			return replaced, changedFiles, fmt.Errorf("failed to get key fragments for file %d: %w", file.ID, err)
 		}
 
 		for _, fragment := range fragments {
@@ -905,51 +1050,29 @@ func (m *UserModel) updateKeyFragments(
 				fragment.EncryptionNonce,
 			)
 			if err != nil {
-				return fmt.Errorf("failed to decrypt fragment %d for file %d: %w",
+				return replaced, changedFiles, fmt.Errorf("failed to decrypt fragment %d for file %d: %w",
 					fragment.FragmentIndex, file.ID, err)
 			}
 
-			// Generate new nonce
-			newNonce, err := utils.GenerateNonce()
-			if err != nil {
-				return fmt.Errorf("failed to generate nonce: %w", err)
-			}
-
-			log.Printf("Re-encrypting fragment with decrypted master key")
+			log.Printf("Re-encrypting fragment with new master key")
 
-			// Re-encrypt fragment with new decrypted master key
-			newEncryptedFragment, err := services.EncryptMasterKey(
-				decryptedFragment,
-				decryptedMasterKey,
-				newNonce,
-			)
-			if err != nil {
-				return fmt.Errorf("failed to re-encrypt fragment: %w", err)
+			version := 1
+			if fragment.MasterKeyVersion != nil {
+				version = *fragment.MasterKeyVersion + 1
 			}
-
-			// Store updated fragment
-			if err := keyFragmentModel.storage.StoreFragment(
-				fragment.NodeIndex,
-				fragment.FragmentPath,
-				newEncryptedFragment,
-			); err != nil {
-				return fmt.Errorf("failed to store fragment: %w", err)
-			}
-
-			// Update fragment metadata
-			updates := map[string]interface{}{
-				"encryption_nonce":   newNonce,
-				"master_key_version": gorm.Expr("master_key_version + ?", 1),
-			}
-
-			if err := tx.Model(&fragment.KeyFragment).Updates(updates).Error; err != nil {
-				return fmt.Errorf("failed to update fragment metadata: %w", err)
+			old, err := keyFragmentModel.ReplaceUserFragment(tx, &fragment.KeyFragment, decryptedFragment, newMasterKey, version)
+			if err != nil {
+				return replaced, changedFiles, err
 			}
+			replaced = append(replaced, old)
 
 			log.Printf("Successfully updated fragment %d for file %d",
 				fragment.FragmentIndex, file.ID)
 		}
+		if len(fragments) > 0 {
+			changedFiles = append(changedFiles, &files[i])
+		}
 	}
 
-	return nil
+	return replaced, changedFiles, nil
 }
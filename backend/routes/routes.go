@@ -6,6 +6,7 @@ import (
 	"safesplit/controllers/PremiumUser"
 	"safesplit/controllers/SuperAdmin"
 	"safesplit/controllers/SysAdmin"
+	"safesplit/jobs"
 	"safesplit/middleware"
 	"safesplit/models"
 	"safesplit/services"
@@ -15,7 +16,9 @@ import (
 )
 
 type RouteHandlers struct {
+	HealthController          *controllers.HealthController
 	LoginController           *controllers.LoginController
+	LogoutController          *controllers.LogoutController
 	SuperAdminLoginController *SuperAdmin.LoginController
 	CreateAccountController   *controllers.CreateAccountController
 	TwoFactorController       *EndUser.TwoFactorController
@@ -47,6 +50,8 @@ type EndUserHandlers struct {
 	SubscriptionController   *EndUser.SubscriptionController
 	ReportController         *EndUser.ReportController
 	FeedbackController       *EndUser.FeedbackController
+	RecoveryKitController    *EndUser.RecoveryKitController
+	SocialRecoveryController *EndUser.SocialRecoveryController
 }
 type PremiumUserHandlers struct {
 	FileRecoveryController      *PremiumUser.FileRecoveryController
@@ -60,6 +65,7 @@ type SuperAdminHandlers struct {
 	ViewSysAdminController   *SuperAdmin.ViewSysAdminController
 	DeleteSysAdminController *SuperAdmin.DeleteSysAdminController
 	SystemLogsController     *SuperAdmin.SystemLogsController
+	ServerKeyController      *SuperAdmin.ServerKeyController
 }
 
 type SysAdminHandlers struct {
@@ -72,6 +78,12 @@ type SysAdminHandlers struct {
 	ViewFeedbacksController          *SysAdmin.ViewFeedbacksController
 	ViewReportsController            *SysAdmin.ViewReportsController
 	ViewBillingRecordsController     *SysAdmin.ViewBillingRecordsController
+	StorageNodeController            *SysAdmin.StorageNodeController
+	StorageScrubController           *SysAdmin.StorageScrubController
+	StorageFsckController            *SysAdmin.StorageFsckController
+	StorageReencodeController        *SysAdmin.StorageReencodeController
+	DurabilityProfileController      *SysAdmin.DurabilityProfileController
+	SealController                   *SysAdmin.SealController
 }
 
 func NewRouteHandlers(
@@ -83,19 +95,34 @@ func NewRouteHandlers(
 	fileModel *models.FileModel,
 	folderModel *models.FolderModel,
 	fileShareModel *models.FileShareModel,
+	socialRecoveryModel *models.SocialRecoveryModel,
 	keyFragmentModel *models.KeyFragmentModel,
 	serverMasterKeyModel *models.ServerMasterKeyModel,
 	feedbackModel *models.FeedbackModel,
+	storageNodeModel *models.StorageNodeModel,
+	fileDurabilityModel *models.FileDurabilityModel,
+	durabilityProfileModel *models.DurabilityProfileModel,
+	rebalancer *jobs.Rebalancer,
+	scrubber *jobs.Scrubber,
+	fsck *jobs.Fsck,
+	reencoder *jobs.Reencoder,
+	keyRotator *jobs.KeyRotator,
 	encryptionService *services.EncryptionService,
 	shamirService *services.ShamirService,
 	compressionService *services.CompressionService,
 	rsService *services.ReedSolomonService,
+	storageService *services.DistributedStorageService,
+	sealService *services.SealService,
+	keyProvider services.KeyProvider,
+	sessionKeys *services.SessionKeyCache,
 	twoFactorService *services.TwoFactorAuthService,
 	emailService *services.SMTPEmailService,
 ) *RouteHandlers {
-	superAdminLoginController := SuperAdmin.NewLoginController(userModel)
+	superAdminLoginController := SuperAdmin.NewLoginController(userModel, sessionKeys)
 	return &RouteHandlers{
-		LoginController:           controllers.NewLoginController(userModel, billingModel, activityLogModel),
+		HealthController:          controllers.NewHealthController(db, storageService, keyProvider),
+		LoginController:           controllers.NewLoginController(userModel, billingModel, activityLogModel, sessionKeys),
+		LogoutController:          controllers.NewLogoutController(userModel, sessionKeys),
 		SuperAdminLoginController: superAdminLoginController,
 		CreateAccountController:   controllers.NewCreateAccountController(userModel, passwordHistoryModel),
 		TwoFactorController:       EndUser.NewTwoFactorController(userModel, twoFactorService),
@@ -105,6 +132,7 @@ func NewRouteHandlers(
 			ViewSysAdminController:   SuperAdmin.NewViewSysAdminController(userModel),
 			DeleteSysAdminController: SuperAdmin.NewDeleteSysAdminController(userModel),
 			SystemLogsController:     SuperAdmin.NewSystemLogsController(activityLogModel),
+			ServerKeyController:      SuperAdmin.NewServerKeyController(serverMasterKeyModel, keyProvider, keyRotator),
 		},
 		SysAdminHandlers: &SysAdminHandlers{
 			UpdateAccountController:          SysAdmin.NewUpdateAccountController(userModel),
@@ -116,71 +144,86 @@ func NewRouteHandlers(
 			ViewFeedbacksController:          SysAdmin.NewViewFeedbacksController(feedbackModel),
 			ViewReportsController:            SysAdmin.NewViewReportsController(feedbackModel, userModel),
 			ViewBillingRecordsController:     SysAdmin.NewViewBillingRecordsController(billingModel),
+			StorageNodeController:            SysAdmin.NewStorageNodeController(storageNodeModel, rebalancer),
+			StorageScrubController:           SysAdmin.NewStorageScrubController(fileDurabilityModel, scrubber),
+			StorageFsckController:            SysAdmin.NewStorageFsckController(fsck),
+			StorageReencodeController:        SysAdmin.NewStorageReencodeController(reencoder),
+			DurabilityProfileController:      SysAdmin.NewDurabilityProfileController(durabilityProfileModel),
+			SealController:                   SysAdmin.NewSealController(serverMasterKeyModel, sealService),
 		},
 		EndUserHandlers: &EndUserHandlers{
-			UploadFileController:     EndUser.NewFileController(fileModel, userModel, activityLogModel, encryptionService, shamirService, keyFragmentModel, compressionService, folderModel, rsService, serverMasterKeyModel),
-			MassUploadController:     EndUser.NewMassUploadFileController(fileModel, userModel, activityLogModel, encryptionService, shamirService, keyFragmentModel, compressionService, folderModel, rsService, serverMasterKeyModel),
+			UploadFileController:     EndUser.NewFileController(fileModel, userModel, activityLogModel, encryptionService, shamirService, keyFragmentModel, compressionService, folderModel, rsService, keyProvider, sessionKeys, durabilityProfileModel),
+			MassUploadController:     EndUser.NewMassUploadFileController(fileModel, userModel, activityLogModel, encryptionService, shamirService, keyFragmentModel, compressionService, folderModel, rsService, keyProvider, sessionKeys, durabilityProfileModel),
 			ViewFilesController:      EndUser.NewViewFilesController(fileModel, folderModel),
-			DownloadFileController:   EndUser.NewDownloadFileController(fileModel, keyFragmentModel, encryptionService, activityLogModel, compressionService, rsService, serverMasterKeyModel),
-			MassDownloadController:   EndUser.NewMassDownloadFileController(fileModel, keyFragmentModel, encryptionService, activityLogModel, compressionService, rsService, serverMasterKeyModel),
+			DownloadFileController:   EndUser.NewDownloadFileController(fileModel, keyFragmentModel, encryptionService, activityLogModel, compressionService, rsService, keyProvider, sessionKeys),
+			MassDownloadController:   EndUser.NewMassDownloadFileController(fileModel, keyFragmentModel, encryptionService, activityLogModel, compressionService, rsService, keyProvider, sessionKeys),
 			DeleteFileController:     EndUser.NewDeleteFileController(fileModel),
 			MassDeleteFileController: EndUser.NewMassDeleteFileController(fileModel),
 			ArchiveFileController:    EndUser.NewArchiveFileController(fileModel),
 			UnarchiveFileController:  EndUser.NewUnarchiveFileController(fileModel),
 			MassArchiveController:    EndUser.NewMassArchiveFileController(fileModel),
 			MassUnarchiveController:  EndUser.NewMassUnarchiveFileController(fileModel),
-			ShareFileController:      EndUser.NewShareFileController(fileModel, fileShareModel, keyFragmentModel, encryptionService, activityLogModel, rsService, userModel, serverMasterKeyModel, twoFactorService, emailService, compressionService),
+			ShareFileController:      EndUser.NewShareFileController(fileModel, fileShareModel, keyFragmentModel, encryptionService, activityLogModel, rsService, userModel, keyProvider, sessionKeys, twoFactorService, emailService, compressionService),
 			CreateFolderController:   EndUser.NewCreateFolderController(folderModel, activityLogModel),
 			ViewFolderController:     EndUser.NewViewFolderController(folderModel, fileModel),
 			DeleteFolderController:   EndUser.NewDeleteFolderController(folderModel, activityLogModel),
-			PasswordResetController:  EndUser.NewPasswordResetController(userModel, passwordHistoryModel, keyFragmentModel, fileModel),
+			PasswordResetController:  EndUser.NewPasswordResetController(userModel, passwordHistoryModel, keyFragmentModel, fileModel, sessionKeys),
 			ViewStorageController:    EndUser.NewViewStorageController(fileModel, userModel),
 			PaymentController:        EndUser.NewPaymentController(billingModel),
 			SubscriptionController:   EndUser.NewSubscriptionController(billingModel),
 			ReportController:         EndUser.NewReportController(feedbackModel, fileModel),
 			FeedbackController:       EndUser.NewFeedbackController(feedbackModel),
+			RecoveryKitController:    EndUser.NewRecoveryKitController(userModel, fileModel, keyFragmentModel, sessionKeys),
+			SocialRecoveryController: EndUser.NewSocialRecoveryController(socialRecoveryModel, userModel, passwordHistoryModel, sessionKeys, emailService),
 		},
 		PremiumUserHandlers: &PremiumUserHandlers{
 			FileRecoveryController:      PremiumUser.NewFileRecoveryController(fileModel),
-			AdvancedShareFileController: PremiumUser.NewShareFileController(fileModel, fileShareModel, keyFragmentModel, encryptionService, activityLogModel, rsService, userModel, serverMasterKeyModel, twoFactorService, emailService, compressionService),
+			AdvancedShareFileController: PremiumUser.NewShareFileController(fileModel, fileShareModel, keyFragmentModel, encryptionService, activityLogModel, rsService, userModel, keyProvider, sessionKeys, twoFactorService, emailService, compressionService),
 			UpdateBillingController:     PremiumUser.NewUpdateBillingController(billingModel),
 		},
 	}
 }
 
-func SetupRoutes(router *gin.Engine, handlers *RouteHandlers, userModel *models.UserModel) {
+func SetupRoutes(router *gin.Engine, handlers *RouteHandlers, userModel *models.UserModel, keyProvider services.KeyProvider) {
+	unsealed := middleware.UnsealedMiddleware(keyProvider)
 	api := router.Group("/api")
 	{
-		setupPublicRoutes(api, handlers)
+		setupPublicRoutes(api, handlers, unsealed)
 
 		protected := api.Group("")
 		protected.Use(middleware.AuthMiddleware(userModel))
-		setupProtectedRoutes(protected, handlers)
+		setupProtectedRoutes(protected, handlers, unsealed)
 	}
 }
 
-func setupPublicRoutes(api *gin.RouterGroup, handlers *RouteHandlers) {
+func setupPublicRoutes(api *gin.RouterGroup, handlers *RouteHandlers, unsealed gin.HandlerFunc) {
 	api.POST("/login", handlers.LoginController.Login)
 	api.POST("/super-login", handlers.SuperAdminLoginController.Login)
 	api.POST("/register", handlers.CreateAccountController.CreateAccount)
 
 	// Public share routes
-	api.GET("/files/share/:shareLink", handlers.EndUserHandlers.ShareFileController.AccessShare)
-	api.POST("/files/share/:shareLink", handlers.EndUserHandlers.ShareFileController.AccessShare)
-	api.POST("/files/share/:shareLink/verify", handlers.EndUserHandlers.ShareFileController.Verify2FAAndDownload)
+	api.GET("/files/share/:shareLink", unsealed, handlers.EndUserHandlers.ShareFileController.AccessShare)
+	api.POST("/files/share/:shareLink", unsealed, handlers.EndUserHandlers.ShareFileController.AccessShare)
+	api.POST("/files/share/:shareLink/verify", unsealed, handlers.EndUserHandlers.ShareFileController.Verify2FAAndDownload)
 
 	// Premium share routes
-	api.GET("/premium/shares/:shareLink", handlers.PremiumUserHandlers.AdvancedShareFileController.AccessShare)
-	api.POST("/premium/shares/:shareLink", handlers.PremiumUserHandlers.AdvancedShareFileController.AccessShare)
-	api.POST("/premium/shares/:shareLink/verify", handlers.PremiumUserHandlers.AdvancedShareFileController.Verify2FAAndDownload)
+	api.GET("/premium/shares/:shareLink", unsealed, handlers.PremiumUserHandlers.AdvancedShareFileController.AccessShare)
+	api.POST("/premium/shares/:shareLink", unsealed, handlers.PremiumUserHandlers.AdvancedShareFileController.AccessShare)
+	api.POST("/premium/shares/:shareLink/verify", unsealed, handlers.PremiumUserHandlers.AdvancedShareFileController.Verify2FAAndDownload)
 
-	api.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"status": "ok"})
-	})
+	// Social recovery of a locked-out account, confirmed through the owner's
+	// email and then authorized by the recovery code
+	api.POST("/social-recovery/requests", handlers.EndUserHandlers.SocialRecoveryController.StartRequest)
+	api.POST("/social-recovery/requests/confirm", handlers.EndUserHandlers.SocialRecoveryController.ConfirmRequest)
+	api.POST("/social-recovery/requests/:id/status", handlers.EndUserHandlers.SocialRecoveryController.RequestStatus)
+	api.POST("/social-recovery/requests/:id/complete", handlers.EndUserHandlers.SocialRecoveryController.CompleteRequest)
+
+	api.GET("/health", handlers.HealthController.Health)
 }
 
-func setupProtectedRoutes(protected *gin.RouterGroup, handlers *RouteHandlers) {
+func setupProtectedRoutes(protected *gin.RouterGroup, handlers *RouteHandlers, unsealed gin.HandlerFunc) {
 	protected.GET("/me", handlers.LoginController.GetMe)
+	protected.POST("/logout", handlers.LogoutController.Logout)
 
 	// 2FA routes
 	twoFactor := protected.Group("/2fa")
@@ -193,12 +236,12 @@ func setupProtectedRoutes(protected *gin.RouterGroup, handlers *RouteHandlers) {
 	}
 
 	// End User routes should be first as they're most commonly accessed
-	setupEndUserRoutes(protected, handlers.EndUserHandlers)
+	setupEndUserRoutes(protected, handlers.EndUserHandlers, unsealed)
 
 	// Premium User routes
 	premium := protected.Group("/premium")
 	premium.Use(middleware.PremiumUserMiddleware())
-	setupPremiumUserRoutes(premium, handlers.PremiumUserHandlers)
+	setupPremiumUserRoutes(premium, handlers.PremiumUserHandlers, unsealed)
 
 	// Admin routes with their respective middleware
 	superAdmin := protected.Group("/admin")
@@ -210,24 +253,26 @@ func setupProtectedRoutes(protected *gin.RouterGroup, handlers *RouteHandlers) {
 	setupSysAdminRoutes(sysAdmin, handlers.SysAdminHandlers)
 }
 
-func setupEndUserRoutes(protected *gin.RouterGroup, handlers *EndUserHandlers) {
+// Routes that encrypt or decrypt files go through unsealed, which refuses them while the server is sealed
+func setupEndUserRoutes(protected *gin.RouterGroup, handlers *EndUserHandlers, unsealed gin.HandlerFunc) {
 	protected.PUT("/reset-password", handlers.PasswordResetController.ResetPassword)
 	files := protected.Group("/files")
 	{
 		files.GET("", handlers.ViewFilesController.ListUserFiles)
-		files.GET("/:id/download", handlers.DownloadFileController.Download)
-		files.POST("/mass-download", handlers.MassDownloadController.MassDownload)
-		files.GET("/mass-download/:id", handlers.MassDownloadController.GetFile)
-		files.POST("/upload", handlers.UploadFileController.Upload)
-		files.POST("/mass-upload", handlers.MassUploadController.MassUpload)
+		files.GET("/:id/download", unsealed, handlers.DownloadFileController.Download)
+		files.POST("/mass-download", unsealed, handlers.MassDownloadController.MassDownload)
+		files.GET("/mass-download/:id", unsealed, handlers.MassDownloadController.GetFile)
+		files.POST("/upload", unsealed, handlers.UploadFileController.Upload)
+		files.POST("/mass-upload", unsealed, handlers.MassUploadController.MassUpload)
 		files.GET("/encryption/options", handlers.UploadFileController.GetEncryptionOptions)
+		files.GET("/durability/profiles", handlers.UploadFileController.GetDurabilityProfiles)
 		files.DELETE("/:id", handlers.DeleteFileController.Delete)
 		files.POST("/mass-delete", handlers.MassDeleteFileController.Delete)
 		files.PUT("/:id/archive", handlers.ArchiveFileController.Archive)
 		files.PUT("/:id/unarchive", handlers.UnarchiveFileController.Unarchive)
 		files.POST("/mass-archive", handlers.MassArchiveController.Archive)
 		files.POST("/mass-unarchive", handlers.MassUnarchiveController.Unarchive)
-		files.POST("/:id/share", handlers.ShareFileController.CreateShare)
+		files.POST("/:id/share", unsealed, handlers.ShareFileController.CreateShare)
 	}
 
 	folders := protected.Group("/folders")
@@ -261,8 +306,25 @@ func setupEndUserRoutes(protected *gin.RouterGroup, handlers *EndUserHandlers) {
 		reports.GET("", handlers.ReportController.GetUserReports)
 	}
 
+	recoveryKit := protected.Group("/recovery-kit")
+	{
+		recoveryKit.POST("/export", handlers.RecoveryKitController.Export)
+		recoveryKit.POST("/import", unsealed, handlers.RecoveryKitController.Import)
+	}
+
+	socialRecovery := protected.Group("/social-recovery")
+	{
+		socialRecovery.GET("", handlers.SocialRecoveryController.GetSetup)
+		socialRecovery.PUT("", handlers.SocialRecoveryController.Setup)
+		socialRecovery.DELETE("", handlers.SocialRecoveryController.RemoveSetup)
+		socialRecovery.POST("/requests/:id/cancel", handlers.SocialRecoveryController.CancelRequest)
+		socialRecovery.GET("/approvals", handlers.SocialRecoveryController.ListApprovals)
+		socialRecovery.POST("/approvals/:id/approve", handlers.SocialRecoveryController.Approve)
+		socialRecovery.POST("/approvals/:id/decline", handlers.SocialRecoveryController.Decline)
+	}
+
 }
-func setupPremiumUserRoutes(premium *gin.RouterGroup, handlers *PremiumUserHandlers) {
+func setupPremiumUserRoutes(premium *gin.RouterGroup, handlers *PremiumUserHandlers, unsealed gin.HandlerFunc) {
 
 	recovery := premium.Group("/recovery")
 	{
@@ -271,7 +333,7 @@ func setupPremiumUserRoutes(premium *gin.RouterGroup, handlers *PremiumUserHandl
 	}
 	shares := premium.Group("/shares")
 	{
-		shares.POST("/files/:id", handlers.AdvancedShareFileController.CreateShare)
+		shares.POST("/files/:id", unsealed, handlers.AdvancedShareFileController.CreateShare)
 	}
 	billing := premium.Group("/billing")
 	{
@@ -286,6 +348,9 @@ func setupSuperAdminRoutes(superAdmin *gin.RouterGroup, handlers *SuperAdminHand
 	superAdmin.GET("/sysadmins", handlers.ViewSysAdminController.ListSysAdmins)
 	superAdmin.DELETE("/sysadmins/:id", handlers.DeleteSysAdminController.DeleteSysAdmin)
 	superAdmin.GET("/system-logs", handlers.SystemLogsController.GetSystemLogs)
+
+	superAdmin.GET("/server-keys", handlers.ServerKeyController.ListServerKeys)
+	superAdmin.POST("/server-keys/rotate", handlers.ServerKeyController.RotateServerKey)
 }
 
 func setupSysAdminRoutes(sysAdmin *gin.RouterGroup, handlers *SysAdminHandlers) {
@@ -302,6 +367,54 @@ func setupSysAdminRoutes(sysAdmin *gin.RouterGroup, handlers *SysAdminHandlers)
 
 	sysAdmin.GET("/storage/stats", handlers.ViewUserStorageController.GetStorageStats)
 
+	nodes := sysAdmin.Group("/storage/nodes")
+	{
+		nodes.GET("", handlers.StorageNodeController.ListNodes)
+		nodes.POST("", handlers.StorageNodeController.AddNode)
+		nodes.PUT("/:index/topology", handlers.StorageNodeController.SetNodeTopology)
+		nodes.PUT("/:index/capacity", handlers.StorageNodeController.SetNodeCapacity)
+		nodes.PUT("/:index/drain", handlers.StorageNodeController.DrainNode)
+		nodes.GET("/:index/drain", handlers.StorageNodeController.GetDrainProgress)
+		nodes.PUT("/:index/activate", handlers.StorageNodeController.ActivateNode)
+		nodes.DELETE("/:index", handlers.StorageNodeController.RemoveNode)
+	}
+	sysAdmin.POST("/storage/rebalance", handlers.StorageNodeController.Rebalance)
+
+	scrub := sysAdmin.Group("/storage/scrub")
+	{
+		scrub.GET("", handlers.StorageScrubController.GetScrubStatus)
+		scrub.POST("", handlers.StorageScrubController.StartScrub)
+		scrub.GET("/files", handlers.StorageScrubController.ListProblemFiles)
+	}
+
+	fsck := sysAdmin.Group("/storage/fsck")
+	{
+		fsck.GET("", handlers.StorageFsckController.GetFsckStatus)
+		fsck.POST("", handlers.StorageFsckController.StartFsck)
+	}
+
+	seal := sysAdmin.Group("/seal")
+	{
+		seal.GET("", handlers.SealController.GetSealStatus)
+		seal.POST("", handlers.SealController.Seal)
+		seal.POST("/unseal", handlers.SealController.SubmitUnsealShare)
+		seal.DELETE("/unseal", handlers.SealController.ResetUnseal)
+	}
+
+	profiles := sysAdmin.Group("/durability-profiles")
+	{
+		profiles.GET("", handlers.DurabilityProfileController.ListProfiles)
+		profiles.POST("", handlers.DurabilityProfileController.CreateProfile)
+		profiles.PUT("/:id", handlers.DurabilityProfileController.UpdateProfile)
+		profiles.DELETE("/:id", handlers.DurabilityProfileController.DeleteProfile)
+	}
+
+	reencode := sysAdmin.Group("/storage/reencode")
+	{
+		reencode.GET("", handlers.StorageReencodeController.GetReencodeStatus)
+		reencode.POST("", handlers.StorageReencodeController.StartReencode)
+	}
+
 	feedback := sysAdmin.Group("/feedback")
 	{
 		feedback.GET("", handlers.ViewFeedbacksController.GetAllFeedbacks)
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrInsufficientCapacity is returned when the writable nodes don't have room
+// for a file's shards
+var ErrInsufficientCapacity = errors.New("not enough free space on the storage nodes")
+
+// BackendUsage is what a storage backend reports about the space it uses
+type BackendUsage struct {
+	UsedBytes   int64 `json:"used_bytes"`   // bytes held by the node's objects
+	ObjectCount int64 `json:"object_count"` // objects, including ones outside shards/ and fragments/
+	FreeBytes   int64 `json:"free_bytes"`   // space left on the underlying device, -1 if unknown
+}
+
+// UsageReporter is implemented by backends that can measure their usage
+// without a Stat per object
+type UsageReporter interface {
+	Usage() (*BackendUsage, error)
+}
+
+// NodeUsage is the capacity accounting of a node as used for placement
+type NodeUsage struct {
+	CapacityBytes int64     `json:"capacity_bytes"` // 0 when unlimited or unknown
+	UsedBytes     int64     `json:"used_bytes"`
+	UpdatedAt     time.Time `json:"updated_at"` // last measurement; writes since then are added to UsedBytes
+}
+
+// FreeBytes returns the space left on the node, or -1 when it is unlimited
+func (u NodeUsage) FreeBytes() int64 {
+	if u.CapacityBytes <= 0 {
+		return -1
+	}
+	return max(u.CapacityBytes-u.UsedBytes, 0)
+}
+
+// Fits reports whether size more bytes fit on the node
+func (u NodeUsage) Fits(size int64) bool {
+	free := u.FreeBytes()
+	return free < 0 || free >= size
+}
+
+// utilizationDecile is used/capacity in tenths, so nodes only compete on
+// fullness once they differ by a meaningful amount
+func (u NodeUsage) utilizationDecile() int {
+	if u.CapacityBytes <= 0 {
+		return 0
+	}
+	return int(min(u.UsedBytes*10/u.CapacityBytes, 10))
+}
+
+// EffectiveCapacity combines a configured limit with the measured usage: the
+// node can hold what it already uses plus whatever is left of the limit and
+// of its device. It returns 0 when neither is known.
+func EffectiveCapacity(configured int64, usage *BackendUsage) int64 {
+	switch {
+	case usage.FreeBytes < 0:
+		return configured
+	case configured <= 0:
+		return usage.UsedBytes + usage.FreeBytes
+	default:
+		return min(configured, usage.UsedBytes+usage.FreeBytes)
+	}
+}
+
+// SetNodeUsage replaces the capacity accounting of a node
+func (s *DistributedStorageService) SetNodeUsage(nodeIndex int, usage NodeUsage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usage[nodeIndex] = usage
+}
+
+// NodeUsage returns the capacity accounting of a node, including writes made
+// since it was last measured
+func (s *DistributedStorageService) NodeUsage(nodeIndex int) NodeUsage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.usage[nodeIndex]
+}
+
+// addUsage accounts for bytes written to a node. Deletes are only picked up by
+// the next measurement, so usage errs on the full side in between.
+func (s *DistributedStorageService) addUsage(nodeIndex int, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := s.usage[nodeIndex]
+	usage.UsedBytes += size
+	s.usage[nodeIndex] = usage
+}
+
+// MeasureUsage asks a node how much space its objects take
+func (s *DistributedStorageService) MeasureUsage(nodeIndex int) (*BackendUsage, error) {
+	node, err := s.node(nodeIndex)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := measureBackendUsage(node)
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure usage of node %d: %w", nodeIndex, err)
+	}
+	return usage, nil
+}
+
+// measureBackendUsage uses the backend's own report when it has one and
+// falls back to a Stat of every object
+func measureBackendUsage(backend StorageBackend) (*BackendUsage, error) {
+	if reporter, ok := backend.(UsageReporter); ok {
+		return reporter.Usage()
+	}
+
+	keys, err := backend.List("")
+	if err != nil {
+		return nil, err
+	}
+	usage := &BackendUsage{FreeBytes: -1}
+	for _, key := range keys {
+		info, err := backend.Stat(key)
+		if err != nil {
+			if errors.Is(err, ErrObjectNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		usage.UsedBytes += info.Size
+		usage.ObjectCount++
+	}
+	return usage, nil
+}
+
+// Usage sums the files below the node directory, including temporary files
+// of writes in progress, and reports the space left on its filesystem
+func (b *LocalStorageBackend) Usage() (*BackendUsage, error) {
+	usage := &BackendUsage{}
+	err := filepath.WalkDir(b.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		usage.UsedBytes += info.Size()
+		usage.ObjectCount++
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure %s: %w", b.root, err)
+	}
+
+	usage.FreeBytes = diskFreeBytes(b.root)
+	return usage, nil
+}
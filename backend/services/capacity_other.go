@@ -0,0 +1,9 @@
+//go:build !unix
+
+package services
+
+// diskFreeBytes can't query the filesystem on this platform; capacity then
+// comes from the node's configured limit only
+func diskFreeBytes(dir string) int64 {
+	return -1
+}
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"io"
 	"log"
 	"sync"
 
@@ -66,3 +67,32 @@ func (s *CompressionService) Close() {
 		s.decoder.Close()
 	}
 }
+
+// CompressBound is the largest size content of size bytes can have once
+// compressed by NewWriter, the bound the zstd format guarantees
+func CompressBound(size int64) int64 {
+	bound := size + size>>8
+	if size < 128<<10 {
+		bound += (128<<10 - size) >> 11
+	}
+	return bound
+}
+
+// NewWriter returns a writer that compresses what is written to it to w, with
+// the settings of Compress. Every stream gets its own encoder so uploads don't
+// wait for each other; Close flushes it without closing w.
+func (s *CompressionService) NewWriter(w io.Writer) (*zstd.Encoder, error) {
+	return zstd.NewWriter(w,
+		zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+		zstd.WithEncoderConcurrency(1),
+	)
+}
+
+// NewReader returns a reader of the decompressed content of r
+func (s *CompressionService) NewReader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
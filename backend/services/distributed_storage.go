@@ -1,10 +1,16 @@
 package services
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"sync"
 )
 
 type StoredShare struct {
@@ -16,190 +22,436 @@ type StoredShare struct {
 	ServerKeyID      *string `json:"server_key_id,omitempty"`
 }
 
+// DistributedStorageService spreads shards and key fragments over a set of
+// storage nodes. Nodes are addressed by a stable node index that is recorded
+// with every shard and fragment, so membership can change at runtime without
+// invalidating existing placements.
 type DistributedStorageService struct {
-	basePath  string
-	nodePaths []string
+	mu       sync.RWMutex
+	nodes    map[int]StorageBackend
+	writable map[int]bool
+	topology map[int]NodeTopology
+	usage    map[int]NodeUsage
+	health   map[int]NodeHealth
 }
 
-func NewDistributedStorageService(basePath string, nodeCount int) (*DistributedStorageService, error) {
-	log.Printf("Initializing distributed storage at %s with %d nodes", basePath, nodeCount)
+func NewDistributedStorageService() *DistributedStorageService {
+	return &DistributedStorageService{
+		nodes:    make(map[int]StorageBackend),
+		writable: make(map[int]bool),
+		topology: make(map[int]NodeTopology),
+		usage:    make(map[int]NodeUsage),
+		health:   make(map[int]NodeHealth),
+	}
+}
 
-	// Create base storage directory
-	if err := os.MkdirAll(basePath, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create base directory: %w", err)
+// AddNode registers a backend under nodeIndex. Only writable nodes receive new data.
+func (s *DistributedStorageService) AddNode(nodeIndex int, backend StorageBackend, writable bool) error {
+	if nodeIndex < 0 {
+		return fmt.Errorf("invalid node index: %d", nodeIndex)
 	}
+	if backend == nil {
+		return fmt.Errorf("storage node %d has no backend", nodeIndex)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Create nodes directory
-	nodesDir := filepath.Join(basePath, "nodes")
-	if err := os.MkdirAll(nodesDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create nodes directory: %w", err)
+	if _, exists := s.nodes[nodeIndex]; exists {
+		return fmt.Errorf("storage node %d is already registered", nodeIndex)
 	}
+	s.nodes[nodeIndex] = backend
+	s.writable[nodeIndex] = writable
 
-	nodePaths := make([]string, nodeCount)
-	for i := 0; i < nodeCount; i++ {
-		// Create node directory
-		nodePath := filepath.Join(nodesDir, fmt.Sprintf("node_%d", i))
-		if err := os.MkdirAll(nodePath, 0755); err != nil {
-			return nil, fmt.Errorf("failed to create node directory %s: %w", nodePath, err)
-		}
+	log.Printf("Node %d: %v (writable: %v)", nodeIndex, backend, writable)
+	return nil
+}
 
-		// Create fragments and shards directories for each node
-		if err := os.MkdirAll(filepath.Join(nodePath, "fragments"), 0755); err != nil {
-			return nil, fmt.Errorf("failed to create fragments directory: %w", err)
-		}
-		if err := os.MkdirAll(filepath.Join(nodePath, "shards"), 0755); err != nil {
-			return nil, fmt.Errorf("failed to create shards directory: %w", err)
-		}
+// SetNodeWritable controls whether new shards and fragments may be placed on a node
+func (s *DistributedStorageService) SetNodeWritable(nodeIndex int, writable bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		nodePaths[i] = nodePath
-		log.Printf("Created node directory: %s", nodePath)
+	if _, exists := s.nodes[nodeIndex]; !exists {
+		return fmt.Errorf("invalid node index: %d", nodeIndex)
 	}
+	s.writable[nodeIndex] = writable
+	return nil
+}
 
-	return &DistributedStorageService{
-		basePath:  basePath,
-		nodePaths: nodePaths,
-	}, nil
+// RemoveNode unregisters a node; data still referencing it becomes unreachable
+func (s *DistributedStorageService) RemoveNode(nodeIndex int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.nodes, nodeIndex)
+	delete(s.writable, nodeIndex)
+	delete(s.topology, nodeIndex)
+	delete(s.usage, nodeIndex)
+	delete(s.health, nodeIndex)
+	log.Printf("Removed node %d", nodeIndex)
 }
 
-// NodeCount returns the number of available storage nodes
+// HasNode reports whether a node is registered
+func (s *DistributedStorageService) HasNode(nodeIndex int) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, exists := s.nodes[nodeIndex]
+	return exists
+}
+
+// NodeCount returns the number of registered storage nodes
 func (s *DistributedStorageService) NodeCount() int {
-	return len(s.nodePaths)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.nodes)
+}
+
+// WritableNodes returns the sorted indexes of nodes accepting new data
+func (s *DistributedStorageService) WritableNodes() []int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var indexes []int
+	for nodeIndex, writable := range s.writable {
+		if writable {
+			indexes = append(indexes, nodeIndex)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes
 }
 
-// StoreShards distributes and stores file shards across nodes
-func (s *DistributedStorageService) StoreShards(fileID uint, shards [][]byte) error {
+func shardDirKey(fileID uint) string {
+	return fmt.Sprintf("shards/file_%d/", fileID)
+}
+
+func shardKey(fileID uint, shardIndex int) string {
+	return fmt.Sprintf("shards/file_%d/shard_%d", fileID, shardIndex)
+}
+
+func fragmentDirKey(fileID uint) string {
+	return fmt.Sprintf("fragments/file_%d/", fileID)
+}
+
+// fragmentKey maps a KeyFragment.FragmentPath onto the node namespace
+func fragmentKey(fragmentPath string) string {
+	return path.Join("fragments", filepath.ToSlash(fragmentPath))
+}
+
+func (s *DistributedStorageService) node(nodeIndex int) (StorageBackend, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	node, exists := s.nodes[nodeIndex]
+	if !exists {
+		return nil, fmt.Errorf("invalid node index: %d", nodeIndex)
+	}
+	return node, nil
+}
+
+// StoreShards distributes and stores file shards across the nodes of the target
+// tier so that any single zone can be lost, and returns the node index chosen
+// for each shard
+func (s *DistributedStorageService) StoreShards(fileID uint, shards [][]byte, parityShards int, target ShardPlacement) ([]int, error) {
 	log.Printf("Storing %d shards for file %d", len(shards), fileID)
 
-	fileDir := fmt.Sprintf("file_%d", fileID)
+	placement, err := s.PlaceShards(fileID, len(shards), parityShards, int64(len(shards[0])), target)
+	if err != nil {
+		return nil, err
+	}
 
 	for i, shard := range shards {
-		nodeIndex := i % len(s.nodePaths)
-		shardPath := filepath.Join(s.nodePaths[nodeIndex], "shards", fileDir)
+		nodeIndex := placement[i]
+		node, err := s.liveNode(nodeIndex)
+		if err != nil {
+			return nil, err
+		}
+
+		key := shardKey(fileID, i)
+		if err := node.Put(key, shard); err != nil {
+			return nil, fmt.Errorf("failed to write shard %d to node %d: %w", i, nodeIndex, err)
+		}
+		s.addUsage(nodeIndex, int64(len(shard)))
+
+		log.Printf("Stored shard %d in node %d: %s", i, nodeIndex, key)
+	}
+
+	return placement, nil
+}
+
+// StoreShardStreams is StoreShards for shards that are read from streams, each
+// holding exactly shardSize bytes
+func (s *DistributedStorageService) StoreShardStreams(fileID uint, shards []io.Reader, shardSize int64, parityShards int, target ShardPlacement) ([]int, error) {
+	log.Printf("Streaming %d shards of %d bytes for file %d", len(shards), shardSize, fileID)
+
+	placement, err := s.PlaceShards(fileID, len(shards), parityShards, shardSize, target)
+	if err != nil {
+		return nil, err
+	}
 
-		if err := os.MkdirAll(shardPath, 0755); err != nil {
-			return fmt.Errorf("failed to create directory in node %d: %w", nodeIndex, err)
+	for i, shard := range shards {
+		nodeIndex := placement[i]
+		node, err := s.liveNode(nodeIndex)
+		if err != nil {
+			return nil, err
 		}
 
-		// Store shard
-		fullPath := filepath.Join(shardPath, fmt.Sprintf("shard_%d", i))
-		if err := os.WriteFile(fullPath, shard, 0600); err != nil {
-			return fmt.Errorf("failed to write shard %d to node %d: %w", i, nodeIndex, err)
+		key := shardKey(fileID, i)
+		if err := node.PutStream(key, shard, shardSize); err != nil {
+			return nil, fmt.Errorf("failed to write shard %d to node %d: %w", i, nodeIndex, err)
 		}
+		s.addUsage(nodeIndex, shardSize)
 
-		log.Printf("Stored shard %d in node %d: %s", i, nodeIndex, fullPath)
+		log.Printf("Stored shard %d in node %d: %s", i, nodeIndex, key)
 	}
 
-	return nil
+	return placement, nil
+}
+
+// CorruptShard identifies a shard whose content no longer matches its recorded checksum
+type CorruptShard struct {
+	ShardIndex int    `json:"shard_index"`
+	NodeIndex  int    `json:"node_index"`
+	Expected   string `json:"expected"`
+	Actual     string `json:"actual"`
+}
+
+// ShardChecksum returns the hex encoded SHA-256 of a shard
+func ShardChecksum(shard []byte) string {
+	sum := sha256.Sum256(shard)
+	return hex.EncodeToString(sum[:])
+}
+
+// ShardChecksums returns the checksum of every shard
+func ShardChecksums(shards [][]byte) []string {
+	checksums := make([]string, len(shards))
+	for i, shard := range shards {
+		checksums[i] = ShardChecksum(shard)
+	}
+	return checksums
 }
 
-// RetrieveShards collects shards for a file from nodes
-func (s *DistributedStorageService) RetrieveShards(fileID uint, totalShards int) ([][]byte, error) {
+// RetrieveShards collects shards for a file from nodes. shardNodes holds the
+// node index of every shard, so its length is the total shard count, and at
+// least dataShards of them have to be readable. Shards that can't be read or
+// whose checksum doesn't match are dropped so Reed-Solomon treats them as
+// erasures; an empty checksum skips verification for shards stored before
+// checksums were recorded. Read failures count against the node's health.
+func (s *DistributedStorageService) RetrieveShards(fileID uint, shardNodes []int, checksums []string, dataShards int) ([][]byte, []CorruptShard, error) {
+	totalShards := len(shardNodes)
 	log.Printf("Retrieving %d shards for file %d", totalShards, fileID)
 
 	shards := make([][]byte, totalShards)
+	var corrupted []CorruptShard
 	retrievedCount := 0
-	dataShards := totalShards - 2
-	fileDir := fmt.Sprintf("file_%d", fileID)
 
-	for shardIndex := 0; shardIndex < totalShards; shardIndex++ {
-		nodeIndex := shardIndex % len(s.nodePaths)
-		fullPath := filepath.Join(s.nodePaths[nodeIndex], "shards", fileDir,
-			fmt.Sprintf("shard_%d", shardIndex))
+	for shardIndex, nodeIndex := range shardNodes {
+		key := shardKey(fileID, shardIndex)
+
+		node, err := s.liveNode(nodeIndex)
+		if err != nil {
+			log.Printf("Shard %d unavailable: %v", shardIndex, err)
+			continue
+		}
 
-		data, err := os.ReadFile(fullPath)
+		data, err := node.Get(key)
 		if err != nil {
-			if !os.IsNotExist(err) {
-				return nil, fmt.Errorf("error reading shard %d: %w", shardIndex, err)
+			if errors.Is(err, ErrObjectNotFound) {
+				log.Printf("Shard %d missing from node %d", shardIndex, nodeIndex)
+			} else {
+				log.Printf("Shard %d unreadable on node %d: %v", shardIndex, nodeIndex, err)
+				s.recordReadFailure(nodeIndex, err)
 			}
-			log.Printf("Shard %d missing from node %d", shardIndex, nodeIndex)
 			continue
 		}
 
+		if shardIndex < len(checksums) && checksums[shardIndex] != "" {
+			if actual := ShardChecksum(data); actual != checksums[shardIndex] {
+				log.Printf("Corrupt shard %d of file %d on node %d: expected checksum %s, got %s",
+					shardIndex, fileID, nodeIndex, checksums[shardIndex], actual)
+				corrupted = append(corrupted, CorruptShard{
+					ShardIndex: shardIndex,
+					NodeIndex:  nodeIndex,
+					Expected:   checksums[shardIndex],
+					Actual:     actual,
+				})
+				continue
+			}
+		}
+
 		shards[shardIndex] = data
 		retrievedCount++
-		log.Printf("Retrieved shard %d from node %d: %s", shardIndex, nodeIndex, fullPath)
+		log.Printf("Retrieved shard %d from node %d: %s", shardIndex, nodeIndex, key)
 	}
 
 	if retrievedCount < dataShards {
-		return nil, fmt.Errorf("insufficient shards: found %d, need %d",
-			retrievedCount, dataShards)
+		return nil, corrupted, fmt.Errorf("insufficient shards: found %d, need %d (%d corrupt)",
+			retrievedCount, dataShards, len(corrupted))
 	}
 
-	return shards, nil
+	return shards, corrupted, nil
 }
 
-// StoreFragment stores a single key fragment in a node
-func (s *DistributedStorageService) StoreFragment(nodeIndex int, fragmentPath string, data []byte) error {
-	if nodeIndex >= len(s.nodePaths) {
-		return fmt.Errorf("invalid node index: %d", nodeIndex)
+// RetrieveShard reads a single shard from a node
+func (s *DistributedStorageService) RetrieveShard(fileID uint, shardIndex, nodeIndex int) ([]byte, error) {
+	node, err := s.liveNode(nodeIndex)
+	if err != nil {
+		return nil, err
 	}
+	return node.Get(shardKey(fileID, shardIndex))
+}
 
-	fullPath := filepath.Join(s.nodePaths[nodeIndex], "fragments", fragmentPath)
-	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
-		return fmt.Errorf("failed to create fragment directory: %w", err)
+// RetrieveShardStream opens a single shard on a node for reading
+func (s *DistributedStorageService) RetrieveShardStream(fileID uint, shardIndex, nodeIndex int) (io.ReadCloser, error) {
+	node, err := s.liveNode(nodeIndex)
+	if err != nil {
+		return nil, err
 	}
+	return node.GetStream(shardKey(fileID, shardIndex))
+}
+
+// StoreShard writes a single shard to a node, replacing any existing copy
+func (s *DistributedStorageService) StoreShard(fileID uint, shardIndex, nodeIndex int, data []byte) error {
+	node, err := s.liveNode(nodeIndex)
+	if err != nil {
+		return err
+	}
+	if err := node.Put(shardKey(fileID, shardIndex), data); err != nil {
+		return fmt.Errorf("failed to write shard %d to node %d: %w", shardIndex, nodeIndex, err)
+	}
+	s.addUsage(nodeIndex, int64(len(data)))
+	return nil
+}
+
+// CopyShard copies a single shard between nodes without touching the source.
+// A non-empty checksum is verified first so corruption is never propagated.
+func (s *DistributedStorageService) CopyShard(fileID uint, shardIndex, fromNode, toNode int, checksum string) error {
+	return s.copyObject(shardKey(fileID, shardIndex), fromNode, toNode, checksum)
+}
+
+// DeleteShard removes a single shard from a node
+func (s *DistributedStorageService) DeleteShard(fileID uint, shardIndex, nodeIndex int) error {
+	node, err := s.liveNode(nodeIndex)
+	if err != nil {
+		return err
+	}
+	if err := node.Delete(shardKey(fileID, shardIndex)); err != nil {
+		return fmt.Errorf("failed to delete shard %d: %w", shardIndex, err)
+	}
+	return nil
+}
+
+// CopyFragment copies a single key fragment between nodes without touching the
+// source, verifying a non-empty checksum first
+func (s *DistributedStorageService) CopyFragment(fragmentPath string, fromNode, toNode int, checksum string) error {
+	return s.copyObject(fragmentKey(fragmentPath), fromNode, toNode, checksum)
+}
 
-	if err := os.WriteFile(fullPath, data, 0600); err != nil {
+func (s *DistributedStorageService) copyObject(key string, fromNode, toNode int, checksum string) error {
+	source, err := s.liveNode(fromNode)
+	if err != nil {
+		return err
+	}
+	target, err := s.liveNode(toNode)
+	if err != nil {
+		return err
+	}
+
+	data, err := source.Get(key)
+	if err != nil {
+		return fmt.Errorf("failed to read %s from node %d: %w", key, fromNode, err)
+	}
+	if checksum != "" && ShardChecksum(data) != checksum {
+		return fmt.Errorf("%s on node %d does not match its checksum", key, fromNode)
+	}
+	if err := target.Put(key, data); err != nil {
+		return fmt.Errorf("failed to write %s to node %d: %w", key, toNode, err)
+	}
+	s.addUsage(toNode, int64(len(data)))
+
+	log.Printf("Copied %s from node %d to node %d", key, fromNode, toNode)
+	return nil
+}
+
+// StoreFragment stores a single key fragment in a node
+func (s *DistributedStorageService) StoreFragment(nodeIndex int, fragmentPath string, data []byte) error {
+	node, err := s.liveNode(nodeIndex)
+	if err != nil {
+		return err
+	}
+
+	key := fragmentKey(fragmentPath)
+	if err := node.Put(key, data); err != nil {
 		return fmt.Errorf("failed to write fragment: %w", err)
 	}
+	s.addUsage(nodeIndex, int64(len(data)))
 
-	log.Printf("Stored fragment in node %d: %s", nodeIndex, fullPath)
+	log.Printf("Stored fragment in node %d: %s", nodeIndex, key)
 	return nil
 }
 
 // RetrieveFragment retrieves a single key fragment from a node
 func (s *DistributedStorageService) RetrieveFragment(nodeIndex int, fragmentPath string) ([]byte, error) {
-	if nodeIndex >= len(s.nodePaths) {
-		return nil, fmt.Errorf("invalid node index: %d", nodeIndex)
+	node, err := s.liveNode(nodeIndex)
+	if err != nil {
+		return nil, err
 	}
 
-	fullPath := filepath.Join(s.nodePaths[nodeIndex], "fragments", fragmentPath)
-	data, err := os.ReadFile(fullPath)
+	key := fragmentKey(fragmentPath)
+	data, err := node.Get(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read fragment: %w", err)
 	}
 
-	log.Printf("Retrieved fragment from node %d: %s", nodeIndex, fullPath)
+	log.Printf("Retrieved fragment from node %d: %s", nodeIndex, key)
 	return data, nil
 }
 
 // DeleteFragment removes a single key fragment from a node
 func (s *DistributedStorageService) DeleteFragment(nodeIndex int, fragmentPath string) error {
-	if nodeIndex >= len(s.nodePaths) {
-		return fmt.Errorf("invalid node index: %d", nodeIndex)
+	node, err := s.liveNode(nodeIndex)
+	if err != nil {
+		return err
 	}
 
-	fullPath := filepath.Join(s.nodePaths[nodeIndex], "fragments", fragmentPath)
-	if err := os.Remove(fullPath); err != nil {
-		if !os.IsNotExist(err) {
-			return fmt.Errorf("failed to delete fragment: %w", err)
-		}
+	key := fragmentKey(fragmentPath)
+	if err := node.Delete(key); err != nil {
+		return fmt.Errorf("failed to delete fragment: %w", err)
 	}
 
-	log.Printf("Deleted fragment from node %d: %s", nodeIndex, fullPath)
+	log.Printf("Deleted fragment from node %d: %s", nodeIndex, key)
 	return nil
 }
 
 // DeleteShards removes all shards and fragments for a file
 func (s *DistributedStorageService) DeleteShards(fileID uint) error {
 	log.Printf("Deleting shards and fragments for file %d", fileID)
-	fileDir := fmt.Sprintf("file_%d", fileID)
 
-	for nodeIndex, nodePath := range s.nodePaths {
+	s.mu.RLock()
+	nodes := make(map[int]StorageBackend, len(s.nodes))
+	for nodeIndex, node := range s.nodes {
+		nodes[nodeIndex] = node
+	}
+	s.mu.RUnlock()
+
+	for nodeIndex, node := range nodes {
+		if s.IsNodeDown(nodeIndex) {
+			// Left for fsck to collect once the node is back
+			log.Printf("Warning: skipping node %d while deleting file %d: node is down", nodeIndex, fileID)
+			continue
+		}
+
 		// Delete shards
-		shardDir := filepath.Join(nodePath, "shards", fileDir)
-		if err := os.RemoveAll(shardDir); err != nil {
-			if !os.IsNotExist(err) {
-				log.Printf("Warning: failed to delete shards from node %d: %v", nodeIndex, err)
-			}
+		if err := deleteObjectsWithPrefix(node, shardDirKey(fileID)); err != nil {
+			log.Printf("Warning: failed to delete shards from node %d: %v", nodeIndex, err)
 		}
 
 		// Delete fragments
-		fragmentDir := filepath.Join(nodePath, "fragments", fileDir)
-		if err := os.RemoveAll(fragmentDir); err != nil {
-			if !os.IsNotExist(err) {
-				log.Printf("Warning: failed to delete fragments from node %d: %v", nodeIndex, err)
-			}
+		if err := deleteObjectsWithPrefix(node, fragmentDirKey(fileID)); err != nil {
+			log.Printf("Warning: failed to delete fragments from node %d: %v", nodeIndex, err)
 		}
 
 		log.Printf("Deleted data from node %d", nodeIndex)
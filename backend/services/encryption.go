@@ -5,13 +5,11 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"log"
 
 	"golang.org/x/crypto/chacha20poly1305"
-	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/crypto/twofish"
 )
 
@@ -47,7 +45,7 @@ func (s *EncryptionService) EncryptFileWithType(
 	if _, err := rand.Read(key); err != nil {
 		return nil, nil, nil, nil, fmt.Errorf("failed to generate key: %w", err)
 	}
-	log.Printf("Generated encryption key: %x (length=%d)", key, len(key))
+	log.Printf("Generated encryption key (length=%d)", len(key))
 
 	// Split key into shares and store them
 	shares, err = s.shamirService.SplitKey(key, n, k, fileID, serverKeyID)
@@ -357,16 +355,19 @@ func (s *EncryptionService) validateDecryptionInputs(encrypted []byte, iv []byte
 	return s.validateKeyShares(shares, k)
 }
 
-// EncryptKeyFragment encrypts a fragment with a password
-func (s *EncryptionService) EncryptKeyFragment(fragment []byte, password []byte) ([]byte, error) {
-	// Generate a random salt for PBKDF2
+// EncryptKeyFragment encrypts a fragment with a key derived from a password
+// with params, which have to be stored with the fragment
+func (s *EncryptionService) EncryptKeyFragment(fragment []byte, password []byte, params KDFParams) ([]byte, error) {
+	// Generate a random salt for the KDF
 	salt := make([]byte, 32)
 	if _, err := rand.Read(salt); err != nil {
 		return nil, fmt.Errorf("failed to generate salt: %w", err)
 	}
 
-	// Derive key using PBKDF2
-	key := pbkdf2.Key(password, salt, 4096, 32, sha256.New)
+	key, err := params.DeriveKey(password, salt)
+	if err != nil {
+		return nil, err
+	}
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -397,8 +398,9 @@ func (s *EncryptionService) EncryptKeyFragment(fragment []byte, password []byte)
 	return result, nil
 }
 
-// DecryptKeyFragment decrypts a fragment with a password
-func (s *EncryptionService) DecryptKeyFragment(encryptedFragment []byte, password []byte) ([]byte, error) {
+// DecryptKeyFragment decrypts a fragment with a password, deriving the key
+// with the params it was encrypted with
+func (s *EncryptionService) DecryptKeyFragment(encryptedFragment []byte, password []byte, params KDFParams) ([]byte, error) {
 	// Check minimum length (32 bytes salt + 16 bytes nonce + at least 1 byte data)
 	if len(encryptedFragment) < 49 {
 		return nil, fmt.Errorf("encrypted fragment too short")
@@ -409,8 +411,10 @@ func (s *EncryptionService) DecryptKeyFragment(encryptedFragment []byte, passwor
 	nonce := encryptedFragment[32:48]
 	ciphertext := encryptedFragment[48:]
 
-	// Derive key using PBKDF2
-	key := pbkdf2.Key(password, salt, 4096, 32, sha256.New)
+	key, err := params.DeriveKey(password, salt)
+	if err != nil {
+		return nil, err
+	}
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
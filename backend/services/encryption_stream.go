@@ -0,0 +1,286 @@
+package services
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/twofish"
+)
+
+// Encryption formats recorded in File.EncryptionVersion.
+//
+// EncryptionSingleAEAD files are one AEAD ciphertext of the 8 byte size prefix
+// and the content (EncryptFileWithType), so they can only be decrypted whole.
+// EncryptionSegmented files are a sequence of segments of StreamSegmentSize
+// content bytes sealed on their own, so they are encrypted and decrypted while
+// they stream. The nonce of segment i is the file IV with i XORed into its last
+// 8 bytes, and the additional data of every segment is one byte, 1 for the last
+// segment and 0 otherwise, so segments can't be reordered, dropped or cut off.
+// Content of a multiple of StreamSegmentSize bytes, and empty content, ends
+// with a full or empty last segment.
+const (
+	EncryptionSingleAEAD = 1
+	EncryptionSegmented  = 2
+)
+
+// StreamSegmentSize is the amount of content sealed per segment
+const StreamSegmentSize = 64 * 1024
+
+// streamTagSize is the authentication tag size of all encryption types
+const streamTagSize = 16
+
+// SegmentedSize is the size of content of size bytes once encrypted with
+// EncryptionSegmented
+func SegmentedSize(size int64) int64 {
+	segments := max(1, (size+StreamSegmentSize-1)/StreamSegmentSize)
+	return size + segments*streamTagSize
+}
+
+// FileKey is the key of a file encrypted with EncryptionSegmented. The key
+// itself never leaves it; the shares, salt and IVs are stored with the file.
+type FileKey struct {
+	Type   EncryptionType
+	Salt   []byte
+	Shares []KeyShare
+	aead   cipher.AEAD
+}
+
+// NewFileKey generates a key for a file, splits it into n shares of which k
+// recombine it and prepares the cipher of encType
+func (s *EncryptionService) NewFileKey(n, k int, fileID uint, serverKeyID string, encType EncryptionType) (*FileKey, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	defer wipe(key)
+
+	aead, err := streamCipher(encType, key)
+	if err != nil {
+		return nil, err
+	}
+
+	shares, err := s.shamirService.SplitKey(key, n, k, fileID, serverKeyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split and store key: %w", err)
+	}
+	if err := s.testReconstruction(shares[:k], k, key); err != nil {
+		return nil, fmt.Errorf("key reconstruction test failed: %w", err)
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	log.Printf("Generated %s stream key with %d shares (threshold: %d)", encType, len(shares), k)
+	return &FileKey{Type: encType, Salt: salt, Shares: shares, aead: aead}, nil
+}
+
+// NewIV returns a random IV of the size the encryption type needs. Every
+// stream encrypted with the key needs its own.
+func (k *FileKey) NewIV() ([]byte, error) {
+	iv := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, fmt.Errorf("failed to generate IV: %w", err)
+	}
+	return iv, nil
+}
+
+// NewEncryptWriter returns a writer that encrypts what is written to it to w.
+// Close seals the last segment; it does not close w.
+func (k *FileKey) NewEncryptWriter(w io.Writer, iv []byte) (io.WriteCloser, error) {
+	if len(iv) != k.aead.NonceSize() {
+		return nil, fmt.Errorf("invalid IV length for %s: got %d, want %d", k.Type, len(iv), k.aead.NonceSize())
+	}
+	return &encryptWriter{
+		w:     w,
+		aead:  k.aead,
+		iv:    iv,
+		nonce: make([]byte, len(iv)),
+		buf:   make([]byte, 0, StreamSegmentSize),
+		out:   make([]byte, 0, StreamSegmentSize+streamTagSize),
+	}, nil
+}
+
+// DecryptStream returns a reader of the content of the EncryptionSegmented
+// ciphertext read from r. Reads fail once a segment doesn't authenticate or the
+// ciphertext ends before its last segment.
+func (s *EncryptionService) DecryptStream(
+	r io.Reader,
+	iv []byte,
+	keyShares []KeyShare,
+	k int,
+	encType EncryptionType,
+) (io.Reader, error) {
+	key, err := s.shamirService.RecombineKey(keyShares, k)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reconstruct key: %w", err)
+	}
+	defer wipe(key)
+
+	aead, err := streamCipher(encType, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid IV length for %s: got %d, want %d", encType, len(iv), aead.NonceSize())
+	}
+	return &decryptReader{
+		r:     bufio.NewReaderSize(r, StreamSegmentSize),
+		aead:  aead,
+		iv:    iv,
+		nonce: make([]byte, len(iv)),
+		in:    make([]byte, StreamSegmentSize+streamTagSize),
+	}, nil
+}
+
+// streamCipher returns the AEAD of an encryption type, with the nonce sizes
+// EncryptFileWithType uses
+func streamCipher(encType EncryptionType, key []byte) (cipher.AEAD, error) {
+	switch encType {
+	case StandardEncryption:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+		}
+		return cipher.NewGCMWithNonceSize(block, 16)
+	case ChaCha20:
+		return chacha20poly1305.NewX(key)
+	case Twofish:
+		block, err := twofish.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Twofish cipher: %w", err)
+		}
+		return cipher.NewGCM(block)
+	}
+	return nil, fmt.Errorf("unsupported encryption type: %s", encType)
+}
+
+// segmentNonce writes the nonce of a segment to nonce
+func segmentNonce(nonce, iv []byte, segment uint64) {
+	copy(nonce, iv)
+	tail := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^segment)
+}
+
+func segmentAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	iv      []byte
+	nonce   []byte
+	segment uint64
+	buf     []byte
+	out     []byte
+	closed  bool
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encrypt writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more content follows, since
+		// the last one is sealed differently
+		if len(e.buf) == StreamSegmentSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):StreamSegmentSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	segmentNonce(e.nonce, e.iv, e.segment)
+	e.out = e.aead.Seal(e.out[:0], e.nonce, e.buf, segmentAD(last))
+	if _, err := e.w.Write(e.out); err != nil {
+		return err
+	}
+	e.segment++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	iv      []byte
+	nonce   []byte
+	segment uint64
+	in      []byte
+	plain   []byte // decrypted content not read yet
+	done    bool
+	err     error
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.open()
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next segment
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.in)
+	switch {
+	case err == io.EOF:
+		return fmt.Errorf("encrypted content ends before its last segment")
+	case err == io.ErrUnexpectedEOF:
+		d.done = true
+	case err != nil:
+		return err
+	default:
+		// A full segment is the last one when nothing follows it
+		if _, err := d.r.Peek(1); err == io.EOF {
+			d.done = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	segmentNonce(d.nonce, d.iv, d.segment)
+	plain, err := d.aead.Open(d.in[:0], d.nonce, d.in[:n], segmentAD(d.done))
+	if err != nil {
+		return fmt.Errorf("segment %d failed to decrypt: %w", d.segment, err)
+	}
+	d.segment++
+	d.plain = plain
+	return nil
+}
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestEncryptionStreamRoundTrip(t *testing.T) {
+	s := NewEncryptionService(NewShamirService(3))
+	for _, encType := range []EncryptionType{StandardEncryption, ChaCha20, Twofish} {
+		key, err := s.NewFileKey(3, 2, 1, "test", encType)
+		if err != nil {
+			t.Fatalf("%s: NewFileKey: %v", encType, err)
+		}
+
+		for _, size := range []int{0, 1, StreamSegmentSize - 1, StreamSegmentSize, 3*StreamSegmentSize + 17} {
+			content := make([]byte, size)
+			if _, err := rand.Read(content); err != nil {
+				t.Fatal(err)
+			}
+			iv, err := key.NewIV()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var encrypted bytes.Buffer
+			w, err := key.NewEncryptWriter(&encrypted, iv)
+			if err != nil {
+				t.Fatalf("%s: NewEncryptWriter: %v", encType, err)
+			}
+			// Odd write sizes must not change the segmentation
+			for rest := content; len(rest) > 0; {
+				n := min(len(rest), 1000)
+				if _, err := w.Write(rest[:n]); err != nil {
+					t.Fatal(err)
+				}
+				rest = rest[n:]
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			segments := max(1, (size+StreamSegmentSize-1)/StreamSegmentSize)
+			want := size + segments*streamTagSize
+			if encrypted.Len() != want || SegmentedSize(int64(size)) != int64(want) {
+				t.Fatalf("%s size %d: %d encrypted bytes, SegmentedSize %d, want %d",
+					encType, size, encrypted.Len(), SegmentedSize(int64(size)), want)
+			}
+
+			decrypted, err := decryptAll(s, encrypted.Bytes(), iv, key.Shares[1:], encType)
+			if err != nil {
+				t.Fatalf("%s size %d: %v", encType, size, err)
+			}
+			if !bytes.Equal(decrypted, content) {
+				t.Fatalf("%s size %d: content did not round-trip", encType, size)
+			}
+		}
+	}
+}
+
+func TestEncryptionStreamRejectsTampering(t *testing.T) {
+	s := NewEncryptionService(NewShamirService(2))
+	key, err := s.NewFileKey(2, 2, 1, "test", StandardEncryption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv, err := key.NewIV()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 2*StreamSegmentSize+100)
+	var buf bytes.Buffer
+	w, err := key.NewEncryptWriter(&buf, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(content)
+	w.Close()
+	encrypted := buf.Bytes()
+	segment := StreamSegmentSize + streamTagSize
+
+	cases := map[string][]byte{
+		"truncated at a segment boundary": encrypted[:2*segment],
+		"truncated inside a segment":      encrypted[:segment+10],
+		"segments swapped":                append(append(append([]byte(nil), encrypted[segment:2*segment]...), encrypted[:segment]...), encrypted[2*segment:]...),
+		"bit flipped":                     flipped(encrypted, segment+5),
+		"empty":                           nil,
+	}
+	for name, tampered := range cases {
+		if _, err := decryptAll(s, tampered, iv, key.Shares, StandardEncryption); err == nil {
+			t.Errorf("%s: decrypted without error", name)
+		}
+	}
+}
+
+func decryptAll(s *EncryptionService, encrypted, iv []byte, shares []KeyShare, encType EncryptionType) ([]byte, error) {
+	r, err := s.DecryptStream(bytes.NewReader(encrypted), iv, shares, 2, encType)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func flipped(data []byte, at int) []byte {
+	out := append([]byte(nil), data...)
+	out[at] ^= 1
+	return out
+}
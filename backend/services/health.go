@@ -0,0 +1,186 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// NodeState is the outcome of the latest health probes of a node
+type NodeState string
+
+const (
+	NodeUp       NodeState = "up"       // probes succeed in time
+	NodeDegraded NodeState = "degraded" // slow, read-only or failed its last probe
+	NodeDown     NodeState = "down"     // failed NodeDownAfter probes in a row; reads and writes skip it
+	NodeUnknown  NodeState = "unknown"  // not probed yet
+)
+
+const (
+	// NodeDownAfter is how many consecutive failed probes mark a node down
+	NodeDownAfter = 2
+	// NodeSlowProbe is the probe round trip above which a node is degraded
+	NodeSlowProbe = 2 * time.Second
+
+	healthProbeKey = "health/probe"
+)
+
+// ErrNodeDown is returned for operations on a node the health checker marked down
+var ErrNodeDown = errors.New("storage node is down")
+
+// NodeHealth is the health of a node as seen by the last probe
+type NodeHealth struct {
+	State     NodeState `json:"state"`
+	CheckedAt time.Time `json:"checked_at"`
+	LatencyMs int64     `json:"latency_ms"`
+	Failures  int       `json:"consecutive_failures"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// NodeHealth returns the health of a node; nodes not probed yet are unknown
+func (s *DistributedStorageService) NodeHealth(nodeIndex int) NodeHealth {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	health, ok := s.health[nodeIndex]
+	if !ok {
+		return NodeHealth{State: NodeUnknown}
+	}
+	return health
+}
+
+// IsNodeDown reports whether the health checker marked a node down
+func (s *DistributedStorageService) IsNodeDown(nodeIndex int) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.health[nodeIndex].State == NodeDown
+}
+
+// CheckHealth probes every attached node in parallel and records the results
+func (s *DistributedStorageService) CheckHealth() map[int]NodeHealth {
+	nodes := s.AttachedNodes()
+	results := make(map[int]NodeHealth, len(nodes))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, nodeIndex := range nodes {
+		wg.Add(1)
+		go func(nodeIndex int) {
+			defer wg.Done()
+			health := s.CheckNodeHealth(nodeIndex)
+			mu.Lock()
+			results[nodeIndex] = health
+			mu.Unlock()
+		}(nodeIndex)
+	}
+	wg.Wait()
+	return results
+}
+
+// CheckNodeHealth writes, reads back and compares a small probe object on a
+// node. A node that can be read but not written is degraded; one that fails
+// NodeDownAfter probes in a row is down until a probe succeeds again.
+func (s *DistributedStorageService) CheckNodeHealth(nodeIndex int) NodeHealth {
+	node, err := s.node(nodeIndex)
+	if err != nil {
+		return NodeHealth{State: NodeUnknown, Error: err.Error()}
+	}
+
+	started := time.Now()
+	writeErr, readErr := probeNode(node)
+	health := NodeHealth{
+		State:     NodeUp,
+		CheckedAt: time.Now(),
+		LatencyMs: time.Since(started).Milliseconds(),
+	}
+
+	s.mu.Lock()
+	previous := s.health[nodeIndex]
+	switch {
+	case readErr != nil:
+		health.Failures = previous.Failures + 1
+		health.Error = readErr.Error()
+		health.State = NodeDegraded
+		if health.Failures >= NodeDownAfter {
+			health.State = NodeDown
+		}
+	case writeErr != nil:
+		health.State = NodeDegraded
+		health.Error = writeErr.Error()
+	case time.Duration(health.LatencyMs)*time.Millisecond > NodeSlowProbe:
+		health.State = NodeDegraded
+		health.Error = fmt.Sprintf("probe took %dms", health.LatencyMs)
+	}
+	s.health[nodeIndex] = health
+	s.mu.Unlock()
+
+	if health.State != previous.State && previous.State != "" {
+		log.Printf("Storage node %d is now %s (was %s): %s", nodeIndex, health.State, previous.State, health.Error)
+	}
+	return health
+}
+
+// recordReadFailure counts a failed read of an object like a failed probe: the
+// node is degraded, and down after NodeDownAfter failures in a row until a
+// probe succeeds again
+func (s *DistributedStorageService) recordReadFailure(nodeIndex int, err error) {
+	s.mu.Lock()
+	previous := s.health[nodeIndex]
+	health := NodeHealth{
+		State:     NodeDegraded,
+		CheckedAt: time.Now(),
+		LatencyMs: previous.LatencyMs,
+		Failures:  previous.Failures + 1,
+		Error:     fmt.Sprintf("read failed: %v", err),
+	}
+	if health.Failures >= NodeDownAfter {
+		health.State = NodeDown
+	}
+	s.health[nodeIndex] = health
+	s.mu.Unlock()
+
+	if health.State != previous.State {
+		log.Printf("Storage node %d is now %s (was %s): %s", nodeIndex, health.State, previous.State, health.Error)
+	}
+}
+
+// probeNode writes a random probe object and reads it back. The read is tried
+// even when the write fails, to tell read-only nodes from unreachable ones.
+func probeNode(node StorageBackend) (writeErr, readErr error) {
+	probe := make([]byte, 16)
+	if _, err := rand.Read(probe); err != nil {
+		return err, nil
+	}
+
+	if err := node.Put(healthProbeKey, probe); err != nil {
+		writeErr = fmt.Errorf("probe write failed: %w", err)
+	}
+
+	data, err := node.Get(healthProbeKey)
+	switch {
+	case errors.Is(err, ErrObjectNotFound) && writeErr != nil:
+		// Nothing to read back yet; the node answered, so it is readable
+	case err != nil:
+		readErr = fmt.Errorf("probe read failed: %w", err)
+	case writeErr == nil && !bytes.Equal(data, probe):
+		readErr = fmt.Errorf("probe read returned different content")
+	}
+	return writeErr, readErr
+}
+
+// liveNode returns a node for reading or writing objects, failing fast when
+// the health checker marked it down
+func (s *DistributedStorageService) liveNode(nodeIndex int) (StorageBackend, error) {
+	node, err := s.node(nodeIndex)
+	if err != nil {
+		return nil, err
+	}
+	if s.IsNodeDown(nodeIndex) {
+		return nil, fmt.Errorf("node %d: %w", nodeIndex, ErrNodeDown)
+	}
+	return node, nil
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kinds of objects found on storage nodes
+const (
+	ShardObjectKind    = "shard"
+	FragmentObjectKind = "fragment"
+	ManifestObjectKind = "manifest"
+	UnknownObjectKind  = "unknown"
+)
+
+// StoredObject is one object found on a storage node, parsed from its key
+type StoredObject struct {
+	NodeIndex    int    `json:"node_index"`
+	Key          string `json:"key"`
+	Kind         string `json:"kind"`
+	FileID       uint   `json:"file_id"`
+	ShardIndex   int    `json:"shard_index,omitempty"`
+	FragmentPath string `json:"fragment_path,omitempty"` // KeyFragment.FragmentPath of fragments
+}
+
+// parseObjectKey works out what a key under shards/ or fragments/ holds. It
+// returns false for keys outside any per-file directory.
+func parseObjectKey(key string) (StoredObject, bool) {
+	object := StoredObject{Key: key, Kind: UnknownObjectKind}
+
+	var dir string
+	switch {
+	case strings.HasPrefix(key, "shards/"):
+		dir = "shards/"
+	case strings.HasPrefix(key, "fragments/"):
+		dir = "fragments/"
+	default:
+		return object, false
+	}
+	if _, err := fmt.Sscanf(strings.TrimPrefix(key, dir), "file_%d/", &object.FileID); err != nil ||
+		!strings.HasPrefix(key, fmt.Sprintf("%sfile_%d/", dir, object.FileID)) {
+		return object, false
+	}
+
+	switch {
+	case key == manifestKey(object.FileID):
+		object.Kind = ManifestObjectKind
+	case dir == "fragments/":
+		object.Kind = FragmentObjectKind
+		object.FragmentPath = strings.TrimPrefix(key, dir)
+	default:
+		var shardIndex int
+		if _, err := fmt.Sscanf(key, "shards/file_%d/shard_%d", new(uint), &shardIndex); err == nil &&
+			key == shardKey(object.FileID, shardIndex) {
+			object.Kind = ShardObjectKind
+			object.ShardIndex = shardIndex
+		}
+	}
+	return object, true
+}
+
+// ListObjects returns every shard, fragment and manifest stored on a node,
+// along with keys in per-file directories that match none of them
+func (s *DistributedStorageService) ListObjects(nodeIndex int) ([]StoredObject, error) {
+	node, err := s.node(nodeIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []StoredObject
+	for _, prefix := range []string{"shards/", "fragments/"} {
+		keys, err := node.List(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s on node %d: %w", prefix, nodeIndex, err)
+		}
+		for _, key := range keys {
+			object, ok := parseObjectKey(key)
+			if !ok {
+				continue
+			}
+			object.NodeIndex = nodeIndex
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
+// DeleteObject removes an object found by ListObjects
+func (s *DistributedStorageService) DeleteObject(object StoredObject) error {
+	node, err := s.node(object.NodeIndex)
+	if err != nil {
+		return err
+	}
+	if err := node.Delete(object.Key); err != nil {
+		return fmt.Errorf("failed to delete %s from node %d: %w", object.Key, object.NodeIndex, err)
+	}
+	return nil
+}
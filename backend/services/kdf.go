@@ -0,0 +1,145 @@
+package services
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Password key derivation functions
+const (
+	KDFArgon2id     = "argon2id"
+	KDFPBKDF2SHA256 = "pbkdf2-sha256"
+)
+
+// Argon2id parameters for new keys: 3 passes over 64 MiB with 4 lanes, the
+// second recommended option of RFC 9106
+const (
+	Argon2Time    = 3
+	Argon2Memory  = 64 * 1024 // KiB
+	Argon2Threads = 4
+)
+
+// LegacyShareIterations is the PBKDF2 iteration count share fragments were
+// encrypted with before KDF parameters were stored per share
+const LegacyShareIterations = 4096
+
+// KDFParams records how a key was derived from a password. It is stored next
+// to whatever the key protects, encoded like a PHC string without salt and
+// hash, e.g. "argon2id$v=19$m=65536,t=3,p=4" or "pbkdf2-sha256$i=100000", so
+// parameters can change without losing access to older records.
+type KDFParams struct {
+	Algorithm  string
+	Version    int    // Argon2 version
+	Time       uint32 // Argon2 passes or PBKDF2 iterations
+	Memory     uint32 // Argon2 memory in KiB
+	Threads    uint8  // Argon2 lanes
+	KeyLength  uint32
+	legacyRead bool
+}
+
+// DefaultKDFParams returns the parameters new keys are derived with
+func DefaultKDFParams() KDFParams {
+	return KDFParams{
+		Algorithm: KDFArgon2id,
+		Version:   argon2.Version,
+		Time:      Argon2Time,
+		Memory:    Argon2Memory,
+		Threads:   Argon2Threads,
+		KeyLength: KeyEncryptionSize,
+	}
+}
+
+// LegacyKDFParams returns PBKDF2-SHA256 parameters for records that predate
+// stored KDF parameters. They can only be used to read such records.
+func LegacyKDFParams(iterations uint32) KDFParams {
+	return KDFParams{
+		Algorithm:  KDFPBKDF2SHA256,
+		Time:       iterations,
+		KeyLength:  KeyEncryptionSize,
+		legacyRead: true,
+	}
+}
+
+// ParseKDFParams decodes stored parameters; an empty string stands for
+// legacy, the PBKDF2 parameters given
+func ParseKDFParams(encoded string, legacyIterations uint32) (KDFParams, error) {
+	if encoded == "" {
+		return LegacyKDFParams(legacyIterations), nil
+	}
+
+	parts := strings.Split(encoded, "$")
+	fields := make(map[string]uint64)
+	for _, part := range parts[1:] {
+		for _, field := range strings.Split(part, ",") {
+			name, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return KDFParams{}, fmt.Errorf("malformed KDF parameters %q", encoded)
+			}
+			number, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return KDFParams{}, fmt.Errorf("malformed KDF parameter %s in %q", name, encoded)
+			}
+			fields[name] = number
+		}
+	}
+
+	params := KDFParams{Algorithm: parts[0], KeyLength: KeyEncryptionSize}
+	switch params.Algorithm {
+	case KDFArgon2id:
+		params.Version = int(fields["v"])
+		params.Memory = uint32(fields["m"])
+		params.Time = uint32(fields["t"])
+		params.Threads = uint8(fields["p"])
+		if params.Version != argon2.Version || params.Memory < 8*uint32(params.Threads) ||
+			params.Time == 0 || params.Threads == 0 || fields["p"] > 255 {
+			return KDFParams{}, fmt.Errorf("unsupported argon2id parameters %q", encoded)
+		}
+	case KDFPBKDF2SHA256:
+		params.Time = uint32(fields["i"])
+		if params.Time == 0 {
+			return KDFParams{}, fmt.Errorf("unsupported pbkdf2 parameters %q", encoded)
+		}
+	default:
+		return KDFParams{}, fmt.Errorf("unknown key derivation function %q", params.Algorithm)
+	}
+	return params, nil
+}
+
+// String encodes the parameters for storage
+func (p KDFParams) String() string {
+	switch p.Algorithm {
+	case KDFArgon2id:
+		return fmt.Sprintf("%s$v=%d$m=%d,t=%d,p=%d", p.Algorithm, p.Version, p.Memory, p.Time, p.Threads)
+	case KDFPBKDF2SHA256:
+		if p.legacyRead {
+			return ""
+		}
+		return fmt.Sprintf("%s$i=%d", p.Algorithm, p.Time)
+	}
+	return ""
+}
+
+// NeedsUpgrade reports whether keys derived with p should be re-derived with
+// DefaultKDFParams at the next chance
+func (p KDFParams) NeedsUpgrade() bool {
+	return p.String() != DefaultKDFParams().String()
+}
+
+// DeriveKey derives a key from password and salt
+func (p KDFParams) DeriveKey(password, salt []byte) ([]byte, error) {
+	if len(salt) < 16 {
+		return nil, fmt.Errorf("invalid salt length: expected at least 16, got %d", len(salt))
+	}
+	switch p.Algorithm {
+	case KDFArgon2id:
+		return argon2.IDKey(password, salt, p.Time, p.Memory, p.Threads, p.KeyLength), nil
+	case KDFPBKDF2SHA256:
+		return pbkdf2.Key(password, salt, int(p.Time), int(p.KeyLength), sha256.New), nil
+	}
+	return nil, fmt.Errorf("unknown key derivation function %q", p.Algorithm)
+}
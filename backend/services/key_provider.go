@@ -0,0 +1,284 @@
+package services
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Key providers selectable with SERVER_KEY_PROVIDER
+const (
+	KeyProviderDatabase = "database"
+	KeyProviderFile     = "file"
+	KeyProviderVault    = "vault"
+)
+
+// ErrUnknownKeyID is returned by KeyProvider.Unwrap for key IDs the provider doesn't hold
+var ErrUnknownKeyID = errors.New("unknown server key ID")
+
+// KeyProvider wraps the server's key fragments under a key it manages, so
+// fragment code never handles server key bytes. Key IDs are stored with each
+// fragment and must not contain ':'.
+type KeyProvider interface {
+	// KeyID returns the ID of the key new fragments are wrapped under
+	KeyID() (string, error)
+	// Wrap encrypts a fragment under the current key. nonce is the fragment's
+	// stored 16-byte nonce; providers that generate their own may ignore it.
+	Wrap(plaintext, nonce []byte) (wrapped []byte, keyID string, err error)
+	// Unwrap decrypts a fragment wrapped under keyID
+	Unwrap(keyID string, wrapped, nonce []byte) ([]byte, error)
+	// Rotate makes a new key current and returns its ID; older keys stay
+	// available for Unwrap
+	Rotate() (string, error)
+}
+
+// KeyRetirer is implemented by providers that retire keys nothing is wrapped
+// under any more
+type KeyRetirer interface {
+	RetireUnreferenced() ([]string, error)
+}
+
+// ProviderSealed reports whether a provider can't wrap until the server is unsealed
+func ProviderSealed(provider KeyProvider) bool {
+	sealed, ok := provider.(interface{ IsSealed() bool })
+	return ok && sealed.IsSealed()
+}
+
+// KeyProviderChain wraps with its primary provider and unwraps with whichever
+// provider holds the key ID, so fragments wrapped before switching providers
+// stay readable until key rotation re-wraps them
+type KeyProviderChain struct {
+	primary   KeyProvider
+	fallbacks []KeyProvider
+}
+
+func NewKeyProviderChain(primary KeyProvider, fallbacks ...KeyProvider) *KeyProviderChain {
+	return &KeyProviderChain{primary: primary, fallbacks: fallbacks}
+}
+
+func (c *KeyProviderChain) KeyID() (string, error) {
+	return c.primary.KeyID()
+}
+
+func (c *KeyProviderChain) Wrap(plaintext, nonce []byte) ([]byte, string, error) {
+	return c.primary.Wrap(plaintext, nonce)
+}
+
+func (c *KeyProviderChain) Unwrap(keyID string, wrapped, nonce []byte) ([]byte, error) {
+	plaintext, err := c.primary.Unwrap(keyID, wrapped, nonce)
+	for _, fallback := range c.fallbacks {
+		if !errors.Is(err, ErrUnknownKeyID) {
+			break
+		}
+		if ProviderSealed(fallback) {
+			// The unsealed middleware only checks the primary provider, so say
+			// why this fragment can't be read rather than failing obscurely
+			return nil, fmt.Errorf("%w: server key %s belongs to a previous key provider; unseal the server to read fragments wrapped under it",
+				ErrSealed, keyID)
+		}
+		plaintext, err = fallback.Unwrap(keyID, wrapped, nonce)
+	}
+	return plaintext, err
+}
+
+func (c *KeyProviderChain) Rotate() (string, error) {
+	return c.primary.Rotate()
+}
+
+// IsSealed reports whether the primary provider is sealed. Fallbacks are not
+// checked, since most requests never need them; Unwrap fails with ErrSealed
+// for fragments whose key is held by a sealed fallback.
+func (c *KeyProviderChain) IsSealed() bool {
+	return ProviderSealed(c.primary)
+}
+
+// RetireUnreferenced retires unused keys of every provider that supports it
+func (c *KeyProviderChain) RetireUnreferenced() ([]string, error) {
+	var retired []string
+	for _, provider := range append([]KeyProvider{c.primary}, c.fallbacks...) {
+		if retirer, ok := provider.(KeyRetirer); ok {
+			keyIDs, err := retirer.RetireUnreferenced()
+			retired = append(retired, keyIDs...)
+			if err != nil {
+				return retired, err
+			}
+		}
+	}
+	return retired, nil
+}
+
+// FileKeyProvider wraps fragments with AES-256-GCM under keys kept in a local
+// key ring file: one hex-encoded 32-byte key per line, the last one current.
+// Fragments use the same format as under the database keys, so
+// safesplit-recover can decrypt them given the key ring's keys.
+type FileKeyProvider struct {
+	path string
+
+	mu   sync.RWMutex
+	keys map[string][]byte
+	id   string
+}
+
+// NewFileKeyProvider loads the key ring at path, creating it with a new key if it doesn't exist
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	p := &FileKeyProvider{path: path}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err := p.Rotate(); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *FileKeyProvider) load() error {
+	file, err := os.Open(p.path)
+	if err != nil {
+		return fmt.Errorf("failed to open key ring: %w", err)
+	}
+	defer file.Close()
+
+	keys := make(map[string][]byte)
+	var current string
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(text)
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("key ring %s line %d: expected a hex-encoded 32-byte key", p.path, line)
+		}
+		current = fileKeyID(key)
+		keys[current] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read key ring: %w", err)
+	}
+	if current == "" {
+		return fmt.Errorf("key ring %s holds no keys", p.path)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys, p.id = keys, current
+	return nil
+}
+
+// fileKeyID derives a key ID from the key, so the key ring needs no IDs of its own
+func fileKeyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("safesplit-server-key:"), key...))
+	return "file-" + hex.EncodeToString(sum[:8])
+}
+
+func (p *FileKeyProvider) KeyID() (string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.id, nil
+}
+
+func (p *FileKeyProvider) Wrap(plaintext, nonce []byte) ([]byte, string, error) {
+	p.mu.RLock()
+	key, keyID := p.keys[p.id], p.id
+	p.mu.RUnlock()
+
+	wrapped, err := EncryptMasterKey(plaintext, key, nonce)
+	if err != nil {
+		return nil, "", err
+	}
+	return wrapped, keyID, nil
+}
+
+func (p *FileKeyProvider) Unwrap(keyID string, wrapped, nonce []byte) ([]byte, error) {
+	p.mu.RLock()
+	key, ok := p.keys[keyID]
+	p.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKeyID, keyID)
+	}
+	return DecryptMasterKey(wrapped, key, nonce)
+}
+
+// Rotate appends a new key to the key ring. The file is replaced atomically
+// so a crash leaves either the old or the new key ring.
+func (p *FileKeyProvider) Rotate() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate server key: %w", err)
+	}
+
+	existing, err := os.ReadFile(p.path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read key ring: %w", err)
+	}
+	if len(existing) > 0 && existing[len(existing)-1] != '\n' {
+		existing = append(existing, '\n')
+	}
+	data := append(existing, hex.EncodeToString(key)+"\n"...)
+
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), ".keyring-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to write key ring: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write key ring: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write key ring: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to write key ring: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), p.path); err != nil {
+		return "", fmt.Errorf("failed to replace key ring: %w", err)
+	}
+
+	if err := p.load(); err != nil {
+		return "", err
+	}
+	return fileKeyID(key), nil
+}
+
+// LoadKeyProvider returns the provider selected by SERVER_KEY_PROVIDER:
+// "database" (the default) wraps with the server master keys, "file" with the
+// key ring at SERVER_KEYRING_FILE and "vault" with the Transit key
+// VAULT_TRANSIT_KEY at VAULT_ADDR. Fragments wrapped under the database keys
+// stay readable with the other providers.
+func LoadKeyProvider(database KeyProvider) (KeyProvider, error) {
+	switch name := os.Getenv("SERVER_KEY_PROVIDER"); name {
+	case "", KeyProviderDatabase:
+		return database, nil
+	case KeyProviderFile:
+		path := os.Getenv("SERVER_KEYRING_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("SERVER_KEYRING_FILE is required for the file key provider")
+		}
+		provider, err := NewFileKeyProvider(path)
+		if err != nil {
+			return nil, err
+		}
+		return NewKeyProviderChain(provider, database), nil
+	case KeyProviderVault:
+		provider, err := NewVaultTransitProviderFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return NewKeyProviderChain(provider, database), nil
+	default:
+		return nil, fmt.Errorf("unknown SERVER_KEY_PROVIDER %q", name)
+	}
+}
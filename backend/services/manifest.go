@@ -0,0 +1,378 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// ManifestVersion is the current shard manifest format
+const ManifestVersion = 1
+
+// ErrManifestNotFound is returned when no node holds a valid manifest for a file,
+// e.g. for files stored before manifests were written
+var ErrManifestNotFound = errors.New("shard manifest not found")
+
+// ShardManifest describes the shards of a file so they can be decoded without
+// the files table. A signed copy is stored next to the shards on every node.
+// Every write raises the generation above that of the copies on the nodes, so
+// copies a write didn't reach are recognized as older.
+type ShardManifest struct {
+	Version             int      `json:"version"`
+	Generation          uint64   `json:"generation,omitempty"` // 0 for manifests written before it was recorded
+	FileID              uint     `json:"file_id"`
+	Layout              int      `json:"layout"`
+	DataShards          int      `json:"data_shards"`
+	ParityShards        int      `json:"parity_shards"`
+	ShardSize           int64    `json:"shard_size"`
+	OriginalSize        int64    `json:"original_size"` // stored (encrypted) bytes
+	StripeSize          int64    `json:"stripe_size,omitempty"`
+	StripeIndexChecksum string   `json:"stripe_index_checksum,omitempty"` // SHA-256 of the stripe index
+	EncryptionType      string   `json:"encryption_type"`
+	EncryptionIV        []byte   `json:"encryption_iv"`
+	EncryptionVersion   int      `json:"encryption_version,omitempty"` // 0 for EncryptionSingleAEAD manifests written before it was recorded
+	ShardChecksums      []string `json:"shard_checksums"`
+
+	// What is needed to decrypt the file without the database
+	OwnerID      uint               `json:"owner_id"`
+	Threshold    int                `json:"threshold"`
+	Compressed   bool               `json:"compressed"`
+	KeyFragments []ManifestFragment `json:"key_fragments"`
+}
+
+// ManifestFragment locates one encrypted key fragment of a file. The fragment
+// itself stays where it was stored; only the nonce and holder are recorded here.
+type ManifestFragment struct {
+	Index            int    `json:"index"`
+	HolderType       string `json:"holder_type"`
+	NodeIndex        int    `json:"node_index"`
+	Path             string `json:"path"`
+	Nonce            []byte `json:"nonce"`
+	ServerKeyID      string `json:"server_key_id,omitempty"`
+	MasterKeyVersion int    `json:"master_key_version,omitempty"`
+}
+
+// TotalShards returns the number of shards described by the manifest
+func (m *ShardManifest) TotalShards() int {
+	return m.DataShards + m.ParityShards
+}
+
+// signedManifest is the stored form: the exact manifest bytes and their HMAC
+type signedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"`
+}
+
+// ManifestSigner authenticates shard manifests with HMAC-SHA256
+type ManifestSigner struct {
+	key []byte
+}
+
+func NewManifestSigner(key string) (*ManifestSigner, error) {
+	if len(key) < MinNodeSecretLength {
+		return nil, fmt.Errorf("manifest signing key must be at least %d characters", MinNodeSecretLength)
+	}
+	return &ManifestSigner{key: []byte(key)}, nil
+}
+
+func (s *ManifestSigner) sign(data []byte) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Seal encodes and signs a manifest. Encoding is deterministic, so sealing the
+// same manifest twice gives the same bytes.
+func (s *ManifestSigner) Seal(manifest *ShardManifest) ([]byte, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	return json.Marshal(signedManifest{Manifest: data, Signature: s.sign(data)})
+}
+
+// Open verifies a sealed manifest and decodes it
+func (s *ManifestSigner) Open(sealed []byte) (*ShardManifest, error) {
+	var envelope signedManifest
+	if err := json.Unmarshal(sealed, &envelope); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if !hmac.Equal([]byte(s.sign(envelope.Manifest)), []byte(envelope.Signature)) {
+		return nil, fmt.Errorf("invalid manifest signature")
+	}
+
+	var manifest ShardManifest
+	if err := json.Unmarshal(envelope.Manifest, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if manifest.Version != ManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", manifest.Version)
+	}
+	if manifest.DataShards < 1 || manifest.ParityShards < 1 || len(manifest.ShardChecksums) != manifest.TotalShards() {
+		return nil, fmt.Errorf("malformed manifest")
+	}
+	return &manifest, nil
+}
+
+// StripeIndexChecksum returns the value recorded in ShardManifest.StripeIndexChecksum
+func StripeIndexChecksum(index []byte) string {
+	return ShardChecksum(index)
+}
+
+func manifestKey(fileID uint) string {
+	return fmt.Sprintf("shards/file_%d/manifest", fileID)
+}
+
+// AttachedNodes returns the indexes of every registered node, sorted
+func (s *DistributedStorageService) AttachedNodes() []int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	indexes := make([]int, 0, len(s.nodes))
+	for nodeIndex := range s.nodes {
+		indexes = append(indexes, nodeIndex)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// WriteManifest stores the signed manifest of a file on every writable node,
+// so draining nodes can be emptied, as the generation after the newest copy
+// on the nodes. Nodes that fail are logged; at least one copy has to be
+// written. It returns the nodes written to.
+func (s *ReedSolomonService) WriteManifest(manifest *ShardManifest) ([]int, error) {
+	manifest.Version = ManifestVersion
+	manifest.Generation = 1
+	if copies := s.readManifestCopies(manifest.FileID, nil); len(copies) > 0 {
+		manifest.Generation = copies[0].manifest.Generation + 1
+	}
+	sealed, err := s.signer.Seal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var written []int
+	for _, nodeIndex := range s.storage.WritableNodes() {
+		if err := s.writeManifestCopy(manifest.FileID, nodeIndex, sealed); err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		written = append(written, nodeIndex)
+	}
+	if len(written) == 0 {
+		return nil, fmt.Errorf("failed to write manifest of file %d to any node", manifest.FileID)
+	}
+	return written, nil
+}
+
+func (s *ReedSolomonService) writeManifestCopy(fileID uint, nodeIndex int, sealed []byte) error {
+	node, err := s.storage.liveNode(nodeIndex)
+	if err != nil {
+		return err
+	}
+	if err := node.Put(manifestKey(fileID), sealed); err != nil {
+		return fmt.Errorf("failed to write manifest of file %d to node %d: %w", fileID, nodeIndex, err)
+	}
+	return nil
+}
+
+// DeleteManifest removes the copy of a file's manifest from a node
+func (s *DistributedStorageService) DeleteManifest(fileID uint, nodeIndex int) error {
+	node, err := s.liveNode(nodeIndex)
+	if err != nil {
+		return err
+	}
+	if err := node.Delete(manifestKey(fileID)); err != nil {
+		return fmt.Errorf("failed to delete manifest: %w", err)
+	}
+	return nil
+}
+
+// RepairManifest rewrites every copy of a manifest on a writable node that is
+// missing, unreadable or differs from the given one and returns the number of
+// copies rewritten. The manifest keeps the generation of the newest copy if it
+// is the same, and gets the next one otherwise.
+func (s *ReedSolomonService) RepairManifest(manifest *ShardManifest) (int, error) {
+	manifest.Version = ManifestVersion
+	manifest.Generation = 1
+	if copies := s.readManifestCopies(manifest.FileID, nil); len(copies) > 0 {
+		newest := copies[0]
+		manifest.Generation = newest.manifest.Generation
+		if sealed, err := s.signer.Seal(manifest); err != nil || !bytes.Equal(sealed, newest.sealed) {
+			manifest.Generation++
+		}
+	}
+	sealed, err := s.signer.Seal(manifest)
+	if err != nil {
+		return 0, err
+	}
+
+	repaired := 0
+	for _, nodeIndex := range s.storage.WritableNodes() {
+		node, err := s.storage.liveNode(nodeIndex)
+		if err != nil {
+			continue
+		}
+		existing, err := node.Get(manifestKey(manifest.FileID))
+		if err == nil && bytes.Equal(existing, sealed) {
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			log.Printf("Warning: failed to read manifest of file %d from node %d: %v", manifest.FileID, nodeIndex, err)
+			continue
+		}
+
+		if err := s.writeManifestCopy(manifest.FileID, nodeIndex, sealed); err != nil {
+			return repaired, err
+		}
+		repaired++
+	}
+	return repaired, nil
+}
+
+// manifestCopy is a valid copy of a manifest as read from a node
+type manifestCopy struct {
+	nodeIndex int
+	manifest  *ShardManifest
+	sealed    []byte
+}
+
+// readManifestCopies reads the manifest of a file from the nodes in shardNodes
+// and every other attached node and returns the valid copies, newest
+// generation first and in the order of the nodes among equals. Copies with a
+// bad signature are skipped.
+func (s *ReedSolomonService) readManifestCopies(fileID uint, shardNodes []int) []manifestCopy {
+	tried := make(map[int]bool)
+	var candidates []int
+	for _, nodeIndex := range append(append([]int{}, shardNodes...), s.storage.AttachedNodes()...) {
+		if !tried[nodeIndex] {
+			tried[nodeIndex] = true
+			candidates = append(candidates, nodeIndex)
+		}
+	}
+
+	read := make([]*manifestCopy, len(candidates))
+	var wg sync.WaitGroup
+	for i, nodeIndex := range candidates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			read[i] = s.readManifestCopy(fileID, nodeIndex)
+		}()
+	}
+	wg.Wait()
+
+	var copies []manifestCopy
+	for _, c := range read {
+		if c != nil {
+			copies = append(copies, *c)
+		}
+	}
+	sort.SliceStable(copies, func(a, b int) bool {
+		return copies[a].manifest.Generation > copies[b].manifest.Generation
+	})
+	return copies
+}
+
+// readManifestCopy returns the manifest of a file on a node, or nil if the node
+// holds no valid one
+func (s *ReedSolomonService) readManifestCopy(fileID uint, nodeIndex int) *manifestCopy {
+	node, err := s.storage.liveNode(nodeIndex)
+	if err != nil {
+		return nil
+	}
+	sealed, err := node.Get(manifestKey(fileID))
+	if err != nil {
+		if !errors.Is(err, ErrObjectNotFound) {
+			log.Printf("Warning: failed to read manifest of file %d from node %d: %v", fileID, nodeIndex, err)
+		}
+		return nil
+	}
+
+	manifest, err := s.signer.Open(sealed)
+	if err != nil {
+		log.Printf("Rejected manifest of file %d on node %d: %v", fileID, nodeIndex, err)
+		return nil
+	}
+	if manifest.FileID != fileID {
+		log.Printf("Rejected manifest on node %d: belongs to file %d, not %d", nodeIndex, manifest.FileID, fileID)
+		return nil
+	}
+	return &manifestCopy{nodeIndex: nodeIndex, manifest: manifest, sealed: sealed}
+}
+
+// ReadManifest returns the valid manifest of a file with the highest
+// generation, preferring copies on the nodes in shardNodes among equals
+func (s *ReedSolomonService) ReadManifest(fileID uint, shardNodes []int) (*ShardManifest, error) {
+	copies := s.readManifestCopies(fileID, shardNodes)
+	if len(copies) == 0 {
+		return nil, ErrManifestNotFound
+	}
+	return copies[0].manifest, nil
+}
+
+// loadManifest returns the newest manifest of a file that agrees with what the
+// database records: the shard counts, the placement, the shard checksums that
+// are known and whatever check verifies. Copies that don't, such as copies a
+// layout change didn't replace, are skipped. It returns nil for files without
+// such a manifest, which are then read with the database alone.
+func (s *ReedSolomonService) loadManifest(fileID uint, shardNodes []int, checksums []string, dataShards, parityShards int, check func(*ShardManifest) error) *ShardManifest {
+	copies := s.readManifestCopies(fileID, shardNodes)
+	for _, c := range copies {
+		err := manifestMatches(c.manifest, shardNodes, checksums, dataShards, parityShards)
+		if err == nil && check != nil {
+			err = check(c.manifest)
+		}
+		if err != nil {
+			log.Printf("Skipping manifest of file %d on node %d (generation %d): %v",
+				fileID, c.nodeIndex, c.manifest.Generation, err)
+			continue
+		}
+		return c.manifest
+	}
+	if len(copies) > 0 {
+		log.Printf("Warning: no manifest of file %d matches its database records, reading it without one", fileID)
+	}
+	return nil
+}
+
+// manifestMatches checks a manifest against the shard counts, placement and
+// checksums of a file in the database
+func manifestMatches(manifest *ShardManifest, shardNodes []int, checksums []string, dataShards, parityShards int) error {
+	if manifest.DataShards != dataShards || manifest.ParityShards != parityShards {
+		return fmt.Errorf("describes %d+%d shards, expected %d+%d",
+			manifest.DataShards, manifest.ParityShards, dataShards, parityShards)
+	}
+	if len(shardNodes) != manifest.TotalShards() {
+		return fmt.Errorf("describes %d shards, have placement for %d", manifest.TotalShards(), len(shardNodes))
+	}
+	for i, checksum := range checksums {
+		if i < len(manifest.ShardChecksums) && checksum != "" && checksum != manifest.ShardChecksums[i] {
+			return fmt.Errorf("checksum of shard %d differs", i)
+		}
+	}
+	return nil
+}
+
+// mergeChecksums fills checksums missing from the database with the ones in the manifest
+func mergeChecksums(checksums []string, manifest *ShardManifest) []string {
+	if manifest == nil {
+		return checksums
+	}
+	merged := make([]string, manifest.TotalShards())
+	for i := range merged {
+		if i < len(checksums) && checksums[i] != "" {
+			merged[i] = checksums[i]
+		} else {
+			merged[i] = manifest.ShardChecksums[i]
+		}
+	}
+	return merged
+}
@@ -0,0 +1,80 @@
+package services
+
+import "testing"
+
+func TestManifestGenerations(t *testing.T) {
+	rsService := newTestRSService(t, 4)
+	const fileID = 7
+
+	old := &ShardManifest{FileID: fileID, Layout: LayoutSingleCodeword, DataShards: 2, ParityShards: 1,
+		OriginalSize: 10, ShardChecksums: []string{"a", "b", "c"}}
+	if _, err := rsService.WriteManifest(old); err != nil {
+		t.Fatal(err)
+	}
+	node3, err := rsService.storage.node(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := node3.Get(manifestKey(fileID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := &ShardManifest{FileID: fileID, Layout: LayoutSingleCodeword, DataShards: 3, ParityShards: 1,
+		OriginalSize: 10, ShardChecksums: []string{"d", "e", "f", "g"}}
+	if _, err := rsService.WriteManifest(current); err != nil {
+		t.Fatal(err)
+	}
+	if old.Generation != 1 || current.Generation != 2 {
+		t.Fatalf("written as generations %d and %d, want 1 and 2", old.Generation, current.Generation)
+	}
+	// Node 3 missed the second write
+	if err := node3.Put(manifestKey(fileID), stale); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := rsService.ReadManifest(fileID, []int{3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Generation != 2 {
+		t.Fatalf("read generation %d, want the newest", manifest.Generation)
+	}
+
+	cases := []struct {
+		name       string
+		shardNodes []int
+		checksums  []string
+		data       int
+		parity     int
+		want       uint64
+	}{
+		{"newest matching", []int{0, 1, 2, 3}, nil, 3, 1, 2},
+		{"older matching", []int{3, 0, 1}, []string{"a", "", "c"}, 2, 1, 1},
+		{"checksum mismatch", []int{0, 1, 2, 3}, []string{"d", "x", "f", "g"}, 3, 1, 0},
+		{"count mismatch", []int{0, 1, 2, 3, 0}, nil, 4, 1, 0},
+	}
+	for _, c := range cases {
+		manifest := rsService.loadManifest(fileID, c.shardNodes, c.checksums, c.data, c.parity, nil)
+		switch {
+		case c.want == 0 && manifest != nil:
+			t.Errorf("%s: loaded generation %d, want none", c.name, manifest.Generation)
+		case c.want != 0 && (manifest == nil || manifest.Generation != c.want):
+			t.Errorf("%s: loaded %v, want generation %d", c.name, manifest, c.want)
+		}
+	}
+
+	// Repairing with the newest content keeps its generation and fixes node 3
+	repair := *current
+	repair.Generation = 0
+	repaired, err := rsService.RepairManifest(&repair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired != 1 || repair.Generation != 2 {
+		t.Fatalf("repaired %d copies as generation %d, want 1 as generation 2", repaired, repair.Generation)
+	}
+	if manifest := rsService.loadManifest(fileID, []int{3, 0, 1}, nil, 2, 1, nil); manifest != nil {
+		t.Fatalf("generation %d still matches the old layout after the repair", manifest.Generation)
+	}
+}
@@ -26,19 +26,16 @@ func GenerateMasterKey() ([]byte, error) {
 	return masterKey, nil
 }
 
-// DeriveKeyEncryptionKey derives a key encryption key from password using PBKDF2
+// DeriveKeyEncryptionKey derives a key encryption key from password using
+// PBKDF2. It only reads master keys wrapped before KDF parameters were stored
+// per user; new keys are derived with DefaultKDFParams.
 func DeriveKeyEncryptionKey(password string, salt []byte) ([]byte, error) {
 	if len(salt) != 32 {
 		return nil, fmt.Errorf("invalid salt length: expected 32, got %d", len(salt))
 	}
 
-	log.Printf("Deriving KEK - Salt: %x", salt)
-	log.Printf("Password length: %d bytes", len(password))
-
-	kek := pbkdf2.Key([]byte(password), salt, PBKDF2Iterations, KeyEncryptionSize, sha256.New)
-	log.Printf("Derived KEK: %x", kek)
-
-	return kek, nil
+	// Never log the password or the derived key, which would persist them
+	return pbkdf2.Key([]byte(password), salt, PBKDF2Iterations, KeyEncryptionSize, sha256.New), nil
 }
 
 // EncryptMasterKey encrypts using AES-GCM with 16-byte nonce
@@ -51,8 +48,6 @@ func EncryptMasterKey(data []byte, key []byte, nonce []byte) ([]byte, error) {
 	}
 
 	log.Printf("EncryptMasterKey - Data length: %d", len(data))
-	log.Printf("Key: %x", key)
-	log.Printf("Nonce: %x", nonce)
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -65,7 +60,7 @@ func EncryptMasterKey(data []byte, key []byte, nonce []byte) ([]byte, error) {
 	}
 
 	encrypted := gcm.Seal(nil, nonce, data, nil)
-	log.Printf("Encrypted result - Length: %d, Value: %x", len(encrypted), encrypted)
+	log.Printf("Encrypted result - Length: %d", len(encrypted))
 	return encrypted, nil
 }
 
@@ -82,7 +77,6 @@ func DecryptMasterKey(encryptedKey []byte, key []byte, nonce []byte) ([]byte, er
 	encryptedKey = encryptedKey[:48]
 
 	log.Printf("Original Encrypted Master Key Length: %d", len(encryptedKey))
-	log.Printf("Original Encrypted Master Key: %x", encryptedKey)
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -96,8 +90,7 @@ func DecryptMasterKey(encryptedKey []byte, key []byte, nonce []byte) ([]byte, er
 
 	log.Printf("DecryptMasterKey Debug:")
 	log.Printf("- Encrypted Key Len: %d", len(encryptedKey))
-	log.Printf("- KEK: %x", key)
-	log.Printf("- Nonce: %x", nonce)
+	log.Printf("- Nonce Len: %d", len(nonce))
 	log.Printf("- GCM NonceSize: %d", gcm.NonceSize())
 
 	decrypted, err := gcm.Open(nil, nonce, encryptedKey, nil)
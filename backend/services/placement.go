@@ -0,0 +1,269 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// MaxNodeWeight bounds NodeTopology.Weight so the placement ring stays small
+const MaxNodeWeight = 100
+
+// ErrPlacementUnsatisfiable is returned when the writable nodes span too few
+// zones to place a file's objects without breaking the placement policy
+var ErrPlacementUnsatisfiable = errors.New("placement policy cannot be satisfied")
+
+// ErrNotEnoughHealthyNodes is returned when the policy could be satisfied by
+// the writable nodes, but not by those the health checker hasn't marked down
+var ErrNotEnoughHealthyNodes = errors.New("not enough healthy storage nodes")
+
+// NodeTopology places a storage node in the failure-domain hierarchy and in a
+// storage tier. A node without a label at some level is a domain of its own at
+// that level, so unlabeled nodes are each treated as a separate zone.
+type NodeTopology struct {
+	Zone   string `json:"zone"`
+	Rack   string `json:"rack"`
+	Host   string `json:"host"`
+	Weight int    `json:"weight"` // relative share of new objects, 1 to MaxNodeWeight
+	Tier   string `json:"tier"`   // TierHot or TierCold; empty means hot
+}
+
+func (t NodeTopology) tier() string {
+	if t.Tier == "" {
+		return TierHot
+	}
+	return t.Tier
+}
+
+func (t NodeTopology) zone(nodeIndex int) string {
+	return domainKey("zone", t.Zone, nodeIndex)
+}
+
+func (t NodeTopology) rack(nodeIndex int) string {
+	if t.Rack == "" {
+		return domainKey("rack", "", nodeIndex)
+	}
+	return domainKey("rack", t.Zone+"/"+t.Rack, nodeIndex)
+}
+
+func (t NodeTopology) host(nodeIndex int) string {
+	return domainKey("host", t.Host, nodeIndex)
+}
+
+func (t NodeTopology) weight() int {
+	return min(max(t.Weight, 1), MaxNodeWeight)
+}
+
+func domainKey(level, label string, nodeIndex int) string {
+	if label == "" {
+		return fmt.Sprintf("%s:node_%d", level, nodeIndex)
+	}
+	return level + ":" + label
+}
+
+// ShardZoneLimit is how many shards of a file a single zone may hold so the
+// file stays readable after losing that zone
+func ShardZoneLimit(parityShards int) int {
+	return parityShards
+}
+
+// FragmentZoneLimit is how many key fragments of a file a single zone may hold
+// without being able to reconstruct the key on its own
+func FragmentZoneLimit(threshold int) int {
+	return threshold - 1
+}
+
+// SetNodeTopology records the failure domains and weight of a registered node
+func (s *DistributedStorageService) SetNodeTopology(nodeIndex int, topology NodeTopology) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.nodes[nodeIndex]; !exists {
+		return fmt.Errorf("invalid node index: %d", nodeIndex)
+	}
+	s.topology[nodeIndex] = topology
+	return nil
+}
+
+// ZoneOf returns the zone a node belongs to; unlabeled nodes are their own zone
+func (s *DistributedStorageService) ZoneOf(nodeIndex int) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.topology[nodeIndex].zone(nodeIndex)
+}
+
+// ShardPlacement constrains where the shards of a file are placed
+type ShardPlacement struct {
+	Tier string // TierHot or TierCold
+	// Avoid[i], if set, is a node shard i must not be placed on. Re-encoded
+	// shards are written under the keys of the ones they replace, so each has
+	// to go to another node than its predecessor until the switch.
+	Avoid []int
+}
+
+// PlaceShards picks a writable node of the target tier with room for each of
+// count shards of shardSize bytes so that no zone holds more than parityShards of them
+func (s *DistributedStorageService) PlaceShards(seed uint, count, parityShards int, shardSize int64, target ShardPlacement) ([]int, error) {
+	placement, err := s.place(seed, count, ShardZoneLimit(parityShards), shardSize, target.Tier, target.Avoid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to place %d shards with %d parity on the %s tier: %w", count, parityShards, target.Tier, err)
+	}
+	return placement, nil
+}
+
+// PlaceFragments picks a writable node of any tier for each of count key
+// fragments so that no zone, and therefore no node, holds threshold of them
+func (s *DistributedStorageService) PlaceFragments(seed uint, count, threshold int) ([]int, error) {
+	// Fragments are a few dozen bytes, so they are placed regardless of free space
+	placement, err := s.place(seed, count, FragmentZoneLimit(threshold), 0, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to place %d key fragments with threshold %d: %w", count, threshold, err)
+	}
+	return placement, nil
+}
+
+// place assigns count objects of size bytes to writable nodes of tier, or of
+// any tier if tier is empty, with room for them and other than avoid[i] for
+// object i, holding at most zoneLimit in any zone. Each object goes to the
+// candidate whose zone, rack, host and node hold the fewest of the file's
+// objects so far, then to an up rather than degraded node, then to the emptier
+// node. Nodes marked down are skipped. Remaining ties are broken by a
+// weighted ring rotated by seed, so heavier nodes are picked first more often
+// and small files don't all start on the same node.
+func (s *DistributedStorageService) place(seed uint, count, zoneLimit int, size int64, tier string, avoid []int) ([]int, error) {
+	s.mu.RLock()
+	var writable []int
+	topology := make(map[int]NodeTopology)
+	usage := make(map[int]NodeUsage)
+	degraded := make(map[int]int)
+	var healthy []int
+	for nodeIndex, ok := range s.writable {
+		if !ok || (tier != "" && s.topology[nodeIndex].tier() != tier) {
+			continue
+		}
+		writable = append(writable, nodeIndex)
+		topology[nodeIndex] = s.topology[nodeIndex]
+		usage[nodeIndex] = s.usage[nodeIndex]
+		switch s.health[nodeIndex].State {
+		case NodeDown:
+			continue
+		case NodeDegraded:
+			degraded[nodeIndex] = 1
+		}
+		healthy = append(healthy, nodeIndex)
+	}
+	s.mu.RUnlock()
+
+	if len(writable) == 0 {
+		return nil, fmt.Errorf("no writable storage nodes available")
+	}
+	sort.Ints(writable)
+	sort.Ints(healthy)
+
+	if zones := countZones(writable, topology); zoneLimit < 1 || count > zoneLimit*zones {
+		return nil, fmt.Errorf("%w: %d writable zones hold at most %d objects each",
+			ErrPlacementUnsatisfiable, zones, max(zoneLimit, 0))
+	}
+	if zones := countZones(healthy, topology); count > zoneLimit*zones {
+		return nil, fmt.Errorf("%w: %d of %d writable nodes are down, leaving %d zones for %d objects",
+			ErrNotEnoughHealthyNodes, len(writable)-len(healthy), len(writable), zones, count)
+	}
+
+	order := candidateOrder(seed, healthy, topology)
+	counts := make(map[string]int)
+	placement := make([]int, count)
+	for i := range placement {
+		best := -1
+		var bestScore [6]int
+		avoided := false
+		for _, nodeIndex := range order {
+			if i < len(avoid) && avoid[i] == nodeIndex {
+				avoided = true
+				continue
+			}
+			t := topology[nodeIndex]
+			placed := counts[fmt.Sprintf("node:%d", nodeIndex)]
+			score := [6]int{
+				counts[t.zone(nodeIndex)],
+				counts[t.rack(nodeIndex)],
+				counts[t.host(nodeIndex)],
+				placed,
+				degraded[nodeIndex],
+				usage[nodeIndex].utilizationDecile(),
+			}
+			if score[0] >= zoneLimit || !usage[nodeIndex].Fits(int64(placed+1)*size) {
+				continue
+			}
+			if best < 0 || lessScore(score, bestScore) {
+				best, bestScore = nodeIndex, score
+			}
+		}
+
+		if best < 0 && avoided {
+			return nil, fmt.Errorf("%w: no node in a zone with room left for object %d besides node %d",
+				ErrPlacementUnsatisfiable, i, avoid[i])
+		}
+		if best < 0 {
+			return nil, fmt.Errorf("%w: no node in a zone with room left has %d bytes free", ErrInsufficientCapacity, size)
+		}
+		t := topology[best]
+		counts[t.zone(best)]++
+		counts[t.rack(best)]++
+		counts[t.host(best)]++
+		counts[fmt.Sprintf("node:%d", best)]++
+		placement[i] = best
+	}
+	return placement, nil
+}
+
+func countZones(nodes []int, topology map[int]NodeTopology) int {
+	zones := make(map[string]bool)
+	for _, nodeIndex := range nodes {
+		zones[topology[nodeIndex].zone(nodeIndex)] = true
+	}
+	return len(zones)
+}
+
+// candidateOrder lists the nodes in the order they first appear on a smooth
+// weighted round-robin ring, starting at a position chosen by seed
+func candidateOrder(seed uint, nodes []int, topology map[int]NodeTopology) []int {
+	total := 0
+	current := make([]int, len(nodes))
+	for _, nodeIndex := range nodes {
+		total += topology[nodeIndex].weight()
+	}
+
+	ring := make([]int, total)
+	for i := range ring {
+		chosen := 0
+		for j, nodeIndex := range nodes {
+			current[j] += topology[nodeIndex].weight()
+			if current[j] > current[chosen] {
+				chosen = j
+			}
+		}
+		current[chosen] -= total
+		ring[i] = nodes[chosen]
+	}
+
+	order := make([]int, 0, len(nodes))
+	seen := make(map[int]bool)
+	start := int(seed % uint(total))
+	for i := 0; i < total && len(order) < len(nodes); i++ {
+		nodeIndex := ring[(start+i)%total]
+		if !seen[nodeIndex] {
+			seen[nodeIndex] = true
+			order = append(order, nodeIndex)
+		}
+	}
+	return order
+}
+
+func lessScore(a, b [6]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
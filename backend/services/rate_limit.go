@@ -0,0 +1,57 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// WindowLimiter allows up to limit events per key within a sliding window,
+// e.g. per email address or client IP of a public endpoint
+type WindowLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu        sync.Mutex
+	events    map[string][]time.Time
+	lastPrune time.Time
+}
+
+func NewWindowLimiter(limit int, window time.Duration) *WindowLimiter {
+	return &WindowLimiter{
+		limit:  limit,
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// Allow records an event for key and reports whether it is within the limit
+func (l *WindowLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	since := now.Add(-l.window)
+	if now.Sub(l.lastPrune) > l.window {
+		// Forget keys that have gone quiet so the map doesn't grow forever
+		for k, times := range l.events {
+			if len(times) == 0 || !times[len(times)-1].After(since) {
+				delete(l.events, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	times := l.events[key]
+	valid := times[:0]
+	for _, t := range times {
+		if t.After(since) {
+			valid = append(valid, t)
+		}
+	}
+	if len(valid) >= l.limit {
+		l.events[key] = valid
+		return false
+	}
+	l.events[key] = append(valid, now)
+	return true
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// RecoveryKeys holds the key material used to decrypt key fragments when the
+// database is unavailable
+type RecoveryKeys struct {
+	ServerKeys map[string][]byte // server master keys by key ID; "" is tried for any key ID
+	UserKeys   map[uint][]byte   // user master keys by user ID; 0 is tried for any user
+}
+
+// candidates returns the keys that may decrypt a fragment of a file owned by ownerID
+func (k RecoveryKeys) candidates(ownerID uint, fragment ManifestFragment) [][]byte {
+	var keys [][]byte
+	switch fragment.HolderType {
+	case "server":
+		if key, ok := k.ServerKeys[fragment.ServerKeyID]; ok {
+			keys = append(keys, key)
+		}
+		if key, ok := k.ServerKeys[""]; ok && fragment.ServerKeyID != "" {
+			keys = append(keys, key)
+		}
+	case "user":
+		if key, ok := k.UserKeys[ownerID]; ok {
+			keys = append(keys, key)
+		}
+		if key, ok := k.UserKeys[0]; ok && ownerID != 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// ScanShards lists the shards held by every attached node by file ID and shard
+// index, so files can be found without the database
+func (s *DistributedStorageService) ScanShards() (map[uint]map[int][]int, error) {
+	found := make(map[uint]map[int][]int)
+	for _, nodeIndex := range s.AttachedNodes() {
+		objects, err := s.ListObjects(nodeIndex)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range objects {
+			if object.Kind != ShardObjectKind {
+				continue
+			}
+			if found[object.FileID] == nil {
+				found[object.FileID] = make(map[int][]int)
+			}
+			found[object.FileID][object.ShardIndex] = append(found[object.FileID][object.ShardIndex], nodeIndex)
+		}
+	}
+	return found, nil
+}
+
+// findFragment reads a key fragment from its recorded node, falling back to
+// every other node in case the node directories were remapped
+func (s *DistributedStorageService) findFragment(nodeIndex int, fragmentPath string) ([]byte, error) {
+	if data, err := s.RetrieveFragment(nodeIndex, fragmentPath); err == nil {
+		return data, nil
+	}
+	for _, other := range s.AttachedNodes() {
+		if other == nodeIndex {
+			continue
+		}
+		if data, err := s.RetrieveFragment(other, fragmentPath); err == nil {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("fragment %s not found on any node", fragmentPath)
+}
+
+// RecoverFile writes the stored (encrypted) content of the file described by
+// manifest to w without consulting the database. locations lists the nodes
+// holding each shard, as found by ScanShards; the first copy of a shard is used.
+func (s *ReedSolomonService) RecoverFile(manifest *ShardManifest, locations map[int][]int, w io.Writer) ([]CorruptShard, error) {
+	shardNodes := make([]int, manifest.TotalShards())
+	for i := range shardNodes {
+		shardNodes[i] = -1 // never a node index, so the shard counts as missing
+		if nodes := locations[i]; len(nodes) > 0 {
+			shardNodes[i] = nodes[0]
+		}
+	}
+
+	var written int64
+	var corrupted []CorruptShard
+	var err error
+	switch manifest.Layout {
+	case LayoutSingleCodeword:
+		written, corrupted, err = s.ReconstructStream(manifest.FileID, shardNodes, manifest.ShardChecksums,
+			manifest.DataShards, manifest.ParityShards, w)
+	case LayoutStriped:
+		written, corrupted, err = s.reconstructStriped(manifest.FileID, shardNodes, manifest.ShardChecksums, StripeLayout{
+			DataShards:   manifest.DataShards,
+			ParityShards: manifest.ParityShards,
+			StripeSize:   manifest.StripeSize,
+			ContentSize:  manifest.OriginalSize,
+		}, w)
+	default:
+		return nil, fmt.Errorf("unsupported shard layout: %d", manifest.Layout)
+	}
+	if err != nil {
+		return corrupted, err
+	}
+	if written != manifest.OriginalSize {
+		return corrupted, fmt.Errorf("recovered %d bytes, manifest records %d", written, manifest.OriginalSize)
+	}
+	return corrupted, nil
+}
+
+// RecoverKeyShares reads and decrypts the key fragments listed in a manifest
+// until the threshold is reached. Fragments without a matching key, missing
+// from every node or failing to decrypt are skipped.
+func (s *ReedSolomonService) RecoverKeyShares(manifest *ShardManifest, keys RecoveryKeys) ([]KeyShare, error) {
+	var shares []KeyShare
+	for _, fragment := range manifest.KeyFragments {
+		if len(shares) == manifest.Threshold {
+			break
+		}
+
+		candidates := keys.candidates(manifest.OwnerID, fragment)
+		if len(candidates) == 0 {
+			log.Printf("No key for %s fragment %d of file %d", fragment.HolderType, fragment.Index, manifest.FileID)
+			continue
+		}
+
+		data, err := s.storage.findFragment(fragment.NodeIndex, fragment.Path)
+		if err != nil {
+			log.Printf("Skipping fragment %d of file %d: %v", fragment.Index, manifest.FileID, err)
+			continue
+		}
+		if len(data) != 48 {
+			log.Printf("Invalid fragment length for file %d, index %d: got %d bytes, expected 48",
+				manifest.FileID, fragment.Index, len(data))
+			continue
+		}
+
+		share, err := decryptFragment(data, fragment.Nonce, candidates)
+		if err != nil {
+			log.Printf("Skipping fragment %d of file %d: %v", fragment.Index, manifest.FileID, err)
+			continue
+		}
+		shares = append(shares, KeyShare{
+			Index:        fragment.Index,
+			Value:        hex.EncodeToString(share),
+			HolderType:   fragment.HolderType,
+			NodeIndex:    fragment.NodeIndex,
+			FragmentPath: fragment.Path,
+		})
+	}
+
+	if len(shares) < manifest.Threshold {
+		return nil, fmt.Errorf("decrypted %d key fragments, need %d", len(shares), manifest.Threshold)
+	}
+	return shares, nil
+}
+
+// decryptFragment tries each key in turn and returns the share normalized to 32 bytes
+func decryptFragment(data, nonce []byte, keys [][]byte) ([]byte, error) {
+	for _, key := range keys {
+		decrypted, err := DecryptMasterKey(data, key, nonce)
+		if err != nil {
+			continue
+		}
+		share := make([]byte, 32)
+		copy(share, decrypted)
+		return share, nil
+	}
+	return nil, errors.New("no key decrypts the fragment")
+}
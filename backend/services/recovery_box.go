@@ -0,0 +1,132 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Recovery boxes seal a small secret, such as a share of a master key, to an
+// X25519 public key so that only the holder of the private key can open it:
+//
+//	ephemeral public key (32 bytes) | nonce (12 bytes) | AES-256-GCM ciphertext and tag
+//
+// The AES key is HKDF-SHA256 of the X25519 shared secret, salted with the
+// ephemeral and recipient public keys.
+
+const (
+	RecoveryKeySize = 32
+
+	recoveryBoxInfo      = "safesplit recovery box v1"
+	recoveryBoxNonceSize = 12
+	masterKeyCheckInfo   = "safesplit master key check v1"
+)
+
+// GenerateRecoveryKeyPair returns a new X25519 private and public key
+func GenerateRecoveryKeyPair() ([]byte, []byte, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate recovery key pair: %w", err)
+	}
+	return privateKey.Bytes(), privateKey.PublicKey().Bytes(), nil
+}
+
+// RecoveryPublicKey returns the public key of an X25519 private key
+func RecoveryPublicKey(privateKey []byte) ([]byte, error) {
+	key, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recovery key: %w", err)
+	}
+	return key.PublicKey().Bytes(), nil
+}
+
+// SealToRecoveryKey encrypts plaintext to the holder of the private key of publicKey
+func SealToRecoveryKey(publicKey, plaintext []byte) ([]byte, error) {
+	recipient, err := ecdh.X25519().NewPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recovery public key: %w", err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to agree on key: %w", err)
+	}
+
+	ephemeralPublic := ephemeral.PublicKey().Bytes()
+	gcm, err := recoveryBoxCipher(shared, ephemeralPublic, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, recoveryBoxNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := append(ephemeralPublic, nonce...)
+	return gcm.Seal(sealed, nonce, plaintext, nil), nil
+}
+
+// OpenWithRecoveryKey decrypts a box sealed to the public key of privateKey
+func OpenWithRecoveryKey(privateKey, sealed []byte) ([]byte, error) {
+	if len(sealed) < RecoveryKeySize+recoveryBoxNonceSize {
+		return nil, errors.New("recovery box is truncated")
+	}
+	key, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recovery key: %w", err)
+	}
+	ephemeralPublic := sealed[:RecoveryKeySize]
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("failed to agree on key: %w", err)
+	}
+
+	gcm, err := recoveryBoxCipher(shared, ephemeralPublic, key.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	nonce := sealed[RecoveryKeySize : RecoveryKeySize+recoveryBoxNonceSize]
+	plaintext, err := gcm.Open(nil, nonce, sealed[RecoveryKeySize+recoveryBoxNonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recovery box: %w", err)
+	}
+	return plaintext, nil
+}
+
+func recoveryBoxCipher(shared, ephemeralPublic, recipientPublic []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte(nil), ephemeralPublic...), recipientPublic...)
+	key := make([]byte, KeyEncryptionSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(recoveryBoxInfo)), key); err != nil {
+		return nil, fmt.Errorf("failed to derive recovery box key: %w", err)
+	}
+	defer wipe(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// MasterKeyCheck returns a value that identifies a master key without
+// revealing it, to verify a key recombined from shares
+func MasterKeyCheck(masterKey []byte) string {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte(masterKeyCheckInfo))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,285 @@
+package services
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/tyler-smith/go-bip39/wordlists"
+)
+
+// Recovery kits carry a user's master key, or their user-held key shares of
+// chosen files, out of SafeSplit under a passphrase of their choosing, so
+// access survives the loss of the wrapped master key or moves with the data
+// to another instance. A kit is the binary envelope
+//
+//	"SSRK" | version (1 byte) | kind (1 byte) | length of KDF parameters (1 byte) |
+//	KDF parameters, encoded as by KDFParams.String | salt (16 bytes) |
+//	nonce (12 bytes) | AES-256-GCM ciphertext and tag
+//
+// The AES key is derived from the passphrase and salt with the KDF parameters,
+// and everything before the ciphertext is authenticated as additional data.
+// The plaintext of a master key kit is the 32-byte master key, that of a
+// fragments kit the JSON document RecoveryKitFiles.
+//
+// Kits are printed in one of two encodings:
+//   - words: the envelope followed by the first 4 bytes of its SHA-256 as
+//     11-bit groups, the last padded with zero bits, each written as a word
+//     of the BIP39 English list; lines of six words are numbered by their
+//     first word. When reading, tokens containing digits, '.' or ':' are
+//     taken for line numbers and skipped; any other token must be a word of
+//     the list, so a mistyped word is reported rather than dropped
+//   - armor: a PEM block of type "SAFESPLIT RECOVERY KIT"
+
+// RecoveryKitKind is what a recovery kit holds
+type RecoveryKitKind byte
+
+const (
+	RecoveryKitMasterKey RecoveryKitKind = 1
+	RecoveryKitFragments RecoveryKitKind = 2
+)
+
+// Recovery kit text encodings
+const (
+	RecoveryKitFormatWords = "words"
+	RecoveryKitFormatArmor = "armor"
+)
+
+const (
+	RecoveryKitVersion = 1
+	// MinRecoveryPassphraseLength is the shortest passphrase a kit is sealed with
+	MinRecoveryPassphraseLength = 12
+
+	recoveryKitMagic     = "SSRK"
+	recoveryKitSaltSize  = 16
+	recoveryKitNonceSize = 12
+	recoveryKitPEMType   = "SAFESPLIT RECOVERY KIT"
+	recoveryKitChecksum  = 4
+	recoveryKitLineWords = 6
+
+	// Bounds on the KDF cost of kits read back, which come from outside
+	maxRecoveryKitMemory     = 4 * Argon2Memory
+	maxRecoveryKitTime       = 16
+	maxRecoveryKitIterations = 10000000
+)
+
+// ErrRecoveryKitPassphrase is returned when a kit does not decrypt, which
+// normally means the passphrase is wrong
+var ErrRecoveryKitPassphrase = errors.New("wrong passphrase or damaged recovery kit")
+
+// RecoveryKitFiles is the payload of a fragments kit
+type RecoveryKitFiles struct {
+	Files []RecoveryKitFile `json:"files"`
+}
+
+// RecoveryKitFile holds the user-held key shares of one file. The file hash
+// identifies the file on another instance, where its ID differs.
+type RecoveryKitFile struct {
+	FileID       uint               `json:"file_id"`
+	FileHash     string             `json:"file_hash"`
+	OriginalName string             `json:"original_name"`
+	Threshold    uint               `json:"threshold"`
+	ShareCount   uint               `json:"share_count"`
+	Shares       []RecoveryKitShare `json:"shares"`
+}
+
+// RecoveryKitShare is a Shamir share as in KeyShare
+type RecoveryKitShare struct {
+	Index int    `json:"index"`
+	Value string `json:"value"` // hex
+}
+
+// SealRecoveryKit encrypts a payload of the given kind under passphrase
+func SealRecoveryKit(kind RecoveryKitKind, payload []byte, passphrase string) ([]byte, error) {
+	if len(passphrase) < MinRecoveryPassphraseLength {
+		return nil, fmt.Errorf("passphrase must be at least %d characters", MinRecoveryPassphraseLength)
+	}
+
+	params := DefaultKDFParams()
+	encodedParams := params.String()
+	salt := make([]byte, recoveryKitSaltSize)
+	nonce := make([]byte, recoveryKitNonceSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	header := make([]byte, 0, len(recoveryKitMagic)+3+len(encodedParams)+recoveryKitSaltSize+recoveryKitNonceSize)
+	header = append(header, recoveryKitMagic...)
+	header = append(header, RecoveryKitVersion, byte(kind), byte(len(encodedParams)))
+	header = append(header, encodedParams...)
+	header = append(header, salt...)
+	header = append(header, nonce...)
+
+	gcm, err := recoveryKitCipher(params, passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(header, nonce, payload, header), nil
+}
+
+// OpenRecoveryKit decrypts a kit with passphrase and returns its kind and payload
+func OpenRecoveryKit(kit []byte, passphrase string) (RecoveryKitKind, []byte, error) {
+	fixed := len(recoveryKitMagic) + 3
+	if len(kit) < fixed || string(kit[:len(recoveryKitMagic)]) != recoveryKitMagic {
+		return 0, nil, errors.New("not a SafeSplit recovery kit")
+	}
+	if version := kit[len(recoveryKitMagic)]; version != RecoveryKitVersion {
+		return 0, nil, fmt.Errorf("unsupported recovery kit version %d", version)
+	}
+	kind := RecoveryKitKind(kit[len(recoveryKitMagic)+1])
+	if kind != RecoveryKitMasterKey && kind != RecoveryKitFragments {
+		return 0, nil, fmt.Errorf("unknown recovery kit kind %d", kind)
+	}
+
+	paramsEnd := fixed + int(kit[fixed-1])
+	headerEnd := paramsEnd + recoveryKitSaltSize + recoveryKitNonceSize
+	if len(kit) < headerEnd {
+		return 0, nil, errors.New("recovery kit is truncated")
+	}
+	params, err := ParseKDFParams(string(kit[fixed:paramsEnd]), 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	if params.Memory > maxRecoveryKitMemory || params.Algorithm == KDFArgon2id && params.Time > maxRecoveryKitTime ||
+		params.Algorithm == KDFPBKDF2SHA256 && params.Time > maxRecoveryKitIterations {
+		return 0, nil, fmt.Errorf("recovery kit KDF parameters %q exceed the supported cost", params.String())
+	}
+
+	header := kit[:headerEnd]
+	salt := kit[paramsEnd : paramsEnd+recoveryKitSaltSize]
+	nonce := kit[paramsEnd+recoveryKitSaltSize : headerEnd]
+	gcm, err := recoveryKitCipher(params, passphrase, salt)
+	if err != nil {
+		return 0, nil, err
+	}
+	payload, err := gcm.Open(nil, nonce, kit[headerEnd:], header)
+	if err != nil {
+		return 0, nil, ErrRecoveryKitPassphrase
+	}
+	return kind, payload, nil
+}
+
+func recoveryKitCipher(params KDFParams, passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := params.DeriveKey([]byte(passphrase), salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive recovery kit key: %w", err)
+	}
+	defer wipe(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncodeRecoveryKit prints a kit in the given text encoding
+func EncodeRecoveryKit(kit []byte, format string) (string, error) {
+	switch format {
+	case RecoveryKitFormatWords:
+		return encodeRecoveryWords(kit), nil
+	case RecoveryKitFormatArmor:
+		return string(pem.EncodeToMemory(&pem.Block{Type: recoveryKitPEMType, Bytes: kit})), nil
+	}
+	return "", fmt.Errorf("unknown recovery kit format %q", format)
+}
+
+// DecodeRecoveryKit reads a kit printed in either text encoding
+func DecodeRecoveryKit(text string) ([]byte, error) {
+	if strings.Contains(text, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(strings.TrimSpace(text)))
+		if block == nil || block.Type != recoveryKitPEMType {
+			return nil, errors.New("malformed recovery kit armor")
+		}
+		return block.Bytes, nil
+	}
+	return decodeRecoveryWords(text)
+}
+
+var (
+	recoveryWordIndexOnce sync.Once
+	recoveryWordIndex     map[string]int
+)
+
+func encodeRecoveryWords(kit []byte) string {
+	sum := sha256.Sum256(kit)
+	data := append(append([]byte(nil), kit...), sum[:recoveryKitChecksum]...)
+
+	var out strings.Builder
+	count := (len(data)*8 + 10) / 11
+	for i := 0; i < count; i++ {
+		value := 0
+		for bit := i * 11; bit < i*11+11; bit++ {
+			value <<= 1
+			if bit < len(data)*8 && data[bit/8]&(0x80>>(bit%8)) != 0 {
+				value |= 1
+			}
+		}
+		switch {
+		case i%recoveryKitLineWords == 0:
+			if i > 0 {
+				out.WriteByte('\n')
+			}
+			fmt.Fprintf(&out, "%3d. ", i+1)
+		default:
+			out.WriteByte(' ')
+		}
+		out.WriteString(wordlists.English[value])
+	}
+	out.WriteByte('\n')
+	return out.String()
+}
+
+func decodeRecoveryWords(text string) ([]byte, error) {
+	recoveryWordIndexOnce.Do(func() {
+		recoveryWordIndex = make(map[string]int, len(wordlists.English))
+		for i, word := range wordlists.English {
+			recoveryWordIndex[word] = i
+		}
+	})
+
+	var values []int
+	for _, token := range strings.Fields(strings.ToLower(text)) {
+		// Skip line numbers
+		if strings.ContainsAny(token, "0123456789.:") {
+			continue
+		}
+		value, ok := recoveryWordIndex[token]
+		if !ok {
+			return nil, fmt.Errorf("unknown word %q at position %d of the recovery kit", token, len(values)+1)
+		}
+		values = append(values, value)
+	}
+
+	data := make([]byte, len(values)*11/8)
+	for i, value := range values {
+		for b := 0; b < 11; b++ {
+			bit := i*11 + b
+			if bit/8 < len(data) && value&(0x400>>b) != 0 {
+				data[bit/8] |= 0x80 >> (bit % 8)
+			}
+		}
+	}
+
+	// The padding may or may not fill another byte
+	for length := len(data); length > recoveryKitChecksum && length >= len(data)-1; length-- {
+		if (length*8+10)/11 != len(values) {
+			continue
+		}
+		kit, checksum := data[:length-recoveryKitChecksum], data[length-recoveryKitChecksum:length]
+		sum := sha256.Sum256(kit)
+		if bytes.Equal(sum[:recoveryKitChecksum], checksum) {
+			return append([]byte(nil), kit...), nil
+		}
+	}
+	return nil, errors.New("recovery kit words are incomplete or mistyped")
+}
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRecoveryKitSealOpen(t *testing.T) {
+	masterKey := make([]byte, MasterKeySize)
+	if _, err := rand.Read(masterKey); err != nil {
+		t.Fatal(err)
+	}
+
+	kit, err := SealRecoveryKit(RecoveryKitMasterKey, masterKey, "correct horse battery")
+	if err != nil {
+		t.Fatalf("SealRecoveryKit: %v", err)
+	}
+
+	for _, format := range []string{RecoveryKitFormatWords, RecoveryKitFormatArmor} {
+		text, err := EncodeRecoveryKit(kit, format)
+		if err != nil {
+			t.Fatalf("EncodeRecoveryKit(%s): %v", format, err)
+		}
+		decoded, err := DecodeRecoveryKit(text)
+		if err != nil {
+			t.Fatalf("DecodeRecoveryKit(%s): %v", format, err)
+		}
+		if !bytes.Equal(decoded, kit) {
+			t.Fatalf("%s encoding did not round-trip", format)
+		}
+	}
+
+	kind, payload, err := OpenRecoveryKit(kit, "correct horse battery")
+	if err != nil {
+		t.Fatalf("OpenRecoveryKit: %v", err)
+	}
+	if kind != RecoveryKitMasterKey || !bytes.Equal(payload, masterKey) {
+		t.Fatalf("opened kind %d payload %x, want kind %d payload %x", kind, payload, RecoveryKitMasterKey, masterKey)
+	}
+
+	if _, _, err := OpenRecoveryKit(kit, "wrong horse battery"); !errors.Is(err, ErrRecoveryKitPassphrase) {
+		t.Fatalf("wrong passphrase: got %v, want ErrRecoveryKitPassphrase", err)
+	}
+
+	tampered := append([]byte(nil), kit...)
+	tampered[len(recoveryKitMagic)+1] = byte(RecoveryKitFragments)
+	if _, _, err := OpenRecoveryKit(tampered, "correct horse battery"); !errors.Is(err, ErrRecoveryKitPassphrase) {
+		t.Fatalf("tampered header: got %v, want ErrRecoveryKitPassphrase", err)
+	}
+
+	if _, err := SealRecoveryKit(RecoveryKitMasterKey, masterKey, "short"); err == nil {
+		t.Fatal("SealRecoveryKit accepted a short passphrase")
+	}
+}
+
+func TestRecoveryKitWordsRoundTrip(t *testing.T) {
+	var paddedByte bool
+	for size := 1; size <= 96; size++ {
+		kit := make([]byte, size)
+		if _, err := rand.Read(kit); err != nil {
+			t.Fatal(err)
+		}
+
+		// Decoding yields an extra byte when the zero padding of the last
+		// word is 8 bits or more
+		words := ((size+recoveryKitChecksum)*8 + 10) / 11
+		if words*11/8 > size+recoveryKitChecksum {
+			paddedByte = true
+		}
+
+		text := encodeRecoveryWords(kit)
+		decoded, err := decodeRecoveryWords(text)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(decoded, kit) {
+			t.Fatalf("size %d: decoded %x, want %x", size, decoded, kit)
+		}
+	}
+	if !paddedByte {
+		t.Fatal("no kit size exercised the padding byte")
+	}
+}
+
+func TestRecoveryKitWordsRejectsMistakes(t *testing.T) {
+	kit := []byte("a recovery kit envelope")
+	text := encodeRecoveryWords(kit)
+	fields := strings.Fields(text)
+
+	// Line numbers and layout don't matter
+	var words []string
+	for _, field := range fields {
+		if !strings.HasSuffix(field, ".") {
+			words = append(words, strings.ToUpper(field))
+		}
+	}
+	if decoded, err := decodeRecoveryWords(strings.Join(words, " ")); err != nil || !bytes.Equal(decoded, kit) {
+		t.Fatalf("unnumbered words: decoded %x, %v", decoded, err)
+	}
+
+	// A token that is not a word is reported, not skipped
+	mistyped := strings.Replace(text, fields[1], fields[1]+"x", 1)
+	if _, err := decodeRecoveryWords(mistyped); err == nil || !strings.Contains(err.Error(), "unknown word") {
+		t.Fatalf("mistyped word: got %v", err)
+	}
+
+	// Swapping two words fails the checksum
+	swapped := strings.Replace(text, fields[1]+" "+fields[2], fields[2]+" "+fields[1], 1)
+	if fields[1] != fields[2] {
+		if _, err := decodeRecoveryWords(swapped); err == nil {
+			t.Fatal("swapped words decoded")
+		}
+	}
+
+	// A missing word is incomplete
+	if _, err := decodeRecoveryWords(strings.Join(words[1:], " ")); err == nil {
+		t.Fatal("kit with a missing word decoded")
+	}
+}
@@ -10,21 +10,27 @@ import (
 
 type ReedSolomonService struct {
     storage *DistributedStorageService
+    signer  *ManifestSigner
 }
 
 type FileShards struct {
     Shards       [][]byte
     OriginalSize uint64
+    Corrupted    []CorruptShard // shards dropped because their checksum didn't match
 }
 
 // Updated constructor to accept an existing storage service
-func NewReedSolomonService(storage *DistributedStorageService) (*ReedSolomonService, error) {
+func NewReedSolomonService(storage *DistributedStorageService, signer *ManifestSigner) (*ReedSolomonService, error) {
     if storage == nil {
         return nil, fmt.Errorf("storage service cannot be nil")
     }
+    if signer == nil {
+        return nil, fmt.Errorf("manifest signer cannot be nil")
+    }
 
     return &ReedSolomonService{
         storage: storage,
+        signer:  signer,
     }, nil
 }
 
@@ -46,14 +52,8 @@ func (s *ReedSolomonService) SplitFile(data []byte, dataShards, parityShards int
         return nil, fmt.Errorf("failed to create encoder: %w", err)
     }
 
-    // Calculate chunk size (64KB) and shard size
-    chunkSize := 64 * 1024
-    shardSize := (len(dataWithSize) + dataShards - 1) / dataShards
-
-    // Round up to nearest chunk size
-    if shardSize%chunkSize != 0 {
-        shardSize = ((shardSize + chunkSize - 1) / chunkSize) * chunkSize
-    }
+    // Shard size rounded up to the 64KB chunk size
+    shardSize := int(streamShardSize(int64(len(dataWithSize)), dataShards))
 
     log.Printf("Splitting file - Original size: %d, Data with size header: %d, Shard size: %d, Total shards: %d",
         originalSize, len(dataWithSize), shardSize, dataShards+parityShards)
@@ -127,31 +127,125 @@ func (s *ReedSolomonService) ReconstructFile(shards [][]byte, dataShards, parity
     return data, nil
 }
 
-func (s *ReedSolomonService) StoreShards(fileID uint, fileShards *FileShards) error {
+// StoreShards stores the shards produced by SplitFile on the hot tier and
+// returns the node index of each one along with the manifest describing them
+func (s *ReedSolomonService) StoreShards(fileID uint, fileShards *FileShards, dataShards, parityShards int) ([]int, *ShardManifest, error) {
     log.Printf("Storing %d shards for file %d", len(fileShards.Shards), fileID)
-    return s.storage.StoreShards(fileID, fileShards.Shards)
+    if len(fileShards.Shards) != dataShards+parityShards || len(fileShards.Shards[0]) < 8 {
+        return nil, nil, fmt.Errorf("invalid shard data")
+    }
+
+    shardNodes, err := s.storage.StoreShards(fileID, fileShards.Shards, parityShards, ShardPlacement{Tier: TierHot})
+    if err != nil {
+        return nil, nil, err
+    }
+
+    return shardNodes, &ShardManifest{
+        FileID:         fileID,
+        Layout:         LayoutSingleCodeword,
+        DataShards:     dataShards,
+        ParityShards:   parityShards,
+        ShardSize:      int64(len(fileShards.Shards[0])),
+        OriginalSize:   int64(binary.LittleEndian.Uint64(fileShards.Shards[0][:8])),
+        ShardChecksums: ShardChecksums(fileShards.Shards),
+    }, nil
 }
 
-func (s *ReedSolomonService) RetrieveShards(fileID uint, totalShards int) (*FileShards, error) {
-    log.Printf("Retrieving %d shards for file %d", totalShards, fileID)
-    shards, err := s.storage.RetrieveShards(fileID, totalShards)
+// RetrieveShards reads the shards of a file from the nodes listed in shardNodes,
+// dropping any shard that can't be read or fails its checksum. The shard counts, original size
+// and any checksums missing from the database come from the file's manifest;
+// files stored before manifests existed fall back to dataShards and the size
+// prefix in shard 0.
+func (s *ReedSolomonService) RetrieveShards(fileID uint, shardNodes []int, checksums []string, dataShards int) (*FileShards, error) {
+    log.Printf("Retrieving %d shards for file %d", len(shardNodes), fileID)
+
+    manifest := s.loadManifest(fileID, shardNodes, checksums, dataShards, len(shardNodes)-dataShards, nil)
+
+    shards, corrupted, err := s.storage.RetrieveShards(fileID, shardNodes, mergeChecksums(checksums, manifest), dataShards)
     if err != nil {
         return nil, err
     }
 
-    // Get original size from first shard
-    if len(shards) == 0 || len(shards[0]) < 8 {
+    if len(shards) == 0 {
         return nil, fmt.Errorf("invalid shard data")
     }
 
-    originalSize := binary.LittleEndian.Uint64(shards[0][:8])
+    var originalSize uint64
+    switch {
+    case manifest != nil:
+        originalSize = uint64(manifest.OriginalSize)
+    case len(shards[0]) >= 8:
+        // Get original size from first shard when it survived; otherwise it is
+        // only known after reconstruction
+        originalSize = binary.LittleEndian.Uint64(shards[0][:8])
+    }
 
     return &FileShards{
         Shards:       shards,
         OriginalSize: originalSize,
+        Corrupted:    corrupted,
     }, nil
 }
 
+// RepairShards rebuilds every missing (nil) shard in place, parity included,
+// and verifies that the complete set is consistent
+func (s *ReedSolomonService) RepairShards(shards [][]byte, dataShards, parityShards int) error {
+    // An empty striped file has empty shards, which the encoder rejects
+    if emptyShards(shards) {
+        for i := range shards {
+            if shards[i] == nil {
+                shards[i] = []byte{}
+            }
+        }
+        return nil
+    }
+
+    enc, err := reedsolomon.New(dataShards, parityShards)
+    if err != nil {
+        return fmt.Errorf("failed to create RS encoder: %w", err)
+    }
+
+    if err := enc.Reconstruct(shards); err != nil {
+        return fmt.Errorf("failed to reconstruct shards: %w", err)
+    }
+
+    ok, err := enc.Verify(shards)
+    if err != nil {
+        return fmt.Errorf("failed to verify shards: %w", err)
+    }
+    if !ok {
+        return fmt.Errorf("parity verification failed after reconstruction")
+    }
+    return nil
+}
+
+// VerifyShards checks that a complete set of shards matches its parity
+func (s *ReedSolomonService) VerifyShards(shards [][]byte, dataShards, parityShards int) (bool, error) {
+    if emptyShards(shards) {
+        return true, nil
+    }
+
+    enc, err := reedsolomon.New(dataShards, parityShards)
+    if err != nil {
+        return false, fmt.Errorf("failed to create RS encoder: %w", err)
+    }
+    return enc.Verify(shards)
+}
+
+// emptyShards reports whether every shard present has no data
+func emptyShards(shards [][]byte) bool {
+    present := false
+    for _, shard := range shards {
+        if len(shard) > 0 {
+            return false
+        }
+        if shard != nil {
+            present = true
+        }
+    }
+    return present
+}
+
 func (s *ReedSolomonService) ValidateShards(shards [][]byte, dataShards int) bool {
     validShards := 0
     shardSize := -1
@@ -0,0 +1,416 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// shardChunkSize is the granularity shards are padded to, shared with SplitFile
+// so streamed and in-memory uploads produce the same shard layout
+const shardChunkSize = 64 * 1024
+
+// streamShardSize returns the size of every shard for a payload (size prefix included)
+func streamShardSize(payloadSize int64, dataShards int) int64 {
+	shardSize := (payloadSize + int64(dataShards) - 1) / int64(dataShards)
+	if shardSize%shardChunkSize != 0 {
+		shardSize = ((shardSize + shardChunkSize - 1) / shardChunkSize) * shardChunkSize
+	}
+	return shardSize
+}
+
+// zeroReader yields an endless stream of zero bytes for shard padding
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// countingReader tracks how many bytes were read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// sourceReader remembers the last error of the reader it wraps, to tell
+// failures reading a copy's source from failures writing its destination
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+// shardSpool holds one temporary file per shard. Shards are spooled to disk so
+// that encoding and reconstruction only keep the stream encoder's block
+// buffers in memory, whatever the size of the file.
+type shardSpool struct {
+	files []*os.File
+}
+
+func newShardSpool(count int) (*shardSpool, error) {
+	spool := &shardSpool{}
+	for i := 0; i < count; i++ {
+		f, err := os.CreateTemp("", "safesplit-shard-*")
+		if err != nil {
+			spool.Close()
+			return nil, fmt.Errorf("failed to create shard spool file: %w", err)
+		}
+		spool.files = append(spool.files, f)
+	}
+	return spool, nil
+}
+
+func (sp *shardSpool) rewind() error {
+	for i, f := range sp.files {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// reset empties a single spool file so it can be written again
+func (sp *shardSpool) reset(i int) error {
+	if err := sp.files[i].Truncate(0); err != nil {
+		return fmt.Errorf("failed to reset shard %d: %w", i, err)
+	}
+	_, err := sp.files[i].Seek(0, io.SeekStart)
+	return err
+}
+
+func (sp *shardSpool) Close() {
+	for _, f := range sp.files {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// ErrInsufficientSpoolSpace is returned when the temporary directory has no
+// room for the shards of a file being encoded
+var ErrInsufficientSpoolSpace = errors.New("not enough temporary disk space to encode the file")
+
+// spoolReserved is the spool space claimed by encodings in progress, so that
+// concurrent uploads don't all count on the same free space
+var spoolReserved struct {
+	sync.Mutex
+	bytes int64
+}
+
+// reserveSpool claims size bytes of the temporary directory for a shard spool
+// and returns the function releasing them. Spools count against the free space
+// while they fill as well as through their claim, which errs on the safe side.
+func reserveSpool(size int64) (func(), error) {
+	spoolReserved.Lock()
+	defer spoolReserved.Unlock()
+	if free := diskFreeBytes(os.TempDir()); free >= 0 && free-spoolReserved.bytes < size {
+		return nil, fmt.Errorf("%w: %d bytes needed, %d available", ErrInsufficientSpoolSpace,
+			size, max(free-spoolReserved.bytes, 0))
+	}
+	spoolReserved.bytes += size
+	return func() {
+		spoolReserved.Lock()
+		defer spoolReserved.Unlock()
+		spoolReserved.bytes -= size
+	}, nil
+}
+
+// StoreStream encodes size bytes read from r into dataShards+parityShards
+// shards and stores them on the hot tier. The shards are byte for byte
+// what SplitFile would produce, so files uploaded either way read back the
+// same. It returns the node of every shard and the manifest describing them.
+func (s *ReedSolomonService) StoreStream(fileID uint, r io.Reader, size int64, dataShards, parityShards int) ([]int, *ShardManifest, error) {
+	enc, err := reedsolomon.NewStream(dataShards, parityShards)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create stream encoder: %w", err)
+	}
+
+	totalShards := dataShards + parityShards
+	spool, err := newShardSpool(totalShards)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer spool.Close()
+
+	// Same layout as SplitFile: 8 byte size prefix, the data, zero padding
+	shardSize := streamShardSize(size+8, dataShards)
+	sizePrefix := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sizePrefix, uint64(size))
+
+	input := &countingReader{r: io.LimitReader(r, size)}
+	padding := shardSize*int64(dataShards) - 8 - size
+	payload := io.MultiReader(bytes.NewReader(sizePrefix), input, io.LimitReader(zeroReader{}, padding))
+
+	log.Printf("Streaming file %d - Original size: %d, Shard size: %d, Total shards: %d",
+		fileID, size, shardSize, totalShards)
+
+	hashers := make([]hash.Hash, totalShards)
+	for i := range hashers {
+		hashers[i] = sha256.New()
+	}
+
+	for i := 0; i < dataShards; i++ {
+		if _, err := io.CopyN(io.MultiWriter(spool.files[i], hashers[i]), payload, shardSize); err != nil {
+			return nil, nil, fmt.Errorf("failed to write data shard %d: %w", i, err)
+		}
+	}
+	if input.n != size {
+		return nil, nil, fmt.Errorf("input ended after %d bytes, expected %d", input.n, size)
+	}
+
+	// Encode parity from the spooled data shards
+	if err := spool.rewind(); err != nil {
+		return nil, nil, err
+	}
+	dataReaders := make([]io.Reader, dataShards)
+	for i := range dataReaders {
+		dataReaders[i] = spool.files[i]
+	}
+	parityWriters := make([]io.Writer, parityShards)
+	for i := range parityWriters {
+		parityWriters[i] = io.MultiWriter(spool.files[dataShards+i], hashers[dataShards+i])
+	}
+	if err := enc.Encode(dataReaders, parityWriters); err != nil {
+		return nil, nil, fmt.Errorf("failed to encode parity shards: %w", err)
+	}
+
+	if err := spool.rewind(); err != nil {
+		return nil, nil, err
+	}
+	shardReaders := make([]io.Reader, totalShards)
+	for i := range shardReaders {
+		shardReaders[i] = spool.files[i]
+	}
+	shardNodes, err := s.storage.StoreShardStreams(fileID, shardReaders, shardSize, parityShards, ShardPlacement{Tier: TierHot})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	checksums := make([]string, totalShards)
+	for i, hasher := range hashers {
+		checksums[i] = hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	log.Printf("Streamed %d shards for file %d", totalShards, fileID)
+	return shardNodes, &ShardManifest{
+		FileID:         fileID,
+		Layout:         LayoutSingleCodeword,
+		DataShards:     dataShards,
+		ParityShards:   parityShards,
+		ShardSize:      shardSize,
+		OriginalSize:   size,
+		ShardChecksums: checksums,
+	}, nil
+}
+
+// spoolShard copies a stored shard into the spool. It returns false when the
+// shard is missing, can't be read or doesn't match its checksum, so it counts
+// as an erasure. Read failures count against the node's health; only failures
+// of the spool itself are returned.
+func (s *ReedSolomonService) spoolShard(fileID uint, shardIndex, nodeIndex int, checksum string, spool *shardSpool) (bool, *CorruptShard, error) {
+	if !s.storage.HasNode(nodeIndex) {
+		log.Printf("Shard %d unavailable: invalid node index: %d", shardIndex, nodeIndex)
+		return false, nil, nil
+	}
+
+	shard, err := s.storage.RetrieveShardStream(fileID, shardIndex, nodeIndex)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrObjectNotFound):
+			log.Printf("Shard %d missing from node %d", shardIndex, nodeIndex)
+		case errors.Is(err, ErrNodeDown):
+			log.Printf("Shard %d unavailable: %v", shardIndex, err)
+		default:
+			log.Printf("Shard %d unreadable on node %d: %v", shardIndex, nodeIndex, err)
+			s.storage.recordReadFailure(nodeIndex, err)
+		}
+		return false, nil, nil
+	}
+	defer shard.Close()
+
+	hasher := sha256.New()
+	source := &sourceReader{r: shard}
+	if _, err := io.Copy(io.MultiWriter(spool.files[shardIndex], hasher), source); err != nil {
+		if source.err == nil {
+			return false, nil, fmt.Errorf("failed to spool shard %d: %w", shardIndex, err)
+		}
+		log.Printf("Shard %d unreadable on node %d: %v", shardIndex, nodeIndex, err)
+		s.storage.recordReadFailure(nodeIndex, err)
+		if err := spool.reset(shardIndex); err != nil {
+			return false, nil, err
+		}
+		return false, nil, nil
+	}
+
+	if checksum != "" {
+		if actual := hex.EncodeToString(hasher.Sum(nil)); actual != checksum {
+			log.Printf("Corrupt shard %d of file %d on node %d: expected checksum %s, got %s",
+				shardIndex, fileID, nodeIndex, checksum, actual)
+			if err := spool.reset(shardIndex); err != nil {
+				return false, nil, err
+			}
+			return false, &CorruptShard{
+				ShardIndex: shardIndex,
+				NodeIndex:  nodeIndex,
+				Expected:   checksum,
+				Actual:     actual,
+			}, nil
+		}
+	}
+	return true, nil, nil
+}
+
+// ReconstructStream reads the shards of a file and writes the original bytes
+// to w. Parity shards are only fetched when a data shard is missing or
+// corrupt, and only the missing data shards are recomputed. It returns the
+// number of bytes written and any shards dropped for a checksum mismatch.
+func (s *ReedSolomonService) ReconstructStream(fileID uint, shardNodes []int, checksums []string, dataShards, parityShards int, w io.Writer) (int64, []CorruptShard, error) {
+	if len(shardNodes) != dataShards+parityShards {
+		return 0, nil, fmt.Errorf("expected %d shards, have placement for %d", dataShards+parityShards, len(shardNodes))
+	}
+
+	manifest := s.loadManifest(fileID, shardNodes, checksums, dataShards, parityShards, func(manifest *ShardManifest) error {
+		if manifest.Layout != LayoutSingleCodeword {
+			return fmt.Errorf("describes layout %d, expected %d", manifest.Layout, LayoutSingleCodeword)
+		}
+		return nil
+	})
+
+	spool, corrupted, err := s.spoolDataShards(fileID, shardNodes, mergeChecksums(checksums, manifest), dataShards, parityShards)
+	if err != nil {
+		return 0, corrupted, err
+	}
+	defer spool.Close()
+
+	dataReaders := make([]io.Reader, dataShards)
+	for i := range dataReaders {
+		dataReaders[i] = spool.files[i]
+	}
+	joined := io.MultiReader(dataReaders...)
+
+	// First 8 bytes contain the original size
+	sizePrefix := make([]byte, 8)
+	if _, err := io.ReadFull(joined, sizePrefix); err != nil {
+		return 0, corrupted, fmt.Errorf("reconstructed data too short")
+	}
+	originalSize := int64(binary.LittleEndian.Uint64(sizePrefix))
+	if manifest != nil && originalSize != manifest.OriginalSize {
+		return 0, corrupted, fmt.Errorf("reconstructed size %d does not match manifest size %d", originalSize, manifest.OriginalSize)
+	}
+
+	written, err := io.CopyN(w, joined, originalSize)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return written, corrupted, fmt.Errorf("reconstructed data shorter than original size")
+		}
+		return written, corrupted, fmt.Errorf("failed to write reconstructed data: %w", err)
+	}
+
+	log.Printf("Successfully reconstructed data: %d bytes", written)
+	return written, corrupted, nil
+}
+
+// spoolDataShards fetches the shards of a file into a spool, rebuilding any
+// missing data shards from parity, and leaves it rewound. The caller closes
+// the spool.
+func (s *ReedSolomonService) spoolDataShards(fileID uint, shardNodes []int, checksums []string, dataShards, parityShards int) (*shardSpool, []CorruptShard, error) {
+	totalShards := len(shardNodes)
+	spool, err := newShardSpool(totalShards)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	present := make([]bool, totalShards)
+	var corrupted []CorruptShard
+	available, missingData := 0, 0
+
+	for shardIndex, nodeIndex := range shardNodes {
+		if shardIndex >= dataShards && missingData == 0 {
+			break
+		}
+
+		var checksum string
+		if shardIndex < len(checksums) {
+			checksum = checksums[shardIndex]
+		}
+		ok, corrupt, err := s.spoolShard(fileID, shardIndex, nodeIndex, checksum, spool)
+		if err != nil {
+			spool.Close()
+			return nil, corrupted, err
+		}
+		if corrupt != nil {
+			corrupted = append(corrupted, *corrupt)
+		}
+		if ok {
+			present[shardIndex] = true
+			available++
+		} else if shardIndex < dataShards {
+			missingData++
+		}
+	}
+
+	if available < dataShards {
+		spool.Close()
+		return nil, corrupted, fmt.Errorf("insufficient shards: found %d, need %d (%d corrupt)",
+			available, dataShards, len(corrupted))
+	}
+
+	if err := spool.rewind(); err != nil {
+		spool.Close()
+		return nil, corrupted, err
+	}
+	if missingData == 0 {
+		return spool, corrupted, nil
+	}
+
+	log.Printf("Reconstructing %d missing data shards of file %d", missingData, fileID)
+
+	enc, err := reedsolomon.NewStream(dataShards, parityShards)
+	if err != nil {
+		spool.Close()
+		return nil, corrupted, fmt.Errorf("failed to create stream encoder: %w", err)
+	}
+
+	valid := make([]io.Reader, totalShards)
+	fill := make([]io.Writer, totalShards)
+	for i := range spool.files {
+		if present[i] {
+			valid[i] = spool.files[i]
+		} else if i < dataShards {
+			fill[i] = spool.files[i]
+		}
+	}
+	if err := enc.Reconstruct(valid, fill); err != nil {
+		spool.Close()
+		return nil, corrupted, fmt.Errorf("failed to reconstruct shards: %w", err)
+	}
+
+	if err := spool.rewind(); err != nil {
+		spool.Close()
+		return nil, corrupted, err
+	}
+	return spool, corrupted, nil
+}
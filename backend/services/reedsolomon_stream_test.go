@@ -0,0 +1,127 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+var errFlaky = errors.New("input/output error")
+
+// flakyBackend fails reads with a generic error once told to, either right
+// away or after the first bytes of a stream
+type flakyBackend struct {
+	StorageBackend
+	failGet      bool
+	failMidShard bool
+}
+
+func (b *flakyBackend) Get(key string) ([]byte, error) {
+	if b.failGet || b.failMidShard {
+		return nil, errFlaky
+	}
+	return b.StorageBackend.Get(key)
+}
+
+func (b *flakyBackend) GetStream(key string) (io.ReadCloser, error) {
+	if b.failGet {
+		return nil, errFlaky
+	}
+	r, err := b.StorageBackend.GetStream(key)
+	if err != nil || !b.failMidShard {
+		return r, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(io.LimitReader(r, 100), failingReader{}), r}, nil
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errFlaky
+}
+
+func TestReadErrorsAreErasures(t *testing.T) {
+	storage := NewDistributedStorageService()
+	nodes := make([]*flakyBackend, 6)
+	for i := range nodes {
+		backend, err := NewLocalStorageBackend(fmt.Sprintf("%s/node_%d", t.TempDir(), i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = &flakyBackend{StorageBackend: backend}
+		if err := storage.AddNode(i, nodes[i], true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signer, err := NewManifestSigner("a manifest signing key for the read error test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsService, err := NewReedSolomonService(storage, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 3*StreamSegmentSize+17)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	streamNodes, streamManifest, err := rsService.StoreStream(1, bytes.NewReader(content), int64(len(content)), 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileShards, err := rsService.SplitFile(content, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shardNodes, manifest, err := rsService.StoreShards(2, fileShards, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two nodes holding data shards of both files fail; parity covers them
+	nodes[streamNodes[0]].failGet = true
+	nodes[streamNodes[1]].failMidShard = true
+
+	var out bytes.Buffer
+	if _, _, err := rsService.ReconstructStream(1, streamNodes, streamManifest.ShardChecksums, 4, 2, &out); err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Fatal("stream: content did not round-trip")
+	}
+	for _, nodeIndex := range streamNodes[:2] {
+		if state := storage.NodeHealth(nodeIndex).State; state != NodeDegraded && state != NodeDown {
+			t.Fatalf("node %d is %s after a failed read", nodeIndex, state)
+		}
+	}
+
+	retrieved, err := rsService.RetrieveShards(2, shardNodes, manifest.ShardChecksums, 4)
+	if err != nil {
+		t.Fatalf("in memory: %v", err)
+	}
+	data, err := rsService.ReconstructFile(retrieved.Shards, 4, 2)
+	if err != nil {
+		t.Fatalf("in memory: %v", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatal("in memory: content did not round-trip")
+	}
+
+	// A third failure leaves fewer shards than data shards
+	for _, nodeIndex := range []int{streamNodes[2], shardNodes[2], shardNodes[3]} {
+		nodes[nodeIndex].failGet = true
+	}
+	if _, _, err := rsService.ReconstructStream(1, streamNodes, streamManifest.ShardChecksums, 4, 2, io.Discard); err == nil {
+		t.Fatal("stream: read with three shards of six unreadable")
+	}
+	if _, err := rsService.RetrieveShards(2, shardNodes, manifest.ShardChecksums, 4); err == nil {
+		t.Fatal("in memory: read with three shards of six unreadable")
+	}
+}
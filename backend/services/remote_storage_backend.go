@@ -0,0 +1,301 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const remoteNodeTimeout = 5 * time.Minute
+
+// RemoteBackendConfig points at a safesplit-node daemon
+type RemoteBackendConfig struct {
+	URL    string `json:"url"`
+	Secret string `json:"-"`
+	CAFile string `json:"ca_file,omitempty"`
+}
+
+// RemoteStorageBackend talks to a safesplit-node daemon over the signed HTTP protocol
+type RemoteStorageBackend struct {
+	baseURL      string
+	secret       []byte
+	client       *http.Client
+	streamClient *http.Client // no overall timeout, streamed shards can take a while
+}
+
+func NewRemoteStorageBackend(cfg RemoteBackendConfig) (*RemoteStorageBackend, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("remote node URL is required")
+	}
+	if len(cfg.Secret) < MinNodeSecretLength {
+		return nil, fmt.Errorf("remote node secret must be at least %d characters", MinNodeSecretLength)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CAFile != "" {
+		caPEM, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	transport.ResponseHeaderTimeout = remoteNodeTimeout
+
+	return &RemoteStorageBackend{
+		baseURL: strings.TrimSuffix(cfg.URL, "/"),
+		secret:  []byte(cfg.Secret),
+		client: &http.Client{
+			Timeout:   remoteNodeTimeout,
+			Transport: transport,
+		},
+		streamClient: &http.Client{Transport: transport},
+	}, nil
+}
+
+func (b *RemoteStorageBackend) String() string {
+	return "remote:" + b.baseURL
+}
+
+func (b *RemoteStorageBackend) do(method, endpoint string, query url.Values, body []byte) (*http.Response, error) {
+	return b.send(b.client, method, endpoint, query, body)
+}
+
+func (b *RemoteStorageBackend) send(client *http.Client, method, endpoint string, query url.Values, body []byte) (*http.Response, error) {
+	reqURL := b.baseURL + endpoint
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build node request: %w", err)
+	}
+	SignNodeRequest(req, body, b.secret)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("node request failed: %w", err)
+	}
+	return resp, nil
+}
+
+// doStream sends a request whose body is streamed from a seekable reader. The
+// body is read once to hash it for the signature and then again to send it.
+func (b *RemoteStorageBackend) doStream(method, endpoint string, body io.ReadSeeker, size int64) (*http.Response, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, body); err != nil {
+		return nil, fmt.Errorf("failed to hash request body: %w", err)
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind request body: %w", err)
+	}
+
+	req, err := http.NewRequest(method, b.baseURL+endpoint, io.NopCloser(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build node request: %w", err)
+	}
+	req.ContentLength = size
+	SignNodeRequestHash(req, hex.EncodeToString(hasher.Sum(nil)), b.secret)
+
+	resp, err := b.streamClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("node request failed: %w", err)
+	}
+	return resp, nil
+}
+
+func remoteError(resp *http.Response, action, key string) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrObjectNotFound
+	}
+	var payload struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&payload)
+	return fmt.Errorf("failed to %s %s: node returned %d: %s", action, key, resp.StatusCode, payload.Error)
+}
+
+func (b *RemoteStorageBackend) Put(key string, data []byte) error {
+	if err := validateObjectKey(key); err != nil {
+		return err
+	}
+
+	resp, err := b.do(http.MethodPut, "/v1/objects/"+key, nil, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return remoteError(resp, "put", key)
+	}
+	return nil
+}
+
+func (b *RemoteStorageBackend) Get(key string) ([]byte, error) {
+	if err := validateObjectKey(key); err != nil {
+		return nil, err
+	}
+
+	resp, err := b.do(http.MethodGet, "/v1/objects/"+key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, remoteError(resp, "get", key)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return data, nil
+}
+
+func (b *RemoteStorageBackend) PutStream(key string, r io.Reader, size int64) error {
+	if err := validateObjectKey(key); err != nil {
+		return err
+	}
+
+	body, cleanup, err := seekableBody(r)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	resp, err := b.doStream(http.MethodPut, "/v1/objects/"+key, body, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return remoteError(resp, "put", key)
+	}
+	return nil
+}
+
+func (b *RemoteStorageBackend) GetStream(key string) (io.ReadCloser, error) {
+	if err := validateObjectKey(key); err != nil {
+		return nil, err
+	}
+
+	resp, err := b.send(b.streamClient, http.MethodGet, "/v1/objects/"+key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, remoteError(resp, "get", key)
+	}
+	return resp.Body, nil
+}
+
+func (b *RemoteStorageBackend) Delete(key string) error {
+	if err := validateObjectKey(key); err != nil {
+		return err
+	}
+
+	resp, err := b.do(http.MethodDelete, "/v1/objects/"+key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return remoteError(resp, "delete", key)
+	}
+	return nil
+}
+
+func (b *RemoteStorageBackend) List(prefix string) ([]string, error) {
+	resp, err := b.do(http.MethodGet, "/v1/objects", url.Values{"prefix": {prefix}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, remoteError(resp, "list", prefix)
+	}
+
+	var payload struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, fmt.Errorf("failed to decode listing: %w", err)
+	}
+	return payload.Keys, nil
+}
+
+func (b *RemoteStorageBackend) Stat(key string) (*ObjectInfo, error) {
+	if err := validateObjectKey(key); err != nil {
+		return nil, err
+	}
+
+	resp, err := b.do(http.MethodGet, "/v1/stat/"+key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, remoteError(resp, "stat", key)
+	}
+
+	var info ObjectInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to decode object info: %w", err)
+	}
+	return &info, nil
+}
+
+// Usage asks the node server to measure its backend
+func (b *RemoteStorageBackend) Usage() (*BackendUsage, error) {
+	resp, err := b.do(http.MethodGet, "/v1/usage", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, remoteError(resp, "measure", "usage")
+	}
+
+	var usage BackendUsage
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		return nil, fmt.Errorf("failed to decode usage: %w", err)
+	}
+	return &usage, nil
+}
+
+// Ping checks that the node is reachable and accepts our signature
+func (b *RemoteStorageBackend) Ping() error {
+	resp, err := b.do(http.MethodGet, "/v1/health", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("node health check returned %d", resp.StatusCode)
+	}
+	return nil
+}
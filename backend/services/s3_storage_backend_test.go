@@ -0,0 +1,232 @@
+package services
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 serves the path-style object and ListObjectsV2 calls the S3 backend
+// makes from an in-memory bucket. Listings are paged two keys at a time so
+// the backend has to follow continuation tokens.
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	fail    bool // answer every request with a 500
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{bucket: bucket, objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+type s3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string   `xml:"Name"`
+	Prefix                string   `xml:"Prefix"`
+	KeyCount              int      `xml:"KeyCount"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken,omitempty"`
+	Contents              []s3ListEntry
+}
+
+type s3ListEntry struct {
+	Key  string `xml:"Key"`
+	Size int64  `xml:"Size"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		f.writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	if f.fail {
+		f.writeError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		f.writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(data)) != r.ContentLength {
+			f.writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[key] = data
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			f.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	// The continuation token is the last key of the previous page
+	if after := r.URL.Query().Get("continuation-token"); after != "" {
+		keys = keys[sort.SearchStrings(keys, after)+1:]
+	}
+	result := s3ListResult{Name: f.bucket, Prefix: prefix}
+	if len(keys) > 2 {
+		keys = keys[:2]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[1]
+	}
+	result.KeyCount = len(keys)
+	for _, key := range keys {
+		result.Contents = append(result.Contents, s3ListEntry{Key: key, Size: int64(len(f.objects[key]))})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeS3) writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(s3Error{Code: code, Message: code})
+}
+
+func TestS3StorageBackend(t *testing.T) {
+	fake, server := newFakeS3(t, "safesplit")
+	backend, err := NewS3StorageBackend(S3BackendConfig{
+		Endpoint:        server.URL,
+		Bucket:          "safesplit",
+		Prefix:          "/node-3/",
+		AccessKeyID:     "test",
+		SecretAccessKey: "test-secret",
+		UsePathStyle:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shard := bytes.Repeat([]byte("shard"), 1000)
+	if err := backend.Put("shards/file_1/shard_0", shard); err != nil {
+		t.Fatal(err)
+	}
+	// A reader that can't seek is spooled so the SDK can sign it
+	if err := backend.PutStream("shards/file_1/shard_1", io.MultiReader(bytes.NewReader(shard)), int64(len(shard))); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"shards/file_1/manifest", "fragments/file_1/a", "fragments/file_2/b"} {
+		if err := backend.Put(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := fake.objects["node-3/shards/file_1/shard_0"]; !ok {
+		t.Fatal("object not stored below the prefix")
+	}
+
+	data, err := backend.Get("shards/file_1/shard_0")
+	if err != nil || !bytes.Equal(data, shard) {
+		t.Fatalf("Get returned %d bytes, %v", len(data), err)
+	}
+	stream, err := backend.GetStream("shards/file_1/shard_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = io.ReadAll(stream)
+	stream.Close()
+	if err != nil || !bytes.Equal(data, shard) {
+		t.Fatalf("GetStream returned %d bytes, %v", len(data), err)
+	}
+
+	info, err := backend.Stat("shards/file_1/shard_1")
+	if err != nil || info.Size != int64(len(shard)) || info.Key != "shards/file_1/shard_1" {
+		t.Fatalf("Stat returned %+v, %v", info, err)
+	}
+
+	keys, err := backend.List("shards/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"shards/file_1/manifest", "shards/file_1/shard_0", "shards/file_1/shard_1"}
+	if strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Fatalf("List returned %v, want %v", keys, want)
+	}
+	usage, err := backend.Usage()
+	if err != nil || usage.ObjectCount != 5 || usage.FreeBytes != -1 {
+		t.Fatalf("Usage returned %+v, %v", usage, err)
+	}
+
+	if err := backend.Delete("shards/file_1/shard_0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Delete("shards/file_1/shard_0"); err != nil {
+		t.Fatalf("deleting a missing object: %v", err)
+	}
+	if _, err := backend.Get("shards/file_1/shard_0"); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("Get of a deleted object returned %v", err)
+	}
+	if _, err := backend.GetStream("shards/file_1/shard_0"); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("GetStream of a deleted object returned %v", err)
+	}
+	if _, err := backend.Stat("shards/file_1/shard_0"); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("Stat of a deleted object returned %v", err)
+	}
+	if err := backend.Put("../escape", nil); err == nil {
+		t.Fatal("stored an object outside the node namespace")
+	}
+
+	// Server errors are not mistaken for missing objects
+	fake.mu.Lock()
+	fake.fail = true
+	fake.mu.Unlock()
+	if _, err := backend.Get("shards/file_1/shard_1"); err == nil || errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("Get during an outage returned %v", err)
+	}
+}
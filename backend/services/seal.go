@@ -0,0 +1,310 @@
+package services
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// KEKSize is the size of the key-encryption key wrapping the server master keys
+	KEKSize = 32
+
+	kekCheckSize      = 4
+	wrapNonceSize     = 16
+	unsealShareHeader = 1 + kekCheckSize // threshold, then the KEK check value
+)
+
+// How the server was unsealed
+const (
+	UnsealFromShares      = "shares"
+	UnsealFromFile        = "file"
+	UnsealFromEnvironment = "environment"
+)
+
+var (
+	// ErrSealed is returned for operations that need the server master key while the server is sealed
+	ErrSealed = errors.New("server is sealed")
+	// ErrWrongKEK is returned when a key-encryption key cannot unwrap the stored server keys
+	ErrWrongKEK = errors.New("key-encryption key does not match the stored server keys")
+)
+
+// SealStatus reports whether the server can use its master keys
+type SealStatus struct {
+	Sealed          bool       `json:"sealed"`
+	Source          string     `json:"source,omitempty"` // how the server was unsealed
+	UnsealedAt      *time.Time `json:"unsealed_at,omitempty"`
+	Threshold       int        `json:"threshold"` // unseal shares needed, once the first was submitted
+	SharesSubmitted int        `json:"shares_submitted"`
+}
+
+// SealService holds the key-encryption key (KEK) in memory. The KEK never
+// reaches the database: it is supplied at startup from a key file or an
+// environment secret, or recombined from Shamir unseal shares entered by
+// several operators. Until then the server is sealed and cannot unwrap its
+// master keys.
+type SealService struct {
+	shamirService *ShamirService
+
+	mu         sync.RWMutex
+	kek        []byte
+	source     string
+	unsealedAt time.Time
+	threshold  int
+	check      []byte
+	shares     map[byte][]byte // x-coordinate to raw share
+}
+
+// NewSealService creates a sealed SealService
+func NewSealService(shamirService *ShamirService) *SealService {
+	return &SealService{
+		shamirService: shamirService,
+		shares:        make(map[byte][]byte),
+	}
+}
+
+// IsSealed reports whether the KEK is missing
+func (s *SealService) IsSealed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.kek == nil
+}
+
+// Status returns the seal state and unseal progress
+func (s *SealService) Status() SealStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status := SealStatus{
+		Sealed:          s.kek == nil,
+		Threshold:       s.threshold,
+		SharesSubmitted: len(s.shares),
+	}
+	if s.kek != nil {
+		unsealedAt := s.unsealedAt
+		status.Source, status.UnsealedAt = s.source, &unsealedAt
+	}
+	return status
+}
+
+// Unseal installs a KEK the caller has verified against the stored keys
+func (s *SealService) Unseal(kek []byte, source string) error {
+	if len(kek) != KEKSize {
+		return fmt.Errorf("key-encryption key must be %d bytes, got %d", KEKSize, len(kek))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kek = append([]byte(nil), kek...)
+	s.source = source
+	s.unsealedAt = time.Now()
+	s.resetShares()
+	return nil
+}
+
+// Seal forgets the KEK; crypto operations fail until the server is unsealed again
+func (s *SealService) Seal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.kek {
+		s.kek[i] = 0
+	}
+	s.kek = nil
+	s.source = ""
+	s.resetShares()
+}
+
+// AddUnsealShare records an unseal share. Once the threshold is reached it
+// returns the recombined KEK, which the caller verifies before unsealing; the
+// submitted shares are discarded either way.
+func (s *SealService) AddUnsealShare(encoded string) ([]byte, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(raw) != unsealShareHeader+1+KEKSize {
+		return nil, fmt.Errorf("malformed unseal share")
+	}
+	threshold, check, share := int(raw[0]), raw[1:unsealShareHeader], raw[unsealShareHeader:]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.kek != nil {
+		return nil, fmt.Errorf("server is already unsealed")
+	}
+	if len(s.shares) > 0 && (threshold != s.threshold || !bytes.Equal(check, s.check)) {
+		return nil, fmt.Errorf("unseal share belongs to a different key than the shares submitted so far")
+	}
+	if _, exists := s.shares[share[0]]; exists {
+		return nil, fmt.Errorf("unseal share was already submitted")
+	}
+	s.threshold, s.check = threshold, check
+	s.shares[share[0]] = share
+
+	if len(s.shares) < s.threshold {
+		return nil, nil
+	}
+
+	shares := make([][]byte, 0, len(s.shares))
+	for _, share := range s.shares {
+		shares = append(shares, share)
+	}
+	s.resetShares()
+
+	kek, err := s.shamirService.CombineSecret(shares)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(kekCheck(kek), check) {
+		return nil, fmt.Errorf("unseal shares did not reconstruct the key; submit them again")
+	}
+	return kek, nil
+}
+
+// ResetUnsealShares discards the unseal shares submitted so far
+func (s *SealService) ResetUnsealShares() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resetShares()
+}
+
+func (s *SealService) resetShares() {
+	s.threshold, s.check = 0, nil
+	s.shares = make(map[byte][]byte)
+}
+
+// Wrap encrypts a key under the KEK, binding it to additionalData
+func (s *SealService) Wrap(key, additionalData []byte) (wrapped, nonce []byte, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.kek == nil {
+		return nil, nil, ErrSealed
+	}
+	return WrapKey(s.kek, key, additionalData)
+}
+
+// Unwrap decrypts a key wrapped by Wrap
+func (s *SealService) Unwrap(wrapped, nonce, additionalData []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.kek == nil {
+		return nil, ErrSealed
+	}
+	return UnwrapKey(s.kek, wrapped, nonce, additionalData)
+}
+
+// SplitKEK splits a KEK into n unseal shares of which k recombine it. Each
+// share carries the threshold and a short check value of the KEK so mixed-up
+// or mistyped shares are rejected instead of unsealing with a wrong key.
+func (s *SealService) SplitKEK(kek []byte, n, k int) ([]string, error) {
+	if len(kek) != KEKSize {
+		return nil, fmt.Errorf("key-encryption key must be %d bytes, got %d", KEKSize, len(kek))
+	}
+	raw, err := s.shamirService.SplitSecret(kek, n, k)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte{byte(k)}, kekCheck(kek)...)
+	shares := make([]string, len(raw))
+	for i, share := range raw {
+		shares[i] = hex.EncodeToString(append(append([]byte(nil), header...), share...))
+	}
+	return shares, nil
+}
+
+// WrapKey encrypts a key with AES-256-GCM under kek
+func WrapKey(kek, key, additionalData []byte) (wrapped, nonce []byte, err error) {
+	gcm, err := newWrapCipher(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce = make([]byte, wrapNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return gcm.Seal(nil, nonce, key, additionalData), nonce, nil
+}
+
+// UnwrapKey decrypts a key wrapped by WrapKey, returning ErrWrongKEK if kek doesn't match
+func UnwrapKey(kek, wrapped, nonce, additionalData []byte) ([]byte, error) {
+	gcm, err := newWrapCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != wrapNonceSize {
+		return nil, fmt.Errorf("invalid nonce length: got %d, expected %d bytes", len(nonce), wrapNonceSize)
+	}
+	key, err := gcm.Open(nil, nonce, wrapped, additionalData)
+	if err != nil {
+		return nil, ErrWrongKEK
+	}
+	return key, nil
+}
+
+func newWrapCipher(kek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, wrapNonceSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return gcm, nil
+}
+
+func kekCheck(kek []byte) []byte {
+	sum := sha256.Sum256(append([]byte("safesplit-kek-check:"), kek...))
+	return sum[:kekCheckSize]
+}
+
+// GenerateKEK returns a new random key-encryption key
+func GenerateKEK() ([]byte, error) {
+	kek := make([]byte, KEKSize)
+	if _, err := rand.Read(kek); err != nil {
+		return nil, fmt.Errorf("failed to generate key-encryption key: %w", err)
+	}
+	return kek, nil
+}
+
+// ParseKEK decodes a hex-encoded key-encryption key
+func ParseKEK(encoded string) ([]byte, error) {
+	kek, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(kek) != KEKSize {
+		return nil, fmt.Errorf("key-encryption key must be %d hex-encoded bytes", KEKSize)
+	}
+	return kek, nil
+}
+
+// LoadKEK reads the KEK from the file named by SERVER_KEK_FILE or from the
+// SERVER_KEK environment variable. It returns a nil key if neither is set, in
+// which case the server starts sealed.
+func LoadKEK() ([]byte, string, error) {
+	if path := os.Getenv("SERVER_KEK_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read key file: %w", err)
+		}
+		kek, err := ParseKEK(string(data))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid key file %s: %w", path, err)
+		}
+		return kek, UnsealFromFile, nil
+	}
+	if encoded := os.Getenv("SERVER_KEK"); encoded != "" {
+		kek, err := ParseKEK(encoded)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid SERVER_KEK: %w", err)
+		}
+		return kek, UnsealFromEnvironment, nil
+	}
+	return nil, "", nil
+}
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultSessionKeyIdleTimeout locks a session that hasn't used its master key for this long
+const DefaultSessionKeyIdleTimeout = 30 * time.Minute
+
+// ErrSessionLocked is returned when a session holds no unwrapped master key,
+// e.g. after a restart or when it sat idle; logging in again unlocks it
+var ErrSessionLocked = errors.New("session is locked, log in again to access your files")
+
+// SessionKeyCache holds the master keys of logged-in users, unwrapped with
+// the password they logged in with, in memory only. Keys are bound to the
+// session ID of the login's token and wiped on logout, after the idle timeout
+// or when the token expires, so the server can only decrypt a user's
+// fragments while they are logged in.
+type SessionKeyCache struct {
+	idleTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*sessionKey
+}
+
+type sessionKey struct {
+	userID    uint
+	masterKey []byte
+	lastUsed  time.Time
+	expiresAt time.Time
+}
+
+func NewSessionKeyCache(idleTimeout time.Duration) *SessionKeyCache {
+	return &SessionKeyCache{
+		idleTimeout: idleTimeout,
+		sessions:    make(map[string]*sessionKey),
+	}
+}
+
+// NewSessionKeyCacheFromEnv reads the idle timeout from SESSION_KEY_IDLE_TIMEOUT,
+// e.g. "15m", defaulting to DefaultSessionKeyIdleTimeout
+func NewSessionKeyCacheFromEnv() (*SessionKeyCache, error) {
+	idleTimeout := DefaultSessionKeyIdleTimeout
+	if value := os.Getenv("SESSION_KEY_IDLE_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid SESSION_KEY_IDLE_TIMEOUT %q", value)
+		}
+		idleTimeout = parsed
+	}
+	return NewSessionKeyCache(idleTimeout), nil
+}
+
+// NewSessionID generates the random ID a login's token and master key are bound to
+func NewSessionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate session ID: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Unlock stores a copy of the user's master key for the session until expiresAt
+func (c *SessionKeyCache) Unlock(sessionID string, userID uint, masterKey []byte, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, ok := c.sessions[sessionID]; ok {
+		wipe(existing.masterKey)
+	}
+	c.sessions[sessionID] = &sessionKey{
+		userID:    userID,
+		masterKey: append([]byte(nil), masterKey...),
+		lastUsed:  time.Now(),
+		expiresAt: expiresAt,
+	}
+}
+
+// MasterKey returns a copy of the master key unlocked for the session, which
+// must belong to userID, and extends its idle timeout
+func (c *SessionKeyCache) MasterKey(sessionID string, userID uint) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	session, ok := c.sessions[sessionID]
+	if !ok || session.userID != userID {
+		return nil, ErrSessionLocked
+	}
+	now := time.Now()
+	if c.expired(session, now) {
+		wipe(session.masterKey)
+		delete(c.sessions, sessionID)
+		return nil, ErrSessionLocked
+	}
+	session.lastUsed = now
+	return append([]byte(nil), session.masterKey...), nil
+}
+
+// Rekey swaps the master key of an unlocked session of userID for another,
+// e.g. one restored from a recovery kit
+func (c *SessionKeyCache) Rekey(sessionID string, userID uint, masterKey []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	session, ok := c.sessions[sessionID]
+	if !ok || session.userID != userID {
+		return ErrSessionLocked
+	}
+	wipe(session.masterKey)
+	session.masterKey = append([]byte(nil), masterKey...)
+	session.lastUsed = time.Now()
+	return nil
+}
+
+// Lock wipes the master key of a session, e.g. on logout
+func (c *SessionKeyCache) Lock(sessionID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if session, ok := c.sessions[sessionID]; ok {
+		wipe(session.masterKey)
+		delete(c.sessions, sessionID)
+	}
+}
+
+// LockUser wipes the master keys of every session of a user but keep
+func (c *SessionKeyCache) LockUser(userID uint, keep string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	locked := 0
+	for sessionID, session := range c.sessions {
+		if session.userID == userID && sessionID != keep {
+			wipe(session.masterKey)
+			delete(c.sessions, sessionID)
+			locked++
+		}
+	}
+	return locked
+}
+
+// Sweep wipes the master keys of expired and idle sessions
+func (c *SessionKeyCache) Sweep() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	swept := 0
+	for sessionID, session := range c.sessions {
+		if c.expired(session, now) {
+			wipe(session.masterKey)
+			delete(c.sessions, sessionID)
+			swept++
+		}
+	}
+	return swept
+}
+
+// StartSweeper sweeps the cache every interval in the background
+func (c *SessionKeyCache) StartSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if swept := c.Sweep(); swept > 0 {
+				log.Printf("Locked %d idle or expired sessions", swept)
+			}
+		}
+	}()
+}
+
+func (c *SessionKeyCache) expired(session *sessionKey, now time.Time) bool {
+	return now.After(session.expiresAt) || now.Sub(session.lastUsed) > c.idleTimeout
+}
+
+// wipe overwrites key material that is no longer needed
+func wipe(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
+}
@@ -159,7 +159,6 @@ func (s *ShamirService) RecombineKey(shares []KeyShare, k int) ([]byte, error) {
 
 	log.Printf("Share combination successful")
 	log.Printf("Combined key length: %d bytes", len(combinedKey))
-	log.Printf("Combined key: %x", combinedKey)
 
 	if len(combinedKey) != 32 {
 		log.Printf("Error: Unexpected recombined key size: got %d, want 32", len(combinedKey))
@@ -179,9 +178,7 @@ func (s *ShamirService) testReconstruction(shares []KeyShare, originalKey []byte
 		return false, err
 	}
 
-	log.Printf("Test reconstruction result:")
-	log.Printf("  Original key    : %x", originalKey)
-	log.Printf("  Reconstructed key: %x", reconstructed)
+	log.Printf("Test reconstruction result: original %d bytes, reconstructed %d bytes", len(originalKey), len(reconstructed))
 
 	// Compare reconstructed key with original
 	if len(reconstructed) != len(originalKey) {
@@ -243,3 +240,28 @@ func (s *ShamirService) ValidateShares(shares []KeyShare) error {
 	log.Printf("\nAll shares validated successfully")
 	return nil
 }
+
+// SplitSecret splits an arbitrary secret into n raw shares with threshold k.
+// Each share is the x-coordinate followed by the secret-sized y values.
+// Unlike SplitKey it logs nothing about the secret.
+func (s *ShamirService) SplitSecret(secret []byte, n, k int) ([][]byte, error) {
+	if k < 2 || k > n {
+		return nil, fmt.Errorf("threshold must be between 2 and the number of shares")
+	}
+	shares, err := shamir.Split(secret, n, k)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split secret: %w", err)
+	}
+	return shares, nil
+}
+
+// CombineSecret recombines raw shares produced by SplitSecret. With fewer than
+// the threshold it returns a wrong secret rather than an error, so callers must
+// verify the result.
+func (s *ShamirService) CombineSecret(shares [][]byte) ([]byte, error) {
+	secret, err := shamir.Combine(shares)
+	if err != nil {
+		return nil, fmt.Errorf("failed to combine shares: %w", err)
+	}
+	return secret, nil
+}
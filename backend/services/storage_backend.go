@@ -0,0 +1,371 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrObjectNotFound is returned by a StorageBackend when the requested key does not exist
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectInfo describes a single object held by a storage backend
+type ObjectInfo struct {
+	Key        string    `json:"key"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+// StorageBackend is the per-node object store used by DistributedStorageService.
+// Keys are slash separated, e.g. "shards/file_12/shard_3" or "fragments/file_12/fragment_1".
+type StorageBackend interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	// PutStream stores size bytes read from r without buffering them in memory
+	PutStream(key string, r io.Reader, size int64) error
+	// GetStream opens an object for reading; the caller must close it
+	GetStream(key string) (io.ReadCloser, error)
+	Delete(key string) error
+	List(prefix string) ([]string, error)
+	Stat(key string) (*ObjectInfo, error)
+}
+
+// validateObjectKey rejects keys that could escape the node namespace
+func validateObjectKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("object key cannot be empty")
+	}
+	if strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("invalid object key: %s", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." || strings.HasPrefix(part, tempObjectPrefix) {
+			return fmt.Errorf("invalid object key: %s", key)
+		}
+	}
+	return nil
+}
+
+// validateListPrefix checks a List prefix like validateObjectKey, except that it
+// may be empty or end in '/'
+func validateListPrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if strings.HasPrefix(prefix, "/") || strings.Contains(prefix, "\\") {
+		return fmt.Errorf("invalid list prefix: %s", prefix)
+	}
+	for _, part := range strings.Split(strings.TrimSuffix(prefix, "/"), "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("invalid list prefix: %s", prefix)
+		}
+	}
+	return nil
+}
+
+const (
+	// tempObjectPrefix marks files that are still being written. They are
+	// skipped by List and renamed into place once complete.
+	tempObjectPrefix = ".tmp-"
+	staleTempFileAge = 24 * time.Hour
+)
+
+// LocalStorageBackend stores objects as files below a root directory
+type LocalStorageBackend struct {
+	root string
+}
+
+func NewLocalStorageBackend(root string) (*LocalStorageBackend, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create node directory %s: %w", root, err)
+	}
+
+	// Keep the fragments/shards layout so existing node directories stay valid
+	if err := os.MkdirAll(filepath.Join(root, "fragments"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create fragments directory: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "shards"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create shards directory: %w", err)
+	}
+
+	backend := &LocalStorageBackend{root: root}
+	backend.removeStaleTempFiles()
+	return backend, nil
+}
+
+// removeStaleTempFiles deletes temporary files of writes interrupted by a
+// crash. Recent ones are kept since another process may still be writing them.
+func (b *LocalStorageBackend) removeStaleTempFiles() {
+	cutoff := time.Now().Add(-staleTempFileAge)
+	filepath.WalkDir(b.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasPrefix(d.Name(), tempObjectPrefix) {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.ModTime().Before(cutoff) {
+			if err := os.Remove(p); err != nil {
+				log.Printf("Warning: failed to remove stale temporary file %s: %v", p, err)
+			}
+		}
+		return nil
+	})
+}
+
+// syncDir flushes a directory entry so renames and new files in it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (b *LocalStorageBackend) String() string {
+	return "local:" + b.root
+}
+
+func (b *LocalStorageBackend) fullPath(key string) (string, error) {
+	if err := validateObjectKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(b.root, filepath.FromSlash(key)), nil
+}
+
+func (b *LocalStorageBackend) Put(key string, data []byte) error {
+	return b.PutStream(key, bytes.NewReader(data), int64(len(data)))
+}
+
+func (b *LocalStorageBackend) Get(key string) ([]byte, error) {
+	fullPath, err := b.fullPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return data, nil
+}
+
+// PutStream writes the object to a temporary file next to its final path,
+// syncs it and renames it into place, so a crash never leaves a truncated
+// object under the key
+func (b *LocalStorageBackend) PutStream(key string, r io.Reader, size int64) error {
+	fullPath, err := b.fullPath(key)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(fullPath)
+	_, statErr := os.Stat(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", key, err)
+	}
+
+	f, err := os.CreateTemp(dir, tempObjectPrefix+filepath.Base(fullPath)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", key, err)
+	}
+	tempPath := f.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			os.Remove(tempPath)
+		}
+	}()
+
+	written, err := io.Copy(f, r)
+	if err == nil && written != size {
+		err = fmt.Errorf("got %d bytes, expected %d", written, size)
+	}
+	if err == nil {
+		err = f.Chmod(0600)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+
+	if err := os.Rename(tempPath, fullPath); err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	committed = true
+
+	// Persist the rename, and the per-file directory itself if it was just created
+	if err := syncDir(dir); err != nil {
+		return fmt.Errorf("failed to sync directory of %s: %w", key, err)
+	}
+	if os.IsNotExist(statErr) {
+		if err := syncDir(filepath.Dir(dir)); err != nil {
+			return fmt.Errorf("failed to sync directory of %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func (b *LocalStorageBackend) GetStream(key string) (io.ReadCloser, error) {
+	fullPath, err := b.fullPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to open %s: %w", key, err)
+	}
+	return f, nil
+}
+
+func (b *LocalStorageBackend) Delete(key string) error {
+	fullPath, err := b.fullPath(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+
+	// Drop the per-file directory (e.g. shards/file_12) once it is empty;
+	// os.Remove leaves non-empty directories alone
+	if strings.Contains(path.Dir(key), "/") {
+		os.Remove(filepath.Dir(fullPath))
+	}
+	return nil
+}
+
+func (b *LocalStorageBackend) List(prefix string) ([]string, error) {
+	if err := validateListPrefix(prefix); err != nil {
+		return nil, err
+	}
+
+	// Start walking from the deepest directory covered by the prefix
+	walkRoot := b.root
+	if prefix != "" {
+		dir := prefix
+		if !strings.HasSuffix(prefix, "/") {
+			dir = path.Dir(prefix)
+		}
+		if dir != "." {
+			walkRoot = filepath.Join(b.root, filepath.FromSlash(strings.TrimSuffix(dir, "/")))
+		}
+	}
+
+	var keys []string
+	err := filepath.WalkDir(walkRoot, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), tempObjectPrefix) {
+			// Write in progress, or left behind by a crash
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+	return keys, nil
+}
+
+func (b *LocalStorageBackend) Stat(key string) (*ObjectInfo, error) {
+	fullPath, err := b.fullPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to stat %s: %w", key, err)
+	}
+	if info.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+
+	return &ObjectInfo{
+		Key:        key,
+		Size:       info.Size(),
+		ModifiedAt: info.ModTime(),
+	}, nil
+}
+
+// seekableBody returns r as an io.ReadSeeker, spooling it to a temporary file
+// when it can't seek. Backends that must hash or sign a body before sending it
+// need to read it twice. The returned cleanup func must always be called.
+func seekableBody(r io.Reader) (io.ReadSeeker, func(), error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		return rs, func() {}, nil
+	}
+
+	spool, err := os.CreateTemp("", "safesplit-body-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	cleanup := func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+
+	if _, err := io.Copy(spool, r); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to spool body: %w", err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to rewind spool file: %w", err)
+	}
+	return spool, cleanup, nil
+}
+
+// deleteObjectsWithPrefix removes every object below prefix, logging failures
+func deleteObjectsWithPrefix(backend StorageBackend, prefix string) error {
+	keys, err := backend.List(prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := backend.Delete(key); err != nil {
+			log.Printf("Warning: failed to delete %s: %v", key, err)
+		}
+	}
+	return nil
+}
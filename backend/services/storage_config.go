@@ -0,0 +1,105 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	LocalBackendType  = "local"
+	S3BackendType     = "s3"
+	RemoteBackendType = "remote"
+)
+
+// StorageNodeConfig selects and configures the backend of a single storage node
+type StorageNodeConfig struct {
+	Backend string              `json:"backend"`
+	Path    string              `json:"path,omitempty"`
+	S3      S3BackendConfig     `json:"s3"`
+	Remote  RemoteBackendConfig `json:"remote"`
+}
+
+// LoadStorageNodeConfigs reads per-node backend settings from the environment.
+// Nodes default to local directories under basePath/nodes/node_N; set
+// STORAGE_NODE_<N>_BACKEND=s3 together with the STORAGE_NODE_<N>_S3_* variables
+// to point a node at an S3-compatible bucket, or STORAGE_NODE_<N>_BACKEND=remote
+// with STORAGE_NODE_<N>_URL to use a safesplit-node daemon. Remote nodes sign
+// requests with STORAGE_NODE_<N>_SECRET, falling back to STORAGE_NODE_SECRET.
+func LoadStorageNodeConfigs(basePath string, nodeCount int) []StorageNodeConfig {
+	configs := make([]StorageNodeConfig, nodeCount)
+	for i := 0; i < nodeCount; i++ {
+		env := func(name string) string {
+			return os.Getenv(fmt.Sprintf("STORAGE_NODE_%d_%s", i, name))
+		}
+
+		backend := env("BACKEND")
+		if backend == "" {
+			backend = LocalBackendType
+		}
+
+		nodePath := env("PATH")
+		if nodePath == "" {
+			nodePath = filepath.Join(basePath, "nodes", fmt.Sprintf("node_%d", i))
+		}
+
+		usePathStyle, err := strconv.ParseBool(env("S3_PATH_STYLE"))
+		if err != nil {
+			// MinIO and most self-hosted S3 servers need path-style addressing
+			usePathStyle = env("S3_ENDPOINT") != ""
+		}
+
+		configs[i] = StorageNodeConfig{
+			Backend: backend,
+			Path:    nodePath,
+			S3: S3BackendConfig{
+				Endpoint:     env("S3_ENDPOINT"),
+				Region:       env("S3_REGION"),
+				Bucket:       env("S3_BUCKET"),
+				Prefix:       env("S3_PREFIX"),
+				AccessKeyID:  env("S3_ACCESS_KEY"),
+				UsePathStyle: usePathStyle,
+			},
+			Remote: RemoteBackendConfig{
+				URL:    env("URL"),
+				CAFile: env("CA_FILE"),
+			},
+		}
+		ApplyStorageNodeSecrets(&configs[i], i)
+	}
+	return configs
+}
+
+// ApplyStorageNodeSecrets fills in the credentials of a node from the environment.
+// Secrets are never persisted with the node registry, so nodes added at runtime
+// read them from the same STORAGE_NODE_<N>_* variables as the initial nodes.
+func ApplyStorageNodeSecrets(cfg *StorageNodeConfig, nodeIndex int) {
+	env := func(name string) string {
+		return os.Getenv(fmt.Sprintf("STORAGE_NODE_%d_%s", nodeIndex, name))
+	}
+
+	cfg.S3.SecretAccessKey = env("S3_SECRET_KEY")
+
+	cfg.Remote.Secret = env("SECRET")
+	if cfg.Remote.Secret == "" {
+		cfg.Remote.Secret = os.Getenv("STORAGE_NODE_SECRET")
+	}
+}
+
+// NewStorageBackend builds the backend described by cfg
+func NewStorageBackend(cfg StorageNodeConfig) (StorageBackend, error) {
+	switch cfg.Backend {
+	case LocalBackendType, "":
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("local backend requires a path")
+		}
+		return NewLocalStorageBackend(cfg.Path)
+	case S3BackendType:
+		return NewS3StorageBackend(cfg.S3)
+	case RemoteBackendType:
+		return NewRemoteStorageBackend(cfg.Remote)
+	default:
+		return nil, fmt.Errorf("unsupported storage backend: %s", cfg.Backend)
+	}
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultNodeMaxObjectSize caps the size of a single shard or fragment upload
+const DefaultNodeMaxObjectSize = int64(2 << 30) // 2GB
+
+// StorageNodeServer exposes a StorageBackend over the signed node HTTP protocol
+// used by RemoteStorageBackend:
+//
+//	GET    /v1/health
+//	GET    /v1/usage                bytes and objects stored, free space
+//	GET    /v1/objects?prefix=...   list keys
+//	PUT    /v1/objects/<key>        store object
+//	GET    /v1/objects/<key>        read object
+//	GET    /v1/stat/<key>           object metadata
+//	DELETE /v1/objects/<key>        delete object
+type StorageNodeServer struct {
+	backend       StorageBackend
+	secret        []byte
+	maxObjectSize int64
+	nonces        *NodeNonceCache
+}
+
+func NewStorageNodeServer(backend StorageBackend, secret []byte, maxObjectSize int64) *StorageNodeServer {
+	if maxObjectSize <= 0 {
+		maxObjectSize = DefaultNodeMaxObjectSize
+	}
+	return &StorageNodeServer{
+		backend:       backend,
+		secret:        secret,
+		maxObjectSize: maxObjectSize,
+		nonces:        NewNodeNonceCache(),
+	}
+}
+
+// Handler returns the gin engine serving the node protocol
+func (s *StorageNodeServer) Handler() http.Handler {
+	router := gin.New()
+	router.Use(gin.Logger(), gin.Recovery())
+
+	v1 := router.Group("/v1")
+	v1.Use(s.authenticate())
+	{
+		v1.GET("/health", s.health)
+		v1.GET("/usage", s.usage)
+		v1.GET("/objects", s.list)
+		v1.PUT("/objects/*key", s.put)
+		v1.GET("/objects/*key", s.get)
+		v1.GET("/stat/*key", s.stat)
+		v1.DELETE("/objects/*key", s.delete)
+	}
+
+	return router
+}
+
+// authenticate hashes the request body once and verifies the HMAC signature
+// over it. Object uploads are spooled to a temporary file so that a shard is
+// never held in memory and is only stored after the signature checks out.
+func (s *StorageNodeServer) authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body := http.MaxBytesReader(c.Writer, c.Request.Body, s.maxObjectSize)
+		hasher := sha256.New()
+
+		var spool *os.File
+		var size int64
+		if c.Request.Method == http.MethodPut {
+			var err error
+			spool, err = os.CreateTemp("", "safesplit-node-*")
+			if err != nil {
+				log.Printf("Failed to create spool file: %v", err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to buffer request"})
+				return
+			}
+			defer func() {
+				spool.Close()
+				os.Remove(spool.Name())
+			}()
+
+			if size, err = io.Copy(io.MultiWriter(spool, hasher), body); err != nil {
+				c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body too large"})
+				return
+			}
+			if _, err := spool.Seek(0, io.SeekStart); err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to buffer request"})
+				return
+			}
+		} else if _, err := io.Copy(hasher, body); err != nil {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body too large"})
+			return
+		}
+
+		if err := VerifyNodeRequestHash(c.Request, hex.EncodeToString(hasher.Sum(nil)), s.secret, s.nonces); err != nil {
+			log.Printf("Rejected node request %s %s from %s: %v",
+				c.Request.Method, c.Request.URL.Path, c.ClientIP(), err)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+
+		if spool != nil {
+			c.Set("body", spool)
+			c.Set("bodySize", size)
+		}
+		c.Next()
+	}
+}
+
+func objectKeyParam(c *gin.Context) string {
+	return strings.TrimPrefix(c.Param("key"), "/")
+}
+
+func (s *StorageNodeServer) respondError(c *gin.Context, err error) {
+	if errors.Is(err, ErrObjectNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "object not found"})
+		return
+	}
+	log.Printf("Node request %s %s failed: %v", c.Request.Method, c.Request.URL.Path, err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+func (s *StorageNodeServer) health(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (s *StorageNodeServer) usage(c *gin.Context) {
+	usage, err := measureBackendUsage(s.backend)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
+
+func (s *StorageNodeServer) list(c *gin.Context) {
+	prefix := c.Query("prefix")
+	if err := validateListPrefix(prefix); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	keys, err := s.backend.List(prefix)
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+func (s *StorageNodeServer) put(c *gin.Context) {
+	body := c.MustGet("body").(*os.File)
+	if err := s.backend.PutStream(objectKeyParam(c), body, c.GetInt64("bodySize")); err != nil {
+		s.respondError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (s *StorageNodeServer) get(c *gin.Context) {
+	object, err := s.backend.GetStream(objectKeyParam(c))
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	defer object.Close()
+
+	// Unknown length: the response is sent chunked
+	c.DataFromReader(http.StatusOK, -1, "application/octet-stream", object, nil)
+}
+
+func (s *StorageNodeServer) stat(c *gin.Context) {
+	info, err := s.backend.Stat(objectKeyParam(c))
+	if err != nil {
+		s.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+func (s *StorageNodeServer) delete(c *gin.Context) {
+	if err := s.backend.Delete(objectKeyParam(c)); err != nil {
+		s.respondError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
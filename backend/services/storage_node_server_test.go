@@ -0,0 +1,133 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testNodeSecret = "a node secret of at least 32 characters"
+
+// newTestNodes starts count safesplit-node daemons on local backends and
+// attaches them through RemoteStorageBackend
+func newTestNodes(t *testing.T, count int) (*DistributedStorageService, []*httptest.Server) {
+	gin.SetMode(gin.ReleaseMode)
+	storage := NewDistributedStorageService()
+	servers := make([]*httptest.Server, count)
+	for i := range servers {
+		local, err := NewLocalStorageBackend(fmt.Sprintf("%s/node_%d", t.TempDir(), i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[i] = httptest.NewServer(NewStorageNodeServer(local, []byte(testNodeSecret), 0).Handler())
+		t.Cleanup(servers[i].Close)
+
+		remote, err := NewRemoteStorageBackend(RemoteBackendConfig{URL: servers[i].URL, Secret: testNodeSecret})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Ping(); err != nil {
+			t.Fatalf("node %d: %v", i, err)
+		}
+		if err := storage.AddNode(i, remote, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return storage, servers
+}
+
+func TestRemoteNodes(t *testing.T) {
+	storage, servers := newTestNodes(t, 6)
+	signer, err := NewManifestSigner("a manifest signing key for the node test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsService, err := NewReedSolomonService(storage, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Daemons only answer requests signed with their secret
+	stranger, err := NewRemoteStorageBackend(RemoteBackendConfig{URL: servers[0].URL, Secret: "another secret of at least 32 characters"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stranger.Ping(); err == nil {
+		t.Fatal("node accepted a request signed with the wrong secret")
+	}
+
+	content := make([]byte, 5*StreamSegmentSize+3)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	// Streamed shards are sent with PutStream, in-memory ones with Put
+	streamNodes, streamManifest, err := rsService.StoreStream(1, bytes.NewReader(content), int64(len(content)), 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rsService.WriteManifest(streamManifest); err != nil {
+		t.Fatal(err)
+	}
+	fileShards, err := rsService.SplitFile(content, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shardNodes, manifest, err := rsService.StoreShards(2, fileShards, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := storage.ListObjects(streamNodes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]int)
+	for _, object := range objects {
+		kinds[object.Kind]++
+	}
+	if kinds[ShardObjectKind] == 0 || kinds[ManifestObjectKind] != 1 {
+		t.Fatalf("node %d lists %v", streamNodes[0], kinds)
+	}
+
+	// Two daemons go away; parity covers their shards
+	servers[streamNodes[0]].Close()
+	servers[streamNodes[1]].Close()
+
+	var out bytes.Buffer
+	if _, _, err := rsService.ReconstructStream(1, streamNodes, streamManifest.ShardChecksums, 4, 2, &out); err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Fatal("stream: content did not round-trip")
+	}
+	retrieved, err := rsService.RetrieveShards(2, shardNodes, manifest.ShardChecksums, 4)
+	if err != nil {
+		t.Fatalf("in memory: %v", err)
+	}
+	data, err := rsService.ReconstructFile(retrieved.Shards, 4, 2)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("in memory: content did not round-trip: %v", err)
+	}
+	if read, err := rsService.ReadManifest(1, streamNodes); err != nil || read.OriginalSize != int64(len(content)) {
+		t.Fatalf("manifest: %+v, %v", read, err)
+	}
+
+	if err := storage.DeleteShards(1); err != nil {
+		t.Fatal(err)
+	}
+	for _, nodeIndex := range streamNodes[2:] {
+		objects, err := storage.ListObjects(nodeIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, object := range objects {
+			if object.FileID == 1 && object.Kind == ShardObjectKind {
+				t.Fatalf("shard %d of a deleted file left on node %d", object.ShardIndex, nodeIndex)
+			}
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Shard layouts recorded in File.LayoutVersion.
+//
+// LayoutSingleCodeword files are one Reed-Solomon codeword over the whole file
+// with an 8 byte size prefix (SplitFile and StoreStream). LayoutStriped files
+// are cut into fixed-size stripes that are encoded on their own; piece s of
+// every shard belongs to stripe s. Files are read whole either way, since
+// content is compressed before it is encrypted and stored, so offsets in a
+// file don't map onto offsets in its shards.
+const (
+	LayoutSingleCodeword = 1
+	LayoutStriped        = 2
+)
+
+// DefaultStripeSize is the amount of file content encoded per stripe
+const DefaultStripeSize = int64(1 << 20) // 1MB
+
+// StripeLayout describes where the content of a striped file lives in its shards
+type StripeLayout struct {
+	DataShards     int
+	ParityShards   int
+	StripeSize     int64 // content bytes per stripe
+	ContentSize    int64 // total content bytes
+	MaxContentSize int64 // bound of content of UnknownContentSize while it is stored, 0 for none
+}
+
+func (l StripeLayout) TotalShards() int {
+	return l.DataShards + l.ParityShards
+}
+
+// PieceSize is the number of bytes each shard holds per stripe
+func (l StripeLayout) PieceSize() int64 {
+	return (l.StripeSize + int64(l.DataShards) - 1) / int64(l.DataShards)
+}
+
+func (l StripeLayout) StripeCount() int64 {
+	return (l.ContentSize + l.StripeSize - 1) / l.StripeSize
+}
+
+func (l StripeLayout) ShardSize() int64 {
+	return l.StripeCount() * l.PieceSize()
+}
+
+// IndexSize is the length of the stripe index: one SHA-256 per piece
+func (l StripeLayout) IndexSize() int64 {
+	return l.StripeCount() * int64(l.TotalShards()) * sha256.Size
+}
+
+func (l StripeLayout) validate() error {
+	if l.DataShards < 1 || l.ParityShards < 1 {
+		return fmt.Errorf("invalid shard counts: %d data, %d parity", l.DataShards, l.ParityShards)
+	}
+	if l.StripeSize <= 0 {
+		return fmt.Errorf("invalid stripe size: %d", l.StripeSize)
+	}
+	if l.ContentSize < 0 {
+		return fmt.Errorf("invalid content size: %d", l.ContentSize)
+	}
+	if l.MaxContentSize < 0 {
+		return fmt.Errorf("invalid maximum content size: %d", l.MaxContentSize)
+	}
+	return nil
+}
+
+// UnknownContentSize is the StripeLayout.ContentSize of content whose size is
+// only known once it has been read, e.g. because it is encrypted while stored
+const UnknownContentSize = int64(-1)
+
+// StoreStriped encodes layout.ContentSize bytes read from r stripe by stripe and
+// stores the shards on the nodes target allows. Only one stripe is held in memory.
+// Content of UnknownContentSize is read until r ends, failing once it exceeds
+// layout.MaxContentSize; the manifest's OriginalSize is its size then.
+// The shards are spooled to the temporary directory before they are sent to
+// the nodes, which takes TotalShards/DataShards times the content size (or
+// its maximum) of free space there. StoreStriped claims that space up front,
+// next to the claims of other encodings in progress, and fails with
+// ErrInsufficientSpoolSpace if it isn't there.
+// It returns the node of every shard, the manifest describing them and the
+// stripe index, the checksum of every piece.
+func (s *ReedSolomonService) StoreStriped(fileID uint, r io.Reader, layout StripeLayout, target ShardPlacement) ([]int, *ShardManifest, []byte, error) {
+	sized := layout.ContentSize != UnknownContentSize
+	if !sized {
+		layout.ContentSize = 0
+	}
+	if err := layout.validate(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Claim the spool for the content, or for its maximum while the size is unknown
+	spooled := layout
+	if !sized {
+		spooled.ContentSize = layout.MaxContentSize
+	}
+	release, err := reserveSpool(spooled.ShardSize() * int64(spooled.TotalShards()))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer release()
+
+	enc, err := reedsolomon.New(layout.DataShards, layout.ParityShards)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create encoder: %w", err)
+	}
+
+	totalShards := layout.TotalShards()
+	spool, err := newShardSpool(totalShards)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer spool.Close()
+
+	// Data pieces are views into the stripe buffer, so reading a stripe fills them
+	pieceSize := layout.PieceSize()
+	stripe := make([]byte, pieceSize*int64(layout.DataShards))
+	pieces := make([][]byte, totalShards)
+	for i := range pieces {
+		if i < layout.DataShards {
+			pieces[i] = stripe[int64(i)*pieceSize : int64(i+1)*pieceSize]
+		} else {
+			pieces[i] = make([]byte, pieceSize)
+		}
+	}
+
+	hashers := make([]hash.Hash, totalShards)
+	writers := make([]io.Writer, totalShards)
+	for i := range hashers {
+		hashers[i] = sha256.New()
+		writers[i] = io.MultiWriter(spool.files[i], hashers[i])
+	}
+
+	if sized {
+		log.Printf("Striping file %d - Size: %d, Stripes: %d, Piece size: %d, Total shards: %d",
+			fileID, layout.ContentSize, layout.StripeCount(), pieceSize, totalShards)
+		r = io.LimitReader(r, layout.ContentSize)
+	} else {
+		log.Printf("Striping file %d - Size: unknown, Piece size: %d, Total shards: %d",
+			fileID, pieceSize, totalShards)
+	}
+
+	input := &countingReader{r: r}
+	index := make([]byte, 0, layout.IndexSize())
+	for st := int64(0); !sized || st < layout.StripeCount(); st++ {
+		n := layout.StripeSize
+		if sized {
+			n = min(n, layout.ContentSize-st*layout.StripeSize)
+		}
+		clear(stripe)
+		read, err := io.ReadFull(input, stripe[:n])
+		if sized && err != nil {
+			return nil, nil, nil, fmt.Errorf("input ended after %d bytes, expected %d", input.n, layout.ContentSize)
+		}
+		if !sized {
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return nil, nil, nil, fmt.Errorf("failed to read stripe %d: %w", st, err)
+			}
+			if read == 0 {
+				break
+			}
+			layout.ContentSize += int64(read)
+			if layout.MaxContentSize > 0 && layout.ContentSize > layout.MaxContentSize {
+				return nil, nil, nil, fmt.Errorf("content exceeds its maximum of %d bytes", layout.MaxContentSize)
+			}
+		}
+
+		if err := enc.Encode(pieces); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to encode stripe %d: %w", st, err)
+		}
+
+		for i, piece := range pieces {
+			if _, err := writers[i].Write(piece); err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to write shard %d: %w", i, err)
+			}
+			sum := sha256.Sum256(piece)
+			index = append(index, sum[:]...)
+		}
+	}
+
+	if err := spool.rewind(); err != nil {
+		return nil, nil, nil, err
+	}
+	shardReaders := make([]io.Reader, totalShards)
+	for i := range shardReaders {
+		shardReaders[i] = spool.files[i]
+	}
+	shardNodes, err := s.storage.StoreShardStreams(fileID, shardReaders, layout.ShardSize(), layout.ParityShards, target)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	checksums := make([]string, totalShards)
+	for i, hasher := range hashers {
+		checksums[i] = hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	log.Printf("Striped %d shards for file %d", totalShards, fileID)
+	return shardNodes, &ShardManifest{
+		FileID:              fileID,
+		Layout:              LayoutStriped,
+		DataShards:          layout.DataShards,
+		ParityShards:        layout.ParityShards,
+		ShardSize:           layout.ShardSize(),
+		OriginalSize:        layout.ContentSize,
+		StripeSize:          layout.StripeSize,
+		StripeIndexChecksum: StripeIndexChecksum(index),
+		ShardChecksums:      checksums,
+	}, index, nil
+}
+
+// checkStripedManifest returns the newest manifest of a file that matches the
+// stripe layout and index from the database, if any
+func (s *ReedSolomonService) checkStripedManifest(fileID uint, shardNodes []int, checksums []string, layout StripeLayout, index []byte) *ShardManifest {
+	indexChecksum := StripeIndexChecksum(index)
+	return s.loadManifest(fileID, shardNodes, checksums, layout.DataShards, layout.ParityShards, func(manifest *ShardManifest) error {
+		switch {
+		case manifest.Layout != LayoutStriped:
+			return fmt.Errorf("describes layout %d, expected %d", manifest.Layout, LayoutStriped)
+		case manifest.StripeSize != layout.StripeSize || manifest.OriginalSize != layout.ContentSize:
+			return fmt.Errorf("does not match the stripe layout")
+		case manifest.StripeIndexChecksum != indexChecksum:
+			return fmt.Errorf("does not match the stripe index")
+		}
+		return nil
+	})
+}
+
+// ReconstructStriped writes the whole content of a striped file to w. Whole
+// shards are fetched with one request each and corrupt shards are rebuilt
+// from parity.
+func (s *ReedSolomonService) ReconstructStriped(fileID uint, shardNodes []int, checksums []string, layout StripeLayout, index []byte, w io.Writer) (int64, []CorruptShard, error) {
+	manifest := s.checkStripedManifest(fileID, shardNodes, checksums, layout, index)
+	return s.reconstructStriped(fileID, shardNodes, mergeChecksums(checksums, manifest), layout, w)
+}
+
+// reconstructStriped writes the whole content of a striped file to w. It only
+// needs the whole-shard checksums, not the stripe index, since every shard of
+// a striped file is still one codeword across its pieces.
+func (s *ReedSolomonService) reconstructStriped(fileID uint, shardNodes []int, checksums []string, layout StripeLayout, w io.Writer) (int64, []CorruptShard, error) {
+	if err := layout.validate(); err != nil {
+		return 0, nil, err
+	}
+	if len(shardNodes) != layout.TotalShards() {
+		return 0, nil, fmt.Errorf("expected %d shards, have placement for %d", layout.TotalShards(), len(shardNodes))
+	}
+	if layout.ContentSize == 0 {
+		return 0, nil, nil
+	}
+
+	spool, corrupted, err := s.spoolDataShards(fileID, shardNodes, checksums, layout.DataShards, layout.ParityShards)
+	if err != nil {
+		return 0, corrupted, err
+	}
+	defer spool.Close()
+
+	pieceSize := layout.PieceSize()
+	piece := make([]byte, pieceSize)
+	var written int64
+	for st := int64(0); st < layout.StripeCount(); st++ {
+		remaining := min(layout.StripeSize, layout.ContentSize-st*layout.StripeSize)
+		for i := 0; i < layout.DataShards && remaining > 0; i++ {
+			if _, err := spool.files[i].ReadAt(piece, st*pieceSize); err != nil {
+				return written, corrupted, fmt.Errorf("failed to read stripe %d of shard %d: %w", st, i, err)
+			}
+			n := min(pieceSize, remaining)
+			if _, err := w.Write(piece[:n]); err != nil {
+				return written, corrupted, fmt.Errorf("failed to write stripe %d: %w", st, err)
+			}
+			written += n
+			remaining -= n
+		}
+	}
+	return written, corrupted, nil
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func newTestRSService(t *testing.T, nodes int) *ReedSolomonService {
+	storage := NewDistributedStorageService()
+	for i := 0; i < nodes; i++ {
+		backend, err := NewLocalStorageBackend(fmt.Sprintf("%s/node_%d", t.TempDir(), i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.AddNode(i, backend, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signer, err := NewManifestSigner("a manifest signing key for the stripe test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsService, err := NewReedSolomonService(storage, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsService
+}
+
+func TestStoreStripedUnknownSize(t *testing.T) {
+	rsService := newTestRSService(t, 6)
+
+	for fileID, size := range []int64{0, 1000, 3*4096 + 5} {
+		content := make([]byte, size)
+		if _, err := rand.Read(content); err != nil {
+			t.Fatal(err)
+		}
+		layout := StripeLayout{DataShards: 4, ParityShards: 2, StripeSize: 4096, ContentSize: UnknownContentSize}
+		shardNodes, manifest, index, err := rsService.StoreStriped(uint(fileID+1), bytes.NewReader(content), layout,
+			ShardPlacement{Tier: TierHot})
+		if err != nil {
+			t.Fatalf("size %d: StoreStriped: %v", size, err)
+		}
+		if manifest.OriginalSize != size {
+			t.Fatalf("size %d: manifest has %d bytes", size, manifest.OriginalSize)
+		}
+		if _, err := rsService.WriteManifest(manifest); err != nil {
+			t.Fatal(err)
+		}
+
+		layout.ContentSize = manifest.OriginalSize
+		var out bytes.Buffer
+		if _, _, err := rsService.ReconstructStriped(uint(fileID+1), shardNodes, manifest.ShardChecksums, layout, index, &out); err != nil {
+			t.Fatalf("size %d: ReconstructStriped: %v", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), content) {
+			t.Fatalf("size %d: content did not round-trip", size)
+		}
+	}
+}
+
+func TestStoreStripedMaxContentSize(t *testing.T) {
+	rsService := newTestRSService(t, 6)
+
+	layout := StripeLayout{DataShards: 4, ParityShards: 2, StripeSize: 4096,
+		ContentSize: UnknownContentSize, MaxContentSize: 2*4096 + 100}
+	content := make([]byte, layout.MaxContentSize+1)
+	if _, _, _, err := rsService.StoreStriped(1, bytes.NewReader(content), layout, ShardPlacement{Tier: TierHot}); err == nil {
+		t.Fatal("stored content larger than its maximum")
+	}
+	if _, _, _, err := rsService.StoreStriped(2, bytes.NewReader(content[:layout.MaxContentSize]), layout, ShardPlacement{Tier: TierHot}); err != nil {
+		t.Fatalf("content of the maximum size: %v", err)
+	}
+
+	if spoolReserved.bytes != 0 {
+		t.Fatalf("%d bytes of spool still claimed", spoolReserved.bytes)
+	}
+	if diskFreeBytes(os.TempDir()) < 0 {
+		t.Skip("free disk space unknown on this platform")
+	}
+	layout.MaxContentSize = 1 << 50
+	if _, _, _, err := rsService.StoreStriped(3, bytes.NewReader(nil), layout, ShardPlacement{Tier: TierHot}); !errors.Is(err, ErrInsufficientSpoolSpace) {
+		t.Fatalf("got %v for a spool larger than the disk, want ErrInsufficientSpoolSpace", err)
+	}
+}
@@ -0,0 +1,55 @@
+package services
+
+import "sort"
+
+// Storage tiers a node can belong to. New files are placed on the hot tier;
+// archived files are re-encoded onto the cold tier with wider parameters.
+const (
+	TierHot  = "hot"
+	TierCold = "cold"
+)
+
+// Reed-Solomon parameters of files on the cold tier. Wider stripes cost less
+// overhead for the same loss tolerance, at the price of slower reads.
+// Moving between tiers only re-encodes the shards; content is not compressed
+// again. Uploads already compress with zstd's best level, and the migration
+// couldn't anyway: it runs without the user's session, so it can't recombine
+// the file key to decrypt the content.
+const (
+	ColdDataShards   = 10
+	ColdParityShards = 4
+)
+
+// Reed-Solomon parameters for files returning to the hot tier whose hot
+// parameters weren't recorded; the upload defaults
+const (
+	DefaultDataShards   = 4
+	DefaultParityShards = 2
+)
+
+// ValidTier reports whether tier names a storage tier
+func ValidTier(tier string) bool {
+	return tier == TierHot || tier == TierCold
+}
+
+// TierOf returns the tier a node belongs to; unlabeled nodes are hot
+func (s *DistributedStorageService) TierOf(nodeIndex int) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.topology[nodeIndex].tier()
+}
+
+// TierNodes returns the sorted indexes of writable nodes in a tier
+func (s *DistributedStorageService) TierNodes(tier string) []int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var indexes []int
+	for nodeIndex, writable := range s.writable {
+		if writable && s.topology[nodeIndex].tier() == tier {
+			indexes = append(indexes, nodeIndex)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes
+}
@@ -0,0 +1,229 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VaultTransitProvider wraps fragments with a key of HashiCorp Vault's Transit
+// secrets engine; the key never leaves Vault. Each Transit key version is a
+// key ID of its own, "vault-<key>-v<version>". Fragments are wrapped as Vault
+// ciphertext, so they can't be recovered without Vault.
+//
+// Try it against a dev server:
+//
+//	vault server -dev -dev-root-token-id=root
+//	vault secrets enable transit
+//	SERVER_KEY_PROVIDER=vault VAULT_ADDR=http://127.0.0.1:8200 VAULT_TOKEN=root
+type VaultTransitProvider struct {
+	addr      string
+	token     string
+	namespace string
+	mount     string
+	key       string
+	client    *http.Client
+}
+
+// NewVaultTransitProvider connects to the Transit key at addr, creating it as
+// an aes256-gcm96 key if it doesn't exist yet
+func NewVaultTransitProvider(addr, token, namespace, mount, key string) (*VaultTransitProvider, error) {
+	if addr == "" || token == "" {
+		return nil, fmt.Errorf("vault address and token are required")
+	}
+	if key == "" || strings.ContainsAny(key, ":/") {
+		return nil, fmt.Errorf("invalid transit key name %q", key)
+	}
+	p := &VaultTransitProvider{
+		addr:      strings.TrimRight(addr, "/"),
+		token:     token,
+		namespace: namespace,
+		mount:     strings.Trim(mount, "/"),
+		key:       key,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+
+	if _, err := p.latestVersion(); err != nil {
+		var vaultErr *VaultError
+		if !errors.As(err, &vaultErr) || vaultErr.StatusCode != http.StatusNotFound {
+			return nil, err
+		}
+		if err := p.request(http.MethodPost, "keys/"+url.PathEscape(key), map[string]string{"type": "aes256-gcm96"}, nil); err != nil {
+			return nil, fmt.Errorf("failed to create transit key: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// NewVaultTransitProviderFromEnv reads VAULT_ADDR, VAULT_TOKEN, VAULT_NAMESPACE,
+// VAULT_TRANSIT_MOUNT (default "transit") and VAULT_TRANSIT_KEY (default "safesplit")
+func NewVaultTransitProviderFromEnv() (*VaultTransitProvider, error) {
+	mount := os.Getenv("VAULT_TRANSIT_MOUNT")
+	if mount == "" {
+		mount = "transit"
+	}
+	key := os.Getenv("VAULT_TRANSIT_KEY")
+	if key == "" {
+		key = "safesplit"
+	}
+	return NewVaultTransitProvider(os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN"), os.Getenv("VAULT_NAMESPACE"), mount, key)
+}
+
+func (p *VaultTransitProvider) keyID(version int) string {
+	return fmt.Sprintf("vault-%s-v%d", p.key, version)
+}
+
+func (p *VaultTransitProvider) latestVersion() (int, error) {
+	var response struct {
+		Data struct {
+			LatestVersion int `json:"latest_version"`
+		} `json:"data"`
+	}
+	if err := p.request(http.MethodGet, "keys/"+url.PathEscape(p.key), nil, &response); err != nil {
+		return 0, fmt.Errorf("failed to read transit key: %w", err)
+	}
+	return response.Data.LatestVersion, nil
+}
+
+func (p *VaultTransitProvider) KeyID() (string, error) {
+	version, err := p.latestVersion()
+	if err != nil {
+		return "", err
+	}
+	return p.keyID(version), nil
+}
+
+// Wrap encrypts with the latest key version; Vault picks its own nonce
+func (p *VaultTransitProvider) Wrap(plaintext, nonce []byte) ([]byte, string, error) {
+	var response struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	if err := p.request(http.MethodPost, "encrypt/"+url.PathEscape(p.key),
+		map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)}, &response); err != nil {
+		return nil, "", fmt.Errorf("failed to encrypt with transit key: %w", err)
+	}
+
+	version, err := ciphertextVersion(response.Data.Ciphertext)
+	if err != nil {
+		return nil, "", err
+	}
+	return []byte(response.Data.Ciphertext), p.keyID(version), nil
+}
+
+func (p *VaultTransitProvider) Unwrap(keyID string, wrapped, nonce []byte) ([]byte, error) {
+	prefix := fmt.Sprintf("vault-%s-v", p.key)
+	if !strings.HasPrefix(keyID, prefix) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKeyID, keyID)
+	}
+	version, err := ciphertextVersion(string(wrapped))
+	if err != nil {
+		return nil, err
+	}
+	if p.keyID(version) != keyID {
+		return nil, fmt.Errorf("fragment is wrapped under %s, expected %s", p.keyID(version), keyID)
+	}
+
+	var response struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := p.request(http.MethodPost, "decrypt/"+url.PathEscape(p.key),
+		map[string]string{"ciphertext": string(wrapped)}, &response); err != nil {
+		return nil, fmt.Errorf("failed to decrypt with transit key: %w", err)
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(response.Data.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid plaintext from vault: %w", err)
+	}
+	return plaintext, nil
+}
+
+// Rotate adds a key version in Vault; older versions keep decrypting
+func (p *VaultTransitProvider) Rotate() (string, error) {
+	if err := p.request(http.MethodPost, "keys/"+url.PathEscape(p.key)+"/rotate", nil, nil); err != nil {
+		return "", fmt.Errorf("failed to rotate transit key: %w", err)
+	}
+	return p.KeyID()
+}
+
+// ciphertextVersion parses the key version of a "vault:v<version>:..." ciphertext
+func ciphertextVersion(ciphertext string) (int, error) {
+	parts := strings.SplitN(ciphertext, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" || !strings.HasPrefix(parts[1], "v") {
+		return 0, fmt.Errorf("malformed vault ciphertext")
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(parts[1], "v"))
+	if err != nil {
+		return 0, fmt.Errorf("malformed vault ciphertext version: %w", err)
+	}
+	return version, nil
+}
+
+// VaultError is a non-success response from Vault
+type VaultError struct {
+	StatusCode int
+	Errors     []string `json:"errors"`
+}
+
+func (e *VaultError) Error() string {
+	return fmt.Sprintf("vault returned %d: %s", e.StatusCode, strings.Join(e.Errors, "; "))
+}
+
+// request calls the Transit API and decodes the response into out, if given
+func (p *VaultTransitProvider) request(method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/v1/%s/%s", p.addr, p.mount, path), reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+	if p.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		vaultErr := &VaultError{StatusCode: resp.StatusCode}
+		json.Unmarshal(data, vaultErr)
+		return vaultErr
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("invalid response from vault: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package services
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeTransit serves the parts of Vault's Transit API the provider uses for
+// the keys below /v1/transit/. Every key version is an AES-GCM key of its own
+// and ciphertexts look like Vault's, "vault:v<version>:<base64>".
+type fakeTransit struct {
+	token string
+
+	mu   sync.Mutex
+	keys map[string][]cipher.AEAD // versions of a key, version 1 first
+}
+
+func (f *fakeTransit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("X-Vault-Token") != f.token {
+		writeVaultError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	path, ok := strings.CutPrefix(r.URL.Path, "/v1/transit/")
+	if !ok {
+		writeVaultError(w, http.StatusNotFound, "no handler for route")
+		return
+	}
+	action, name, _ := strings.Cut(path, "/")
+	name, rotate := strings.CutSuffix(name, "/rotate")
+	versions := f.keys[name]
+
+	var body map[string]string
+	if r.Method == http.MethodPost && r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeVaultError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	switch {
+	case action == "keys" && r.Method == http.MethodGet:
+		if versions == nil {
+			writeVaultError(w, http.StatusNotFound, "")
+			return
+		}
+		writeVaultData(w, map[string]int{"latest_version": len(versions)})
+	case action == "keys" && r.Method == http.MethodPost && (versions == nil || rotate):
+		f.keys[name] = append(versions, newFakeTransitVersion())
+		w.WriteHeader(http.StatusNoContent)
+	case action == "encrypt" && versions != nil:
+		plaintext, err := base64.StdEncoding.DecodeString(body["plaintext"])
+		if err != nil {
+			writeVaultError(w, http.StatusBadRequest, "plaintext is not base64")
+			return
+		}
+		nonce := make([]byte, 12)
+		rand.Read(nonce)
+		sealed := versions[len(versions)-1].Seal(nonce, nonce, plaintext, nil)
+		writeVaultData(w, map[string]string{
+			"ciphertext": fmt.Sprintf("vault:v%d:%s", len(versions), base64.StdEncoding.EncodeToString(sealed)),
+		})
+	case action == "decrypt" && versions != nil:
+		parts := strings.SplitN(body["ciphertext"], ":", 3)
+		if len(parts) != 3 {
+			writeVaultError(w, http.StatusBadRequest, "invalid ciphertext")
+			return
+		}
+		version, err := strconv.Atoi(strings.TrimPrefix(parts[1], "v"))
+		sealed, decodeErr := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil || decodeErr != nil || version < 1 || version > len(versions) || len(sealed) < 12 {
+			writeVaultError(w, http.StatusBadRequest, "invalid ciphertext")
+			return
+		}
+		plaintext, err := versions[version-1].Open(nil, sealed[:12], sealed[12:], nil)
+		if err != nil {
+			writeVaultError(w, http.StatusBadRequest, "cipher: message authentication failed")
+			return
+		}
+		writeVaultData(w, map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)})
+	default:
+		writeVaultError(w, http.StatusNotFound, "unsupported path")
+	}
+}
+
+func newFakeTransitVersion() cipher.AEAD {
+	key := make([]byte, 32)
+	rand.Read(key)
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+func writeVaultData(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func writeVaultError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	errs := []string{}
+	if message != "" {
+		errs = append(errs, message)
+	}
+	json.NewEncoder(w).Encode(map[string][]string{"errors": errs})
+}
+
+func TestVaultTransitProvider(t *testing.T) {
+	fake := &fakeTransit{token: "root", keys: make(map[string][]cipher.AEAD)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	if _, err := NewVaultTransitProvider(server.URL, "wrong", "", "transit", "safesplit"); err == nil {
+		t.Fatal("connected with the wrong token")
+	}
+
+	// The key is created on first use
+	provider, err := NewVaultTransitProvider(server.URL+"/", "root", "", "/transit/", "safesplit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, err := provider.KeyID()
+	if err != nil || keyID != "vault-safesplit-v1" {
+		t.Fatalf("KeyID returned %q, %v", keyID, err)
+	}
+
+	fragment := make([]byte, 32)
+	rand.Read(fragment)
+	wrapped, wrappedID, err := provider.Wrap(fragment, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrappedID != "vault-safesplit-v1" || !strings.HasPrefix(string(wrapped), "vault:v1:") {
+		t.Fatalf("wrapped as %s under %s", wrapped, wrappedID)
+	}
+
+	rotatedID, err := provider.Rotate()
+	if err != nil || rotatedID != "vault-safesplit-v2" {
+		t.Fatalf("Rotate returned %q, %v", rotatedID, err)
+	}
+	rewrapped, rewrappedID, err := provider.Wrap(fragment, nil)
+	if err != nil || rewrappedID != rotatedID {
+		t.Fatalf("wrapped under %s after rotation, %v", rewrappedID, err)
+	}
+
+	// Both versions keep unwrapping
+	for id, w := range map[string][]byte{wrappedID: wrapped, rewrappedID: rewrapped} {
+		plaintext, err := provider.Unwrap(id, w, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		if !bytes.Equal(plaintext, fragment) {
+			t.Fatalf("%s: unwrapped a different fragment", id)
+		}
+	}
+
+	if _, err := provider.Unwrap(rotatedID, wrapped, nil); err == nil {
+		t.Fatal("unwrapped a v1 ciphertext as v2")
+	}
+	if _, err := provider.Unwrap("local-1", wrapped, nil); !errors.Is(err, ErrUnknownKeyID) {
+		t.Fatalf("foreign key ID returned %v", err)
+	}
+
+	tampered := []byte(string(wrapped[:len(wrapped)-4]) + "AAA=")
+	_, err = provider.Unwrap(wrappedID, tampered, nil)
+	var vaultErr *VaultError
+	if !errors.As(err, &vaultErr) || vaultErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("tampered ciphertext returned %v", err)
+	}
+}
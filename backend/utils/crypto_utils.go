@@ -25,6 +25,6 @@ func GenerateNonce() ([]byte, error) {
 	if _, err := rand.Read(nonce); err != nil {
 		return nil, fmt.Errorf("failed to generate nonce: %w", err)
 	}
-	log.Printf("Generated nonce: %d bytes, Value: %x", len(nonce), nonce)
+	log.Printf("Generated nonce: %d bytes", len(nonce))
 	return nonce, nil
 }
@@ -14,7 +14,12 @@ CREATE TABLE users (
     master_key_nonce BINARY(16) NOT NULL,          -- Nonce for master key encryption
     encrypted_master_key BINARY(64) NOT NULL,      -- Encrypted user master key
     master_key_version INT NOT NULL DEFAULT 1,     -- Current version of master key
+    master_key_wrap_version INT NOT NULL DEFAULT 0, -- 0 KEK from the password hash (legacy), 1 KEK from the password at login
+    kdf_params VARCHAR(64) NULL,                   -- KDF of the KEK, e.g. argon2id$v=19$m=65536,t=3,p=4; NULL for legacy PBKDF2
     key_last_rotated TIMESTAMP NULL,              -- Last key rotation timestamp
+    recovery_public_key BINARY(32) NULL,           -- X25519 key social recovery shares are sealed to
+    encrypted_recovery_key VARBINARY(48) NULL,     -- Its private key, encrypted under the master key
+    recovery_key_nonce BINARY(16) NULL,            -- Nonce for recovery key encryption
     role ENUM('end_user', 'premium_user', 'sys_admin', 'super_admin') NOT NULL DEFAULT 'end_user',
     read_access BOOLEAN NOT NULL DEFAULT TRUE,
     write_access BOOLEAN NOT NULL DEFAULT TRUE,
@@ -38,8 +43,9 @@ CREATE TABLE users (
 CREATE TABLE server_master_keys (
     id INT AUTO_INCREMENT PRIMARY KEY,
     key_id VARCHAR(64) NOT NULL UNIQUE,           -- Unique identifier for the key
-    encrypted_key BINARY(32) NOT NULL,            -- Encrypted server master key
+    encrypted_key VARBINARY(64) NOT NULL,         -- Server master key wrapped by the key-encryption key
     key_nonce BINARY(16) NOT NULL,               -- Nonce for key encryption
+    wrap_version INT NOT NULL DEFAULT 0,         -- 0 raw (wrapped on next unseal), 1 AES-256-GCM under the KEK
     is_active BOOLEAN DEFAULT TRUE,              -- Whether this is the current active key
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     activated_at TIMESTAMP NULL,                 -- When the key became active
@@ -112,7 +118,8 @@ CREATE TABLE files (
     encryption_iv VARBINARY(24),                  -- Initialization vector
     encryption_salt BINARY(32),                   -- Salt for key derivation
     encryption_type VARCHAR(20) DEFAULT 'standard',-- Type of encryption used
-    encryption_version INT DEFAULT 1,             -- Version of encryption
+    encryption_version INT DEFAULT 1,             -- 1: single AEAD, 2: segmented stream
+    layout_version INT NOT NULL DEFAULT 1,        -- Shard layout: 1 single codeword, 2 striped
     master_key_version INT NOT NULL DEFAULT 1,    -- Version of master key used
     server_key_id VARCHAR(64) NULL,               -- ID of server key used
     share_count INTEGER NOT NULL DEFAULT 2,       -- Shamir's scheme shares
@@ -121,12 +128,56 @@ CREATE TABLE files (
     data_shard_count INTEGER NOT NULL DEFAULT 4,  -- Reed-Solomon data shards
     parity_shard_count INTEGER NOT NULL DEFAULT 2,-- Reed-Solomon parity shards
     is_sharded BOOLEAN DEFAULT FALSE,             -- Uses Reed-Solomon
+    durability_profile VARCHAR(64) NULL,          -- Durability profile chosen at upload
+    storage_tier VARCHAR(10) NOT NULL DEFAULT 'hot', -- Tier holding the shards: hot or cold
+    hot_data_shards INTEGER NOT NULL DEFAULT 0,   -- Shard counts on the hot tier while the file is cold
+    hot_parity_shards INTEGER NOT NULL DEFAULT 0,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
     FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE SET NULL
 );
 
+-- Durability profiles users choose from when uploading
+CREATE TABLE durability_profiles (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(64) NOT NULL UNIQUE,             -- Identifier sent by clients
+    display_name VARCHAR(255) NOT NULL,
+    description TEXT,
+    data_shards INT NOT NULL,                     -- Reed-Solomon data shards
+    parity_shards INT NOT NULL,                   -- Reed-Solomon parity shards
+    shares INT NOT NULL,                          -- Shamir's scheme shares
+    threshold INT NOT NULL,                       -- Shamir's scheme threshold
+    premium_only BOOLEAN NOT NULL DEFAULT FALSE,  -- Only offered on the premium plan
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,    -- Used when an upload names no profile
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
+
+-- Size-based overrides of durability profiles
+CREATE TABLE durability_profile_overrides (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    profile_id INT NOT NULL,
+    min_size BIGINT NOT NULL,                     -- Applies to files of at least this many bytes
+    data_shards INT NOT NULL,
+    parity_shards INT NOT NULL,
+    shares INT NOT NULL,
+    threshold INT NOT NULL,
+    UNIQUE KEY unique_profile_size (profile_id, min_size),
+    FOREIGN KEY (profile_id) REFERENCES durability_profiles(id) ON DELETE CASCADE
+);
+
+INSERT INTO durability_profiles (name, display_name, description, data_shards, parity_shards, shares, threshold, premium_only, is_default) VALUES
+    ('standard', 'Standard', 'Survives the loss of any two storage nodes', 4, 2, 5, 3, FALSE, TRUE),
+    ('high_durability', 'High durability', 'Survives the loss of any four storage nodes', 6, 4, 7, 4, TRUE, FALSE),
+    ('archival', 'Archival', 'Wide stripes with low storage overhead for large, rarely read files', 10, 4, 5, 3, TRUE, FALSE);
+
+-- Large files use wider stripes: less overhead for the same number of node losses
+INSERT INTO durability_profile_overrides (profile_id, min_size, data_shards, parity_shards, shares, threshold) VALUES
+    ((SELECT id FROM durability_profiles WHERE name = 'standard'), 1073741824, 8, 2, 5, 3),
+    ((SELECT id FROM durability_profiles WHERE name = 'high_durability'), 1073741824, 12, 4, 7, 4);
+
 -- Key fragments table
 CREATE TABLE key_fragments (
     id INT AUTO_INCREMENT PRIMARY KEY,
@@ -138,11 +189,83 @@ CREATE TABLE key_fragments (
     holder_type ENUM('user', 'server') NOT NULL,    -- Whether server or user holds this fragment
     master_key_version INT,                         -- Version of master key used (for user fragments)
     server_key_id VARCHAR(64),                      -- Server key ID (for server fragments)
+    checksum CHAR(64),                              -- SHA-256 of the stored fragment, empty for legacy fragments
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
     UNIQUE KEY unique_fragment (file_id, fragment_index)    
 );
 
+-- Storage node registry
+CREATE TABLE storage_nodes (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    node_index INT NOT NULL UNIQUE,                 -- Stable index referenced by shard_locations/key_fragments
+    name VARCHAR(255) NOT NULL,
+    backend VARCHAR(20) NOT NULL,                   -- local, s3 or remote
+    config TEXT NOT NULL,                           -- JSON backend settings (no secrets)
+    status ENUM('active', 'draining', 'removed') DEFAULT 'active',
+    zone VARCHAR(64) NOT NULL DEFAULT '',           -- Failure domains; an empty label is a domain of its own
+    rack VARCHAR(64) NOT NULL DEFAULT '',
+    host VARCHAR(255) NOT NULL DEFAULT '',
+    weight INT NOT NULL DEFAULT 1,                  -- Relative share of new placements (1-100)
+    tier ENUM('hot', 'cold') NOT NULL DEFAULT 'hot', -- Archived files are moved to cold nodes
+    capacity_limit BIGINT NOT NULL DEFAULT 0,       -- Bytes that may be placed on the node, 0 = free space of its device
+    capacity_bytes BIGINT NOT NULL DEFAULT 0,       -- Effective capacity at the last measurement, 0 = unknown
+    used_bytes BIGINT NOT NULL DEFAULT 0,           -- Bytes stored at the last measurement
+    object_count BIGINT NOT NULL DEFAULT 0,
+    usage_checked_at TIMESTAMP NULL,
+    drain_started_at TIMESTAMP NULL,                -- When the node started draining
+    drain_objects BIGINT NOT NULL DEFAULT 0,        -- Shards and fragments on the node when draining started
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
+
+-- Shard placement table
+CREATE TABLE shard_locations (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    file_id INT NOT NULL,
+    shard_index INT NOT NULL,                       -- Reed-Solomon shard index
+    node_index INT NOT NULL,                        -- Which node stores this shard
+    checksum CHAR(64),                              -- SHA-256 of the shard, empty for legacy shards
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
+    UNIQUE KEY unique_shard (file_id, shard_index)
+);
+
+-- Stripe index of files using the striped shard layout
+CREATE TABLE stripe_indexes (
+    file_id INT PRIMARY KEY,
+    stripe_size BIGINT NOT NULL,                    -- Content bytes per stripe
+    content_size BIGINT NOT NULL,                   -- Stored (encrypted) bytes
+    checksums LONGBLOB NOT NULL,                    -- SHA-256 of every piece, stripe by stripe
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE
+);
+
+-- Scrub results per file
+CREATE TABLE file_durability (
+    file_id INT PRIMARY KEY,
+    status ENUM('healthy', 'repaired', 'degraded', 'unrecoverable') NOT NULL,
+    missing_shards INT NOT NULL DEFAULT 0,
+    corrupt_shards INT NOT NULL DEFAULT 0,
+    repaired_shards INT NOT NULL DEFAULT 0,
+    missing_fragments INT NOT NULL DEFAULT 0,
+    corrupt_fragments INT NOT NULL DEFAULT 0,
+    details TEXT,                                   -- Problems found during the last scrub
+    last_scrubbed_at TIMESTAMP NULL,
+    FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE
+);
+
+-- Uploads whose shards may be on the nodes before their file row commits.
+-- No foreign key: the file row is still inside the upload transaction.
+CREATE TABLE upload_journal (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    file_id INT NOT NULL UNIQUE,                    -- ID assigned to the uncommitted file row
+    user_id INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_created_at (created_at)
+);
+
 -- File shares table
 CREATE TABLE file_shares (
     id INT AUTO_INCREMENT PRIMARY KEY,
@@ -152,6 +275,7 @@ CREATE TABLE file_shares (
     password_hash VARCHAR(255) NOT NULL,          -- Share password hash
     password_salt VARCHAR(32) NOT NULL,           -- Share password salt
     encrypted_key_fragment MEDIUMBLOB NOT NULL,   -- Password-encrypted fragment
+    kdf_params VARCHAR(64) NULL,                  -- KDF of the fragment key; NULL for legacy PBKDF2 (4096 iterations)
     fragment_index INT NOT NULL DEFAULT 1,
     expires_at TIMESTAMP NULL,                    -- Optional expiration
     max_downloads INT NULL,                       -- Optional download limit
@@ -210,17 +334,85 @@ CREATE TABLE feedbacks (
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );
 
+-- Social recovery: a user's master key split between trusted contacts
+CREATE TABLE social_recovery_setups (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL UNIQUE,                  -- User whose master key is split
+    threshold INT NOT NULL,                       -- Shares needed to recombine the key
+    share_count INT NOT NULL,                     -- One share per contact
+    key_check CHAR(64) NOT NULL,                  -- HMAC identifying the master key the shares belong to
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE recovery_contacts (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    setup_id INT NOT NULL,
+    contact_id INT NOT NULL,                      -- Trusted contact holding the share
+    share_index INT NOT NULL,
+    wrapped_share VARBINARY(128) NOT NULL,        -- Share sealed to the contact's recovery public key
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY unique_setup_contact (setup_id, contact_id),
+    FOREIGN KEY (setup_id) REFERENCES social_recovery_setups(id) ON DELETE CASCADE,
+    FOREIGN KEY (contact_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Requests outlive their setup as history, so setup_id has no foreign key
+CREATE TABLE recovery_requests (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,                         -- Account being recovered
+    setup_id INT NOT NULL,
+    public_key BINARY(32) NOT NULL,               -- Released shares are sealed to it; the requester holds the private key
+    status ENUM('pending', 'completed', 'cancelled', 'expired') NOT NULL DEFAULT 'pending',
+    expires_at TIMESTAMP NOT NULL,
+    completed_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_setup_id (setup_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Emailed links confirming a recovery request; only the token's hash is stored
+CREATE TABLE recovery_confirmations (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,                         -- Account to be recovered
+    token_hash CHAR(64) NOT NULL UNIQUE,          -- SHA-256 of the token in the link
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE recovery_approvals (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    request_id INT NOT NULL,
+    contact_id INT NOT NULL,
+    status ENUM('pending', 'approved', 'declined') NOT NULL DEFAULT 'pending',
+    released_share VARBINARY(128) NULL,           -- Contact's share sealed to the request's public key
+    decided_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY unique_request_contact (request_id, contact_id),
+    FOREIGN KEY (request_id) REFERENCES recovery_requests(id) ON DELETE CASCADE,
+    FOREIGN KEY (contact_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
 -- Create indexes for better query performance
 CREATE INDEX idx_files_user_id ON files(user_id);
 CREATE INDEX idx_files_folder_id ON files(folder_id);
 CREATE INDEX idx_key_fragments_file_id ON key_fragments(file_id);
+CREATE INDEX idx_key_fragments_node_index ON key_fragments(node_index);
+CREATE INDEX idx_shard_locations_node_index ON shard_locations(node_index);
+CREATE INDEX idx_file_durability_status ON file_durability(status);
 CREATE INDEX idx_file_shares_link ON file_shares(share_link);
 CREATE INDEX idx_share_access_logs_share_id ON share_access_logs(share_id);
 CREATE INDEX idx_activity_logs_user_id ON activity_logs(user_id);
 CREATE INDEX idx_activity_logs_created_at ON activity_logs(created_at);
 CREATE INDEX idx_feedback_user_id ON feedbacks(user_id);
 CREATE INDEX idx_feedback_status ON feedbacks(status);
+CREATE INDEX idx_recovery_requests_user_status ON recovery_requests(user_id, status);
+CREATE INDEX idx_recovery_approvals_contact_status ON recovery_approvals(contact_id, status);
 CREATE INDEX idx_files_is_shared ON files(is_shared);
 CREATE INDEX idx_files_key_version ON files(master_key_version);
 CREATE INDEX idx_key_fragments_key_version ON key_fragments(master_key_version);
+CREATE INDEX idx_key_fragments_server_key ON key_fragments(server_key_id);
 CREATE INDEX idx_server_master_keys_active ON server_master_keys(is_active);
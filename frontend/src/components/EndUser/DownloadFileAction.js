@@ -56,7 +56,11 @@ const DownloadFileAction = ({ file, selectedFiles = [], onClearSelection, onClos
                     },
                 });
 
-                if (!response.ok) throw new Error('Download failed');
+                if (!response.ok) {
+                    // e.g. the session is locked and the user has to log in again
+                    const result = await response.json().catch(() => ({}));
+                    throw new Error(result.error || 'Download failed');
+                }
 
                 const blob = await response.blob();
                 const url = window.URL.createObjectURL(blob);
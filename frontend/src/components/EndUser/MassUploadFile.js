@@ -5,8 +5,8 @@ const MassUploadFile = ({ isOpen, onClose, onUpload, currentFolder }) => {
     const [selectedFiles, setSelectedFiles] = useState([]);
     const [uploading, setUploading] = useState(false);
     const [error, setError] = useState('');
-    const [shares, setShares] = useState(3);
-    const [threshold, setThreshold] = useState(2);
+    const [durabilityProfiles, setDurabilityProfiles] = useState([]);
+    const [selectedProfile, setSelectedProfile] = useState('');
     const [showTooltip, setShowTooltip] = useState(false);
     const [encryptionTypes, setEncryptionTypes] = useState([]);
     const [selectedEncryption, setSelectedEncryption] = useState('standard');
@@ -17,10 +17,10 @@ const MassUploadFile = ({ isOpen, onClose, onUpload, currentFolder }) => {
         if (isOpen) {
             setSelectedFiles([]);
             setError('');
-            setShares(3);
-            setThreshold(2);
+            setSelectedProfile('');
             setUploadProgress({});
             fetchEncryptionOptions();
+            fetchDurabilityProfiles();
         }
     }, [isOpen]);
 
@@ -46,6 +46,27 @@ const MassUploadFile = ({ isOpen, onClose, onUpload, currentFolder }) => {
         }
     };
 
+    const fetchDurabilityProfiles = async () => {
+        try {
+            const token = localStorage.getItem('token');
+            const response = await fetch('http://localhost:8080/api/files/durability/profiles', {
+                headers: {
+                    'Authorization': `Bearer ${token}`,
+                },
+                credentials: 'include',
+            });
+
+            if (!response.ok) throw new Error('Failed to fetch durability profiles');
+
+            const data = await response.json();
+            setDurabilityProfiles(data.data.profiles);
+            setSelectedProfile(data.data.default);
+        } catch (err) {
+            console.error('Failed to fetch durability profiles:', err);
+            setError('Failed to load durability options');
+        }
+    };
+
     const handleFileSelect = useCallback((event) => {
         const files = Array.from(event.target.files);
         setSelectedFiles(prev => [...prev, ...files]);
@@ -69,11 +90,6 @@ const MassUploadFile = ({ isOpen, onClose, onUpload, currentFolder }) => {
             return;
         }
 
-        if (shares < threshold) {
-            setError('Number of shares must be greater than or equal to threshold');
-            return;
-        }
-
         setUploading(true);
         setError('');
 
@@ -88,8 +104,9 @@ const MassUploadFile = ({ isOpen, onClose, onUpload, currentFolder }) => {
             selectedFiles.forEach(file => {
                 formData.append('files', file);
             });
-            formData.append('shares', shares);
-            formData.append('threshold', threshold);
+            if (selectedProfile) {
+                formData.append('durability_profile', selectedProfile);
+            }
             formData.append('encryption_type', selectedEncryption);
 
             if (currentFolder?.id) {
@@ -203,7 +220,7 @@ const MassUploadFile = ({ isOpen, onClose, onUpload, currentFolder }) => {
                     </div>
                 )}
 
-                {/* Encryption and Share Settings */}
+                {/* Encryption and Durability Settings */}
                 <div className="grid grid-cols-2 gap-4 mb-6">
                     <div>
                         <div className="flex items-center mb-2">
@@ -229,33 +246,22 @@ const MassUploadFile = ({ isOpen, onClose, onUpload, currentFolder }) => {
                         </select>
                     </div>
 
-                    <div className="space-y-4">
-                        <div>
-                            <label className="text-sm font-medium text-gray-700 mb-1 block">
-                                Number of Shares
-                            </label>
-                            <input
-                                type="number"
-                                min="2"
-                                max="10"
-                                value={shares}
-                                onChange={(e) => setShares(parseInt(e.target.value))}
-                                className="w-full p-2 border rounded-md"
-                            />
-                        </div>
-                        <div>
-                            <label className="text-sm font-medium text-gray-700 mb-1 block">
-                                Threshold
-                            </label>
-                            <input
-                                type="number"
-                                min="2"
-                                max={shares}
-                                value={threshold}
-                                onChange={(e) => setThreshold(parseInt(e.target.value))}
-                                className="w-full p-2 border rounded-md"
-                            />
-                        </div>
+                    <div>
+                        <label htmlFor="durabilityProfile" className="text-sm font-medium text-gray-700 mb-2 block">
+                            Durability
+                        </label>
+                        <select
+                            id="durabilityProfile"
+                            value={selectedProfile}
+                            onChange={(e) => setSelectedProfile(e.target.value)}
+                            className="w-full p-2 border rounded-md bg-white"
+                        >
+                            {durabilityProfiles.map((profile) => (
+                                <option key={profile.name} value={profile.name}>
+                                    {profile.display_name}
+                                </option>
+                            ))}
+                        </select>
                     </div>
                 </div>
 
@@ -5,8 +5,8 @@ const UploadFile = ({ isOpen, onClose, onUpload, currentFolder }) => {
     const [selectedFile, setSelectedFile] = useState(null);
     const [uploading, setUploading] = useState(false);
     const [error, setError] = useState('');
-    const [shares, setShares] = useState(3);
-    const [threshold, setThreshold] = useState(2);
+    const [durabilityProfiles, setDurabilityProfiles] = useState([]);
+    const [selectedProfile, setSelectedProfile] = useState('');
     const [showTooltip, setShowTooltip] = useState(false);
     const [encryptionTypes, setEncryptionTypes] = useState([]);
     const [selectedEncryption, setSelectedEncryption] = useState('standard');
@@ -16,9 +16,9 @@ const UploadFile = ({ isOpen, onClose, onUpload, currentFolder }) => {
         if (isOpen) {
             setSelectedFile(null);
             setError('');
-            setShares(3);
-            setThreshold(2);
+            setSelectedProfile('');
             fetchEncryptionOptions();
+            fetchDurabilityProfiles();
         }
     }, [isOpen]);
 
@@ -44,6 +44,27 @@ const UploadFile = ({ isOpen, onClose, onUpload, currentFolder }) => {
         }
     };
 
+    const fetchDurabilityProfiles = async () => {
+        try {
+            const token = localStorage.getItem('token');
+            const response = await fetch('http://localhost:8080/api/files/durability/profiles', {
+                headers: {
+                    'Authorization': `Bearer ${token}`,
+                },
+                credentials: 'include',
+            });
+
+            if (!response.ok) throw new Error('Failed to fetch durability profiles');
+
+            const data = await response.json();
+            setDurabilityProfiles(data.data.profiles);
+            setSelectedProfile(data.data.default);
+        } catch (err) {
+            console.error('Failed to fetch durability profiles:', err);
+            setError('Failed to load durability options');
+        }
+    };
+
     const handleFileSelect = useCallback((event) => {
         const file = event.target.files[0];
         setSelectedFile(file);
@@ -67,21 +88,6 @@ const UploadFile = ({ isOpen, onClose, onUpload, currentFolder }) => {
             return;
         }
 
-        if (shares < threshold) {
-            setError('Number of shares must be greater than or equal to threshold');
-            return;
-        }
-
-        if (threshold < 2) {
-            setError('Threshold must be at least 2');
-            return;
-        }
-
-        if (shares > 10) {
-            setError('Number of shares cannot exceed 10');
-            return;
-        }
-
         setUploading(true);
         setError('');
 
@@ -94,8 +100,9 @@ const UploadFile = ({ isOpen, onClose, onUpload, currentFolder }) => {
 
             const formData = new FormData();
             formData.append('file', selectedFile);
-            formData.append('shares', shares);
-            formData.append('threshold', threshold);
+            if (selectedProfile) {
+                formData.append('durability_profile', selectedProfile);
+            }
             formData.append('encryption_type', selectedEncryption);
 
             if (currentFolder?.id) {
@@ -106,8 +113,7 @@ const UploadFile = ({ isOpen, onClose, onUpload, currentFolder }) => {
                 fileName: selectedFile.name,
                 fileSize: selectedFile.size,
                 fileType: selectedFile.type,
-                shares,
-                threshold,
+                durabilityProfile: selectedProfile,
                 encryptionType: selectedEncryption,
                 folderId: currentFolder?.id || 'root'
             });
@@ -247,66 +253,45 @@ const UploadFile = ({ isOpen, onClose, onUpload, currentFolder }) => {
                     )}
                 </div>
 
-                <div className="mb-6 space-y-4">
-                    <div className="flex items-center justify-between">
-                        <div className="flex items-center">
-                            <label htmlFor="shares" className="text-sm font-medium text-gray-700 mr-2">
-                                Number of Shares
-                            </label>
-                            <div className="relative">
-                                <Info 
-                                    size={16} 
-                                    className="text-gray-400 cursor-help"
-                                    onMouseEnter={() => setShowTooltip(true)}
-                                    onMouseLeave={() => setShowTooltip(false)}
-                                />
-                                {showTooltip && (
-                                    <div className="absolute bottom-full left-1/2 transform -translate-x-1/2 p-2 bg-gray-800 text-white text-xs rounded whitespace-nowrap">
-                                        Total number of key shares to create
-                                    </div>
-                                )}
-                            </div>
+                {/* Durability Options */}
+                <div className="mb-6">
+                    <div className="flex items-center mb-2">
+                        <label htmlFor="durabilityProfile" className="text-sm font-medium text-gray-700 mr-2">
+                            Durability
+                        </label>
+                        <div className="relative">
+                            <Info 
+                                size={16} 
+                                className="text-gray-400 cursor-help"
+                                onMouseEnter={() => setShowTooltip(true)}
+                                onMouseLeave={() => setShowTooltip(false)}
+                            />
+                            {showTooltip && (
+                                <div className="absolute bottom-full left-1/2 transform -translate-x-1/2 p-2 bg-gray-800 text-white text-xs rounded whitespace-nowrap">
+                                    How many storage failures your file can survive
+                                </div>
+                            )}
                         </div>
-                        <input
-                            type="number"
-                            id="shares"
-                            min="2"
-                            max="10"
-                            value={shares}
-                            onChange={(e) => setShares(parseInt(e.target.value))}
-                            className="w-20 px-2 py-1 border rounded-md"
-                        />
-                    </div>
-
-                    <div className="flex items-center justify-between">
-                        <div className="flex items-center">
-                            <label htmlFor="threshold" className="text-sm font-medium text-gray-700 mr-2">
-                                Threshold
-                            </label>
-                            <div className="relative">
-                                <Info 
-                                    size={16} 
-                                    className="text-gray-400 cursor-help"
-                                    onMouseEnter={() => setShowTooltip(true)}
-                                    onMouseLeave={() => setShowTooltip(false)}
-                                />
-                                {showTooltip && (
-                                    <div className="absolute bottom-full left-1/2 transform -translate-x-1/2 p-2 bg-gray-800 text-white text-xs rounded whitespace-nowrap">
-                                        Minimum shares required to decrypt
-                                    </div>
-                                )}
-                            </div>
-                        </div>
-                        <input
-                            type="number"
-                            id="threshold"
-                            min="2"
-                            max={shares}
-                            value={threshold}
-                            onChange={(e) => setThreshold(parseInt(e.target.value))}
-                            className="w-20 px-2 py-1 border rounded-md"
-                        />
                     </div>
+                    <select
+                        id="durabilityProfile"
+                        value={selectedProfile}
+                        onChange={(e) => setSelectedProfile(e.target.value)}
+                        className="w-full p-2 border rounded-md bg-white"
+                    >
+                        {durabilityProfiles.map((profile) => (
+                            <option key={profile.name} value={profile.name}>
+                                {profile.display_name}
+                            </option>
+                        ))}
+                    </select>
+                    {durabilityProfiles.map((profile) => 
+                        profile.name === selectedProfile && profile.description && (
+                            <p key={profile.name} className="mt-1 text-sm text-gray-500">
+                                {profile.description}
+                            </p>
+                        )
+                    )}
                 </div>
 
                 {error && (
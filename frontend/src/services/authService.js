@@ -119,6 +119,16 @@ export const getCurrentBilling = () => {
 };
 
 export const logout = () => {
+    // Wipe the file keys the server unlocked for this session
+    const token = localStorage.getItem('token');
+    if (token) {
+        fetch(`${API_BASE_URL}/logout`, {
+            method: 'POST',
+            headers: {
+                'Authorization': `Bearer ${token}`,
+            },
+        }).catch((error) => console.error('Logout error:', error));
+    }
     localStorage.removeItem('token');
     localStorage.removeItem('user');
     localStorage.removeItem('billing');